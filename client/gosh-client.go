@@ -22,11 +22,14 @@ import (
 var (
 	agentForward = flag.Bool("ssh_agent_forwarding", false, "If true, listen on a socket to forward SSH agent requests")
 	debug        = flag.Bool("debug", false, "If true, enable DEBUG log level for verbose log output")
+	fec          = flag.Bool("fec", true, "If true, send parity with large updates so they survive packet loss, adapting to the observed loss rate")
 	initCols     = flag.Int("initial_cols", vt.DEF_COLS, "Numer of columns to start the terminal with")
 	initRows     = flag.Int("initial_rows", vt.DEF_ROWS, "Numer of rows to start the terminal with")
 	logfile      = flag.String("logfile", "", "If set, logs will be written to this file.")
+	obfuscate    = flag.Bool("obfuscate_traffic", false, "If true, pad datagrams and send keystrokes on a fixed cadence with cover traffic, at the cost of bandwidth")
 	remoteHost   = flag.String("remote_host", "", "Remote host to dial")
 	remotePort   = flag.String("remote_port", "61000", "Port to dial on remote host")
+	tcpFallback  = flag.Bool("tcp_fallback", true, "If true, fall back to TCP when UDP to the server is blocked")
 )
 
 func die(msg string, args ...any) {
@@ -51,8 +54,13 @@ func main() {
 	if err != nil {
 		die("couldn't setup network layer: %v", err)
 	}
+	gc.SetPadding(*obfuscate)
+	var remote network.Transport = gc
+	if *tcpFallback {
+		remote = network.NewFallbackClient(gc)
+	}
 	defer func() {
-		if err := gc.Close(); err != nil {
+		if err := remote.Close(); err != nil {
 			slog.Error("error closing gosh conn", "err", err)
 		}
 	}()
@@ -72,11 +80,16 @@ func main() {
 		}
 		defer sock.Close()
 	}
-	c := stm.NewClient(gc.RemoteAddr(), gc, t, sock)
+	c := stm.NewClient(gc.RemoteAddr(), remote, t, sock)
+	c.NotifyNetworkChanges(network.AddrChanges())
+	c.SetObfuscation(*obfuscate)
+	c.SetFEC(*fec)
 	c.Run()
 
 	slog.Info("Shutting down")
 
+	os.Stdout.Write(t.Restore())
+
 	undoAlt() // may be a no-op, depending on what maybeAltScreen() did
 	if err := term.Restore(int(os.Stdin.Fd()), orig); err != nil {
 		slog.Error("couldn't restore terminal state", "err", err)
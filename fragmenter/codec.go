@@ -0,0 +1,263 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package fragmenter
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+	tspb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Codec compresses payloads. Fragments carry the id of the codec used
+// so the receiver knows how to reverse it.
+type Codec interface {
+	ID() goshpb.Codec
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+var codecs = map[goshpb.Codec]Codec{
+	goshpb.Codec_CODEC_NONE:         noneCodec{},
+	goshpb.Codec_CODEC_GZIP:         gzipCodec{},
+	goshpb.Codec_CODEC_DEFLATE_DICT: dictCodec{},
+}
+
+// Codecs are negotiated in band. Each fragment we send advertises
+// acceptCodecs, the bitmask of codecs we can decode, and we only use
+// codecs our peer has advertised. Until we hear from it, or if it
+// advertises nothing, we assume peerDefaultCodecs, which every
+// version understands. Versions from before codecs know gzip by the
+// fragment's compressed flag, which we set along with CODEC_GZIP.
+var (
+	acceptCodecs      = codecMask(goshpb.Codec_CODEC_NONE, goshpb.Codec_CODEC_GZIP, goshpb.Codec_CODEC_DEFLATE_DICT, goshpb.Codec_CODEC_DEFLATE_STREAM)
+	peerDefaultCodecs = codecMask(goshpb.Codec_CODEC_NONE, goshpb.Codec_CODEC_GZIP)
+)
+
+func codecMask(ids ...goshpb.Codec) uint32 {
+	var m uint32
+	for _, id := range ids {
+		m |= 1 << id
+	}
+	return m
+}
+
+// readAll reads everything from r, up to MAX_PAYLOAD bytes.
+func readAll(r io.Reader) ([]byte, error) {
+	var obuf bytes.Buffer
+	n, err := io.Copy(&obuf, io.LimitReader(r, MAX_PAYLOAD+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > MAX_PAYLOAD {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", MAX_PAYLOAD)
+	}
+
+	return obuf.Bytes(), nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() goshpb.Codec {
+	return goshpb.Codec_CODEC_NONE
+}
+
+func (noneCodec) Compress(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (noneCodec) Decompress(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+// gzipCodec was our only compression originally. It's kept for
+// peers that don't support anything better.
+type gzipCodec struct{}
+
+func (gzipCodec) ID() goshpb.Codec {
+	return goshpb.Codec_CODEC_GZIP
+}
+
+func (gzipCodec) Compress(buf []byte) ([]byte, error) {
+	var gbuf bytes.Buffer
+	gz := gzip.NewWriter(&gbuf)
+
+	if _, err := gz.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return gbuf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(buf []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	return readAll(gz)
+}
+
+// dictCodec is raw DEFLATE, without gzip's header and trailer, primed
+// with termDict. Even small diffs compress well, as the field tags
+// and formats they're made of are already in the dictionary.
+type dictCodec struct{}
+
+// flate writers are expensive to create, so we reuse them.
+var dictWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriterDict(nil, flate.BestCompression, termDict)
+		return w
+	},
+}
+
+func (dictCodec) ID() goshpb.Codec {
+	return goshpb.Codec_CODEC_DEFLATE_DICT
+}
+
+func (dictCodec) Compress(buf []byte) ([]byte, error) {
+	var fbuf bytes.Buffer
+	w := dictWriters.Get().(*flate.Writer)
+	defer dictWriters.Put(w)
+	w.Reset(&fbuf)
+
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return fbuf.Bytes(), nil
+}
+
+func (dictCodec) Decompress(buf []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(buf), termDict)
+	defer r.Close()
+
+	return readAll(r)
+}
+
+// termDict holds byte sequences common in our payloads. DEFLATE can
+// refer back to it, so its contents needn't appear in a payload
+// before being compressed. Matches near the end are cheapest, so the
+// most common sequences go last. Changing it breaks compatibility
+// with peers using the old dictionary, so it needs a new codec id.
+//
+// It's built from marshalled Payloads and TermDiffs, so it has their
+// field tags along with the modes, formats, spans and cursor moves
+// that most screen updates are made of.
+var termDict = buildDict()
+
+// Values from vt that diffs commonly carry.
+const (
+	dictBasic   = 1 // color types
+	dictAnsi256 = 2
+	dictRGB     = 3
+	dictBold    = 1 << 0 // attributes
+	dictUL      = 1 << 4
+	dictRev     = 1 << 6
+)
+
+func buildDict() []byte {
+	var dict []byte
+	add := func(m proto.Message) {
+		b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+		dict = append(dict, b...)
+	}
+	color := func(typ int32, data ...int32) *goshpb.Color {
+		return goshpb.Color_builder{Type: proto.Int32(typ), Data: data}.Build()
+	}
+	format := func(fg, bg *goshpb.Color, attrs uint32) *goshpb.Format {
+		return goshpb.Format_builder{Fg: fg, Bg: bg, Attrs: proto.Uint32(attrs)}.Build()
+	}
+
+	// Titles, links and modes
+	add(goshpb.TermDiff_builder{
+		Title: proto.String(""),
+		Icon:  proto.String(""),
+		Links: []string{"file://", "http://", "https://"},
+	}.Build())
+	for _, m := range []int32{1, 7, 12, 25, 47, 1000, 1002, 1006, 1049, 2004} {
+		for _, set := range []bool{false, true} {
+			add(goshpb.TermDiff_builder{Modes: []*goshpb.TermMode{goshpb.TermMode_builder{
+				Code:   proto.Int32(m),
+				Public: proto.Bool(false),
+				Set:    proto.Bool(set),
+			}.Build()}}.Build())
+		}
+	}
+	add(goshpb.TermDiff_builder{Scroll: goshpb.Scroll_builder{
+		Top:    proto.Int32(0),
+		Bottom: proto.Int32(23),
+		Count:  proto.Int32(1),
+	}.Build()}.Build())
+
+	// Formats, with the less common colours and attributes
+	// first.
+	var fs []*goshpb.Format
+	fs = append(fs,
+		format(color(dictRGB, 0, 0, 0), nil, 0),
+		format(color(dictAnsi256, 0), nil, 0),
+		format(nil, color(dictAnsi256, 0), 0),
+		format(nil, nil, dictUL),
+		format(nil, nil, dictRev),
+	)
+	for c := int32(0); c < 8; c++ {
+		fs = append(fs,
+			format(color(dictBasic, 90+c), nil, 0),
+			format(nil, color(dictBasic, 40+c), 0),
+			format(color(dictBasic, 30+c), nil, 0),
+			format(color(dictBasic, 30+c), nil, dictBold),
+		)
+	}
+	fs = append(fs, format(nil, nil, dictBold))
+	for _, f := range fs {
+		add(goshpb.TermDiff_builder{Formats: []*goshpb.Format{f}}.Build())
+	}
+
+	// Common text
+	add(goshpb.TermDiff_builder{Spans: []*goshpb.CellSpan{goshpb.CellSpan_builder{
+		Row:   proto.Int32(0),
+		Col:   proto.Int32(0),
+		Runes: proto.String("────────────────│├┤┌┐└┘" + strings.Repeat(" ", 64)),
+	}.Build()}}.Build())
+
+	// The payload around a diff.
+	ts := tspb.New(time.Unix(1_700_000_000, 500_000_000))
+	add(goshpb.Payload_builder{
+		Source:    ts,
+		Target:    ts,
+		Retire:    ts,
+		Type:      goshpb.PayloadType_SERVER_OUTPUT.Enum(),
+		DataCodec: goshpb.Codec_CODEC_DEFLATE_STREAM.Enum(),
+	}.Build())
+
+	// Spans and cursor moves, with the most frequently seen rows
+	// last.
+	for r := int32(60); r >= 0; r-- {
+		add(goshpb.TermDiff_builder{
+			Spans: []*goshpb.CellSpan{goshpb.CellSpan_builder{
+				Row:     proto.Int32(r),
+				Col:     proto.Int32(0),
+				Runes:   proto.String(" "),
+				Formats: []uint32{1, 1},
+			}.Build()},
+			CursorRow: proto.Int32(r),
+			CursorCol: proto.Int32(0),
+		}.Build())
+	}
+
+	return dict
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package fragmenter
+
+import (
+	"crypto/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+	tspb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	rbytes := make([]byte, 1000)
+	rand.Read(rbytes)
+
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("\x1b[12;1H\x1b[m$ ls -l\x1b[K"),
+		rbytes,
+	}
+
+	for id, c := range codecs {
+		if c.ID() != id {
+			t.Errorf("%s: Got ID() %s", id, c.ID())
+		}
+		for i, in := range inputs {
+			comp, err := c.Compress(in)
+			if err != nil {
+				t.Errorf("%s/%d: Compress() error: %v", id, i, err)
+				continue
+			}
+			if got, err := c.Decompress(comp); err != nil || !slices.Equal(got, in) {
+				t.Errorf("%s/%d: Got %q (err: %v), wanted %q", id, i, got, err, in)
+			}
+		}
+	}
+}
+
+func TestDictCompression(t *testing.T) {
+	// Each screen update is sent as a SERVER_OUTPUT payload
+	// holding the diff it makes. Sizes are raw/gzip/dictionary.
+	screens := [][]byte{
+		// 104/129/72
+		[]byte("\x1b[1;32muser@host\x1b[m:\x1b[1;34m~/src\x1b[m$ "),
+		// 56/81/43
+		[]byte("l"),
+		// 140/138/104
+		[]byte("\r\n\x1b[01;34mdir\x1b[0m  file.go  \x1b[01;32mrun.sh\x1b[0m\r\n\x1b[1;32muser@host\x1b[m:\x1b[1;34m~/src\x1b[m$ "),
+		// 110/135/82
+		[]byte("\x1b[?25l\x1b[7m  GNU nano 7.2        main.go        Modified  \x1b[m\x1b[?25h"),
+		// 102/127/82
+		[]byte("\x1b[12;1Hfunc main() {\r\n\tfmt.Println(\"hi\")\r\n}"),
+	}
+
+	now := time.Unix(1_760_000_000, 123_456_789)
+	for i, d := range diffs(screens) {
+		p, _ := proto.Marshal(goshpb.Payload_builder{
+			Type:   goshpb.PayloadType_SERVER_OUTPUT.Enum(),
+			Source: tspb.New(now),
+			Target: tspb.New(now.Add(20 * time.Millisecond)),
+			Retire: tspb.New(now),
+			Data:   d,
+		}.Build())
+
+		gz, _ := codecs[goshpb.Codec_CODEC_GZIP].Compress(p)
+		dict, _ := codecs[goshpb.Codec_CODEC_DEFLATE_DICT].Compress(p)
+		if len(dict) >= len(p) || len(dict) >= len(gz) {
+			t.Errorf("%d: Got %d bytes with dictionary, wanted fewer than %d (raw) and %d (gzip)", i, len(dict), len(p), len(gz))
+		}
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	diff := []byte("\x1b[24;1H\x1b[m\x1b[1m\x1b[32muser@host\x1b[m:\x1b[1m\x1b[34m~/src\x1b[m$ \x1b[?25h")
+
+	cases := []struct {
+		accept    *uint32
+		wantCodec goshpb.Codec
+	}{
+		// Peers that don't advertise only get what every
+		// version understands.
+		{nil, goshpb.Codec_CODEC_NONE},
+		{&acceptCodecs, goshpb.Codec_CODEC_DEFLATE_DICT},
+		{&peerDefaultCodecs, goshpb.Codec_CODEC_NONE},
+	}
+
+	for i, c := range cases {
+		peer, f := New(100), New(100)
+
+		frag := peer.Wrap([]byte("hi"))
+		if c.accept != nil {
+			frag.SetAcceptCodecs(*c.accept)
+		}
+		f.Store(frag)
+
+		got, _ := f.CreateFragments(diff)
+		if codec := got[0].GetCodec(); codec != c.wantCodec {
+			t.Errorf("%d: Got codec %s, wanted %s", i, codec, c.wantCodec)
+		}
+		if got[0].GetAcceptCodecs() != acceptCodecs {
+			t.Errorf("%d: Got accept_codecs %b, wanted %b", i, got[0].GetAcceptCodecs(), acceptCodecs)
+		}
+
+		peer.Store(got[0])
+		if d, err := peer.Assemble(got[0].GetId()); err != nil || !slices.Equal(d, diff) {
+			t.Errorf("%d: Got %q (err: %v), wanted %q", i, d, err, diff)
+		}
+	}
+}
+
+func TestLegacyCompressed(t *testing.T) {
+	buf := make([]byte, 2*COMPRESS_THRESHOLD)
+	f := New(len(buf))
+	frags, _ := f.CreateFragments(buf)
+	if len(frags) != 1 || frags[0].GetCodec() != goshpb.Codec_CODEC_GZIP || !frags[0].GetCompressed() {
+		t.Fatalf("Got %v, wanted one fragment with CODEC_GZIP and compressed set", frags)
+	}
+
+	// Peers from before codecs only set compressed.
+	frags[0].ClearCodec()
+	frags[0].ClearAcceptCodecs()
+	peer := New(len(buf))
+	peer.Store(frags[0])
+	if got, err := peer.Assemble(frags[0].GetId()); err != nil || !slices.Equal(got, buf) {
+		t.Errorf("Got %d bytes (err: %v), wanted %d", len(got), err, len(buf))
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	peer, f := New(100), New(100)
+	f.Refuse(goshpb.Codec_CODEC_DEFLATE_STREAM)
+
+	frags, _ := f.CreateFragments([]byte("hi"))
+	if want := acceptCodecs &^ (1 << goshpb.Codec_CODEC_DEFLATE_STREAM); frags[0].GetAcceptCodecs() != want {
+		t.Errorf("Got accept_codecs %b, wanted %b", frags[0].GetAcceptCodecs(), want)
+	}
+	peer.Store(frags[0])
+	if peer.PeerAccepts(goshpb.Codec_CODEC_DEFLATE_STREAM) || !peer.PeerAccepts(goshpb.Codec_CODEC_DEFLATE_DICT) {
+		t.Errorf("Got peer accepting stream %t and dict %t, wanted false and true", peer.PeerAccepts(goshpb.Codec_CODEC_DEFLATE_STREAM), peer.PeerAccepts(goshpb.Codec_CODEC_DEFLATE_DICT))
+	}
+}
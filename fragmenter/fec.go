@@ -0,0 +1,219 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package fragmenter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Forward error correction. A payload of n data fragments is sent
+// with k parity fragments, computed so that any n of the n+k
+// fragments are enough to rebuild the payload. With a single parity
+// fragment, that's a plain XOR of the data. With more, it's a
+// systematic Reed-Solomon erasure code over GF(2^8) using a Cauchy
+// matrix, for which every n rows of the full encoding matrix are
+// invertible.
+
+// MAX_SHARDS is the most data and parity fragments GF(2^8) can code
+// together.
+const MAX_SHARDS = 256
+
+// gfExp and gfLog are exponent and logarithm tables for GF(2^8) with
+// the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d) and generator 2.
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// mulAdd adds c*src to dst, element wise.
+func mulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range src {
+			dst[i] ^= b
+		}
+	default:
+		lc := gfLog[c]
+		for i, b := range src {
+			if b != 0 {
+				dst[i] ^= gfExp[lc+gfLog[b]]
+			}
+		}
+	}
+}
+
+// parityRows returns the k x n matrix used to compute parity from n
+// data shards.
+func parityRows(n, k int) [][]byte {
+	rows := make([][]byte, k)
+	for i := range rows {
+		rows[i] = make([]byte, n)
+		for j := range rows[i] {
+			if k == 1 {
+				rows[i][j] = 1
+			} else {
+				// Cauchy: 1 / (x_i + y_j), with x_i and y_j
+				// distinct.
+				rows[i][j] = gfInv(byte(n+i) ^ byte(j))
+			}
+		}
+	}
+	return rows
+}
+
+// encodeParity returns k parity shards for data. All data shards must
+// be the same length.
+func encodeParity(data [][]byte, k int) [][]byte {
+	if k == 0 || len(data) == 0 {
+		return nil
+	}
+
+	rows := parityRows(len(data), k)
+	parity := make([][]byte, k)
+	for i := range parity {
+		parity[i] = make([]byte, len(data[0]))
+		for j, d := range data {
+			mulAdd(parity[i], d, rows[i][j])
+		}
+	}
+
+	return parity
+}
+
+var tooFewShards = errors.New("too few shards to reconstruct")
+
+// reconstruct fills in the missing (nil) data shards among the first
+// n entries of shards, using the k parity shards that follow. All
+// present shards must be the same length.
+func reconstruct(shards [][]byte, n, k int) error {
+	if len(shards) != n+k {
+		return fmt.Errorf("got %d shards, wanted %d", len(shards), n+k)
+	}
+
+	missing := false
+	for _, s := range shards[:n] {
+		if s == nil {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	// Build the encoding matrix rows for the first n shards we
+	// have, along with the shards themselves.
+	prows := parityRows(n, k)
+	m := make([][]byte, 0, n)
+	have := make([][]byte, 0, n)
+	size := 0
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if i < n {
+			row := make([]byte, n)
+			row[i] = 1
+			m = append(m, row)
+		} else {
+			m = append(m, prows[i-n])
+		}
+		have = append(have, s)
+		size = len(s)
+		if len(m) == n {
+			break
+		}
+	}
+	if len(m) < n {
+		return tooFewShards
+	}
+
+	inv, err := invert(m)
+	if err != nil {
+		return err
+	}
+
+	// Each missing data shard is its row of the inverse applied
+	// to the shards we have.
+	for i := 0; i < n; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for j, s := range have {
+			mulAdd(out, s, inv[i][j])
+		}
+		shards[i] = out
+	}
+
+	return nil
+}
+
+// invert returns the inverse of the square matrix m, using
+// Gauss-Jordan elimination. m is not modified.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	// Work on [m | I]
+	w := make([][]byte, n)
+	for i := range w {
+		w[i] = make([]byte, 2*n)
+		copy(w[i], m[i])
+		w[i][n+i] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && w[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errors.New("singular matrix")
+		}
+		w[c], w[p] = w[p], w[c]
+
+		if v := w[c][c]; v != 1 {
+			iv := gfInv(v)
+			for j := range w[c] {
+				w[c][j] = gfMul(w[c][j], iv)
+			}
+		}
+
+		for r := 0; r < n; r++ {
+			if r != c && w[r][c] != 0 {
+				mulAdd(w[r], w[c], w[r][c])
+			}
+		}
+	}
+
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = w[i][n:]
+	}
+
+	return inv, nil
+}
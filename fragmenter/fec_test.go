@@ -0,0 +1,68 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package fragmenter
+
+import (
+	"crypto/rand"
+	"slices"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	cases := []struct {
+		n, k int
+		lose []int
+	}{
+		{2, 1, []int{0}},
+		{2, 1, []int{1}},
+		{2, 1, []int{2}},
+		{5, 1, []int{3}},
+		{4, 2, []int{0, 3}},
+		{4, 2, []int{1, 5}},
+		{10, 4, []int{0, 2, 4, 9}},
+		{10, 4, []int{9, 10, 11, 12}},
+		{16, 16, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+	}
+
+	for i, c := range cases {
+		data := make([][]byte, c.n)
+		for j := range data {
+			data[j] = make([]byte, 20)
+			rand.Read(data[j])
+		}
+
+		shards := append(slices.Clone(data), encodeParity(data, c.k)...)
+		for _, l := range c.lose {
+			shards[l] = nil
+		}
+
+		if err := reconstruct(shards, c.n, c.k); err != nil {
+			t.Errorf("%d: reconstruct() failed: %v", i, err)
+			continue
+		}
+		for j := range data {
+			if !slices.Equal(shards[j], data[j]) {
+				t.Errorf("%d/%d: Got %v, wanted %v", i, j, shards[j], data[j])
+			}
+		}
+	}
+}
+
+func TestReconstructTooFew(t *testing.T) {
+	data := [][]byte{{1, 2}, {3, 4}, {5, 6}}
+	shards := append(slices.Clone(data), encodeParity(data, 2)...)
+	shards[0], shards[1], shards[3] = nil, nil, nil
+
+	if err := reconstruct(shards, 3, 2); err != tooFewShards {
+		t.Errorf("Got %v, wanted %v", err, tooFewShards)
+	}
+}
+
+func TestXORParity(t *testing.T) {
+	data := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+	want := []byte{1 ^ 4 ^ 7, 2 ^ 5 ^ 8, 3 ^ 6 ^ 9}
+
+	if got := encodeParity(data, 1); len(got) != 1 || !slices.Equal(got[0], want) {
+		t.Errorf("Got %v, wanted [%v]", got, want)
+	}
+}
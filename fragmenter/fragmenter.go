@@ -3,59 +3,172 @@
 package fragmenter
 
 import (
-	"bytes"
-	"compress/gzip"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"math"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bdwalton/gosh/protos/goshpb"
 	"google.golang.org/protobuf/proto"
 )
 
-// For now this is a magic number - we seem to save bytes when
-// payload is 100 bytes or more.
-const COMPRESS_THRESHOLD = 100
+// For now this is a magic number - we seem to save bytes with gzip
+// when payload is 100 bytes or more. With the preset dictionary, much
+// smaller payloads shrink.
+const (
+	COMPRESS_THRESHOLD      = 100
+	DICT_COMPRESS_THRESHOLD = 16
+)
+
+// FRAGMENT_OVERHEAD is the room needed for the fragment proto fields
+// wrapped around the data in each fragment, rounded up generously.
+const FRAGMENT_OVERHEAD = 32
+
+// Forward error correction tuning. We only add parity to payloads of
+// more than one fragment, once our peer reports losing at least
+// FEC_MIN_LOSS of what we send. We then send about twice the
+// expected number of lost fragments as parity, up to MAX_PARITY.
+const (
+	FEC_MIN_LOSS = 0.01
+	MAX_PARITY   = 16
+	// Assembled sets are kept this long to count late fragments
+	// towards our loss estimate, and ignore them.
+	DONE_TTL = 5 * time.Second
+)
+
+// Limits on what we'll accept from our peer, so that a buggy or
+// hostile one can't make us allocate without bound.
+const (
+	// MAX_FRAGS is the most data fragments in one set.
+	MAX_FRAGS = 4096
+	// MAX_FRAG_DATA is the most data in one fragment.
+	MAX_FRAG_DATA = 65535
+	// MAX_SETS, MAX_BUFFERED and MAX_BUFFERED_BYTES limit the
+	// sets, and fragments and their data across all sets, that we
+	// hold at once. When any is reached, the least recently
+	// updated set is dropped. A set that alone would hold more
+	// than MAX_BUFFERED_BYTES is dropped itself.
+	MAX_SETS           = 256
+	MAX_BUFFERED       = 8192
+	MAX_BUFFERED_BYTES = 16 << 20
+	// MAX_PAYLOAD is the largest payload we'll decompress.
+	MAX_PAYLOAD = 16 << 20
+)
 
 type fragSet struct {
 	first, last   time.Time // Used for GC on stale fragments we've stored
 	cnt, expected uint32
+	parity        uint32
+	codec         goshpb.Codec
+	plen          uint32
+	bytes         int // data held
 	frags         []*goshpb.Fragment
+	assembled     bool
+	counted       bool // loss has been observed
 }
 
-func newFragSet(size uint32) *fragSet {
+// newFragSet returns an empty set for fragments like frag, which must
+// already be validated.
+func newFragSet(frag *goshpb.Fragment) *fragSet {
 	t := time.Now()
+	size, parity := frag.GetTotalFrags(), frag.GetParityFrags()
 
 	return &fragSet{
 		first:    t,
 		last:     t,
 		expected: size,
-		frags:    make([]*goshpb.Fragment, int(size), (size)),
+		parity:   parity,
+		codec:    fragCodec(frag),
+		plen:     frag.GetPayloadLen(),
+		frags:    make([]*goshpb.Fragment, int(size+parity), (size + parity)),
 	}
 }
 
-func (f *fragSet) add(frag *goshpb.Fragment) {
+// matches returns true if frag agrees with the set about its shape.
+func (f *fragSet) matches(frag *goshpb.Fragment) bool {
+	return frag.GetTotalFrags() == f.expected &&
+		frag.GetParityFrags() == f.parity &&
+		fragCodec(frag) == f.codec &&
+		frag.GetPayloadLen() == f.plen
+}
+
+// add stores frag, returning false if it's a duplicate.
+func (f *fragSet) add(frag *goshpb.Fragment) bool {
+	i := frag.GetThisFrag()
+	if int(i) >= len(f.frags) || f.frags[i] != nil {
+		return false
+	}
+
 	f.last = time.Now()
-	f.frags[frag.GetThisFrag()] = frag
+	f.frags[i] = frag
 	f.cnt += 1
+	f.bytes += len(frag.GetData())
+
+	return true
 }
 
+// fragCodec returns the codec frag's set was compressed with. Peers
+// from before codecs only set compressed, for gzip.
+func fragCodec(frag *goshpb.Fragment) goshpb.Codec {
+	if !frag.HasCodec() && frag.GetCompressed() {
+		return goshpb.Codec_CODEC_GZIP
+	}
+	return frag.GetCodec()
+}
+
+// validate checks that frag is self consistent and within our limits.
+func validate(frag *goshpb.Fragment) error {
+	total, parity, this := frag.GetTotalFrags(), frag.GetParityFrags(), frag.GetThisFrag()
+
+	switch {
+	case total == 0 || total > MAX_FRAGS:
+		return fmt.Errorf("invalid total fragments %d", total)
+	case parity > MAX_PARITY || (parity > 0 && total+parity > MAX_SHARDS):
+		return fmt.Errorf("invalid parity fragments %d for %d fragments", parity, total)
+	case this >= total+parity:
+		return fmt.Errorf("fragment %d out of range for %d+%d fragments", this, total, parity)
+	case codecs[fragCodec(frag)] == nil:
+		return fmt.Errorf("unknown codec %d", fragCodec(frag))
+	case len(frag.GetData()) > MAX_FRAG_DATA:
+		return fmt.Errorf("fragment data of %d bytes is too large", len(frag.GetData()))
+	case parity > 0 && uint64(frag.GetPayloadLen()) > uint64(total)*MAX_FRAG_DATA:
+		return fmt.Errorf("payload length %d too large for %d fragments", frag.GetPayloadLen(), total)
+	}
+
+	return nil
+}
+
+// complete returns true if we have enough fragments, data or parity,
+// to rebuild the payload.
 func (f *fragSet) complete() bool {
-	return f.cnt == f.expected
+	return f.cnt >= f.expected
+}
+
+// loss returns the fraction of the set's fragments we didn't receive.
+func (f *fragSet) loss() float64 {
+	return 1 - float64(f.cnt)/float64(len(f.frags))
 }
 
 type Fragger struct {
-	id           uint32 // Increment for each new batch
-	size         int    // How much data we can include in each fragment
-	idMux, asMux sync.Mutex
+	id                           uint32 // Increment for each new batch
+	size                         int    // How much data we can include in each fragment
+	idMux, asMux, szMux, lossMux sync.Mutex
 
-	asmbl map[uint32]*fragSet
-	last  map[uint32]time.Time
+	asmbl    map[uint32]*fragSet
+	last     map[uint32]time.Time
+	buffered int // fragments held across all sets
+	bufBytes int // and their data
+
+	fec      bool
+	peerLoss float64 // loss our peer sees from us
+	recvLoss float64 // loss we see from our peer
+
+	accept     atomic.Uint32 // codecs we tell our peer we can decode
+	peerCodecs atomic.Uint32 // codecs our peer can decode
 }
 
 func (f *Fragger) getUniqueId() uint32 {
@@ -67,101 +180,292 @@ func (f *Fragger) getUniqueId() uint32 {
 }
 
 func New(size int) *Fragger {
-	return &Fragger{
+	f := &Fragger{
 		size:  size,
 		asmbl: make(map[uint32]*fragSet),
 		last:  make(map[uint32]time.Time),
 	}
+	f.accept.Store(acceptCodecs)
+	f.peerCodecs.Store(peerDefaultCodecs)
+	return f
+}
+
+// SetSize changes how much data is included in each new fragment.
+// Fragments already created or being assembled are unaffected.
+func (f *Fragger) SetSize(size int) {
+	f.szMux.Lock()
+	defer f.szMux.Unlock()
+	f.size = size
+}
+
+func (f *Fragger) Size() int {
+	f.szMux.Lock()
+	defer f.szMux.Unlock()
+	return f.size
 }
 
-func compress(buf []byte) ([]byte, error) {
-	var gbuf bytes.Buffer
-	gz := gzip.NewWriter(&gbuf)
+// SetFEC turns forward error correction of new payloads on or off.
+// When on, the amount of parity sent adapts to the loss our peer
+// reports. Receiving parity works either way.
+func (f *Fragger) SetFEC(on bool) {
+	f.lossMux.Lock()
+	defer f.lossMux.Unlock()
+	f.fec = on
+}
 
-	n, err := gz.Write(buf)
-	if err != nil || n != len(buf) {
-		slog.Error("failed to compress data", "err", err, "n", n)
+// Refuse stops telling our peer we can decode c, for when what we're
+// sent with it can't be decoded after all.
+func (f *Fragger) Refuse(c goshpb.Codec) {
+	f.accept.And(^uint32(1 << c))
+}
+
+// PeerAccepts reports whether our peer has told us it can decode c.
+func (f *Fragger) PeerAccepts(c goshpb.Codec) bool {
+	return f.peerCodecs.Load()&(1<<c) != 0
+}
+
+// parityFor returns how many parity fragments to send with n data
+// fragments.
+func (f *Fragger) parityFor(n int) int {
+	f.lossMux.Lock()
+	defer f.lossMux.Unlock()
+
+	if !f.fec || n < 2 || f.peerLoss < FEC_MIN_LOSS {
+		return 0
+	}
+
+	k := min(int(math.Ceil(2*f.peerLoss*float64(n))), n, MAX_PARITY)
+	if n+k > MAX_SHARDS {
+		return 0
 	}
-	gz.Close()
-	return gbuf.Bytes(), nil
+	return k
 }
 
-func decompress(buf []byte) ([]byte, error) {
-	gz, err := gzip.NewReader(bytes.NewBuffer(buf))
-	if err != nil {
-		return nil, err
+// lossReport returns the loss we see, in parts per thousand.
+func (f *Fragger) lossReport() uint32 {
+	f.lossMux.Lock()
+	defer f.lossMux.Unlock()
+	return uint32(math.Round(f.recvLoss * 1000))
+}
+
+// observeLoss folds the loss seen on a finished set into our
+// estimate. Sets of a single fragment tell us nothing, as we only
+// know about them if they arrived.
+func (f *Fragger) observeLoss(fset *fragSet) {
+	if len(fset.frags) < 2 || fset.counted {
+		return
 	}
+	fset.counted = true
 
-	var obuf bytes.Buffer
-	if _, err := io.Copy(&obuf, gz); err != nil {
-		return nil, err
+	f.lossMux.Lock()
+	defer f.lossMux.Unlock()
+	f.recvLoss = (7*f.recvLoss + fset.loss()) / 8
+}
+
+// compress returns buf compressed with the best codec our peer
+// accepts, or as is if compression doesn't make it smaller.
+func (f *Fragger) compress(buf []byte) (goshpb.Codec, []byte, error) {
+	peer := f.peerCodecs.Load()
+
+	var c Codec
+	switch {
+	case peer&(1<<goshpb.Codec_CODEC_DEFLATE_DICT) != 0 && len(buf) > DICT_COMPRESS_THRESHOLD:
+		c = codecs[goshpb.Codec_CODEC_DEFLATE_DICT]
+	case peer&(1<<goshpb.Codec_CODEC_GZIP) != 0 && len(buf) > COMPRESS_THRESHOLD:
+		c = codecs[goshpb.Codec_CODEC_GZIP]
+	default:
+		return goshpb.Codec_CODEC_NONE, buf, nil
+	}
+
+	payload, err := c.Compress(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) >= len(buf) {
+		return goshpb.Codec_CODEC_NONE, buf, nil
 	}
 
-	return obuf.Bytes(), nil
+	return c.ID(), payload, nil
 }
 
 func (f *Fragger) CreateFragments(buf []byte) ([]*goshpb.Fragment, error) {
-	fcomp := len(buf) > COMPRESS_THRESHOLD
-
-	var err error
-	payload := buf
-	if fcomp {
-		payload, err = compress(buf)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't compress payload: %v", err)
-		}
+	codec, payload, err := f.compress(buf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compress payload: %v", err)
+	}
+	accept := f.accept.Load()
+	// Peers from before codecs only know gzip by this.
+	var compressed *bool
+	if codec == goshpb.Codec_CODEC_GZIP {
+		compressed = proto.Bool(true)
 	}
 
+	size := f.Size()
 	frid := f.getUniqueId()
-	total := int(math.Ceil(float64(len(payload)) / float64(f.size)))
-	fragments := make([]*goshpb.Fragment, total)
+	total := int(math.Ceil(float64(len(payload)) / float64(size)))
+	parity := f.parityFor(total)
+	loss := f.lossReport()
+	fragments := make([]*goshpb.Fragment, total, total+parity)
 	for i := 0; i < total; i++ {
 		fragments[i] = goshpb.Fragment_builder{
-			Id:         proto.Uint32(frid),
-			ThisFrag:   proto.Uint32(uint32(i)),
-			TotalFrags: proto.Uint32(uint32(total)),
-			Compressed: proto.Bool(fcomp),
+			Id:           proto.Uint32(frid),
+			ThisFrag:     proto.Uint32(uint32(i)),
+			TotalFrags:   proto.Uint32(uint32(total)),
+			Codec:        codec.Enum(),
+			Compressed:   compressed,
+			AcceptCodecs: proto.Uint32(accept),
 		}.Build()
-		s, e := i*f.size, i*f.size+f.size
+		s, e := i*size, i*size+size
 		if e > len(payload) {
 			e = len(payload)
 		}
 		fragments[i].SetData(payload[s:e])
+		// Always sent, so our peer learns when loss stops.
+		fragments[i].SetLoss(loss)
+	}
+
+	if parity == 0 {
+		return fragments, nil
+	}
+
+	// Parity needs equal sized shards, so the last one is zero
+	// padded. The receiver trims it using payload_len.
+	shards := make([][]byte, total)
+	for i, frag := range fragments {
+		shards[i] = frag.GetData()
+		frag.SetParityFrags(uint32(parity))
+		frag.SetPayloadLen(uint32(len(payload)))
+	}
+	shards[total-1] = append(slices.Clone(shards[total-1]), make([]byte, size-len(shards[total-1]))...)
+
+	for i, p := range encodeParity(shards, parity) {
+		frag := goshpb.Fragment_builder{
+			Id:           proto.Uint32(frid),
+			ThisFrag:     proto.Uint32(uint32(total + i)),
+			TotalFrags:   proto.Uint32(uint32(total)),
+			Codec:        codec.Enum(),
+			Compressed:   compressed,
+			AcceptCodecs: proto.Uint32(accept),
+			ParityFrags:  proto.Uint32(uint32(parity)),
+			PayloadLen:   proto.Uint32(uint32(len(payload))),
+		}.Build()
+		frag.SetData(p)
+		frag.SetLoss(loss)
+		fragments = append(fragments, frag)
 	}
 
 	return fragments, nil
 }
 
+// Wrap returns buf as a single, uncompressed fragment, ignoring the
+// configured fragment size. This is for messages that must go out as
+// exactly one datagram of a known size, like path MTU probes.
+func (f *Fragger) Wrap(buf []byte) *goshpb.Fragment {
+	frag := goshpb.Fragment_builder{
+		Id:         proto.Uint32(f.getUniqueId()),
+		ThisFrag:   proto.Uint32(0),
+		TotalFrags: proto.Uint32(1),
+		Codec:      goshpb.Codec_CODEC_NONE.Enum(),
+	}.Build()
+	frag.SetData(buf)
+	return frag
+}
+
 // Store accepts a fragment and returns a bool indicating whether we
-// have all fragments to complete the set for the fragment's id.
+// have enough fragments to complete the set for the fragment's id.
+// It returns true only once per set. Invalid fragments, duplicates
+// and those inconsistent with others in their set are dropped.
 func (f *Fragger) Store(frag *goshpb.Fragment) bool {
 	id := frag.GetId()
 
+	if err := validate(frag); err != nil {
+		slog.Debug("dropping invalid fragment", "id", id, "err", err)
+		return false
+	}
+
+	if frag.HasLoss() {
+		f.lossMux.Lock()
+		f.peerLoss = float64(min(frag.GetLoss(), 1000)) / 1000
+		f.lossMux.Unlock()
+	}
+
+	if frag.HasAcceptCodecs() {
+		f.peerCodecs.Store(frag.GetAcceptCodecs())
+	}
+
 	f.asMux.Lock()
+	defer f.asMux.Unlock()
+
 	fset, ok := f.asmbl[id]
+	if ok && !fset.matches(frag) {
+		slog.Debug("dropping fragment inconsistent with its set", "id", id)
+		return false
+	}
+
+	n := len(frag.GetData())
+	if ok && fset.bytes+n > MAX_BUFFERED_BYTES {
+		slog.Debug("fragment set too large, dropping", "id", id)
+		f.drop(id)
+		return false
+	}
+
+	f.makeRoom(id, n)
 	if !ok {
-		fset = newFragSet(frag.GetTotalFrags())
+		fset = newFragSet(frag)
 		f.asmbl[id] = fset
 	}
-	f.last[id] = time.Now()
-	f.asMux.Unlock()
+	if !fset.assembled {
+		f.last[id] = time.Now()
+	}
+
+	if !fset.add(frag) {
+		slog.Debug("dropping duplicate fragment", "id", id, "this", frag.GetThisFrag())
+		return false
+	}
+	f.buffered += 1
+	f.bufBytes += n
+
+	return !fset.assembled && fset.complete()
+}
 
-	fset.add(frag)
+// makeRoom drops the least recently updated sets, other than id's,
+// until there's room for a fragment of n bytes within MAX_SETS,
+// MAX_BUFFERED and MAX_BUFFERED_BYTES. The caller must hold asMux.
+func (f *Fragger) makeRoom(id uint32, n int) {
+	for len(f.asmbl) >= MAX_SETS || f.buffered >= MAX_BUFFERED || f.bufBytes+n > MAX_BUFFERED_BYTES {
+		var oldest uint32
+		var ot time.Time
+		for i, t := range f.last {
+			if i != id && (ot.IsZero() || t.Before(ot)) {
+				oldest, ot = i, t
+			}
+		}
+		if ot.IsZero() {
+			return
+		}
+		slog.Debug("too many fragments held, dropping set", "id", oldest)
+		f.drop(oldest)
+	}
+}
 
-	return fset.complete()
+// drop forgets the set for id. The caller must hold asMux.
+func (f *Fragger) drop(id uint32) {
+	if fset, ok := f.asmbl[id]; ok {
+		f.buffered -= int(fset.cnt)
+		f.bufBytes -= fset.bytes
+	}
+	delete(f.asmbl, id)
+	delete(f.last, id)
 }
 
 var unknownFragSet = errors.New("unknown fragement set")
 var incompleteFragSet = errors.New("incomplete fragement set")
 
-// Assemble will consume a fragment set and uncompress it as required,
-// returning the bytes of the fragments in the expected order. An
-// error is returned if the id is unknown or incomplete or if the data
-// is compressed and decompression fails.
+// Assemble will consume a fragment set and decompress it with the
+// set's codec, returning the bytes of the fragments in the expected
+// order. An error is returned if the id is unknown or incomplete or
+// if decompression fails.
 func (f *Fragger) Assemble(id uint32) ([]byte, error) {
-	var err error
-	var ret []byte
-
 	f.asMux.Lock()
 	defer f.asMux.Unlock()
 
@@ -170,30 +474,86 @@ func (f *Fragger) Assemble(id uint32) ([]byte, error) {
 		return nil, unknownFragSet
 	}
 
+	if fset.assembled {
+		return nil, unknownFragSet
+	}
+
 	if !fset.complete() {
 		return nil, incompleteFragSet
 	}
 
-	data := make([][]byte, fset.expected, fset.expected)
+	d, err := fset.data()
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := codecs[fset.codec].Decompress(d)
+	if err != nil {
+		return nil, err
+	}
 
-	for i := 0; i < int(fset.cnt); i++ {
-		data[i] = fset.frags[uint32(i)].GetData()
+	if fset.parity == 0 {
+		f.observeLoss(fset)
+		f.drop(id)
+	} else {
+		// Keep the set around for a while so that late
+		// fragments are counted and ignored. See Clean.
+		fset.assembled = true
+		f.last[id] = time.Now()
 	}
 
-	d := slices.Concat(data...)
-	if fset.frags[0].GetCompressed() {
-		ret, err = decompress(d)
-		if err != nil {
-			return nil, err
+	return ret, nil
+}
+
+// data returns the payload carried by the set, rebuilding any missing
+// data fragments from parity.
+func (fset *fragSet) data() ([]byte, error) {
+	n := int(fset.expected)
+	shards := make([][]byte, len(fset.frags))
+	missing := false
+	for i, frag := range fset.frags {
+		if frag != nil {
+			shards[i] = frag.GetData()
+		} else if i < n {
+			missing = true
 		}
-	} else {
-		ret = d
 	}
 
-	delete(f.asmbl, id)
-	delete(f.last, id)
+	if !missing {
+		return slices.Concat(shards[:n]...), nil
+	}
 
-	return ret, nil
+	// All shards must be the same size, except the final data
+	// fragment, which we pad to match.
+	size := -1
+	for i, s := range shards {
+		if s == nil || i == n-1 {
+			continue
+		}
+		if size == -1 {
+			size = len(s)
+		} else if len(s) != size {
+			return nil, fmt.Errorf("fragment %d has %d bytes, wanted %d", i, len(s), size)
+		}
+	}
+	if last := shards[n-1]; last != nil {
+		if size == -1 || len(last) > size {
+			return nil, fmt.Errorf("final fragment has %d bytes, more than %d", len(last), size)
+		}
+		shards[n-1] = append(slices.Clone(last), make([]byte, size-len(last))...)
+	}
+	plen := fset.plen
+
+	if err := reconstruct(shards, n, int(fset.parity)); err != nil {
+		return nil, fmt.Errorf("couldn't rebuild payload: %w", err)
+	}
+
+	d := slices.Concat(shards[:n]...)
+	if int(plen) > len(d) {
+		return nil, fmt.Errorf("payload length %d exceeds rebuilt data of %d bytes", plen, len(d))
+	}
+
+	return d[:plen], nil
 }
 
 func (f *Fragger) Clean() {
@@ -201,12 +561,26 @@ func (f *Fragger) Clean() {
 	defer f.asMux.Unlock()
 
 	for id, t := range f.last {
+		fset := f.asmbl[id]
+		if fset != nil && fset.assembled {
+			if t.Add(DONE_TTL).Before(time.Now()) {
+				f.observeLoss(fset)
+				f.drop(id)
+			}
+			continue
+		}
+
+		// A set that's stopped growing has probably lost
+		// fragments, though they may still turn up.
+		if fset != nil && t.Add(DONE_TTL).Before(time.Now()) {
+			f.observeLoss(fset)
+		}
+
 		// Look for fragsets older than 1m. If we haven't seen
 		// a full set in that interval, discard the set.
 		if t.Add(1 * time.Minute).Before(time.Now()) {
 			slog.Debug("expiring old fragset", "id", id, "last", t)
-			delete(f.asmbl, id)
-			delete(f.last, id)
+			f.drop(id)
 		}
 	}
 }
@@ -3,9 +3,12 @@
 package fragmenter
 
 import (
+	"bytes"
 	"crypto/rand"
+	"math"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/bdwalton/gosh/protos/goshpb"
 	"google.golang.org/protobuf/proto"
@@ -15,31 +18,37 @@ func TestCreateFragments(t *testing.T) {
 	f1 := New(10)
 	f2 := New(2)
 	f3 := New(10)
+	f4 := New(10)
+	f4.peerCodecs.Store(acceptCodecs)
 
 	rbytes := make([]byte, COMPRESS_THRESHOLD+1)
 	rand.Read(rbytes)
+	cbytes := bytes.Repeat([]byte("\x1b[1;31mERROR\x1b[m"), 10)
+	none, gz, dict := goshpb.Codec_CODEC_NONE, goshpb.Codec_CODEC_GZIP, goshpb.Codec_CODEC_DEFLATE_DICT
 	cases := []struct {
 		f         *Fragger
 		input     []byte
 		wantId    uint32
 		wantTotal int
-		wantComp  bool
+		wantCodec goshpb.Codec
 		wantFrags [][]byte
 	}{
-		{f1, []byte{1, 2, 3}, 0, 1, false, [][]byte{[]byte{1, 2, 3}}},
-		{f2, []byte{1, 2, 3}, 0, 2, false, [][]byte{[]byte{1, 2}, []byte{3}}},
-		{f2, []byte{1, 2, 3}, 1, 2, false, [][]byte{[]byte{1, 2}, []byte{3}}},
-		{f2, []byte{1, 2, 3, 4, 5}, 2, 2, false, [][]byte{[]byte{1, 2}, []byte{3, 4}, []byte{5}}},
-		{f3, rbytes, 0, 1, true, [][]byte{} /*unused for compress test*/},
+		{f1, []byte{1, 2, 3}, 0, 1, none, [][]byte{[]byte{1, 2, 3}}},
+		{f2, []byte{1, 2, 3}, 0, 2, none, [][]byte{[]byte{1, 2}, []byte{3}}},
+		{f2, []byte{1, 2, 3}, 1, 2, none, [][]byte{[]byte{1, 2}, []byte{3}}},
+		{f2, []byte{1, 2, 3, 4, 5}, 2, 2, none, [][]byte{[]byte{1, 2}, []byte{3, 4}, []byte{5}}},
+		{f3, cbytes, 0, 1, gz, nil},
+		// Incompressible data is sent as is
+		{f3, rbytes, 1, 11, none, nil},
+		{f4, cbytes, 0, 1, dict, nil},
 	}
 
 	for i, c := range cases {
 		// We don't test error cases as we only ever error in
-		// gzip which isn't something we should test for here.
+		// compression which isn't something we should test for
+		// here.
 		got, _ := c.f.CreateFragments(c.input)
-		// Ingore this check for compressed data. TODO: Add
-		// round tripping to verify compression.
-		if !c.wantComp && len(got) != len(c.wantFrags) {
+		if c.wantFrags != nil && len(got) != len(c.wantFrags) {
 			t.Errorf("%d: %d frags, wanted %d", i, len(got), len(c.wantFrags))
 		}
 
@@ -47,26 +56,35 @@ func TestCreateFragments(t *testing.T) {
 			t.Errorf("%d: Got id %d, wanted %d", i, id, c.wantId)
 		}
 
-		if comp := got[0].GetCompressed(); comp != c.wantComp {
-			t.Errorf("%d: Got compressiong %t, wanted %t", i, comp, c.wantComp)
+		if codec := got[0].GetCodec(); codec != c.wantCodec {
+			t.Errorf("%d: Got codec %s, wanted %s", i, codec, c.wantCodec)
 		}
 
-		if !c.wantComp {
-			for j, s := range got {
-				if d := s.GetData(); !slices.Equal(d, c.wantFrags[j]) {
-					t.Errorf("%d/%d: Bytes: %v; Got %v, wanted %v", i, j, c.input, d, c.wantFrags[j])
-				}
+		for j, s := range got {
+			if j >= len(c.wantFrags) {
+				break
+			}
+			if d := s.GetData(); !slices.Equal(d, c.wantFrags[j]) {
+				t.Errorf("%d/%d: Bytes: %v; Got %v, wanted %v", i, j, c.input, d, c.wantFrags[j])
 			}
 		}
+
+		r := New(10)
+		for _, s := range got {
+			r.Store(s)
+		}
+		if d, err := r.Assemble(got[0].GetId()); err != nil || !slices.Equal(d, c.input) {
+			t.Errorf("%d: Round trip got %v (err: %v), wanted %v", i, d, err, c.input)
+		}
 	}
 }
 
-func newFragment(id, this, total uint32, data []byte, compressed bool) *goshpb.Fragment {
+func newFragment(id, this, total uint32, data []byte, codec goshpb.Codec) *goshpb.Fragment {
 	f := goshpb.Fragment_builder{
 		Id:         proto.Uint32(id),
 		ThisFrag:   proto.Uint32(this),
 		TotalFrags: proto.Uint32(total),
-		Compressed: proto.Bool(compressed),
+		Codec:      codec.Enum(),
 	}.Build()
 
 	f.SetData(data)
@@ -85,11 +103,7 @@ func makeFrag(id, this, total uint32, data []byte) *goshpb.Fragment {
 }
 
 func makeFragSet(frags []*goshpb.Fragment) *fragSet {
-	tot := frags[0].GetTotalFrags()
-	fs := &fragSet{
-		expected: tot,
-		frags:    make([]*goshpb.Fragment, tot, tot),
-	}
+	fs := newFragSet(frags[0])
 	for _, f := range frags {
 		fs.add(f)
 	}
@@ -202,3 +216,340 @@ func TestAssemble(t *testing.T) {
 		}
 	}
 }
+
+func TestSetSize(t *testing.T) {
+	f := New(10)
+	buf := []byte("0123456789abcdefghij")
+
+	cases := []struct {
+		size      int
+		wantTotal int
+	}{
+		{10, 2},
+		{5, 4},
+		{20, 1},
+	}
+
+	for i, c := range cases {
+		f.SetSize(c.size)
+		got, _ := f.CreateFragments(buf)
+		if len(got) != c.wantTotal {
+			t.Errorf("%d: Got %d frags, wanted %d", i, len(got), c.wantTotal)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	f := New(2)
+	buf := make([]byte, COMPRESS_THRESHOLD+1)
+
+	got := f.Wrap(buf)
+	if got.GetTotalFrags() != 1 || got.GetThisFrag() != 0 || got.GetCodec() != goshpb.Codec_CODEC_NONE {
+		t.Errorf("Got frag %d of %d (codec: %s), wanted 0 of 1 (%s)", got.GetThisFrag(), got.GetTotalFrags(), got.GetCodec(), goshpb.Codec_CODEC_NONE)
+	}
+
+	if !f.Store(got) {
+		t.Fatalf("Wrapped fragment didn't complete a set")
+	}
+
+	if d, err := f.Assemble(got.GetId()); err != nil || !slices.Equal(d, buf) {
+		t.Errorf("Got %v (err: %v), wanted %v", d, err, buf)
+	}
+}
+
+func TestParityFor(t *testing.T) {
+	cases := []struct {
+		fec  bool
+		loss float64
+		n    int
+		want int
+	}{
+		{false, 0.5, 10, 0},
+		{true, 0, 10, 0},
+		{true, 0.5, 1, 0},
+		{true, FEC_MIN_LOSS / 2, 10, 0},
+		{true, 0.02, 10, 1},
+		{true, 0.1, 10, 2},
+		{true, 0.5, 10, 10},
+		{true, 0.5, 100, MAX_PARITY},
+	}
+
+	for i, c := range cases {
+		f := New(10)
+		f.SetFEC(c.fec)
+		f.peerLoss = c.loss
+		if got := f.parityFor(c.n); got != c.want {
+			t.Errorf("%d: Got %d parity frags, wanted %d", i, got, c.want)
+		}
+	}
+}
+
+func TestFEC(t *testing.T) {
+	buf := make([]byte, 1000)
+	rand.Read(buf) // incompressible, so we get 10 data fragments
+
+	cases := []struct {
+		loss float64
+		drop []int
+	}{
+		{0.1, []int{}},
+		{0.1, []int{3}},
+		{0.1, []int{0, 9}},
+		{0.1, []int{10, 11}},
+		{0.2, []int{1, 2, 4, 8}},
+		{0.02, []int{9}},
+	}
+
+	for i, c := range cases {
+		send, recv := New(110), New(110)
+		send.SetFEC(true)
+		send.peerLoss = c.loss
+
+		frags, err := send.CreateFragments(buf)
+		if err != nil {
+			t.Fatalf("%d: CreateFragments() failed: %v", i, err)
+		}
+
+		var done bool
+		for j, frag := range frags {
+			if slices.Contains(c.drop, j) {
+				continue
+			}
+			if recv.Store(frag) {
+				if done {
+					t.Errorf("%d: Store() reported completion twice", i)
+				}
+				done = true
+				got, err := recv.Assemble(frag.GetId())
+				if err != nil || !slices.Equal(got, buf) {
+					t.Errorf("%d: Got %d bytes (err: %v), wanted %d", i, len(got), err, len(buf))
+				}
+			}
+		}
+		if !done {
+			t.Errorf("%d: Payload not completed with %d of %d frags dropped", i, len(c.drop), len(frags))
+		}
+	}
+}
+
+func TestLossReport(t *testing.T) {
+	f := New(3)
+	if got := f.lossReport(); got != 0 {
+		t.Fatalf("Got initial loss %d, wanted 0", got)
+	}
+
+	// Half of a set never arrives
+	f.Store(makeFrag(1, 0, 4, []byte("123")))
+	f.Store(makeFrag(1, 1, 4, []byte("456")))
+	f.last[1] = time.Now().Add(-2 * DONE_TTL)
+	f.Clean()
+
+	// 1/8th of 50% loss, in parts per thousand
+	if got := f.lossReport(); got != 63 {
+		t.Errorf("Got loss %d, wanted 63", got)
+	}
+
+	// It's only counted once
+	f.Clean()
+	if got := f.lossReport(); got != 63 {
+		t.Errorf("Got loss %d after second Clean(), wanted 63", got)
+	}
+
+	// Our peer learns of it from what we send
+	frags, _ := f.CreateFragments([]byte("hello"))
+	peer := New(3)
+	peer.Store(frags[0])
+	if got := peer.peerLoss; got != 0.063 {
+		t.Errorf("Got peer loss %f, wanted 0.063", got)
+	}
+
+	// Messages without a report, like probes, leave it be
+	peer.Store(f.Wrap([]byte("probe")))
+	if got := peer.peerLoss; got != 0.063 {
+		t.Errorf("Got peer loss %f after a probe, wanted 0.063", got)
+	}
+
+	// And it hears when the loss goes away
+	f.recvLoss = 0
+	frags, _ = f.CreateFragments([]byte("hello"))
+	peer.Store(frags[0])
+	if got := peer.peerLoss; got != 0 {
+		t.Errorf("Got peer loss %f after recovery, wanted 0", got)
+	}
+}
+
+func TestStoreInvalid(t *testing.T) {
+	huge := makeFrag(1, 0, 1, make([]byte, MAX_FRAG_DATA+1))
+
+	parity := makeFrag(1, 0, 2, []byte("123"))
+	parity.SetParityFrags(MAX_PARITY + 1)
+
+	badLen := makeFrag(1, 0, 2, []byte("123"))
+	badLen.SetParityFrags(1)
+	badLen.SetPayloadLen(math.MaxUint32)
+
+	cases := []struct {
+		frag *goshpb.Fragment
+	}{
+		{makeFrag(1, 0, 0, []byte("123"))},
+		{makeFrag(1, 0, MAX_FRAGS+1, []byte("123"))},
+		{makeFrag(1, 1, 1, []byte("123"))},
+		{makeFrag(1, math.MaxUint32, 2, []byte("123"))},
+		{huge},
+		{parity},
+		{badLen},
+		{newFragment(1, 0, 1, []byte("123"), goshpb.Codec(99))},
+	}
+
+	for i, c := range cases {
+		f := New(3)
+		if f.Store(c.frag) {
+			t.Errorf("%d: Store() accepted an invalid fragment", i)
+		}
+		if len(f.asmbl) != 0 || f.buffered != 0 {
+			t.Errorf("%d: Invalid fragment was stored", i)
+		}
+	}
+}
+
+func TestStoreDuplicatesAndInconsistent(t *testing.T) {
+	f := New(3)
+
+	if f.Store(makeFrag(1, 0, 2, []byte("123"))) {
+		t.Fatalf("Store() completed a set with 1 of 2 fragments")
+	}
+	// A duplicate mustn't count towards completion
+	if f.Store(makeFrag(1, 0, 2, []byte("123"))) {
+		t.Errorf("Store() completed a set with a duplicate fragment")
+	}
+	// Nor should a fragment that disagrees about the set size
+	if f.Store(makeFrag(1, 1, 3, []byte("456"))) {
+		t.Errorf("Store() completed a set with an inconsistent fragment")
+	}
+	comp := makeFrag(1, 1, 2, []byte("456"))
+	comp.SetCodec(goshpb.Codec_CODEC_GZIP)
+	if f.Store(comp) {
+		t.Errorf("Store() completed a set with a fragment of a different codec")
+	}
+
+	if !f.Store(makeFrag(1, 1, 2, []byte("456"))) {
+		t.Fatalf("Store() didn't complete a valid set")
+	}
+	if got, err := f.Assemble(1); err != nil || string(got) != "123456" {
+		t.Errorf("Got %q (err: %v), wanted %q", got, err, "123456")
+	}
+	if f.buffered != 0 {
+		t.Errorf("Got %d buffered fragments after Assemble(), wanted 0", f.buffered)
+	}
+}
+
+func TestStoreLimits(t *testing.T) {
+	f := New(3)
+	for i := 0; i < MAX_SETS+10; i++ {
+		f.Store(makeFrag(uint32(i), 0, 2, []byte("123")))
+	}
+	if len(f.asmbl) > MAX_SETS || len(f.last) > MAX_SETS {
+		t.Errorf("Got %d sets, wanted at most %d", len(f.asmbl), MAX_SETS)
+	}
+	// The most recent set survives
+	if _, ok := f.asmbl[MAX_SETS+9]; !ok {
+		t.Errorf("Most recent set was dropped")
+	}
+
+	f = New(3)
+	for i := 0; i < MAX_BUFFERED+10; i++ {
+		f.Store(makeFrag(uint32(i/(MAX_FRAGS-1)), uint32(i%(MAX_FRAGS-1)), MAX_FRAGS, []byte("1")))
+	}
+	if f.buffered > MAX_BUFFERED {
+		t.Errorf("Got %d buffered fragments, wanted at most %d", f.buffered, MAX_BUFFERED)
+	}
+
+	// Sets of large fragments are dropped once their data
+	// reaches the byte budget.
+	data := make([]byte, MAX_FRAG_DATA)
+	perSet := 10
+	f = New(3)
+	for i := 0; i < 2*MAX_BUFFERED_BYTES/MAX_FRAG_DATA; i++ {
+		f.Store(makeFrag(uint32(i/perSet), uint32(i%perSet), MAX_FRAGS, data))
+	}
+	if f.bufBytes > MAX_BUFFERED_BYTES {
+		t.Errorf("Got %d buffered bytes, wanted at most %d", f.bufBytes, MAX_BUFFERED_BYTES)
+	}
+	if _, ok := f.asmbl[0]; ok {
+		t.Errorf("Oldest set survived exceeding the byte budget")
+	}
+	last := uint32((2*MAX_BUFFERED_BYTES/MAX_FRAG_DATA - 1) / perSet)
+	if _, ok := f.asmbl[last]; !ok {
+		t.Errorf("Most recent set was dropped")
+	}
+
+	// As is a single set that exceeds it.
+	f = New(3)
+	for i := 0; i <= MAX_BUFFERED_BYTES/MAX_FRAG_DATA; i++ {
+		f.Store(makeFrag(1, uint32(i), MAX_FRAGS, data))
+	}
+	if _, ok := f.asmbl[1]; ok || f.bufBytes != 0 || f.buffered != 0 {
+		t.Errorf("Got %d buffered bytes in %d fragments, wanted the oversized set dropped", f.bufBytes, f.buffered)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	for id, c := range codecs {
+		if id == goshpb.Codec_CODEC_NONE {
+			continue
+		}
+
+		bomb, _ := c.Compress(make([]byte, MAX_PAYLOAD+1))
+		if _, err := c.Decompress(bomb); err == nil {
+			t.Errorf("%s: Decompress() accepted %d bytes of output", id, MAX_PAYLOAD+1)
+		}
+
+		ok, _ := c.Compress(make([]byte, MAX_PAYLOAD))
+		if d, err := c.Decompress(ok); err != nil || len(d) != MAX_PAYLOAD {
+			t.Errorf("%s: Got %d bytes (err: %v), wanted %d", id, len(d), err, MAX_PAYLOAD)
+		}
+	}
+}
+
+// FuzzStore feeds Store a stream of fragments, each prefixed with a
+// one byte length, and assembles whatever completes.
+func FuzzStore(f *testing.F) {
+	buf := make([]byte, 500)
+	rand.Read(buf)
+	for _, loss := range []float64{0, 0.2} {
+		fr := New(50)
+		fr.SetFEC(true)
+		fr.peerLoss = loss
+		for _, p := range [][]byte{[]byte("hello"), buf, make([]byte, 500)} {
+			frags, _ := fr.CreateFragments(p)
+			var seed []byte
+			for i, frag := range frags {
+				if i == 1 {
+					continue // exercise reconstruction
+				}
+				b, _ := proto.Marshal(frag)
+				seed = append(seed, byte(len(b)))
+				seed = append(seed, b...)
+			}
+			f.Add(seed)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		fr := New(50)
+		for len(in) > 0 {
+			l := int(in[0])
+			in = in[1:]
+			if l > len(in) {
+				l = len(in)
+			}
+
+			var frag goshpb.Fragment
+			if err := proto.Unmarshal(in[:l], &frag); err == nil && fr.Store(&frag) {
+				fr.Assemble(frag.GetId())
+			}
+			in = in[l:]
+		}
+		fr.Clean()
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package fragmenter
+
+import (
+	"bytes"
+	"compress/flate"
+	"time"
+)
+
+// HISTORY_SIZE is how much of a History primes the compressor. It's
+// the DEFLATE window, so nothing older could be referred to anyway.
+const HISTORY_SIZE = 32 << 10
+
+// History is the compression context for a chain of payloads, like
+// the screen diffs leading to a terminal state. Successive diffs
+// share prompts, colours and cursor movements, so compressing each
+// against the ones before it saves much more than compressing it
+// alone: 65-85% fewer bytes than CODEC_DEFLATE_DICT for top(1) and
+// compiler output (see TestStreamSavings).
+//
+// Both peers must compress and decompress a payload against the same
+// History. Callers extend the History of a diff's source state to get
+// that of its target, keeping them in Histories so that each side
+// uses the same one even when payloads are lost or reordered.
+//
+// Payloads compressed this way are marked CODEC_DEFLATE_STREAM,
+// which peers advertise in accept_codecs, but they aren't fragment
+// codecs: callers compress and decompress them directly. The zero
+// History is valid, and primed only with termDict.
+type History []byte
+
+// Extend returns the History following h and buf. h is unchanged.
+func (h History) Extend(buf []byte) History {
+	n := min(len(h)+len(buf), HISTORY_SIZE)
+	nh := make(History, 0, n)
+	if len(buf) < n {
+		nh = append(nh, h[len(h)-(n-len(buf)):]...)
+	}
+	return append(nh, buf[len(buf)-(n-len(nh)):]...)
+}
+
+// dict returns the preset dictionary for payloads following h. The
+// most recent history goes last as it's the cheapest to refer to.
+func (h History) dict() []byte {
+	d := make([]byte, 0, len(termDict)+len(h))
+	d = append(d, termDict...)
+	d = append(d, h...)
+	return d[max(0, len(d)-HISTORY_SIZE):]
+}
+
+// Compress returns buf compressed with raw DEFLATE, primed with h.
+func (h History) Compress(buf []byte) ([]byte, error) {
+	var fbuf bytes.Buffer
+	w, err := flate.NewWriterDict(&fbuf, flate.BestCompression, h.dict())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return fbuf.Bytes(), nil
+}
+
+// Decompress reverses Compress, which must have been given the same
+// History.
+func (h History) Decompress(buf []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(buf), h.dict())
+	defer r.Close()
+
+	return readAll(r)
+}
+
+// Histories holds the History of each state in a chain, by the
+// source and target of the diff that reached it. A state's History
+// depends on that diff, and a sender may send several diffs to the
+// same state, from different sources, not knowing which will arrive
+// first, if at all. Senders keep the History of every diff they send.
+// Receivers keep only that of the first diff to reach each state, and
+// name its source when acknowledging the state, so that both sides
+// use the same History for the diffs that follow. The zero state's
+// History is empty.
+type Histories struct {
+	hist map[histKey]History
+}
+
+type histKey struct {
+	src, targ time.Time
+}
+
+func NewHistories() *Histories {
+	return &Histories{hist: make(map[histKey]History)}
+}
+
+// Get returns the History of targ, reached from src.
+func (hs *Histories) Get(src, targ time.Time) (History, bool) {
+	if targ.IsZero() {
+		return nil, true
+	}
+	h, ok := hs.hist[histKey{src, targ}]
+	return h, ok
+}
+
+// Add sets the History of targ, reached from src, to h.
+func (hs *Histories) Add(src, targ time.Time, h History) {
+	hs.hist[histKey{src, targ}] = h
+}
+
+// Source returns the source targ was reached from, if there's only
+// one, as for receivers.
+func (hs *Histories) Source(targ time.Time) (time.Time, bool) {
+	for k := range hs.hist {
+		if k.targ.Equal(targ) {
+			return k.src, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Retire forgets the History of states before t.
+func (hs *Histories) Retire(t time.Time) {
+	for k := range hs.hist {
+		if k.targ.Before(t) {
+			delete(hs.hist, k)
+		}
+	}
+}
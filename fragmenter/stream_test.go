@@ -0,0 +1,255 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package fragmenter
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"github.com/bdwalton/gosh/vt"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHistoryExtend(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), HISTORY_SIZE)
+
+	cases := []struct {
+		h    History
+		buf  []byte
+		want []byte
+	}{
+		{nil, []byte("abc"), []byte("abc")},
+		{History("abc"), []byte("def"), []byte("abcdef")},
+		{History(big), []byte("def"), append(big[3:], "def"...)},
+		{History("abc"), append(big, 'y'), append(big[1:], 'y')},
+	}
+
+	for i, c := range cases {
+		orig := slices.Clone(c.h)
+		if got := c.h.Extend(c.buf); !slices.Equal(got, c.want) {
+			t.Errorf("%d: Got %d bytes, wanted %d", i, len(got), len(c.want))
+		}
+		if !slices.Equal(c.h, orig) {
+			t.Errorf("%d: Extend() modified the original history", i)
+		}
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	var h History
+	for i, d := range []string{"", "a", "\x1b[1;1Hhello", "\x1b[1;1Hhello world", "\x1b[1;1Hhello"} {
+		comp, err := h.Compress([]byte(d))
+		if err != nil {
+			t.Fatalf("%d: Compress() error: %v", i, err)
+		}
+		if got, err := h.Decompress(comp); err != nil || string(got) != d {
+			t.Errorf("%d: Got %q (err: %v), wanted %q", i, got, err, d)
+		}
+		h = h.Extend([]byte(d))
+	}
+}
+
+func TestHistoriesLossAndReordering(t *testing.T) {
+	var t0 time.Time
+	t1, t2, t3, t4 := t0.Add(time.Second), t0.Add(2*time.Second), t0.Add(3*time.Second), t0.Add(4*time.Second)
+
+	// n names states by their offset from t0.
+	n := func(tm time.Time) int {
+		return int(tm.Sub(t0) / time.Second)
+	}
+	diff := func(src, targ time.Time) []byte {
+		return []byte(fmt.Sprintf("\x1b[1;1Hfrom %d to %d\x1b[K", n(src), n(targ)))
+	}
+
+	type msg struct {
+		src, targ time.Time
+		data      []byte
+		stream    bool
+	}
+
+	for _, late := range []bool{false, true} {
+		snd, rcv := NewHistories(), NewHistories()
+		// What the sender last had acked, and the source the
+		// receiver said it reached it from.
+		var acked, ackedSrc time.Time
+
+		// send compresses a diff from the acked state, as a
+		// server does.
+		send := func(targ time.Time) msg {
+			d := diff(acked, targ)
+			m := msg{acked, targ, d, false}
+			if h, ok := snd.Get(ackedSrc, acked); ok {
+				m.data, _ = h.Compress(d)
+				m.stream = true
+				snd.Add(acked, targ, h.Extend(d))
+			}
+			return m
+		}
+		// recv decodes m as a client does, returning the
+		// source to ack its target with.
+		recv := func(m msg) time.Time {
+			base, _ := rcv.Source(m.src)
+			h, ok := rcv.Get(base, m.src)
+			if !ok {
+				t.Fatalf("%t: No history for %d", late, n(m.src))
+			}
+			d := m.data
+			if m.stream {
+				d, _ = h.Decompress(d)
+			}
+			if want := diff(m.src, m.targ); !slices.Equal(d, want) {
+				t.Errorf("%t: Got %q, wanted %q", late, d, want)
+			}
+			if _, ok := rcv.Source(m.targ); !ok {
+				rcv.Add(m.src, m.targ, h.Extend(d))
+			}
+			src, _ := rcv.Source(m.targ)
+			return src
+		}
+
+		m1 := send(t1)
+		m2 := send(t2)
+		s1 := recv(m1)
+		s2 := recv(m2)
+		// The ack for t1 arrives, so t2 is resent from it,
+		// but that's lost or arrives late.
+		acked, ackedSrc = t1, s1
+		m3 := send(t2)
+		acked, ackedSrc = t2, s2
+		snd.Retire(t2)
+		m4 := send(t3)
+		if late {
+			recv(m3)
+		}
+		s3 := recv(m4)
+		if late {
+			// It doesn't change how t2 was reached.
+			if src, _ := rcv.Source(t2); src != t0 {
+				t.Errorf("%t: Got t2 reached from %d, wanted %d", late, n(src), n(t0))
+			}
+		}
+		acked, ackedSrc = t3, s3
+		rcv.Retire(t2)
+		recv(send(t4))
+	}
+}
+
+// topScreens returns a sequence of screens like those top(1) draws.
+func topScreens(n int) [][]byte {
+	procs := []string{"postgres", "nginx", "python3", "java", "node", "sshd", "systemd", "containerd", "kworker/0:1", "chrome"}
+
+	var screens [][]byte
+	for i := 0; i < n; i++ {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "\x1b[H\x1b[1mtop - 10:%02d:%02d up 12 days,  3:04,  2 users,  load average: 0.%02d, 0.%02d, 0.%02d\x1b[m\x1b[K\r\n", i/60, i%60, (i*7)%100, (i*3)%100, 41)
+		fmt.Fprintf(&b, "Tasks: %d total,   %d running, 211 sleeping,   0 stopped,   0 zombie\x1b[K\r\n", 214+i%3, 1+i%3)
+		fmt.Fprintf(&b, "%%Cpu(s): %2d.%d us,  1.%d sy,  0.0 ni, %2d.%d id,  0.0 wa,  0.0 hi,  0.1 si\x1b[K\r\n\x1b[K\r\n", 3+i%9, i%10, i%7, 90-i%9, 9-i%10)
+		fmt.Fprintf(&b, "\x1b[7m    PID USER      PR  NI    VIRT    RES    SHR S  %%CPU  %%MEM     TIME+ COMMAND\x1b[m\x1b[K\r\n")
+		for j := range procs {
+			p := procs[(j+i/5)%len(procs)]
+			fmt.Fprintf(&b, "\x1b[1m%7d bob       20   0 %7d %6d  %5d %s %5.1f   %3.1f %3d:%02d.%02d %-10s\x1b[m\x1b[K\r\n",
+				1000+j*37, 200000+j*1111, 50000+j*999, 9000+j*13, "SR"[(i+j)%2:(i+j)%2+1], float64((i*j)%50)/3, float64(j)/2, j, (i+j)%60, (i*j)%100, p)
+		}
+		screens = append(screens, b.Bytes())
+	}
+	return screens
+}
+
+// compilerScreens returns a sequence of screens like those of a
+// scrolling build log.
+func compilerScreens(n int) [][]byte {
+	files := []string{"parser", "lexer", "codegen", "optimize", "emit", "types", "resolve", "main"}
+
+	var screens [][]byte
+	for i := 0; i < n; i++ {
+		var b bytes.Buffer
+		f := files[i%len(files)]
+		fmt.Fprintf(&b, "\x1b[32m[%3d%%]\x1b[m Building C object src/CMakeFiles/app.dir/%s_%d.c.o\r\n", i*100/n, f, i)
+		if i%4 == 0 {
+			fmt.Fprintf(&b, "\x1b[1msrc/%s_%d.c:%d:%d: \x1b[35mwarning: \x1b[m\x1b[1munused variable 'tmp' [-Wunused-variable]\x1b[m\r\n", f, i, 100+i, 9)
+			fmt.Fprintf(&b, "  %d |     int tmp = 0;\r\n      |         \x1b[32m^~~\x1b[m\r\n", 100+i)
+		}
+		screens = append(screens, b.Bytes())
+	}
+	return screens
+}
+
+// diffs returns the diffs a server would send as screens are written
+// to a terminal one after the other.
+func diffs(screens [][]byte) [][]byte {
+	t, _ := vt.NewTerminal(vt.DEF_ROWS, vt.DEF_COLS)
+	prev := t.ForceCopy()
+
+	var ret [][]byte
+	for _, s := range screens {
+		t.Write(s)
+		next := t.ForceCopy()
+		d, _ := proto.Marshal(prev.StateDiff(next))
+		ret = append(ret, d)
+		prev = next
+	}
+	return ret
+}
+
+// streamSavings returns the total size of ds compressed on their own
+// with the dictionary codec and against their history.
+func streamSavings(ds [][]byte) (int, int, error) {
+	var single, stream int
+	var h History
+	for _, d := range ds {
+		sc, err := codecs[goshpb.Codec_CODEC_DEFLATE_DICT].Compress(d)
+		if err != nil {
+			return 0, 0, err
+		}
+		hc, err := h.Compress(d)
+		if err != nil {
+			return 0, 0, err
+		}
+		if got, err := h.Decompress(hc); err != nil || !slices.Equal(got, d) {
+			return 0, 0, fmt.Errorf("round trip failed: %v", err)
+		}
+		single += len(sc)
+		stream += len(hc)
+		h = h.Extend(d)
+	}
+	return single, stream, nil
+}
+
+func TestStreamSavings(t *testing.T) {
+	cases := []struct {
+		name    string
+		screens [][]byte
+	}{
+		{"top", topScreens(100)},
+		{"compiler", compilerScreens(200)},
+	}
+
+	for _, c := range cases {
+		single, stream, err := streamSavings(diffs(c.screens))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if stream >= single {
+			t.Errorf("%s: Got %d bytes streamed, wanted fewer than %d compressed individually", c.name, stream, single)
+		}
+		t.Logf("%s: %d bytes compressed individually, %d streamed (%.0f%% saved)", c.name, single, stream, 100-100*float64(stream)/float64(single))
+	}
+}
+
+func BenchmarkHistoryCompress(b *testing.B) {
+	ds := diffs(topScreens(100))
+	var h History
+	for _, d := range ds[:len(ds)-1] {
+		h = h.Extend(d)
+	}
+	last := ds[len(ds)-1]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Compress(last)
+	}
+}
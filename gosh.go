@@ -20,11 +20,17 @@ var (
 	bindServer   = flag.String("bind_server", "any", "Can be ssh, any or a specific IP")
 	debug        = flag.Bool("debug", false, "If true, enable DEBUG log level for verbose log output")
 	dest         = flag.String("dest", "localhost", "The {username@}localhost to connect to.")
+	fec          = flag.Bool("fec", true, "If true, send parity with large updates so they survive packet loss.")
 	goshClient   = flag.String("gosh_client", "gosh-client", "The path to the gosh-client executable on the local system.")
 	goshSrv      = flag.String("gosh_server", "gosh-server", "The path to the gosh-server executable on the remote system.")
 	logfile      = flag.String("logfile", "", "If set, client logs will be written to this file.")
+	obfuscate    = flag.Bool("obfuscate_traffic", false, "If true, pad datagrams and hide keystroke timing with cover traffic, at the cost of bandwidth.")
 	pprofFile    = flag.String("pprof_file", "", "If set, enable pprof capture to the provided file.")
 	remLog       = flag.String("remote_logfile", "", "If set, the remote gosh-server will be asked to log to this file.")
+	statsIntvl   = flag.Duration("remote_stats_interval", 0, "If non-zero, the remote gosh-server will log connection statistics this often.")
+	streamComp   = flag.Bool("stream_compression", true, "If true, the remote gosh-server will compress screen updates against the updates before them.")
+	roamAllow    = flag.String("roam_allowlist", "", "If set, a comma separated list of CIDRs the client is allowed to connect and roam from.")
+	tcpFallback  = flag.Bool("tcp_fallback", true, "If true, fall back to TCP when UDP to the server is blocked.")
 	titlePfx     = flag.String("title_prefix", "[gosh] ", "The prefix applied to the title. Set to '' to disable.")
 	useSystemd   = flag.Bool("use_systemd", true, "If true, execute the remote server under systemd so the detached process outlives the ssh connection.")
 )
@@ -79,6 +85,30 @@ func runServer(rows, cols int) (*connectData, error) {
 		args = append(args, fmt.Sprintf("--pprof_file=%q", *pprofFile))
 	}
 
+	if *roamAllow != "" {
+		args = append(args, fmt.Sprintf("--roam_allowlist=%q", *roamAllow))
+	}
+
+	if !*tcpFallback {
+		args = append(args, "--tcp_fallback=false")
+	}
+
+	if *obfuscate {
+		args = append(args, "--obfuscate_traffic")
+	}
+
+	if !*fec {
+		args = append(args, "--fec=false")
+	}
+
+	if *statsIntvl > 0 {
+		args = append(args, fmt.Sprintf("--stats_interval=%s", *statsIntvl))
+	}
+
+	if !*streamComp {
+		args = append(args, "--stream_compression=false")
+	}
+
 	args = append(args, "--bind_server", *bindServer)
 	args = append(args, fmt.Sprintf("--initial_rows=%d", rows))
 	args = append(args, fmt.Sprintf("--initial_cols=%d", cols))
@@ -115,6 +145,18 @@ func runClient(connD *connectData, rows, cols int) {
 		args = append(args, "--ssh_agent_forwarding")
 	}
 
+	if !*tcpFallback {
+		args = append(args, "--tcp_fallback=false")
+	}
+
+	if *obfuscate {
+		args = append(args, "--obfuscate_traffic")
+	}
+
+	if !*fec {
+		args = append(args, "--fec=false")
+	}
+
 	args = append(args, fmt.Sprintf("--initial_rows=%d", rows))
 	args = append(args, fmt.Sprintf("--initial_cols=%d", cols))
 
@@ -13,12 +13,13 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	KEY_BYTES = 16
-	MTU       = 1280
 )
 
 const (
@@ -28,12 +29,21 @@ const (
 
 type GConn struct {
 	c      *net.UDPConn
+	cmux   sync.RWMutex // guards c, which may be replaced by Rebind
+	rmux   sync.Mutex   // guards remote and path
 	remote *net.UDPAddr
+	path   pathValidator
 	key    []byte
 	aead   cipher.AEAD
 	nce    *nonce // Our local nonce generation
-	rnce   uint64 // Highest seen remote nonce value
+	rnce   *nonce // Highest seen remote nonce value
 	cType  uint8
+	pmtu   *pmtud
+	st     *stats
+	pad    *atomic.Bool // pad messages; see padding.go
+
+	lmux     sync.Mutex
+	lastRecv time.Time // last authenticated datagram of any kind
 }
 
 func initAEAD(key []byte) (cipher.AEAD, error) {
@@ -65,6 +75,7 @@ func NewClient(addr, key string) (*GConn, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't listen on local socket: %w", err)
 	}
+	setDontFragment(c)
 
 	dkey, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
@@ -83,6 +94,10 @@ func NewClient(addr, key string) (*GConn, error) {
 		cType:  CLIENT,
 		remote: ra,
 		nce:    &nonce{},
+		rnce:   &nonce{},
+		pmtu:   newPMTUD(),
+		st:     &stats{},
+		pad:    &atomic.Bool{},
 	}
 
 	return gc, nil
@@ -120,12 +135,17 @@ func NewServer(ip, prng string) (*GConn, error) {
 		aead:  aead,
 		cType: SERVER,
 		nce:   &nonce{},
+		rnce:  &nonce{},
+		pmtu:  newPMTUD(),
+		st:    &stats{},
+		pad:   &atomic.Bool{},
 	}
 
 	ua := &net.UDPAddr{Port: 0, IP: net.ParseIP(ip)}
 	for i := pr[0]; i <= pr[1]; i++ {
 		ua.Port = int(i)
 		if c, err := net.ListenUDP("udp", ua); err == nil {
+			setDontFragment(c)
 			gc.c = c
 			return gc, nil
 		}
@@ -138,21 +158,135 @@ func (gc *GConn) Base64Key() string {
 	return base64.StdEncoding.EncodeToString(gc.key)
 }
 
+// conn returns the current local socket.
+func (gc *GConn) conn() *net.UDPConn {
+	gc.cmux.RLock()
+	defer gc.cmux.RUnlock()
+	return gc.c
+}
+
+// Rebind replaces the client's local socket with a new one on a
+// fresh port. This is used when the local network changes underneath
+// us (interface gone, VPN toggled, resume from suspend) and the old
+// socket can't reach the server anymore. The server sees traffic
+// from the new socket as regular roaming.
+func (gc *GConn) Rebind() error {
+	if gc.cType != CLIENT {
+		return errors.New("only clients can rebind their socket")
+	}
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return fmt.Errorf("couldn't listen on new local socket: %w", err)
+	}
+	setDontFragment(c)
+
+	gc.cmux.Lock()
+	old := gc.c
+	gc.c = c
+	gc.cmux.Unlock()
+
+	// We don't know what the new path supports
+	gc.pmtu.reset()
+	gc.st.roamEvents.Add(1)
+
+	slog.Info("rebound local socket", "old", old.LocalAddr(), "new", c.LocalAddr())
+
+	return old.Close()
+}
+
 func (gc *GConn) LocalPort() int {
-	return gc.c.LocalAddr().(*net.UDPAddr).Port
+	return gc.conn().LocalAddr().(*net.UDPAddr).Port
 }
 
 func (gc *GConn) RemoteAddr() string {
-	return gc.remote.String()
+	return gc.peer().String()
+}
+
+// peer returns the current remote address.
+func (gc *GConn) peer() *net.UDPAddr {
+	gc.rmux.Lock()
+	defer gc.rmux.Unlock()
+	return gc.remote
+}
+
+// SetRoamAllowlist restricts the addresses our peer may use, including
+// the first one we hear from, to those within cidrs. An empty list
+// allows any address.
+func (gc *GConn) SetRoamAllowlist(cidrs []string) error {
+	nets, err := parseAllowlist(cidrs)
+	if err != nil {
+		return err
+	}
+
+	gc.rmux.Lock()
+	defer gc.rmux.Unlock()
+	gc.path.allow = nets
+
+	return nil
+}
+
+// SetPadding turns padding of our messages on or off. See
+// padding.go.
+func (gc *GConn) SetPadding(on bool) {
+	gc.pad.Store(on)
+}
+
+// padOverhead returns the bytes padding adds to every message.
+func (gc *GConn) padOverhead() int {
+	if gc.pad.Load() {
+		return PAD_HEADER_BYTES
+	}
+	return 0
+}
+
+// msgLimit returns the largest sealed message that fits in a single
+// datagram on the current path.
+func (gc *GConn) msgLimit() int {
+	return gc.pmtu.current() - IP_UDP_OVERHEAD - CRYPTO_OVERHEAD
+}
+
+// MaxPayload returns the largest message that can be passed to Write
+// and still fit in a single datagram on the current path.
+func (gc *GConn) MaxPayload() int {
+	return gc.msgLimit() - gc.padOverhead()
+}
+
+// NextProbe returns the message size for the next path MTU probe, if
+// one is due. The caller should pad a message to that size, Write it
+// and have the peer echo the size back so it can be passed to
+// ProbeAcked.
+func (gc *GConn) NextProbe() (int, bool) {
+	size, ok := gc.pmtu.nextProbe(time.Now())
+	if !ok {
+		return 0, false
+	}
+	return size - IP_UDP_OVERHEAD - CRYPTO_OVERHEAD - gc.padOverhead(), true
+}
+
+// ProbeAcked records that the peer received a probe message of size
+// bytes. It returns true if MaxPayload changed as a result.
+func (gc *GConn) ProbeAcked(size int) bool {
+	return gc.pmtu.acked(size+IP_UDP_OVERHEAD+CRYPTO_OVERHEAD+gc.padOverhead(), time.Now())
 }
 
 func (gc *GConn) Close() error {
-	return gc.c.Close()
+	return gc.conn().Close()
 }
 
 func (gc *GConn) Write(msg []byte) (int, error) {
+	return gc.writeTo(KIND_DATA, msg, gc.peer())
+}
+
+func (gc *GConn) writeTo(kind uint8, msg []byte, addr *net.UDPAddr) (int, error) {
+	if gc.pad.Load() {
+		msg = pad(msg, gc.msgLimit())
+		kind |= KIND_PADDED
+	}
+
 	// panics if we overflow 32bits of nonce usage
 	nce := gc.nce.get(gc.cType)
+	nce[1] = kind
 
 	sealed := gc.aead.Seal(nil, nce, msg, nil)
 
@@ -161,56 +295,206 @@ func (gc *GConn) Write(msg []byte) (int, error) {
 	var n int
 	var err error
 
-	n, err = gc.c.WriteToUDP(m, gc.remote)
+	n, err = gc.conn().WriteToUDP(m, addr)
 	if n != len(m) || err != nil {
+		gc.st.sendErrors.Add(1)
 		return 0, fmt.Errorf("wrote %d of %d bytes: %v", n, len(m), err)
 	}
+	gc.st.sent(n)
 
 	return n, err
 }
 
+// datagramBufs holds MAX_DATAGRAM byte read buffers. We read up to
+// 100 times a second in each direction, so they're reused rather than
+// allocated for each read.
+var datagramBufs = sync.Pool{
+	New: func() any {
+		b := make([]byte, MAX_DATAGRAM)
+		return &b
+	},
+}
+
+// Read returns the next data message from our peer. Path validation
+// messages are handled internally.
 func (gc *GConn) Read(extbuf []byte) (int, error) {
-	buf := make([]byte, MTU, MTU)
+	n, _, err := gc.readFresh(extbuf)
+	return n, err
+}
 
-	gc.c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-	n, remote, err := gc.c.ReadFromUDP(buf[:MTU])
-	if err != nil {
-		if e, ok := err.(net.Error); !ok || !e.Timeout() {
-			slog.Error("non-timeout error reading from remote", "err", err)
+// readFresh is Read, also returning whether the message's nonce was
+// fresh. Stale ones may be replays, so mustn't move the session.
+func (gc *GConn) readFresh(extbuf []byte) (int, bool, error) {
+	bp := datagramBufs.Get().(*[]byte)
+	defer datagramBufs.Put(bp)
+	buf := *bp
+
+	c := gc.conn()
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		n, remote, err := c.ReadFromUDP(buf)
+		if err != nil {
+			// A closed socket is expected if we were
+			// rebound while reading.
+			if e, ok := err.(net.Error); (!ok || !e.Timeout()) && !errors.Is(err, net.ErrClosed) {
+				slog.Error("non-timeout error reading from remote", "err", err)
+			}
+			return 0, false, fmt.Errorf("failed to ReadFromUDP(): %w", err)
+		}
+
+		if n < CRYPTO_OVERHEAD {
+			gc.st.decryptFailures.Add(1)
+			return 0, false, fmt.Errorf("short datagram of %d bytes", n)
 		}
-		return 0, fmt.Errorf("failed to ReadFromUDP(): %v", err)
-	} else {
-		nce := buf[0:12]
+
+		nce := buf[0:NONCE_BYTES]
 		// Will panic if the nonce exceeds a 32-bit uint
 		rn, dir := extractNonce(nce)
 		if dir == gc.cType {
+			gc.st.badDirection.Add(1)
 			slog.Error("received nonce with our own 'direction'")
-			return 0, errors.New("invalid nonce received - bad directionality")
+			return 0, false, errors.New("invalid nonce received - bad directionality")
 		}
 
-		m := buf[12:n]
+		m := buf[NONCE_BYTES:n]
 
 		unsealed, err := gc.aead.Open(nil, nce, m, nil)
 		if err != nil {
-			return 0, fmt.Errorf("failed to unseal data: %v", err)
+			gc.st.decryptFailures.Add(1)
+			return 0, false, fmt.Errorf("failed to unseal data: %v", err)
 		}
 
-		// Only update our remote if the nonce sequence has
-		// increased from our last known good remote nonce.
-		if ors, rs := gc.remote.String(), remote.String(); rs != ors && rn > gc.rnce {
-			slog.Info("Updating remote peer", "remote", remote.String())
-			gc.remote = remote
+		gc.st.recv(n)
+		fresh := gc.rnce.advance(rn)
+		if !fresh {
+			gc.st.replays.Add(1)
+		}
+
+		gc.lmux.Lock()
+		gc.lastRecv = time.Now()
+		gc.lmux.Unlock()
+
+		kind := nonceKind(nce)
+		if kind&KIND_PADDED != 0 {
+			if unsealed, err = unpad(unsealed); err != nil {
+				return 0, false, err
+			}
 		}
 
-		if rn > gc.rnce {
-			gc.rnce = rn
+		switch kind &^ KIND_PADDED {
+		case KIND_PATH_CHALLENGE:
+			// Prove we're reachable where the challenge
+			// was sent by echoing it back from here.
+			if _, err := gc.writeTo(KIND_PATH_RESPONSE, unsealed, remote); err != nil {
+				slog.Debug("couldn't send path response", "remote", remote, "err", err)
+			}
+			continue
+		case KIND_PATH_RESPONSE:
+			gc.pathResponse(remote, unsealed)
+			continue
 		}
 
-		n := copy(extbuf, unsealed)
+		// Only consider a new remote if the nonce sequence has
+		// increased from our last known good remote nonce.
+		if fresh {
+			gc.maybeMigrate(remote)
+		}
+
+		n = copy(extbuf, unsealed)
 		if n != len(unsealed) {
-			return 0, fmt.Errorf("couldn't copy buffers (%d, %d): %v", n, len(unsealed), err)
+			return 0, false, fmt.Errorf("couldn't copy buffers (%d, %d): %v", n, len(unsealed), err)
+		}
+
+		return n, fresh, nil
+	}
+}
+
+// Stats returns a snapshot of the connection's counters. They include
+// any TCP connections sharing this GConn's session.
+func (gc *GConn) Stats() Stats {
+	return gc.st.snapshot()
+}
+
+// AddRTTSample records a round trip time measured by the caller.
+func (gc *GConn) AddRTTSample(d time.Duration) {
+	gc.st.addRTT(d)
+}
+
+// LastReceived returns when we last received an authenticated
+// datagram from our peer, including path validation messages.
+func (gc *GConn) LastReceived() time.Time {
+	gc.lmux.Lock()
+	defer gc.lmux.Unlock()
+	return gc.lastRecv
+}
+
+// Ping sends our peer a challenge that it will answer without
+// involving the layers above. The answer is only visible via
+// LastReceived, making this a cheap check that the path works.
+func (gc *GConn) Ping() error {
+	ch := make([]byte, CHALLENGE_BYTES)
+	if _, err := rand.Read(ch); err != nil {
+		return fmt.Errorf("couldn't generate ping: %w", err)
+	}
+
+	_, err := gc.writeTo(KIND_PATH_CHALLENGE, ch, gc.peer())
+	return err
+}
+
+// allows returns true if the roaming allowlist lets our peer use
+// addr.
+func (gc *GConn) allows(addr *net.UDPAddr) bool {
+	gc.rmux.Lock()
+	defer gc.rmux.Unlock()
+	return gc.path.allowed(addr)
+}
+
+// maybeMigrate is called when a fresh data message arrives from
+// remote. The first address we hear from is adopted directly. After
+// that, a different address is sent a challenge and only adopted
+// once it answers. See pathResponse.
+func (gc *GConn) maybeMigrate(remote *net.UDPAddr) {
+	gc.rmux.Lock()
+	defer gc.rmux.Unlock()
+
+	if sameAddr(gc.remote, remote) {
+		return
+	}
+
+	if !gc.path.allowed(remote) {
+		slog.Warn("ignoring peer address outside of roaming allowlist", "remote", remote)
+		return
+	}
+
+	if gc.remote == nil {
+		slog.Info("Setting remote peer", "remote", remote.String())
+		gc.remote = remote
+		return
+	}
+
+	if ch, ok := gc.path.challengeFor(remote, time.Now()); ok {
+		slog.Info("Validating new remote peer address", "remote", remote.String())
+		if _, err := gc.writeTo(KIND_PATH_CHALLENGE, ch, remote); err != nil {
+			slog.Debug("couldn't send path challenge", "remote", remote, "err", err)
 		}
+	}
+}
 
-		return n, nil
+// pathResponse migrates to remote if resp answers our outstanding
+// challenge.
+func (gc *GConn) pathResponse(remote *net.UDPAddr, resp []byte) {
+	gc.rmux.Lock()
+	defer gc.rmux.Unlock()
+
+	if !gc.path.validate(remote, resp, time.Now()) {
+		slog.Debug("ignoring unexpected path response", "remote", remote)
+		return
 	}
+
+	slog.Info("Updating remote peer", "remote", remote.String())
+	gc.remote = remote
+	gc.st.roamEvents.Add(1)
+	// The new path may not carry what the old one did, so
+	// rediscover its MTU.
+	gc.pmtu.reset()
 }
@@ -0,0 +1,198 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func newTestPair(t *testing.T) (*GConn, *GConn) {
+	srv, err := NewServer("127.0.0.1", "40000:50000")
+	if err != nil {
+		t.Fatalf("couldn't create server: %v", err)
+	}
+
+	cl, err := NewClient(fmt.Sprintf("127.0.0.1:%d", srv.LocalPort()), srv.Base64Key())
+	if err != nil {
+		t.Fatalf("couldn't create client: %v", err)
+	}
+
+	return srv, cl
+}
+
+func readMsg(t *testing.T, gc *GConn) []byte {
+	buf := make([]byte, MAX_DATAGRAM)
+	n, err := gc.Read(buf)
+	if err != nil {
+		t.Fatalf("couldn't read: %v", err)
+	}
+	return buf[:n]
+}
+
+// pump reads and discards anything waiting on gc, allowing it to
+// handle any path validation messages.
+func pump(gc *GConn) {
+	buf := make([]byte, MAX_DATAGRAM)
+	for {
+		if _, err := gc.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer srv.Close()
+	defer cl.Close()
+
+	msgs := [][]byte{[]byte("before"), []byte("after")}
+
+	cl.Write(msgs[0])
+	if got := readMsg(t, srv); !slices.Equal(got, msgs[0]) {
+		t.Errorf("Got %q, wanted %q", got, msgs[0])
+	}
+	oldRemote := srv.RemoteAddr()
+
+	oldPort := cl.LocalPort()
+	if err := cl.Rebind(); err != nil {
+		t.Fatalf("Rebind() failed: %v", err)
+	}
+	if cl.LocalPort() == oldPort {
+		t.Errorf("Rebind() kept local port %d", oldPort)
+	}
+
+	cl.Write(msgs[1])
+	if got := readMsg(t, srv); !slices.Equal(got, msgs[1]) {
+		t.Errorf("Got %q, wanted %q", got, msgs[1])
+	}
+	if srv.RemoteAddr() != oldRemote {
+		t.Errorf("Server roamed to %s before validating it", srv.RemoteAddr())
+	}
+
+	// Let the client answer the challenge and the server
+	// process the response.
+	pump(cl)
+	pump(srv)
+	if srv.RemoteAddr() == oldRemote {
+		t.Errorf("Server didn't roam to new client address; still %s", oldRemote)
+	}
+
+	// The server can reach us on the new socket
+	srv.Write(msgs[0])
+	if got := readMsg(t, cl); !slices.Equal(got, msgs[0]) {
+		t.Errorf("Got %q, wanted %q", got, msgs[0])
+	}
+
+	if err := srv.Rebind(); err == nil {
+		t.Errorf("Server Rebind() didn't fail")
+	}
+}
+
+func TestPathValidationWithoutResponse(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer srv.Close()
+	defer cl.Close()
+
+	cl.Write([]byte("hello"))
+	readMsg(t, srv)
+	want := srv.RemoteAddr()
+
+	// A second client with the key stands in for an attacker
+	// replaying fresh packets from another address. It never
+	// answers the challenge, so the server mustn't migrate.
+	atk, err := NewClient(fmt.Sprintf("127.0.0.1:%d", srv.LocalPort()), srv.Base64Key())
+	if err != nil {
+		t.Fatalf("couldn't create attacker: %v", err)
+	}
+	defer atk.Close()
+	atk.nce.v.Store(1000)
+
+	atk.Write([]byte("replayed"))
+	readMsg(t, srv)
+	pump(srv)
+
+	if got := srv.RemoteAddr(); got != want {
+		t.Errorf("Got remote %s, wanted %s", got, want)
+	}
+}
+
+func TestRoamAllowlist(t *testing.T) {
+	cases := []struct {
+		cidrs     []string
+		wantErr   bool
+		wantRoam  bool
+		wantFirst bool
+	}{
+		{[]string{}, false, true, true},
+		{[]string{"127.0.0.0/8"}, false, true, true},
+		{[]string{"10.0.0.0/8"}, false, false, false},
+		{[]string{"not-a-cidr"}, true, false, false},
+	}
+
+	for i, c := range cases {
+		srv, cl := newTestPair(t)
+
+		err := srv.SetRoamAllowlist(c.cidrs)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%d: Got err %v, wanted error: %t", i, err, c.wantErr)
+		}
+		if err != nil {
+			srv.Close()
+			cl.Close()
+			continue
+		}
+
+		cl.Write([]byte("first"))
+		readMsg(t, srv)
+		if got := srv.peer() != nil; got != c.wantFirst {
+			t.Errorf("%d: Got first contact adopted %t, wanted %t", i, got, c.wantFirst)
+		}
+
+		first := srv.RemoteAddr()
+		cl.Rebind()
+		cl.Write([]byte("second"))
+		readMsg(t, srv)
+		pump(cl)
+		pump(srv)
+		if got := srv.RemoteAddr() != first; got != c.wantRoam {
+			t.Errorf("%d: Got roamed %t, wanted %t", i, got, c.wantRoam)
+		}
+
+		srv.Close()
+		cl.Close()
+	}
+}
+
+func TestPadding(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer srv.Close()
+	defer cl.Close()
+
+	before := cl.MaxPayload()
+	cl.SetPadding(true)
+	if got := cl.MaxPayload(); got != before-PAD_HEADER_BYTES {
+		t.Errorf("Got MaxPayload() %d with padding, wanted %d", got, before-PAD_HEADER_BYTES)
+	}
+
+	msgs := [][]byte{[]byte("a"), []byte("bc"), make([]byte, cl.MaxPayload())}
+	for i, m := range msgs {
+		n, err := cl.Write(m)
+		if err != nil {
+			t.Fatalf("%d: Write() failed: %v", i, err)
+		}
+		if got := readMsg(t, srv); !slices.Equal(got, m) {
+			t.Errorf("%d: Got %d bytes, wanted %d", i, len(got), len(m))
+		}
+		if i < 2 && n != padBuckets[0]+CRYPTO_OVERHEAD {
+			t.Errorf("%d: Got datagram of %d bytes, wanted %d", i, n, padBuckets[0]+CRYPTO_OVERHEAD)
+		}
+	}
+
+	// The server doesn't pad, but the client understands it anyway
+	srv.Write(msgs[0])
+	if got := readMsg(t, cl); !slices.Equal(got, msgs[0]) {
+		t.Errorf("Got %q, wanted %q", got, msgs[0])
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+//go:build linux
+
+package network
+
+import (
+	"log/slog"
+	"syscall"
+)
+
+// Netlink multicast groups for address changes. These aren't exposed
+// by the syscall package.
+const (
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// AddrChanges returns a channel that receives a value whenever a
+// local IPv4 or IPv6 address is added or removed. Bursts of changes
+// are coalesced. If we can't subscribe to netlink address events, the
+// returned channel never fires.
+func AddrChanges() <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		slog.Debug("couldn't open netlink socket", "err", err)
+		return ch
+	}
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		slog.Debug("couldn't bind netlink socket", "err", err)
+		syscall.Close(fd)
+		return ch
+	}
+
+	// This goroutine is leaked, living as long as the client.
+	go func() {
+		defer syscall.Close(fd)
+
+		buf := make([]byte, syscall.Getpagesize())
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EINTR || err == syscall.ENOBUFS {
+					continue
+				}
+				slog.Debug("netlink read failed, no longer watching addresses", "err", err)
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				slog.Debug("couldn't parse netlink message", "err", err)
+				continue
+			}
+
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+					slog.Debug("local address change", "type", m.Header.Type)
+					select {
+					case ch <- struct{}{}:
+					default: // one already pending
+					}
+				}
+			}
+		}
+	}()
+
+	return ch
+}
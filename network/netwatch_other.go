@@ -0,0 +1,15 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+//go:build !linux
+
+package network
+
+import "log/slog"
+
+// AddrChanges returns a channel that never fires as we don't watch
+// for local address changes on this platform. Clients still detect
+// network changes via send errors and unanswered heartbeats.
+func AddrChanges() <-chan struct{} {
+	slog.Debug("AddrChanges() not implemented on this platform")
+	return make(chan struct{})
+}
@@ -20,6 +20,15 @@ const (
 	MAX_NONCE_VAL = 1 << 62
 )
 
+// Packet kinds. These are carried in the second byte of the nonce so
+// that they're authenticated along with the message itself. Only
+// KIND_DATA is ever handed to GConn users.
+const (
+	KIND_DATA = iota
+	KIND_PATH_CHALLENGE
+	KIND_PATH_RESPONSE
+)
+
 type nonce struct {
 	v atomic.Uint64
 }
@@ -40,6 +49,21 @@ func (n *nonce) get(dir uint8) []byte {
 	return b
 }
 
+// advance records v as the highest value seen, returning false if
+// it isn't higher than the previous highest. We use this to track the
+// remote side's nonces.
+func (n *nonce) advance(v uint64) bool {
+	for {
+		old := n.v.Load()
+		if v <= old {
+			return false
+		}
+		if n.v.CompareAndSwap(old, v) {
+			return true
+		}
+	}
+}
+
 // extractNonce returns a nonce value and the "direction" of the
 // nonce, which should match either CLIENT or SERVER
 func extractNonce(b []byte) (uint64, uint8) {
@@ -54,3 +78,8 @@ func extractNonce(b []byte) (uint64, uint8) {
 	}
 	return n, uint8(b[0])
 }
+
+// nonceKind returns the packet kind encoded in the nonce.
+func nonceKind(b []byte) uint8 {
+	return uint8(b[1])
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Optional padding to frustrate traffic analysis. Without it, each
+// keystroke, ack and heartbeat is a tiny message of a distinctive
+// size. With padding enabled, messages are prefixed with their length
+// and padded with zeros up to the next of a few fixed sizes, so an
+// observer learns little more than "small" or "large". Padded
+// messages are flagged in the nonce, so either side can pad
+// regardless of what the other does.
+//
+// The cost is bandwidth: a keystroke that would be ~70 bytes on the
+// wire becomes ~200, and large messages are padded to a full
+// datagram.
+const (
+	// KIND_PADDED is or'd into the packet kind of padded messages.
+	KIND_PADDED      = 0x80
+	PAD_HEADER_BYTES = 2
+)
+
+// padBuckets are the sizes, including the header, that padded
+// messages are rounded up to.
+var padBuckets = []int{128, 256, 512, 1024}
+
+// pad returns msg prefixed with its length and padded up to the next
+// bucket. Messages too large for any bucket are padded to limit
+// instead, if they fit and limit is non-zero. Otherwise, only the
+// header is added.
+func pad(msg []byte, limit int) []byte {
+	l := PAD_HEADER_BYTES + len(msg)
+	size := 0
+	for _, b := range padBuckets {
+		if l <= b {
+			size = b
+			break
+		}
+	}
+	if size == 0 {
+		size = max(l, limit)
+	}
+	if limit > 0 && size > limit {
+		size = max(l, limit)
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[PAD_HEADER_BYTES:], msg)
+
+	return buf
+}
+
+// unpad returns the message within a padded buffer.
+func unpad(buf []byte) ([]byte, error) {
+	if len(buf) < PAD_HEADER_BYTES {
+		return nil, fmt.Errorf("padded message of %d bytes is too short", len(buf))
+	}
+
+	l := int(binary.BigEndian.Uint16(buf))
+	if l > len(buf)-PAD_HEADER_BYTES {
+		return nil, fmt.Errorf("padded message claims %d bytes, but only has %d", l, len(buf)-PAD_HEADER_BYTES)
+	}
+
+	return buf[PAD_HEADER_BYTES : PAD_HEADER_BYTES+l], nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	cases := []struct {
+		msgLen, limit int
+		want          int
+	}{
+		{0, 0, 128},
+		{1, 1200, 128},
+		{126, 1200, 128},
+		{127, 1200, 256},
+		{600, 1200, 1024},
+		{1100, 1200, 1200},
+		{1100, 0, 1102},
+		{1300, 1200, 1302},
+		{200, 150, 202},
+		{100, 150, 128},
+	}
+
+	for i, c := range cases {
+		msg := make([]byte, c.msgLen)
+		for j := range msg {
+			msg[j] = byte(j)
+		}
+
+		p := pad(msg, c.limit)
+		if len(p) != c.want {
+			t.Errorf("%d: Got padded length %d, wanted %d", i, len(p), c.want)
+		}
+
+		got, err := unpad(p)
+		if err != nil {
+			t.Errorf("%d: unpad() failed: %v", i, err)
+		}
+		if !slices.Equal(got, msg) {
+			t.Errorf("%d: Got %v after unpad, wanted %v", i, got, msg)
+		}
+	}
+}
+
+func TestUnpadInvalid(t *testing.T) {
+	cases := [][]byte{
+		nil,
+		{0},
+		{0, 3, 1, 2},
+		{0xff, 0xff},
+	}
+
+	for i, c := range cases {
+		if _, err := unpad(c); err == nil {
+			t.Errorf("%d: Expected error unpadding %v", i, c)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Path validation, loosely modelled on QUIC. A valid packet from a
+// new address doesn't prove the peer is there, as an on-path attacker
+// can capture fresh packets and replay them from anywhere. Before
+// sending to a new address, we send it an encrypted challenge and
+// only migrate once the matching response comes back from it.
+const (
+	CHALLENGE_BYTES = 16
+	// We won't start validating another address, or resend a
+	// challenge to the current candidate, more often than this.
+	CHALLENGE_TIMEOUT = 1 * time.Second
+	// Migrations are rate limited to one per interval.
+	MIGRATION_INTERVAL = 1 * time.Second
+)
+
+type pathValidator struct {
+	cand          *net.UDPAddr // address being validated, if any
+	challenge     []byte
+	sent          time.Time
+	lastMigration time.Time
+	allow         []*net.IPNet // empty means any address
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+// parseAllowlist converts a list of CIDRs to networks.
+func parseAllowlist(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid roaming allowlist entry %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowed returns true if the peer may use addr.
+func (pv *pathValidator) allowed(addr *net.UDPAddr) bool {
+	if len(pv.allow) == 0 {
+		return true
+	}
+
+	for _, n := range pv.allow {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// challengeFor returns a new challenge to send to addr, if one should
+// be sent now.
+func (pv *pathValidator) challengeFor(addr *net.UDPAddr, now time.Time) ([]byte, bool) {
+	if now.Before(pv.lastMigration.Add(MIGRATION_INTERVAL)) {
+		slog.Debug("migration rate limited", "addr", addr)
+		return nil, false
+	}
+
+	if pv.cand != nil && now.Before(pv.sent.Add(CHALLENGE_TIMEOUT)) {
+		// Either we recently challenged this address and are
+		// still waiting, or we're busy with another one.
+		return nil, false
+	}
+
+	ch := make([]byte, CHALLENGE_BYTES)
+	if _, err := rand.Read(ch); err != nil {
+		slog.Error("couldn't generate path challenge", "err", err)
+		return nil, false
+	}
+
+	pv.cand = addr
+	pv.challenge = ch
+	pv.sent = now
+
+	return ch, true
+}
+
+// validate returns true if resp, received from addr, answers our
+// outstanding challenge. On success, the candidate is consumed.
+func (pv *pathValidator) validate(addr *net.UDPAddr, resp []byte, now time.Time) bool {
+	if pv.cand == nil || !sameAddr(pv.cand, addr) || subtle.ConstantTimeCompare(pv.challenge, resp) != 1 {
+		return false
+	}
+
+	pv.cand = nil
+	pv.challenge = nil
+	pv.lastMigration = now
+
+	return true
+}
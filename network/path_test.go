@@ -0,0 +1,78 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPathValidatorRateLimit(t *testing.T) {
+	a1 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	a2 := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+	now := time.Now()
+
+	pv := &pathValidator{}
+	ch, ok := pv.challengeFor(a1, now)
+	if !ok {
+		t.Fatalf("No challenge issued for first candidate")
+	}
+
+	cases := []struct {
+		addr *net.UDPAddr
+		when time.Duration
+		want bool
+	}{
+		{a1, 0, false},                      // already waiting on a1
+		{a2, CHALLENGE_TIMEOUT / 2, false},  // busy with a1
+		{a2, CHALLENGE_TIMEOUT + 1, true},   // a1 timed out
+		{a1, CHALLENGE_TIMEOUT + 2, false},  // now busy with a2
+		{a1, 2*CHALLENGE_TIMEOUT + 2, true}, // a2 timed out
+	}
+
+	for i, c := range cases {
+		if _, got := pv.challengeFor(c.addr, now.Add(c.when)); got != c.want {
+			t.Errorf("%d: Got %t, wanted %t", i, got, c.want)
+		}
+	}
+
+	// The original challenge was replaced, so it no longer
+	// validates.
+	if pv.validate(a1, ch, now) {
+		t.Errorf("Stale challenge validated")
+	}
+}
+
+func TestPathValidatorValidate(t *testing.T) {
+	a1 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	a2 := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+	now := time.Now()
+
+	pv := &pathValidator{}
+	ch, _ := pv.challengeFor(a1, now)
+
+	if pv.validate(a2, ch, now) {
+		t.Errorf("Response from wrong address validated")
+	}
+
+	if pv.validate(a1, []byte("wrong"), now) {
+		t.Errorf("Wrong response validated")
+	}
+
+	if !pv.validate(a1, ch, now) {
+		t.Errorf("Correct response didn't validate")
+	}
+
+	if pv.validate(a1, ch, now) {
+		t.Errorf("Response validated twice")
+	}
+
+	// Migrations are rate limited
+	if _, ok := pv.challengeFor(a2, now.Add(MIGRATION_INTERVAL/2)); ok {
+		t.Errorf("Challenge issued within migration interval")
+	}
+	if _, ok := pv.challengeFor(a2, now.Add(MIGRATION_INTERVAL+1)); !ok {
+		t.Errorf("Challenge not issued after migration interval")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Packetization layer path MTU discovery (RFC 8899) for our
+// datagrams. We start from a size every path must support, probe
+// upwards with padded packets that the peer acknowledges, and back
+// off when probes go unanswered.
+const (
+	// BASE_PLPMTU is the datagram size we assume always works. It
+	// is the IPv6 minimum link MTU, which is also safe for any
+	// reasonable IPv4 path.
+	BASE_PLPMTU = 1280
+	// MAX_PLPMTU bounds the search. We never try anything larger
+	// than a jumbo frame.
+	MAX_PLPMTU = 9000
+	// MAX_DATAGRAM is the largest UDP datagram we'll accept on
+	// read. It's deliberately larger than anything we send so
+	// that oversized packets are never truncated.
+	MAX_DATAGRAM = 65535
+	// IP_UDP_OVERHEAD is reserved for IP and UDP headers. We
+	// always assume IPv6 as it has the larger header.
+	IP_UDP_OVERHEAD = 48
+	// CRYPTO_OVERHEAD is the nonce and GCM tag we add to each
+	// message.
+	CRYPTO_OVERHEAD = NONCE_BYTES + 16
+
+	// Stop searching when the gap between the known good size
+	// and the known bad size is smaller than this.
+	PROBE_GRANULARITY = 32
+	// A probe size is considered lost after this many
+	// unanswered attempts.
+	MAX_PROBES    = 3
+	PROBE_TIMEOUT = 1 * time.Second
+	// After a search completes, we periodically reconfirm the
+	// size we're using (to detect black holes) and occasionally
+	// search again in case the path improved.
+	CONFIRM_INTERVAL = 1 * time.Minute
+	RAISE_INTERVAL   = 10 * time.Minute
+)
+
+const (
+	PMTUD_SEARCHING = iota
+	PMTUD_COMPLETE
+)
+
+type pmtud struct {
+	mux sync.Mutex
+
+	state    int
+	plpmtu   int // largest datagram known to reach the peer
+	hi       int // smallest datagram known (or assumed) not to
+	probe    int // size of the outstanding probe, 0 if none
+	attempts int // number of times probe has been sent
+	sent     time.Time
+	confirm  time.Time // when to next confirm plpmtu
+	raise    time.Time // when to next search for a larger size
+}
+
+func newPMTUD() *pmtud {
+	p := &pmtud{}
+	p.reset()
+	return p
+}
+
+// reset drops back to BASE_PLPMTU and starts a fresh search. This is
+// used at startup and when the path changes (eg: roaming).
+func (p *pmtud) reset() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.plpmtu = BASE_PLPMTU
+	p.search(MAX_PLPMTU + 1)
+}
+
+// search begins a new binary search between plpmtu and hi. The caller
+// must hold the lock.
+func (p *pmtud) search(hi int) {
+	p.state = PMTUD_SEARCHING
+	p.hi = hi
+	p.probe = 0
+	p.attempts = 0
+}
+
+func (p *pmtud) current() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return p.plpmtu
+}
+
+// nextProbe returns the datagram size that should be probed now, if
+// any. It handles retransmission and loss of outstanding probes.
+func (p *pmtud) nextProbe(now time.Time) (int, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.probe != 0 {
+		if now.Before(p.sent.Add(PROBE_TIMEOUT)) {
+			return 0, false
+		}
+
+		if p.attempts >= MAX_PROBES {
+			p.lost(now)
+		} else {
+			p.attempts += 1
+			p.sent = now
+			return p.probe, true
+		}
+	}
+
+	switch p.state {
+	case PMTUD_SEARCHING:
+		if p.hi-p.plpmtu <= PROBE_GRANULARITY {
+			slog.Debug("path mtu search complete", "plpmtu", p.plpmtu)
+			p.state = PMTUD_COMPLETE
+			p.confirm = now.Add(CONFIRM_INTERVAL)
+			p.raise = now.Add(RAISE_INTERVAL)
+			return 0, false
+		}
+		p.probe = p.plpmtu + (p.hi-p.plpmtu)/2
+	case PMTUD_COMPLETE:
+		switch {
+		case now.After(p.raise):
+			slog.Debug("raise timer expired, searching for larger path mtu", "plpmtu", p.plpmtu)
+			p.search(MAX_PLPMTU + 1)
+			p.probe = p.plpmtu + (p.hi-p.plpmtu)/2
+		case now.After(p.confirm) && p.plpmtu > BASE_PLPMTU:
+			p.probe = p.plpmtu
+		default:
+			return 0, false
+		}
+	}
+
+	p.attempts = 1
+	p.sent = now
+	return p.probe, true
+}
+
+// lost handles a probe that went unanswered MAX_PROBES times. The
+// caller must hold the lock.
+func (p *pmtud) lost(now time.Time) {
+	size := p.probe
+	p.probe = 0
+	p.attempts = 0
+
+	if size <= p.plpmtu {
+		// A confirmation probe for the size we're actively
+		// using was lost, so the path has become a black hole
+		// for it. Fall back to the base size and start over.
+		slog.Info("path mtu black hole detected, falling back", "plpmtu", p.plpmtu, "base", BASE_PLPMTU)
+		p.plpmtu = BASE_PLPMTU
+		p.search(size)
+		return
+	}
+
+	slog.Debug("path mtu probe lost", "size", size)
+	p.hi = size
+}
+
+// acked records that the peer received a probe of size bytes. It
+// returns true if the usable datagram size changed.
+func (p *pmtud) acked(size int, now time.Time) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if size == p.probe {
+		p.probe = 0
+		p.attempts = 0
+	}
+
+	if p.state == PMTUD_COMPLETE {
+		p.confirm = now.Add(CONFIRM_INTERVAL)
+	}
+
+	if size > p.plpmtu && size < p.hi {
+		slog.Debug("path mtu probe acked", "size", size)
+		p.plpmtu = size
+		return true
+	}
+
+	return false
+}
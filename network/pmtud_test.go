@@ -0,0 +1,108 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// runSearch simulates a path that delivers datagrams up to pathMTU
+// bytes and returns the size discovery settles on.
+func runSearch(p *pmtud, pathMTU int, now time.Time) (int, time.Time) {
+	for i := 0; i < 1000; i++ {
+		now = now.Add(PROBE_TIMEOUT)
+		size, ok := p.nextProbe(now)
+		if !ok {
+			if p.state == PMTUD_COMPLETE {
+				break
+			}
+			continue
+		}
+		if size <= pathMTU {
+			p.acked(size, now)
+		}
+	}
+	return p.current(), now
+}
+
+func TestPMTUDSearch(t *testing.T) {
+	cases := []struct {
+		pathMTU int
+	}{
+		{BASE_PLPMTU},
+		{1400},
+		{1500},
+		{4000},
+		{MAX_PLPMTU},
+	}
+
+	for i, c := range cases {
+		p := newPMTUD()
+		got, _ := runSearch(p, c.pathMTU, time.Now())
+		if got > c.pathMTU || c.pathMTU-got > PROBE_GRANULARITY {
+			t.Errorf("%d: Got %d, wanted within %d below %d", i, got, PROBE_GRANULARITY, c.pathMTU)
+		}
+		if p.state != PMTUD_COMPLETE {
+			t.Errorf("%d: Search didn't complete; state %d", i, p.state)
+		}
+	}
+}
+
+func TestPMTUDBlackHole(t *testing.T) {
+	p := newPMTUD()
+	got, now := runSearch(p, 1500, time.Now())
+	if got <= BASE_PLPMTU {
+		t.Fatalf("Initial search got %d, wanted > %d", got, BASE_PLPMTU)
+	}
+
+	// The path shrinks, so the confirmation probes will all be
+	// lost and we should drop back to the base size.
+	now = now.Add(CONFIRM_INTERVAL)
+	for i := 0; i < MAX_PROBES; i++ {
+		now = now.Add(PROBE_TIMEOUT + time.Millisecond)
+		if size, ok := p.nextProbe(now); !ok || size != got {
+			t.Errorf("%d: Got confirmation probe of %d (%t), wanted %d", i, size, ok, got)
+		}
+	}
+	// The final timeout declares the probe lost
+	p.nextProbe(now.Add(PROBE_TIMEOUT + time.Millisecond))
+
+	if cur := p.current(); cur != BASE_PLPMTU {
+		t.Errorf("Got %d after black hole, wanted %d", cur, BASE_PLPMTU)
+	}
+	if p.state != PMTUD_SEARCHING || p.hi != got {
+		t.Errorf("Got state %d (hi: %d), wanted search below %d", p.state, p.hi, got)
+	}
+}
+
+func TestPMTUDReset(t *testing.T) {
+	p := newPMTUD()
+	runSearch(p, MAX_PLPMTU, time.Now())
+	p.reset()
+
+	if cur := p.current(); cur != BASE_PLPMTU {
+		t.Errorf("Got %d after reset, wanted %d", cur, BASE_PLPMTU)
+	}
+	if p.state != PMTUD_SEARCHING {
+		t.Errorf("Got state %d after reset, wanted %d", p.state, PMTUD_SEARCHING)
+	}
+}
+
+func TestPMTUDAckedIgnoresStale(t *testing.T) {
+	p := newPMTUD()
+	now := time.Now()
+	size, _ := p.nextProbe(now)
+
+	if p.acked(BASE_PLPMTU-1, now) {
+		t.Errorf("acked() of size below current plpmtu reported a change")
+	}
+
+	if !p.acked(size, now) {
+		t.Errorf("acked(%d) didn't report a change", size)
+	}
+
+	if p.probe != 0 {
+		t.Errorf("Outstanding probe %d not cleared by ack", p.probe)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+//go:build linux
+
+package network
+
+import (
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets DF on our outgoing datagrams and stops the
+// kernel from fragmenting them or applying its own path MTU
+// estimate. Without this, oversized path MTU probes would be
+// fragmented at the IP layer and always appear to succeed.
+func setDontFragment(c *net.UDPConn) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		slog.Debug("couldn't get raw conn to set DF", "err", err)
+		return
+	}
+
+	rc.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE); err != nil {
+			slog.Debug("couldn't set IP_MTU_DISCOVER", "err", err)
+		}
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE); err != nil {
+			slog.Debug("couldn't set IPV6_MTU_DISCOVER", "err", err)
+		}
+	})
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+//go:build !linux
+
+package network
+
+import (
+	"log/slog"
+	"net"
+)
+
+func setDontFragment(c *net.UDPConn) {
+	slog.Debug("setDontFragment() not implemented on this platform")
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a connection's counters.
+type Stats struct {
+	PacketsSent, PacketsRecv uint64
+	BytesSent, BytesRecv     uint64
+	// Datagrams or frames that failed authentication.
+	DecryptFailures uint64
+	// Authenticated messages whose nonce wasn't newer than the
+	// highest we'd seen. These are replays or, over UDP, simply
+	// reordered.
+	Replays uint64
+	// Messages carrying our own direction in their nonce.
+	BadDirection uint64
+	// Changes of peer address (server) or local socket (client).
+	RoamEvents uint64
+	SendErrors uint64
+
+	// Round trip times, as measured by the layer above. SRTT and
+	// RTTVar are smoothed as in RFC 6298.
+	RTTSamples   uint64
+	LastRTT      time.Duration
+	MinRTT       time.Duration
+	SRTT, RTTVar time.Duration
+}
+
+// String returns a compact, single line summary of s.
+func (s Stats) String() string {
+	return fmt.Sprintf("rtt %s (min %s, var %s) tx %d/%dB rx %d/%dB decrypt %d replay %d dir %d roam %d senderr %d",
+		s.SRTT.Round(time.Millisecond), s.MinRTT.Round(time.Millisecond), s.RTTVar.Round(time.Millisecond),
+		s.PacketsSent, s.BytesSent, s.PacketsRecv, s.BytesRecv,
+		s.DecryptFailures, s.Replays, s.BadDirection, s.RoamEvents, s.SendErrors)
+}
+
+// LogValue lets Stats be logged as a group of attributes.
+func (s Stats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("packets_sent", s.PacketsSent),
+		slog.Uint64("packets_recv", s.PacketsRecv),
+		slog.Uint64("bytes_sent", s.BytesSent),
+		slog.Uint64("bytes_recv", s.BytesRecv),
+		slog.Uint64("decrypt_failures", s.DecryptFailures),
+		slog.Uint64("replays", s.Replays),
+		slog.Uint64("bad_direction", s.BadDirection),
+		slog.Uint64("roam_events", s.RoamEvents),
+		slog.Uint64("send_errors", s.SendErrors),
+		slog.Uint64("rtt_samples", s.RTTSamples),
+		slog.Duration("last_rtt", s.LastRTT),
+		slog.Duration("min_rtt", s.MinRTT),
+		slog.Duration("srtt", s.SRTT),
+		slog.Duration("rttvar", s.RTTVar),
+	)
+}
+
+// stats holds the live counters for a connection. They're updated
+// from several goroutines, so everything is atomic except the RTT
+// estimates, which are guarded by rttMux.
+type stats struct {
+	packetsSent, packetsRecv atomic.Uint64
+	bytesSent, bytesRecv     atomic.Uint64
+	decryptFailures          atomic.Uint64
+	replays                  atomic.Uint64
+	badDirection             atomic.Uint64
+	roamEvents               atomic.Uint64
+	sendErrors               atomic.Uint64
+
+	rttMux          sync.Mutex
+	rttSamples      uint64
+	lastRTT, minRTT time.Duration
+	srtt, rttvar    time.Duration
+}
+
+func (st *stats) sent(n int) {
+	st.packetsSent.Add(1)
+	st.bytesSent.Add(uint64(n))
+}
+
+func (st *stats) recv(n int) {
+	st.packetsRecv.Add(1)
+	st.bytesRecv.Add(uint64(n))
+}
+
+// addRTT folds a new round trip time sample into our estimates.
+func (st *stats) addRTT(d time.Duration) {
+	st.rttMux.Lock()
+	defer st.rttMux.Unlock()
+
+	st.lastRTT = d
+	if st.rttSamples == 0 {
+		st.minRTT = d
+		st.srtt = d
+		st.rttvar = d / 2
+	} else {
+		st.minRTT = min(st.minRTT, d)
+		diff := st.srtt - d
+		if diff < 0 {
+			diff = -diff
+		}
+		st.rttvar = (3*st.rttvar + diff) / 4
+		st.srtt = (7*st.srtt + d) / 8
+	}
+	st.rttSamples += 1
+}
+
+func (st *stats) snapshot() Stats {
+	st.rttMux.Lock()
+	defer st.rttMux.Unlock()
+
+	return Stats{
+		PacketsSent:     st.packetsSent.Load(),
+		PacketsRecv:     st.packetsRecv.Load(),
+		BytesSent:       st.bytesSent.Load(),
+		BytesRecv:       st.bytesRecv.Load(),
+		DecryptFailures: st.decryptFailures.Load(),
+		Replays:         st.replays.Load(),
+		BadDirection:    st.badDirection.Load(),
+		RoamEvents:      st.roamEvents.Load(),
+		SendErrors:      st.sendErrors.Load(),
+		RTTSamples:      st.rttSamples,
+		LastRTT:         st.lastRTT,
+		MinRTT:          st.minRTT,
+		SRTT:            st.srtt,
+		RTTVar:          st.rttvar,
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddRTT(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		samples          []time.Duration
+		srtt, rttvar, mn time.Duration
+	}{
+		{[]time.Duration{100 * ms}, 100 * ms, 50 * ms, 100 * ms},
+		{[]time.Duration{100 * ms, 100 * ms}, 100 * ms, 37500 * time.Microsecond, 100 * ms},
+		{[]time.Duration{100 * ms, 20 * ms}, 90 * ms, 57500 * time.Microsecond, 20 * ms},
+	}
+
+	for i, c := range cases {
+		var st stats
+		for _, d := range c.samples {
+			st.addRTT(d)
+		}
+		s := st.snapshot()
+		if s.SRTT != c.srtt || s.RTTVar != c.rttvar || s.MinRTT != c.mn {
+			t.Errorf("%d: Got srtt %s, rttvar %s, min %s; wanted %s, %s, %s", i, s.SRTT, s.RTTVar, s.MinRTT, c.srtt, c.rttvar, c.mn)
+		}
+		if s.RTTSamples != uint64(len(c.samples)) || s.LastRTT != c.samples[len(c.samples)-1] {
+			t.Errorf("%d: Got %d samples (last %s), wanted %d", i, s.RTTSamples, s.LastRTT, len(c.samples))
+		}
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer srv.Close()
+	defer cl.Close()
+
+	msg := []byte("hello")
+	cl.Write(msg)
+	readMsg(t, srv)
+
+	// Garbage that can't be authenticated
+	c, err := net.Dial("udp", cl.RemoteAddr())
+	if err != nil {
+		t.Fatalf("couldn't dial server: %v", err)
+	}
+	defer c.Close()
+	c.Write(make([]byte, 64))
+	pump(srv)
+
+	cs, ss := cl.Stats(), srv.Stats()
+	wire := uint64(len(msg) + CRYPTO_OVERHEAD)
+	if cs.PacketsSent != 1 || cs.BytesSent != wire {
+		t.Errorf("Client sent %d/%d, wanted 1/%d", cs.PacketsSent, cs.BytesSent, wire)
+	}
+	if ss.PacketsRecv != 1 || ss.BytesRecv != wire {
+		t.Errorf("Server received %d/%d, wanted 1/%d", ss.PacketsRecv, ss.BytesRecv, wire)
+	}
+	if ss.DecryptFailures != 1 {
+		t.Errorf("Got %d decrypt failures, wanted 1", ss.DecryptFailures)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FRAME_HEADER_BYTES holds the big endian length of each frame.
+const FRAME_HEADER_BYTES = 2
+
+// TConn carries our messages over TCP for networks that won't pass
+// UDP. Each message is sealed exactly as it would be for a datagram,
+// using the session key and the nonce counter shared with the
+// session's GConn, then framed with its length. As the frames are
+// already encrypted and authenticated, we don't layer TLS on top.
+type TConn struct {
+	c     net.Conn
+	aead  cipher.AEAD
+	nce   *nonce // shared with the GConn, so nonces are never reused
+	rnce  *nonce // also shared, so nothing seen on UDP can be replayed
+	cType uint8
+	st    *stats // shared with the GConn, so there's one set of counters
+	pad   *atomic.Bool
+
+	wmux  sync.Mutex
+	msgs  chan []byte // closed when the connection dies
+	resps chan []byte // path responses, see challenge; also closed
+}
+
+// newTConn wraps c, sharing key material and nonces with gc, and
+// starts reading frames from it.
+func newTConn(c net.Conn, gc *GConn) *TConn {
+	tc := &TConn{
+		c:     c,
+		aead:  gc.aead,
+		nce:   gc.nce,
+		rnce:  gc.rnce,
+		st:    gc.st,
+		pad:   gc.pad,
+		cType: gc.cType,
+		msgs:  make(chan []byte, 64),
+		resps: make(chan []byte, 1),
+	}
+
+	go tc.readFrames()
+
+	return tc
+}
+
+// DialTCP connects to the TCP port matching gc's remote UDP address.
+func DialTCP(gc *GConn) (*TConn, error) {
+	addr := gc.RemoteAddr()
+	c, err := net.DialTimeout("tcp", addr, FALLBACK_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to %q: %w", addr, err)
+	}
+
+	return newTConn(c, gc), nil
+}
+
+func (tc *TConn) RemoteAddr() string {
+	return tc.c.RemoteAddr().String()
+}
+
+func (tc *TConn) Close() error {
+	return tc.c.Close()
+}
+
+func (tc *TConn) Write(msg []byte) (int, error) {
+	return tc.writeKind(KIND_DATA, msg)
+}
+
+func (tc *TConn) writeKind(kind uint8, msg []byte) (int, error) {
+	nce := tc.nce.get(tc.cType)
+	nce[1] = kind
+	plain := msg
+	if tc.pad.Load() {
+		// There's no path MTU to fill, so large messages
+		// only get the header.
+		plain = pad(msg, 0)
+		nce[1] |= KIND_PADDED
+	}
+	sealed := tc.aead.Seal(nil, nce, plain, nil)
+
+	l := len(nce) + len(sealed)
+	if l > MAX_DATAGRAM {
+		return 0, fmt.Errorf("message of %d bytes is too large for a frame", l)
+	}
+
+	frame := make([]byte, FRAME_HEADER_BYTES, FRAME_HEADER_BYTES+l)
+	binary.BigEndian.PutUint16(frame, uint16(l))
+	frame = append(frame, nce...)
+	frame = append(frame, sealed...)
+
+	tc.wmux.Lock()
+	defer tc.wmux.Unlock()
+
+	n, err := tc.c.Write(frame)
+	if n != len(frame) || err != nil {
+		tc.st.sendErrors.Add(1)
+		return 0, fmt.Errorf("wrote %d of %d bytes: %v", n, len(frame), err)
+	}
+	tc.st.sent(n)
+
+	return len(msg), nil
+}
+
+// Read returns the next message from our peer, waiting at most as long
+// as GConn would. It returns io.EOF once the connection is gone.
+func (tc *TConn) Read(extbuf []byte) (int, error) {
+	select {
+	case m, ok := <-tc.msgs:
+		if !ok {
+			return 0, io.EOF
+		}
+		n := copy(extbuf, m)
+		if n != len(m) {
+			return 0, fmt.Errorf("couldn't copy buffers (%d, %d)", n, len(m))
+		}
+		return n, nil
+	case <-time.After(100 * time.Millisecond):
+		return 0, fmt.Errorf("failed to read frame: %w", os.ErrDeadlineExceeded)
+	}
+}
+
+// readFrames reads and authenticates frames until the connection
+// dies. Anything that doesn't authenticate kills the connection, as
+// TCP has no excuse for corruption. Frames with stale nonces are
+// dropped: they may be replays, or simply overtaken by datagrams
+// while switching transports.
+func (tc *TConn) readFrames() {
+	defer close(tc.msgs)
+	defer close(tc.resps)
+	defer tc.c.Close()
+
+	r := bufio.NewReader(tc.c)
+	hdr := make([]byte, FRAME_HEADER_BYTES)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("error reading frame header", "err", err)
+			}
+			return
+		}
+
+		l := int(binary.BigEndian.Uint16(hdr))
+		if l < CRYPTO_OVERHEAD {
+			slog.Debug("short frame", "len", l)
+			return
+		}
+
+		frame := make([]byte, l)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			slog.Debug("error reading frame", "err", err)
+			return
+		}
+
+		nce := frame[0:NONCE_BYTES]
+		// Will panic if the nonce exceeds a 32-bit uint
+		rn, dir := extractNonce(nce)
+		if dir == tc.cType {
+			tc.st.badDirection.Add(1)
+			slog.Debug("invalid nonce in frame - bad directionality")
+			return
+		}
+
+		unsealed, err := tc.aead.Open(nil, nce, frame[NONCE_BYTES:], nil)
+		if err != nil {
+			tc.st.decryptFailures.Add(1)
+			slog.Debug("failed to unseal frame", "err", err)
+			return
+		}
+		tc.st.recv(FRAME_HEADER_BYTES + l)
+		if nonceKind(nce)&KIND_PADDED != 0 {
+			if unsealed, err = unpad(unsealed); err != nil {
+				slog.Debug("bad padding in frame", "err", err)
+				return
+			}
+		}
+
+		if !tc.rnce.advance(rn) {
+			tc.st.replays.Add(1)
+			slog.Debug("dropping frame with stale nonce", "nonce", rn)
+			continue
+		}
+
+		switch nonceKind(nce) &^ KIND_PADDED {
+		case KIND_PATH_CHALLENGE:
+			if _, err := tc.writeKind(KIND_PATH_RESPONSE, unsealed); err != nil {
+				slog.Debug("couldn't send path response", "err", err)
+			}
+			continue
+		case KIND_PATH_RESPONSE:
+			select {
+			case tc.resps <- unsealed:
+			default:
+			}
+			continue
+		}
+
+		tc.msgs <- unsealed
+	}
+}
+
+// readFresh is Read. Frames with stale nonces are already dropped, so
+// every message is fresh.
+func (tc *TConn) readFresh(extbuf []byte) (int, bool, error) {
+	n, err := tc.Read(extbuf)
+	return n, err == nil, err
+}
+
+// challenge sends our peer a path challenge and waits until deadline
+// for the answer. A valid frame only shows that someone had it, as
+// fresh datagrams can be captured and replayed over TCP from
+// anywhere. Only our peer can answer.
+func (tc *TConn) challenge(deadline time.Time) error {
+	ch := make([]byte, CHALLENGE_BYTES)
+	if _, err := rand.Read(ch); err != nil {
+		return fmt.Errorf("couldn't generate path challenge: %w", err)
+	}
+	if _, err := tc.writeKind(KIND_PATH_CHALLENGE, ch); err != nil {
+		return fmt.Errorf("couldn't send path challenge: %w", err)
+	}
+
+	for {
+		select {
+		case resp, ok := <-tc.resps:
+			if !ok {
+				return io.EOF
+			}
+			if subtle.ConstantTimeCompare(ch, resp) == 1 {
+				return nil
+			}
+		case <-time.After(time.Until(deadline)):
+			return fmt.Errorf("no path response: %w", os.ErrDeadlineExceeded)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Transport carries messages between client and server. Each Write is
+// delivered to the peer's Read whole or not at all. Read waits only
+// briefly for a message, returning an error if none arrives, and
+// returns io.EOF once the transport is gone for good.
+type Transport interface {
+	io.ReadWriter
+	RemoteAddr() string
+	Close() error
+}
+
+const (
+	// Clients fall back to TCP when UDP has been silent this
+	// long, despite us pinging the server.
+	FALLBACK_TIMEOUT = 3 * time.Second
+	// How often we ping the server while UDP is quiet.
+	PING_INTERVAL = 1 * time.Second
+	// While using TCP, clients check if UDP works again this
+	// often.
+	UDP_RETRY_INTERVAL = 30 * time.Second
+	// Servers drop TCP connections that haven't authenticated
+	// within this long, and won't hold more than MAX_PENDING_TCP
+	// of them.
+	TCP_AUTH_TIMEOUT = 5 * time.Second
+	MAX_PENDING_TCP  = 4
+)
+
+type inbound struct {
+	data  []byte
+	from  Transport
+	fresh bool // not a possible replay
+}
+
+// source is a Transport that knows whether each message it reads is
+// fresh.
+type source interface {
+	Transport
+	readFresh([]byte) (int, bool, error)
+}
+
+// Fallback carries messages over UDP when it can and TCP when it
+// can't. The client decides which to use: UDP first, then TCP if UDP
+// is silent for FALLBACK_TIMEOUT, returning to UDP once it works
+// again. The server replies over whichever transport the client last
+// used. The layers above only see messages, so switching doesn't
+// disturb the session.
+type Fallback struct {
+	udp  *GConn
+	ln   net.Listener // server only
+	msgs chan inbound
+	done chan struct{}
+
+	mux       sync.Mutex
+	tcp       *TConn
+	active    Transport
+	since     time.Time // when we switched transports
+	lastPing  time.Time
+	pending   int // unauthenticated tcp connections (server)
+	closeOnce sync.Once
+}
+
+func newFallback(udp *GConn) *Fallback {
+	f := &Fallback{
+		udp:    udp,
+		msgs:   make(chan inbound, 64),
+		done:   make(chan struct{}),
+		active: udp,
+		since:  time.Now(),
+	}
+
+	go f.pump(udp)
+
+	return f
+}
+
+// NewFallbackClient wraps the client's GConn, falling back to TCP on
+// the same port if UDP doesn't work.
+func NewFallbackClient(udp *GConn) *Fallback {
+	f := newFallback(udp)
+
+	go f.monitor()
+
+	return f
+}
+
+// NewFallbackServer wraps the server's GConn and accepts TCP
+// connections on the same port.
+func NewFallbackServer(udp *GConn) (*Fallback, error) {
+	addr := udp.conn().LocalAddr().(*net.UDPAddr)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen for tcp on %s: %w", addr, err)
+	}
+
+	f := newFallback(udp)
+	f.ln = ln
+
+	go f.accept()
+
+	return f, nil
+}
+
+func (f *Fallback) closed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *Fallback) current() Transport {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.active
+}
+
+// UsingTCP returns true if messages are currently sent over TCP.
+func (f *Fallback) UsingTCP() bool {
+	return f.current() != Transport(f.udp)
+}
+
+func (f *Fallback) RemoteAddr() string {
+	return f.current().RemoteAddr()
+}
+
+func (f *Fallback) Write(msg []byte) (int, error) {
+	return f.current().Write(msg)
+}
+
+// Read returns the next message from either transport. It only
+// returns io.EOF once the Fallback itself is closed.
+func (f *Fallback) Read(extbuf []byte) (int, error) {
+	select {
+	case in := <-f.msgs:
+		// Replays mustn't move us, as with GConn migration.
+		if f.ln != nil && in.fresh {
+			f.replyOver(in.from)
+		}
+		n := copy(extbuf, in.data)
+		if n != len(in.data) {
+			return 0, fmt.Errorf("couldn't copy buffers (%d, %d)", n, len(in.data))
+		}
+		return n, nil
+	case <-f.done:
+		return 0, io.EOF
+	case <-time.After(100 * time.Millisecond):
+		return 0, fmt.Errorf("failed to read message: %w", os.ErrDeadlineExceeded)
+	}
+}
+
+func (f *Fallback) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.done)
+		if f.ln != nil {
+			f.ln.Close()
+		}
+		f.mux.Lock()
+		if f.tcp != nil {
+			f.tcp.Close()
+		}
+		f.mux.Unlock()
+		err = f.udp.Close()
+	})
+	return err
+}
+
+// MaxPayload, NextProbe and ProbeAcked expose path MTU discovery for
+// UDP. TCP has no such limit, but we stay within it so that switching
+// back to UDP doesn't leave oversized fragments in flight.
+func (f *Fallback) MaxPayload() int {
+	return f.udp.MaxPayload()
+}
+
+// NextProbe only probes while UDP is in use, as probes sent over TCP
+// would always succeed.
+func (f *Fallback) NextProbe() (int, bool) {
+	if f.UsingTCP() {
+		return 0, false
+	}
+	return f.udp.NextProbe()
+}
+
+func (f *Fallback) ProbeAcked(size int) bool {
+	if f.UsingTCP() {
+		return false
+	}
+	return f.udp.ProbeAcked(size)
+}
+
+// Stats returns the counters for both transports.
+func (f *Fallback) Stats() Stats {
+	return f.udp.Stats()
+}
+
+func (f *Fallback) AddRTTSample(d time.Duration) {
+	f.udp.AddRTTSample(d)
+}
+
+// Rebind replaces the local UDP socket. See GConn.Rebind.
+func (f *Fallback) Rebind() error {
+	return f.udp.Rebind()
+}
+
+// pump forwards messages from t until it's gone.
+func (f *Fallback) pump(t source) {
+	bp := datagramBufs.Get().(*[]byte)
+	defer datagramBufs.Put(bp)
+	buf := *bp
+	for {
+		n, fresh, err := t.readFresh(buf)
+		if f.closed() {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				f.lost(t)
+				return
+			}
+			continue
+		}
+
+		m := make([]byte, n)
+		copy(m, buf[:n])
+		select {
+		case f.msgs <- inbound{m, t, fresh}:
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// lost handles a tcp connection going away.
+func (f *Fallback) lost(t Transport) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.tcp == nil || t != Transport(f.tcp) {
+		return
+	}
+
+	slog.Info("lost tcp connection, using udp", "remote", t.RemoteAddr())
+	f.tcp = nil
+	f.active = f.udp
+	f.since = time.Now()
+}
+
+// replyOver makes the server send over t, which the client just
+// used, if it's still current.
+func (f *Fallback) replyOver(t Transport) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.active == t || (t != Transport(f.udp) && t != Transport(f.tcp)) {
+		return
+	}
+
+	slog.Debug("switching transport", "remote", t.RemoteAddr())
+	f.active = t
+}
+
+// accept adopts authenticated TCP connections for the server. A
+// connection only replaces the current one once a valid message
+// arrives over it and our peer answers a path challenge over it, so
+// unauthenticated connections and replays can't disrupt the session.
+// As with UDP, peers must be within the roaming allowlist.
+func (f *Fallback) accept() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			if !f.closed() {
+				slog.Error("error accepting tcp connection", "err", err)
+			}
+			return
+		}
+
+		if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok && !f.udp.allows(&net.UDPAddr{IP: ta.IP, Port: ta.Port, Zone: ta.Zone}) {
+			slog.Warn("ignoring tcp connection outside of roaming allowlist", "remote", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+
+		f.mux.Lock()
+		if f.pending >= MAX_PENDING_TCP {
+			f.mux.Unlock()
+			slog.Debug("too many pending tcp connections, dropping", "remote", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		f.pending += 1
+		f.mux.Unlock()
+
+		go f.authenticate(newTConn(c, f.udp))
+	}
+}
+
+func (f *Fallback) authenticate(tc *TConn) {
+	bp := datagramBufs.Get().(*[]byte)
+	buf := *bp
+	deadline := time.Now().Add(TCP_AUTH_TIMEOUT)
+
+	var n int
+	var err error
+	for time.Now().Before(deadline) {
+		if n, err = tc.Read(buf); err == nil || errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	m := make([]byte, n)
+	copy(m, buf[:n])
+	datagramBufs.Put(bp)
+	if err == nil {
+		err = tc.challenge(deadline)
+	}
+
+	f.mux.Lock()
+	f.pending -= 1
+	if err != nil || f.closed() {
+		f.mux.Unlock()
+		slog.Debug("tcp connection didn't authenticate", "remote", tc.RemoteAddr(), "err", err)
+		tc.Close()
+		return
+	}
+
+	slog.Info("client connected over tcp", "remote", tc.RemoteAddr())
+	if f.tcp != nil {
+		f.tcp.Close()
+	}
+	f.tcp = tc
+	f.mux.Unlock()
+
+	select {
+	case f.msgs <- inbound{m, tc, true}:
+	case <-f.done:
+		return
+	}
+
+	f.pump(tc)
+}
+
+// monitor decides, for clients, when to switch between UDP and TCP.
+func (f *Fallback) monitor() {
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-tick.C:
+		}
+
+		now := time.Now()
+		heard := f.udp.LastReceived()
+
+		f.mux.Lock()
+		onUDP := f.active == Transport(f.udp)
+		since, lastPing := f.since, f.lastPing
+		f.mux.Unlock()
+
+		if onUDP {
+			if heard.After(since) {
+				since = heard
+			}
+			quiet := now.Sub(since)
+			switch {
+			case quiet > FALLBACK_TIMEOUT:
+				f.useTCP()
+			case quiet > PING_INTERVAL && now.Sub(lastPing) > PING_INTERVAL:
+				f.ping(now)
+			}
+			continue
+		}
+
+		// We only trust UDP again once the server answers a
+		// ping sent after we switched to TCP. Anything earlier
+		// may just have been delayed.
+		if lastPing.After(since) && heard.After(lastPing) {
+			f.useUDP()
+		} else if now.Sub(lastPing) > UDP_RETRY_INTERVAL {
+			f.ping(now)
+		}
+	}
+}
+
+func (f *Fallback) ping(now time.Time) {
+	f.mux.Lock()
+	f.lastPing = now
+	f.mux.Unlock()
+
+	if err := f.udp.Ping(); err != nil {
+		slog.Debug("couldn't ping over udp", "err", err)
+	}
+}
+
+// useTCP connects to the server over TCP and switches to it. If that
+// fails, we stay on UDP and try again after FALLBACK_TIMEOUT.
+func (f *Fallback) useTCP() {
+	slog.Info("udp isn't getting through, trying tcp", "remote", f.udp.RemoteAddr())
+	tc, err := DialTCP(f.udp)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.since = time.Now()
+	if err != nil {
+		slog.Info("couldn't fall back to tcp", "err", err)
+		return
+	}
+	if f.closed() {
+		tc.Close()
+		return
+	}
+
+	f.tcp = tc
+	f.active = tc
+
+	// The leaked goroutine exits when tc is closed.
+	go f.pump(tc)
+}
+
+// useUDP switches back to UDP and closes our TCP connection.
+func (f *Fallback) useUDP() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	slog.Info("udp is working again, leaving tcp", "remote", f.udp.RemoteAddr())
+	if f.tcp != nil {
+		f.tcp.Close()
+		f.tcp = nil
+	}
+	f.active = f.udp
+	f.since = time.Now()
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readWithin reads from tr, retrying timeouts until d has passed.
+func readWithin(t *testing.T, tr Transport, d time.Duration) []byte {
+	buf := make([]byte, MAX_DATAGRAM)
+	end := time.Now().Add(d)
+	for time.Now().Before(end) {
+		n, err := tr.Read(buf)
+		if err == nil {
+			return buf[:n]
+		}
+		if errors.Is(err, io.EOF) {
+			t.Fatalf("unexpected EOF from %s", tr.RemoteAddr())
+		}
+	}
+	t.Fatalf("no message from %s within %s", tr.RemoteAddr(), d)
+	return nil
+}
+
+func TestTConn(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer srv.Close()
+	defer cl.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *TConn)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- newTConn(c, srv)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("couldn't dial: %v", err)
+	}
+	ctc := newTConn(c, cl)
+	stc := <-accepted
+	if stc == nil {
+		t.Fatalf("couldn't accept connection")
+	}
+
+	cases := []struct {
+		from, to *TConn
+		msg      []byte
+	}{
+		{ctc, stc, []byte("hello")},
+		{stc, ctc, []byte("world")},
+		{ctc, stc, make([]byte, 20000)},
+	}
+
+	for i, c := range cases {
+		if _, err := c.from.Write(c.msg); err != nil {
+			t.Fatalf("%d: Write() failed: %v", i, err)
+		}
+		if got := readWithin(t, c.to, time.Second); !slices.Equal(got, c.msg) {
+			t.Errorf("%d: Got %d bytes, wanted %d", i, len(got), len(c.msg))
+		}
+	}
+
+	ctc.Close()
+	buf := make([]byte, MAX_DATAGRAM)
+	end := time.Now().Add(time.Second)
+	for time.Now().Before(end) {
+		if _, err = stc.Read(buf); errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Got %v after peer closed, wanted EOF", err)
+	}
+}
+
+func TestFallbackServer(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer cl.Close()
+
+	fs, err := NewFallbackServer(srv)
+	if err != nil {
+		t.Fatalf("couldn't create fallback server: %v", err)
+	}
+	defer fs.Close()
+
+	// A connection that doesn't authenticate is never used.
+	junk, err := net.Dial("tcp", cl.RemoteAddr())
+	if err != nil {
+		t.Fatalf("couldn't dial server: %v", err)
+	}
+	junk.Write([]byte{0, 40, 1, 2, 3})
+	defer junk.Close()
+
+	tc, err := DialTCP(cl)
+	if err != nil {
+		t.Fatalf("DialTCP() failed: %v", err)
+	}
+	defer tc.Close()
+
+	msg := []byte("over tcp")
+	tc.Write(msg)
+	if got := readWithin(t, fs, time.Second); !slices.Equal(got, msg) {
+		t.Errorf("Got %q, wanted %q", got, msg)
+	}
+	if !fs.UsingTCP() {
+		t.Errorf("Server isn't replying over tcp")
+	}
+
+	reply := []byte("reply")
+	fs.Write(reply)
+	if got := readWithin(t, tc, time.Second); !slices.Equal(got, reply) {
+		t.Errorf("Got %q, wanted %q", got, reply)
+	}
+
+	// Once the client uses udp again, so does the server.
+	msg = []byte("over udp")
+	cl.Write(msg)
+	if got := readWithin(t, fs, time.Second); !slices.Equal(got, msg) {
+		t.Errorf("Got %q, wanted %q", got, msg)
+	}
+	if fs.UsingTCP() {
+		t.Errorf("Server didn't switch back to udp")
+	}
+
+	fs.Write(reply)
+	if got := readWithin(t, cl, time.Second); !slices.Equal(got, reply) {
+		t.Errorf("Got %q, wanted %q", got, reply)
+	}
+}
+
+func TestFallbackClient(t *testing.T) {
+	srv, other := newTestPair(t)
+	defer srv.Close()
+	other.Close()
+
+	// Nothing answers udp on this port, so the client should
+	// fall back to tcp.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	defer ln.Close()
+
+	cl, err := NewClient(ln.Addr().String(), srv.Base64Key())
+	if err != nil {
+		t.Fatalf("couldn't create client: %v", err)
+	}
+	fc := NewFallbackClient(cl)
+	defer fc.Close()
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(FALLBACK_TIMEOUT + 2*time.Second))
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Client didn't fall back to tcp: %v", err)
+	}
+	stc := newTConn(c, srv)
+	defer stc.Close()
+
+	end := time.Now().Add(time.Second)
+	for !fc.UsingTCP() && time.Now().Before(end) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fc.UsingTCP() {
+		t.Fatalf("Client connected over tcp but isn't using it")
+	}
+
+	msg := []byte("hello")
+	fc.Write(msg)
+	if got := readWithin(t, stc, time.Second); !slices.Equal(got, msg) {
+		t.Errorf("Got %q, wanted %q", got, msg)
+	}
+	stc.Write(msg)
+	if got := readWithin(t, fc, time.Second); !slices.Equal(got, msg) {
+		t.Errorf("Got %q, wanted %q", got, msg)
+	}
+}
+
+// readFrame reads one raw frame from c.
+func readFrame(t *testing.T, c net.Conn) []byte {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	hdr := make([]byte, FRAME_HEADER_BYTES)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		t.Fatalf("couldn't read frame header: %v", err)
+	}
+	frame := make([]byte, int(hdr[0])<<8|int(hdr[1]))
+	if _, err := io.ReadFull(c, frame); err != nil {
+		t.Fatalf("couldn't read frame: %v", err)
+	}
+	return append(hdr, frame...)
+}
+
+// quiet returns true if nothing arrives on tr within d.
+func quiet(tr Transport, d time.Duration) bool {
+	buf := make([]byte, MAX_DATAGRAM)
+	end := time.Now().Add(d)
+	for time.Now().Before(end) {
+		if _, err := tr.Read(buf); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFallbackServerReplay(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer cl.Close()
+
+	fs, err := NewFallbackServer(srv)
+	if err != nil {
+		t.Fatalf("couldn't create fallback server: %v", err)
+	}
+	defer fs.Close()
+
+	// Capture a fresh frame from the client, as an on-path
+	// attacker might, and replay it over tcp from elsewhere.
+	p1, p2 := net.Pipe()
+	ctc := newTConn(p1, cl)
+	go ctc.Write([]byte("captured"))
+	frame := readFrame(t, p2)
+	ctc.Close()
+
+	atk, err := net.Dial("tcp", cl.RemoteAddr())
+	if err != nil {
+		t.Fatalf("couldn't dial server: %v", err)
+	}
+	atk.Write(frame)
+	// The server challenges the connection, which the attacker
+	// can't answer.
+	readFrame(t, atk)
+	atk.Close()
+
+	if !quiet(fs, 500*time.Millisecond) || fs.UsingTCP() {
+		t.Fatalf("Server adopted a replayed tcp connection")
+	}
+
+	tc, err := DialTCP(cl)
+	if err != nil {
+		t.Fatalf("DialTCP() failed: %v", err)
+	}
+	defer tc.Close()
+	tc.Write([]byte("over tcp"))
+	readWithin(t, fs, time.Second)
+	if !fs.UsingTCP() {
+		t.Fatalf("Server isn't replying over tcp")
+	}
+
+	// A replayed udp datagram, with a stale nonce, doesn't move
+	// the server off tcp. We capture one by pointing a client
+	// with the same key somewhere else.
+	sniff, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	defer sniff.Close()
+	old, err := NewClient(sniff.LocalAddr().String(), srv.Base64Key())
+	if err != nil {
+		t.Fatalf("couldn't create client: %v", err)
+	}
+	defer old.Close()
+	old.Write([]byte("stale"))
+	buf := make([]byte, MAX_DATAGRAM)
+	sniff.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := sniff.Read(buf)
+	if err != nil {
+		t.Fatalf("couldn't capture datagram: %v", err)
+	}
+	sniff.WriteToUDP(buf[:n], srv.conn().LocalAddr().(*net.UDPAddr))
+	readWithin(t, fs, time.Second)
+	if !fs.UsingTCP() {
+		t.Errorf("A replayed datagram moved the server off tcp")
+	}
+}
+
+func TestFallbackServerAllowlist(t *testing.T) {
+	srv, cl := newTestPair(t)
+	defer cl.Close()
+	srv.SetRoamAllowlist([]string{"10.0.0.0/8"})
+
+	fs, err := NewFallbackServer(srv)
+	if err != nil {
+		t.Fatalf("couldn't create fallback server: %v", err)
+	}
+	defer fs.Close()
+
+	tc, err := DialTCP(cl)
+	if err != nil {
+		t.Fatalf("DialTCP() failed: %v", err)
+	}
+	defer tc.Close()
+	tc.Write([]byte("over tcp"))
+
+	if !quiet(fs, 500*time.Millisecond) || fs.UsingTCP() {
+		t.Errorf("Server adopted a tcp connection outside of the allowlist")
+	}
+}
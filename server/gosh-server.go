@@ -14,6 +14,7 @@ import (
 	"runtime/pprof"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bdwalton/gosh/logging"
 	"github.com/bdwalton/gosh/network"
@@ -27,11 +28,17 @@ var (
 	debug        = flag.Bool("debug", false, "If true, enable DEBUG log level for verbose log output")
 	defTerm      = flag.String("default_terminal", "xterm-256color", "Default TERM value if not set by remote environment")
 	detached     = flag.Bool("detached", false, "For use gosh-server to setup a detached version")
+	fec          = flag.Bool("fec", true, "If true, send parity with large updates so they survive packet loss, adapting to the observed loss rate")
 	initCols     = flag.Int("initial_cols", vt.DEF_COLS, "Numer of columns to start the terminal with")
 	initRows     = flag.Int("initial_rows", vt.DEF_ROWS, "Numer of rows to start the terminal with")
 	logfile      = flag.String("logfile", "", "If set, logs will be written to this file.")
+	obfuscate    = flag.Bool("obfuscate_traffic", false, "If true, pad datagrams to hide their size, at the cost of bandwidth")
 	portRange    = flag.String("port_range", "60000:61000", "Port range")
 	pprofFile    = flag.String("pprof_file", "", "If set, enable pprof capture to the provided file.")
+	roamAllow    = flag.String("roam_allowlist", "", "If set, a comma separated list of CIDRs the client is allowed to connect and roam from.")
+	statsIntvl   = flag.Duration("stats_interval", 0, "If non-zero, log connection statistics this often.")
+	streamComp   = flag.Bool("stream_compression", true, "If true, compress screen updates against the updates before them, for clients that support it")
+	tcpFallback  = flag.Bool("tcp_fallback", true, "If true, also accept clients over TCP on the same port, for networks that block UDP")
 	titlePfx     = flag.String("title_prefix", "[gosh] ", "The prefix applied to the title. Set to '' to disable.")
 )
 
@@ -84,8 +91,20 @@ func main() {
 	if err != nil {
 		die("couldn't setup network layer: %v", err)
 	}
+	if *roamAllow != "" {
+		if err := gc.SetRoamAllowlist(strings.Split(*roamAllow, ",")); err != nil {
+			die("couldn't set roaming allowlist: %v", err)
+		}
+	}
+	gc.SetPadding(*obfuscate)
+	var remote network.Transport = gc
+	if *tcpFallback {
+		if remote, err = network.NewFallbackServer(gc); err != nil {
+			die("couldn't setup tcp fallback: %v", err)
+		}
+	}
 	defer func() {
-		if err := gc.Close(); err != nil {
+		if err := remote.Close(); err != nil {
 			slog.Error("error closing gosh conn", "err", err)
 		}
 	}()
@@ -108,7 +127,9 @@ func main() {
 	}
 	t.SetTitlePrefix(*titlePfx)
 
-	s := stm.NewServer(gc, t, sock)
+	s := stm.NewServer(remote, t, sock)
+	s.SetFEC(*fec)
+	s.SetStreamCompression(*streamComp)
 
 	port, pid := gc.LocalPort(), os.Getpid()
 	slog.Info("Running", "port", port)
@@ -121,11 +142,25 @@ func main() {
 	os.Stdout.Close()
 	os.Stderr.Close()
 
+	if *statsIntvl > 0 {
+		// This goroutine is leaked
+		go logStats(gc, *statsIntvl)
+	}
+
 	s.Run()
 
+	slog.Info("connection stats", "stats", gc.Stats())
+
 	slog.Info("Shutting down")
 }
 
+// logStats writes the connection statistics to the log every interval.
+func logStats(gc *network.GConn, interval time.Duration) {
+	for range time.Tick(interval) {
+		slog.Info("connection stats", "stats", gc.Stats())
+	}
+}
+
 func runDetached() error {
 	env := os.Environ()
 	if os.Getenv("TERM") == "" {
@@ -10,11 +10,17 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/bdwalton/gosh/fragmenter"
+	"github.com/bdwalton/gosh/network"
 	"github.com/bdwalton/gosh/protos/goshpb"
 	"github.com/bdwalton/gosh/vt"
 	"golang.org/x/term"
@@ -28,16 +34,141 @@ const (
 )
 
 const (
-	// 1280 is as much data as we want to send, so we allow room
-	// for some overheads around packet size, proto message data,
-	// etc. This is conservative for now.
-	//
-	// TODO: Make this more
-	// dynamic and based somehow on the underlying remote
-	// capabilities.
+	// MAX_PACKET_SIZE is the fragment size used when the remote
+	// can't tell us what the path supports. It leaves room within
+	// a 1280 byte datagram for headers, encryption and proto
+	// framing. Remotes implementing pathMTU replace this with a
+	// discovered value.
 	MAX_PACKET_SIZE = 1100
+	// READ_BUFFER_SIZE must hold the largest datagram a remote
+	// could deliver.
+	READ_BUFFER_SIZE = 65535
 )
 
+// Client side detection of local network changes. When something we
+// sent that should provoke a reply goes unanswered for ROAM_QUIET, we
+// check the path with a heartbeat. If that and a retry go unanswered
+// for ROAM_TIMEOUT each, or we see ROAM_SEND_ERRORS consecutive failed
+// sends, we assume our socket is no longer usable and rebind it. (One
+// retry is needed as the server validates our new address before
+// using it, so the reply to the first heartbeat from a new address is
+// sent to the old one.)
+const (
+	ROAM_QUIET        = 2 * time.Second
+	ROAM_TIMEOUT      = 3 * time.Second
+	ROAM_SEND_ERRORS  = 3
+	ROAM_MIN_INTERVAL = 5 * time.Second // don't rebind more often than this
+)
+
+// pathMTU is implemented by remotes that can discover how large a
+// single message can be on the current network path. See
+// network.GConn.
+type pathMTU interface {
+	MaxPayload() int
+	NextProbe() (int, bool)
+	ProbeAcked(int) bool
+}
+
+// DA1_QUERY asks a terminal for its primary device attributes. One of
+// them, DA1_SIXEL, says it can show sixel images. KITTY_QUERY asks
+// whether it understands the kitty graphics protocol, which those
+// that do answer before DA1_QUERY.
+const (
+	DA1_QUERY   = "\x1b[c"
+	DA1_SIXEL   = "4"
+	KITTY_QUERY = "\x1b_Gi=31,s=1,v=1,a=q,t=d,f=24;AAAA\x1b\\"
+)
+
+// Outer terminals known to have styled underlines, and REP, by $TERM
+// or $TERM_PROGRAM. For REP, xterm is known by $XTERM_VERSION and
+// Windows Terminal by $WT_SESSION.
+var (
+	STYLED_UL_TERMS    = []string{"xterm-kitty", "xterm-ghostty", "foot", "foot-extra", "wezterm", "alacritty"}
+	STYLED_UL_PROGRAMS = []string{"WezTerm", "iTerm.app", "ghostty", "vscode"}
+	REP_TERMS          = []string{"xterm-kitty", "xterm-ghostty", "foot", "foot-extra", "wezterm", "alacritty", "tmux", "tmux-256color"}
+	REP_PROGRAMS       = []string{"WezTerm", "iTerm.app", "ghostty", "vscode", "tmux"}
+)
+
+// MIN_VTE is the first VTE version, in $VTE_VERSION, with both.
+const MIN_VTE = 5200
+
+// PALETTE_QUERY asks the outer terminal for its foreground,
+// background and cursor colors and the first 16 indexed colors. The
+// rest are rarely changed from xterm's, which we assume.
+var PALETTE_QUERY = func() string {
+	q := "\x1b]10;?\x1b\\\x1b]11;?\x1b\\\x1b]12;?\x1b\\\x1b]4"
+	for i := 0; i < 16; i++ {
+		q += fmt.Sprintf(";%d;?", i)
+	}
+	return q + "\x1b\\"
+}()
+
+var (
+	da1Reply     = regexp.MustCompile("\x1b\\[\\?([0-9;]*)c")
+	kittyReply   = regexp.MustCompile("\x1b_Gi=31;([^\x1b]*)\x1b\\\\")
+	paletteReply = regexp.MustCompile("\x1b\\]((?:4;[0-9]+)|1[012]);([^\x07\x1b]*)(?:\x07|\x1b\\\\)")
+)
+
+// The outer terminal's colors are resent every PALETTE_RETRY until
+// the server acks them.
+const PALETTE_RETRY = time.Second
+
+// Images are sent to the client separately from the diffs that place
+// them, in IMAGE_CHUNK_SIZE chunks. Each chunk is resent every
+// IMAGE_RETRY until the client acks it, with at most IMAGE_WINDOW of
+// them unacked at a time.
+const (
+	IMAGE_CHUNK_SIZE = 16 * 1024
+	IMAGE_WINDOW     = 8
+	IMAGE_RETRY      = time.Second
+)
+
+// imageSend is an image being sent to the client (server).
+type imageSend struct {
+	id     uint64
+	chunks [][]byte
+	sent   []time.Time
+	acked  []bool
+	left   int // chunks not yet acked
+}
+
+// imageRecv is an image being received from the server (client).
+type imageRecv struct {
+	chunks [][]byte
+	got    int
+}
+
+// RTT_INTERVAL is how often clients send a heartbeat to sample the
+// round trip time, if nothing else prompted one.
+const RTT_INTERVAL = 15 * time.Second
+
+// When obfuscating keystroke timing, input is queued and sent every
+// KEYSTROKE_INTERVAL rather than as it's typed. While the user is
+// typing, and for COVER_DURATION after the last key, a message goes
+// out on every tick, empty if there's no input, so an observer can't
+// tell keystrokes from cover. Combined with padding (see
+// network.GConn.SetPadding), this costs ~20 datagrams of ~200 bytes
+// a second, or ~32kbit/s, while typing and adds up to
+// KEYSTROKE_INTERVAL of latency to each key. Idle sessions cost
+// nothing extra.
+const (
+	KEYSTROKE_INTERVAL = 50 * time.Millisecond
+	COVER_DURATION     = 2 * time.Second
+)
+
+// connStats is implemented by remotes that keep connection statistics
+// and accept round trip time samples from us. See network.GConn.
+type connStats interface {
+	Stats() network.Stats
+	AddRTTSample(time.Duration)
+}
+
+// rebinder is implemented by remotes that can replace their local
+// socket when the network changes. See network.GConn.
+type rebinder interface {
+	Rebind() error
+}
+
 type stmObj struct {
 	remote io.ReadWriter
 	term   *vt.Terminal
@@ -59,7 +190,41 @@ type stmObj struct {
 	remState, localState time.Time
 	lastSeenRem          time.Time
 	states               map[time.Time]*vt.Terminal
+	hist                 *fragmenter.Histories   // compression context for each state
+	remSrc               time.Time               // the source the remote reached remState from
+	sentAt               map[time.Time]time.Time // when we sent each state (server)
 	overlay              bool
+	streamComp           bool // compress diffs against those before them (server)
+
+	// Client roaming
+	netCh      <-chan struct{} // signals local network changes
+	roamMux    sync.Mutex
+	lastSent   time.Time // last send that should provoke a reply
+	hbSent     time.Time // outstanding path check heartbeat
+	hbRetried  bool      // hbSent is a retry
+	lastRebind time.Time
+	sendErrs   int // consecutive failed sends
+
+	// Keystroke timing obfuscation (client)
+	obfuscate bool
+	inMux     sync.Mutex
+	pending   []byte    // input waiting for the next tick
+	lastKey   time.Time // when input was last typed
+
+	gotDA bool        // we've seen the outer terminal's attributes (client)
+	gfx   vt.Graphics // the image protocols it understands (client)
+	// The outer terminal's colors, as they arrive and once we
+	// have them all (client).
+	colors     []*goshpb.PaletteColor
+	paletteID  atomic.Uint32 // the latest palette we've sent (client) or set (server)
+	paletteAck atomic.Uint32 // the latest palette the server acked (client)
+
+	// Images in transit
+	imgMux    sync.Mutex
+	imgOut    []*imageSend          // server
+	imgQueued map[uint64]bool       // server
+	imgIn     map[uint64]*imageRecv // client
+	imgDone   map[uint64]bool       // client
 }
 
 func new(remote io.ReadWriter, t *vt.Terminal, st uint8) *stmObj {
@@ -67,9 +232,14 @@ func new(remote io.ReadWriter, t *vt.Terminal, st uint8) *stmObj {
 		remote:     remote,
 		st:         st,
 		term:       t,
-		frag:       fragmenter.New(MAX_PACKET_SIZE),
+		frag:       fragmenter.New(fragSize(remote)),
 		states:     make(map[time.Time]*vt.Terminal),
+		hist:       fragmenter.NewHistories(),
+		sentAt:     make(map[time.Time]time.Time),
 		agentConns: make(map[uint32]net.Conn),
+		imgQueued:  make(map[uint64]bool),
+		imgIn:      make(map[uint64]*imageRecv),
+		imgDone:    make(map[uint64]bool),
 	}
 
 	// Always use a new, empty terminal for the initial zero
@@ -84,6 +254,15 @@ func new(remote io.ReadWriter, t *vt.Terminal, st uint8) *stmObj {
 	return s
 }
 
+// fragSize returns the amount of data we can put in each fragment
+// for the remote.
+func fragSize(remote io.ReadWriter) int {
+	if pm, ok := remote.(pathMTU); ok {
+		return pm.MaxPayload() - fragmenter.FRAGMENT_OVERHEAD
+	}
+	return MAX_PACKET_SIZE
+}
+
 func NewClient(remHost string, remote io.ReadWriter, t *vt.Terminal, sock net.Conn) *stmObj {
 	s := new(remote, t, CLIENT)
 	s.remHost = remHost
@@ -94,6 +273,32 @@ func NewClient(remHost string, remote io.ReadWriter, t *vt.Terminal, sock net.Co
 	return s
 }
 
+// NotifyNetworkChanges provides a channel that signals changes to
+// the local network, like addresses coming and going. Clients rebind
+// their socket when it fires. See network.AddrChanges.
+func (s *stmObj) NotifyNetworkChanges(ch <-chan struct{}) {
+	s.netCh = ch
+}
+
+// SetObfuscation turns keystroke timing obfuscation on or off for
+// clients. It must be called before Run.
+func (s *stmObj) SetObfuscation(on bool) {
+	s.obfuscate = on
+}
+
+// SetFEC turns forward error correction of what we send on or off.
+// See fragmenter.Fragger.SetFEC.
+func (s *stmObj) SetFEC(on bool) {
+	s.frag.SetFEC(on)
+}
+
+// SetStreamCompression turns compression of each diff against the
+// diffs before it on or off for servers. It only takes effect with
+// clients that advertise support. See fragmenter.History.
+func (s *stmObj) SetStreamCompression(on bool) {
+	s.streamComp = on
+}
+
 func NewServer(remote io.ReadWriter, t *vt.Terminal, sock net.Listener) *stmObj {
 	s := new(remote, t, SERVER)
 	s.remoteAgent = sock
@@ -107,6 +312,7 @@ func (s *stmObj) heartbeat() {
 	secs := 1
 	msg := fmt.Sprintf("%s last seen %%s. 'Ctrl-^ .' to exit.", s.remHost)
 
+	var lastRTT time.Time
 	for {
 		select {
 		case <-time.Tick(time.Second * time.Duration(secs)):
@@ -120,18 +326,48 @@ func (s *stmObj) heartbeat() {
 				}
 
 				slog.Debug("sending heartbeat")
-				err := s.sendPayload(s.buildPayload(goshpb.PayloadType_HEARTBEAT.Enum()))
+				err := s.sendHeartbeat()
 				if err != nil {
 					secs = max(secs*2, 64)
 				} else {
 					secs = 1
 				}
+			} else if now.Sub(lastRTT) > RTT_INTERVAL {
+				// Keep our round trip time estimate fresh
+				lastRTT = now
+				s.sendHeartbeat()
 			}
 			s.smux.Unlock()
 		}
 	}
 }
 
+// sendHeartbeat sends a heartbeat stamped with the current time. The
+// remote echoes the stamp in its ack, giving us a round trip time
+// sample.
+func (s *stmObj) sendHeartbeat() error {
+	msg := s.buildPayload(goshpb.PayloadType_HEARTBEAT.Enum())
+	msg.SetSent(tspb.New(time.Now()))
+	return s.sendPayload(msg)
+}
+
+// addRTT passes a round trip time sample to the remote, if it wants
+// them.
+func (s *stmObj) addRTT(d time.Duration) {
+	if cs, ok := s.remote.(connStats); ok {
+		cs.AddRTTSample(d)
+	}
+}
+
+// statsOverlay returns an overlay showing the connection statistics.
+func (s *stmObj) statsOverlay() []byte {
+	cs, ok := s.remote.(connStats)
+	if !ok {
+		return s.term.MakeOverlay("No connection statistics available")
+	}
+	return s.term.MakeOverlay(cs.Stats().String())
+}
+
 func (s *stmObj) sendPayload(msg *goshpb.Payload) error {
 	p, err := proto.Marshal(msg)
 	if err != nil {
@@ -154,13 +390,115 @@ func (s *stmObj) sendPayload(msg *goshpb.Payload) error {
 
 		if n, err := s.remote.Write(pf); err != nil || n < len(pf) {
 			slog.Error("failed or parial write to remote", "n", n, "err", err)
+			s.roamMux.Lock()
+			s.sendErrs += 1
+			s.roamMux.Unlock()
 			return err
 		}
 	}
 
+	s.roamMux.Lock()
+	s.sendErrs = 0
+	switch msg.GetType() {
+	case goshpb.PayloadType_CLIENT_INPUT:
+		// Cover traffic doesn't provoke a reply
+		if len(msg.GetData()) > 0 {
+			s.lastSent = time.Now()
+		}
+	case goshpb.PayloadType_WINDOW_RESIZE:
+		s.lastSent = time.Now()
+	}
+	s.roamMux.Unlock()
+
 	return nil
 }
 
+// handleRoaming watches for signs that the client's local network
+// changed underneath it and rebinds the remote's socket when it
+// does.
+func (s *stmObj) handleRoaming() {
+	rb, ok := s.remote.(rebinder)
+	if !ok {
+		return
+	}
+
+	tick := time.NewTicker(500 * time.Millisecond)
+	for {
+		if s.shutdown {
+			return
+		}
+
+		select {
+		case <-s.netCh:
+			s.rebind(rb, "Local network changed")
+		case <-tick.C:
+			now := time.Now()
+			seen := s.lastSeenRem
+
+			s.roamMux.Lock()
+			errs := s.sendErrs
+			if !s.hbSent.IsZero() && seen.After(s.hbSent) {
+				s.hbSent = time.Time{}
+			}
+			hbSent := s.hbSent
+			check := hbSent.IsZero() && s.lastSent.After(seen) && now.Sub(s.lastSent) > ROAM_QUIET
+			expired := !hbSent.IsZero() && now.Sub(hbSent) > ROAM_TIMEOUT
+			retry := expired && !s.hbRetried
+			if check || retry {
+				s.hbSent = now
+				s.hbRetried = retry
+			}
+			s.roamMux.Unlock()
+
+			switch {
+			case errs >= ROAM_SEND_ERRORS:
+				s.rebind(rb, "Network unreachable")
+			case retry:
+				slog.Debug("path check unanswered, retrying heartbeat")
+				s.sendHeartbeat()
+			case expired:
+				s.rebind(rb, "Server not responding")
+			case check:
+				slog.Debug("input unanswered, checking path with heartbeat")
+				s.sendHeartbeat()
+			}
+		}
+	}
+}
+
+// rebind replaces the local socket, letting the user know why via
+// the overlay. It's rate limited by ROAM_MIN_INTERVAL.
+func (s *stmObj) rebind(rb rebinder, why string) {
+	now := time.Now()
+
+	s.roamMux.Lock()
+	if now.Sub(s.lastRebind) < ROAM_MIN_INTERVAL {
+		s.roamMux.Unlock()
+		return
+	}
+	s.lastRebind = now
+	s.sendErrs = 0
+	// The heartbeat below checks the new path. If it goes
+	// unanswered, we'll try again.
+	s.hbSent = now
+	s.hbRetried = false
+	s.roamMux.Unlock()
+
+	slog.Info("rebinding local socket", "reason", why)
+	if err := rb.Rebind(); err != nil {
+		slog.Error("couldn't rebind local socket", "err", err)
+		return
+	}
+
+	s.smux.Lock()
+	os.Stdout.Write(s.term.MakeOverlay(fmt.Sprintf("%s; reconnecting to %s...", why, s.remHost)))
+	s.overlay = true
+	s.smux.Unlock()
+
+	// Let the server see us at our new address
+	s.sendHeartbeat()
+}
+
 func (s *stmObj) fragCleaner() {
 	tick := time.NewTicker(1 * time.Second)
 	for {
@@ -175,6 +513,81 @@ func (s *stmObj) fragCleaner() {
 	}
 }
 
+// discoverPathMTU drives path MTU probing when the remote supports
+// it, adjusting our fragment size as the usable size changes.
+func (s *stmObj) discoverPathMTU() {
+	pm, ok := s.remote.(pathMTU)
+	if !ok {
+		return
+	}
+
+	tick := time.NewTicker(250 * time.Millisecond)
+	for {
+		if s.shutdown {
+			break
+		}
+
+		select {
+		case <-tick.C:
+			// The remote may have reset discovery (eg:
+			// after roaming), so always resync.
+			s.updateFragSize()
+
+			// Until we've heard from the remote, we
+			// may not know where to send probes.
+			if s.lastSeenRem.IsZero() {
+				continue
+			}
+
+			if size, ok := pm.NextProbe(); ok {
+				if err := s.sendProbe(size); err != nil {
+					slog.Debug("couldn't send path mtu probe", "size", size, "err", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *stmObj) updateFragSize() {
+	if sz := fragSize(s.remote); sz != s.frag.Size() {
+		slog.Info("changing fragment size", "old", s.frag.Size(), "new", sz)
+		s.frag.SetSize(sz)
+	}
+}
+
+// sendProbe sends a single MTU_PROBE message padded so that it is
+// size bytes when written to the remote.
+func (s *stmObj) sendProbe(size int) error {
+	msg := s.buildPayload(goshpb.PayloadType_MTU_PROBE.Enum())
+	msg.SetProbeSize(uint32(size))
+
+	p, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frag := s.frag.Wrap(p)
+
+	// Varint lengths grow with the padding, so a couple of
+	// rounds may be needed to land on (or just over) size.
+	for pad := 0; proto.Size(frag) < size; {
+		pad += size - proto.Size(frag)
+		msg.SetData(make([]byte, pad))
+		if p, err = proto.Marshal(msg); err != nil {
+			return err
+		}
+		frag.SetData(p)
+	}
+
+	pf, err := proto.Marshal(frag)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("sending path mtu probe", "size", size)
+	_, err = s.remote.Write(pf)
+	return err
+}
+
 func (s *stmObj) shouldSend() bool {
 	// Only send if we've seen the remote side within the last
 	// minute or we think local state and remote state match or
@@ -184,8 +597,9 @@ func (s *stmObj) shouldSend() bool {
 }
 
 func (s *stmObj) Run() {
-	// This goroutine is leaked
+	// These goroutines are leaked
 	go s.fragCleaner()
+	go s.discoverPathMTU()
 
 	s.wg.Add(1)
 	go func() {
@@ -204,6 +618,14 @@ func (s *stmObj) Run() {
 
 		// leaked
 		go s.heartbeat()
+		go s.handleRoaming()
+		if s.obfuscate {
+			go s.sendKeystrokes()
+		}
+
+		// Ask the terminal what it can do. The replies arrive
+		// with the user's input, where handleInput finds them.
+		os.Stdout.Write([]byte(PALETTE_QUERY + KITTY_QUERY + DA1_QUERY))
 
 		// We don't try to gracefully shut this one down
 		// because it'll be blocked on a Read() and using
@@ -240,6 +662,8 @@ func (s *stmObj) Run() {
 
 			select {
 			case <-time.Tick(10 * time.Millisecond):
+				s.sendImages()
+
 				// We always source from the most
 				// recent known remote state for now.
 				// We can get into p-retransmission
@@ -262,15 +686,27 @@ func (s *stmObj) Run() {
 					if !ok {
 						slog.Error("couldn't retrieve expected state", "remState", s.remState)
 					} else {
-						diff := prevT.Diff(nowT)
+						td := prevT.StateDiff(nowT)
+						diff, err := proto.Marshal(td)
+						if err != nil {
+							slog.Error("couldn't marshal diff", "err", err)
+							s.smux.Unlock()
+							continue
+						}
 						msg := s.buildPayload(goshpb.PayloadType_SERVER_OUTPUT.Enum())
 
 						msg.SetSource(tspb.New(s.remState))
 						msg.SetTarget(tspb.New(ntm))
 						msg.SetRetire(tspb.New(s.remState))
 						msg.SetData(diff)
+						if h, ok := s.hist.Get(s.remSrc, s.remState); s.streamComp && ok {
+							s.compressDiff(msg, h)
+							s.hist.Add(s.remState, ntm, h.Extend(diff))
+						}
 						s.sendPayload(msg)
 						s.states[ntm] = nowT
+						s.sentAt[ntm] = time.Now()
+						s.queueImages(nowT, td)
 					}
 				}
 				s.smux.Unlock()
@@ -281,6 +717,28 @@ func (s *stmObj) Run() {
 	s.wg.Wait()
 }
 
+// compressDiff compresses the diff in msg against h, the history of
+// its source state, if the remote can decode it and it's smaller. We
+// only send diffs from states the remote has acked, and use the
+// history of the diff it told us it reached them by, so it will have
+// the same one.
+func (s *stmObj) compressDiff(msg *goshpb.Payload, h fragmenter.History) {
+	if !s.frag.PeerAccepts(goshpb.Codec_CODEC_DEFLATE_STREAM) {
+		return
+	}
+
+	diff := msg.GetData()
+	d, err := h.Compress(diff)
+	if err != nil {
+		slog.Error("couldn't compress diff", "err", err)
+		return
+	}
+	if len(d) < len(diff) {
+		msg.SetData(d)
+		msg.SetDataCodec(goshpb.Codec_CODEC_DEFLATE_STREAM)
+	}
+}
+
 func (s *stmObj) Shutdown() {
 	// Likely a race, but this is ok anyway, as the worst that
 	// happens is errors trying to close closed objects, etc.
@@ -417,25 +875,174 @@ func (s *stmObj) handleInput() {
 			continue
 		}
 
+		in := char[:n]
+		if !s.gotDA {
+			if in = s.takeDA(in); len(in) == 0 {
+				continue
+			}
+		}
+
 		if inEsc {
-			switch char[0] {
+			switch in[0] {
 			case '.':
 				s.Shutdown()
 				return
+			case 's':
+				s.smux.Lock()
+				os.Stdout.Write(s.statsOverlay())
+				s.overlay = true
+				s.smux.Unlock()
+				inEsc = false
+				continue
 			default:
-				msg.SetData(char[:n])
+				msg.SetData(in)
 				inEsc = false
 			}
 		} else {
 
-			switch char[0] {
+			switch in[0] {
 			case '\x1e':
 				inEsc = true
 				continue // Don't immediately send this
 			default:
-				msg.SetData(char[:n])
+				msg.SetData(in)
+			}
+		}
+
+		if s.obfuscate {
+			s.inMux.Lock()
+			s.pending = append(s.pending, msg.GetData()...)
+			s.lastKey = time.Now()
+			s.inMux.Unlock()
+			continue
+		}
+		s.sendPayload(msg)
+	}
+}
+
+// takeDA looks for the outer terminal's replies to PALETTE_QUERY,
+// KITTY_QUERY and DA1_QUERY in the input, telling our terminal which
+// image protocols it can paint with, and the server its colors, once
+// we have them all. It returns the input without them.
+func (s *stmObj) takeDA(in []byte) []byte {
+	for {
+		m := paletteReply.FindSubmatchIndex(in)
+		if m == nil {
+			break
+		}
+		idx := vt.PALETTE_FG
+		switch name := string(in[m[2]:m[3]]); name {
+		case "11":
+			idx = vt.PALETTE_BG
+		case "12":
+			idx = vt.PALETTE_CURSOR
+		default:
+			if n, ok := strings.CutPrefix(name, "4;"); ok {
+				idx, _ = strconv.Atoi(n)
 			}
 		}
+		if pc, ok := vt.PaletteColor(idx, string(in[m[4]:m[5]])); ok {
+			s.colors = append(s.colors, pc)
+		}
+		in = append(in[:m[0]:m[0]], in[m[1]:]...)
+	}
+
+	if m := kittyReply.FindSubmatchIndex(in); m != nil {
+		if string(in[m[2]:m[3]]) == "OK" {
+			s.gfx |= vt.GRAPHICS_KITTY
+		}
+		in = append(in[:m[0]:m[0]], in[m[1]:]...)
+	}
+
+	m := da1Reply.FindSubmatchIndex(in)
+	if m == nil {
+		return in
+	}
+	s.gotDA = true
+
+	attrs := string(in[m[2]:m[3]])
+	if slices.Contains(strings.Split(attrs, ";"), DA1_SIXEL) {
+		s.gfx |= vt.GRAPHICS_SIXEL
+	}
+	// iTerm2's inline images can't be asked about, so we go by
+	// what it, and others that copy it, tell programs.
+	if tp := os.Getenv("TERM_PROGRAM"); tp == "iTerm.app" || tp == "WezTerm" || os.Getenv("LC_TERMINAL") == "iTerm2" {
+		s.gfx |= vt.GRAPHICS_ITERM2
+	}
+	ul, rep := styledUnderlines(s.gfx), repeatRunes()
+	slog.Debug("outer terminal attributes", "attrs", attrs, "graphics", s.gfx, "styled underlines", ul, "rep", rep)
+	s.term.SetGraphics(s.gfx)
+	s.term.SetStyledUnderlines(ul)
+	s.term.SetRepeat(rep)
+	if len(s.colors) > 0 {
+		go s.sendPalette(goshpb.Palette_builder{
+			Colors: s.colors,
+			Id:     proto.Uint32(s.paletteID.Add(1)),
+		}.Build())
+	}
+
+	return append(in[:m[0]:m[0]], in[m[1]:]...)
+}
+
+// sendPalette tells the server the outer terminal's colors, resending
+// them until it acks them or we have newer ones to send.
+func (s *stmObj) sendPalette(p *goshpb.Palette) {
+	tick := time.NewTicker(PALETTE_RETRY)
+	defer tick.Stop()
+
+	id := p.GetId()
+	for !s.shutdown && s.paletteAck.Load() != id && s.paletteID.Load() == id {
+		msg := s.buildPayload(goshpb.PayloadType_PALETTE.Enum())
+		msg.SetPalette(p)
+		s.sendPayload(msg)
+		<-tick.C
+	}
+}
+
+// styledUnderlines returns whether the outer terminal is known to
+// understand underline styles and colors. There's no way to ask, but
+// those with kitty graphics all do, and the rest we know by name.
+func styledUnderlines(gfx vt.Graphics) bool {
+	return gfx&vt.GRAPHICS_KITTY != 0 || outerSupports(STYLED_UL_TERMS, STYLED_UL_PROGRAMS)
+}
+
+// repeatRunes returns whether the outer terminal is known to
+// understand REP. There's no way to ask, and those that don't leave
+// the repeated cells unpainted, so we only use it with those we know
+// by name.
+func repeatRunes() bool {
+	return os.Getenv("XTERM_VERSION") != "" || os.Getenv("WT_SESSION") != "" || outerSupports(REP_TERMS, REP_PROGRAMS)
+}
+
+// outerSupports returns whether the outer terminal is one of terms,
+// by $TERM, or programs, by $TERM_PROGRAM, or at least MIN_VTE.
+func outerSupports(terms, programs []string) bool {
+	if slices.Contains(terms, os.Getenv("TERM")) || slices.Contains(programs, os.Getenv("TERM_PROGRAM")) {
+		return true
+	}
+	v, err := strconv.Atoi(os.Getenv("VTE_VERSION"))
+	return err == nil && v >= MIN_VTE
+}
+
+// sendKeystrokes sends queued input on a fixed cadence, with cover
+// traffic while the user is typing. See KEYSTROKE_INTERVAL.
+func (s *stmObj) sendKeystrokes() {
+	tick := time.NewTicker(KEYSTROKE_INTERVAL)
+	for range tick.C {
+		if s.shutdown {
+			return
+		}
+
+		s.inMux.Lock()
+		if len(s.pending) == 0 && time.Since(s.lastKey) > COVER_DURATION {
+			s.inMux.Unlock()
+			continue
+		}
+		msg := s.buildPayload(goshpb.PayloadType_CLIENT_INPUT.Enum())
+		msg.SetData(s.pending)
+		s.pending = nil
+		s.inMux.Unlock()
+
 		s.sendPayload(msg)
 	}
 }
@@ -466,23 +1073,50 @@ func (s *stmObj) consumePayload(id uint32) {
 	switch msg.GetType() {
 	case goshpb.PayloadType_HEARTBEAT:
 		slog.Debug("received heartbeat")
-		msg := s.buildPayload(goshpb.PayloadType_HEARTBEAT_ACK.Enum())
-		msg.SetReceived(tspb.New(time.Now()))
-		s.sendPayload(msg)
+		ack := s.buildPayload(goshpb.PayloadType_HEARTBEAT_ACK.Enum())
+		ack.SetReceived(tspb.New(time.Now()))
+		if msg.HasSent() {
+			ack.SetSent(msg.GetSent())
+		}
+		s.sendPayload(ack)
 		slog.Debug("sent heartbeat ack")
 	case goshpb.PayloadType_HEARTBEAT_ACK:
 		slog.Debug("received heartbeat ack")
+		if msg.HasSent() {
+			s.addRTT(time.Since(msg.GetSent().AsTime()))
+		}
+	case goshpb.PayloadType_MTU_PROBE:
+		ack := s.buildPayload(goshpb.PayloadType_MTU_PROBE_ACK.Enum())
+		ack.SetProbeSize(msg.GetProbeSize())
+		s.sendPayload(ack)
+	case goshpb.PayloadType_MTU_PROBE_ACK:
+		if pm, ok := s.remote.(pathMTU); ok && pm.ProbeAcked(int(msg.GetProbeSize())) {
+			s.updateFragSize()
+		}
 	case goshpb.PayloadType_ACK:
 		rt := msg.GetReceived().AsTime()
 		slog.Debug("received ack", "time", rt)
 		s.smux.Lock()
+		if sent, ok := s.sentAt[rt]; ok {
+			s.addRTT(time.Since(sent))
+		}
 		s.remState = rt
+		s.remSrc = time.Time{}
+		if msg.HasSource() {
+			s.remSrc = msg.GetSource().AsTime()
+		}
 		for k := range s.states {
 			if k.Before(rt) {
 				delete(s.states, k)
 				slog.Debug("removing state", "k", k)
 			}
 		}
+		s.hist.Retire(rt)
+		for k := range s.sentAt {
+			if !k.After(rt) {
+				delete(s.sentAt, k)
+			}
+		}
 		s.smux.Unlock()
 	case goshpb.PayloadType_SHUTDOWN:
 		slog.Debug("remote initiated shutdown")
@@ -496,8 +1130,29 @@ func (s *stmObj) consumePayload(id uint32) {
 		sz := msg.GetSize()
 		rows, cols := sz.GetRows(), sz.GetCols()
 		s.term.Resize(int(rows), int(cols))
+	case goshpb.PayloadType_PALETTE:
+		p := msg.GetPalette()
+		// Resends, and older palettes arriving late, are only
+		// acked.
+		if id := p.GetId(); id > s.paletteID.Load() {
+			if err := s.term.SetPalette(p); err != nil {
+				slog.Error("couldn't set palette", "err", err)
+				return
+			}
+			s.paletteID.Store(id)
+		}
+		ack := s.buildPayload(goshpb.PayloadType_PALETTE_ACK.Enum())
+		ack.SetPalette(goshpb.Palette_builder{Id: proto.Uint32(p.GetId())}.Build())
+		s.sendPayload(ack)
+	case goshpb.PayloadType_PALETTE_ACK:
+		slog.Debug("palette acked", "id", msg.GetPalette().GetId())
+		s.paletteAck.Store(msg.GetPalette().GetId())
 	case goshpb.PayloadType_SERVER_OUTPUT:
 		s.applyState(&msg)
+	case goshpb.PayloadType_IMAGE_DATA:
+		s.receiveImage(msg.GetChunk())
+	case goshpb.PayloadType_IMAGE_ACK:
+		s.imageAcked(msg.GetChunk())
 	case goshpb.PayloadType_SSH_AGENT_RESPONSE:
 		id := msg.GetAuthid()
 		c, ok := s.agentConns[id]
@@ -553,33 +1208,57 @@ func (s *stmObj) applyState(msg *goshpb.Payload) {
 		return
 	}
 
+	base, _ := s.hist.Source(src)
+	h, hok := s.hist.Get(base, src)
 	diff := msg.GetData()
+	switch c := msg.GetDataCodec(); c {
+	case goshpb.Codec_CODEC_NONE:
+	case goshpb.Codec_CODEC_DEFLATE_STREAM:
+		d, err := h.Decompress(diff)
+		if !hok {
+			err = fmt.Errorf("no history for state %s", src)
+		}
+		if err != nil {
+			s.refuseStream(err)
+			return
+		}
+		diff = d
+	default:
+		slog.Error("unknown diff codec", "codec", c)
+		return
+	}
+
 	// We never want to mutate a stored state because we
 	// might need to use it in the future if we recieve
 	// additional diffs that build on this one. This can
 	// happen because of a dropped ACK or because the
 	// server decides to make a diff to an older state
 	// instead of a more recent one, etc.
+	var td goshpb.TermDiff
+	if err := proto.Unmarshal(diff, &td); err != nil {
+		slog.Error("couldn't unmarshal diff", "err", err)
+		if msg.GetDataCodec() == goshpb.Codec_CODEC_DEFLATE_STREAM {
+			s.refuseStream(err)
+		}
+		return
+	}
 	targT := srcT.ForceCopy()
-	n, err := targT.Write(diff)
-	if err != nil || n != len(diff) {
-		slog.Error("error applying diff", "err", err, "n", n)
+	if err := targT.ApplyDiff(&td); err != nil {
+		slog.Error("error applying diff", "err", err)
 		return
 	}
 
-	// In case we are applying the server side diff to a
-	// state we consider older than our current state, to
-	// bring it up to the current server side, we need to
-	// diff current with target and write that to stdout
-	// for the final display.
-	if s.localState.After(src) {
-		stdDiff := s.term.Diff(targT)
-		os.Stdout.Write(stdDiff)
-	} else {
-		os.Stdout.Write(diff)
-	}
+	// The diff may be from a state older than the one we're
+	// displaying, so we paint the difference between what's
+	// on screen and the target, not the diff itself.
+	os.Stdout.Write(s.term.Diff(targT))
 
 	s.states[targ] = targT
+	// Only the first diff to reach targ sets its history. See
+	// fragmenter.Histories.
+	if _, ok := s.hist.Source(targ); !ok && hok {
+		s.hist.Add(src, targ, h.Extend(diff))
+	}
 	s.term.Replace(targT)
 	s.ack(targ)
 
@@ -592,18 +1271,171 @@ func (s *stmObj) applyState(msg *goshpb.Payload) {
 			delete(s.states, k)
 		}
 	}
+	s.hist.Retire(msg.GetRetire().AsTime())
+}
+
+// refuseStream handles a diff compressed against its history that we
+// couldn't decode. Our history can't match the server's, and every
+// diff that follows would fail too, so we stop accepting them.
+func (s *stmObj) refuseStream(err error) {
+	slog.Error("couldn't decompress diff, refusing compressed diffs", "err", err)
+	s.frag.Refuse(goshpb.Codec_CODEC_DEFLATE_STREAM)
+}
+
+// queueImages starts sending the pixels of the images placed by td,
+// a diff to t, that we haven't sent already. Only images the diff's
+// source state doesn't have carry their size.
+func (s *stmObj) queueImages(t *vt.Terminal, td *goshpb.TermDiff) {
+	s.imgMux.Lock()
+	defer s.imgMux.Unlock()
+
+	for _, pi := range td.GetImages() {
+		id := pi.GetId()
+		if pi.GetRows() == 0 || s.imgQueued[id] {
+			continue
+		}
+		data, ok := t.ImageData(id)
+		if !ok {
+			slog.Error("couldn't retrieve image", "id", id)
+			continue
+		}
+		s.imgQueued[id] = true
+
+		var chunks [][]byte
+		for len(data) > 0 {
+			n := min(len(data), IMAGE_CHUNK_SIZE)
+			chunks = append(chunks, data[:n])
+			data = data[n:]
+		}
+		s.imgOut = append(s.imgOut, &imageSend{
+			id:     id,
+			chunks: chunks,
+			sent:   make([]time.Time, len(chunks)),
+			acked:  make([]bool, len(chunks)),
+			left:   len(chunks),
+		})
+	}
+}
+
+// sendImages sends the image chunks that are due, oldest image first,
+// keeping no more than IMAGE_WINDOW of them unacked.
+func (s *stmObj) sendImages() {
+	s.imgMux.Lock()
+	defer s.imgMux.Unlock()
+
+	now := time.Now()
+	due := func(is *imageSend, i int) bool {
+		return !is.acked[i] && now.Sub(is.sent[i]) >= IMAGE_RETRY
+	}
+
+	inFlight := 0
+	for _, is := range s.imgOut {
+		for i := range is.chunks {
+			if !is.acked[i] && !due(is, i) {
+				inFlight++
+			}
+		}
+	}
+
+	for _, is := range s.imgOut {
+		for i, c := range is.chunks {
+			if inFlight >= IMAGE_WINDOW {
+				return
+			}
+			if !due(is, i) {
+				continue
+			}
+
+			msg := s.buildPayload(goshpb.PayloadType_IMAGE_DATA.Enum())
+			msg.SetChunk(goshpb.ImageChunk_builder{
+				Id:    proto.Uint64(is.id),
+				Index: proto.Uint32(uint32(i)),
+				Total: proto.Uint32(uint32(len(is.chunks))),
+				Data:  c,
+			}.Build())
+			s.sendPayload(msg)
+			is.sent[i] = now
+			inFlight++
+		}
+	}
+}
+
+// imageAcked notes that the client has an image chunk, and stops
+// sending images it has all of.
+func (s *stmObj) imageAcked(c *goshpb.ImageChunk) {
+	s.imgMux.Lock()
+	defer s.imgMux.Unlock()
+
+	for i, is := range s.imgOut {
+		if is.id != c.GetId() {
+			continue
+		}
+		if idx := int(c.GetIndex()); idx < len(is.chunks) && !is.acked[idx] {
+			is.acked[idx] = true
+			is.left -= 1
+		}
+		if is.left == 0 {
+			s.imgOut = slices.Delete(s.imgOut, i, i+1)
+		}
+		return
+	}
+}
+
+// receiveImage acks an image chunk from the server and, once we have
+// the whole image, draws it wherever it's already been placed.
+func (s *stmObj) receiveImage(c *goshpb.ImageChunk) {
+	id, idx, total := c.GetId(), int(c.GetIndex()), int(c.GetTotal())
+	if total == 0 || total > vt.MAX_IMAGE_BYTES/IMAGE_CHUNK_SIZE+1 || idx >= total {
+		slog.Error("invalid image chunk", "id", id, "index", idx, "total", total)
+		return
+	}
+
+	ack := s.buildPayload(goshpb.PayloadType_IMAGE_ACK.Enum())
+	ack.SetChunk(goshpb.ImageChunk_builder{
+		Id:    proto.Uint64(id),
+		Index: proto.Uint32(uint32(idx)),
+	}.Build())
+	s.sendPayload(ack)
+
+	if s.imgDone[id] {
+		return
+	}
+	ir, ok := s.imgIn[id]
+	if !ok {
+		ir = &imageRecv{chunks: make([][]byte, total)}
+		s.imgIn[id] = ir
+	}
+	if len(ir.chunks) != total || ir.chunks[idx] != nil {
+		return
+	}
+	ir.chunks[idx] = c.GetData()
+	ir.got += 1
+	if ir.got < total {
+		return
+	}
+
+	delete(s.imgIn, id)
+	s.imgDone[id] = true
+	if err := s.term.AddImage(id, slices.Concat(ir.chunks...)); err != nil {
+		slog.Error("couldn't decode image", "id", id, "err", err)
+		return
+	}
+	os.Stdout.Write(s.term.PaintImage(id))
 }
 
 func (s *stmObj) ack(t time.Time) {
 	s.localState = t
 	msg := s.buildPayload(goshpb.PayloadType_ACK.Enum())
 	msg.SetReceived(tspb.New(t))
+	if src, ok := s.hist.Source(t); ok {
+		msg.SetSource(tspb.New(src))
+	}
 	s.sendPayload(msg)
 	slog.Debug("sent ack", "time", t)
 }
 
 func (s *stmObj) handleRemote() {
-	buf := make([]byte, 2048)
+	buf := make([]byte, READ_BUFFER_SIZE)
 	for {
 		if s.shutdown {
 			return
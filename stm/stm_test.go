@@ -0,0 +1,117 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package stm
+
+import (
+	"os"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"github.com/bdwalton/gosh/vt"
+	"google.golang.org/protobuf/proto"
+)
+
+// pipe is one end of an in-memory connection. The next lose writes
+// are dropped.
+type pipe struct {
+	in, out chan []byte
+	lose    *atomic.Int32
+}
+
+func newPipes() (pipe, pipe) {
+	a, b := make(chan []byte, 64), make(chan []byte, 64)
+	return pipe{a, b, &atomic.Int32{}}, pipe{b, a, &atomic.Int32{}}
+}
+
+func (p pipe) Read(buf []byte) (int, error) {
+	select {
+	case m := <-p.in:
+		return copy(buf, m), nil
+	case <-time.After(10 * time.Millisecond):
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (p pipe) Write(buf []byte) (int, error) {
+	if p.lose.Add(-1) >= 0 {
+		return len(buf), nil
+	}
+	p.out <- slices.Clone(buf)
+	return len(buf), nil
+}
+
+// waitFor returns true once cond does, or false after a while.
+func waitFor(cond func() bool) bool {
+	end := time.Now().Add(3 * PALETTE_RETRY)
+	for time.Now().Before(end) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSendPalette(t *testing.T) {
+	cp, sp := newPipes()
+	ct, _ := vt.NewTerminal(10, 20)
+	st, _ := vt.NewTerminal(10, 20)
+	cl, srv := new(cp, ct, CLIENT), new(sp, st, SERVER)
+	go cl.handleRemote()
+	go srv.handleRemote()
+	defer func() {
+		cl.shutdown = true
+		srv.shutdown = true
+	}()
+
+	palette := func(id uint32, spec string) *goshpb.Palette {
+		pc, _ := vt.PaletteColor(vt.PALETTE_BG, spec)
+		return goshpb.Palette_builder{
+			Colors: []*goshpb.PaletteColor{pc},
+			Id:     proto.Uint32(id),
+		}.Build()
+	}
+
+	// The first is lost, so it's resent until acked.
+	cp.lose.Store(1)
+	cl.paletteID.Store(1)
+	done := make(chan struct{})
+	go func() {
+		cl.sendPalette(palette(1, "#000000"))
+		close(done)
+	}()
+	if !waitFor(func() bool { return cl.paletteAck.Load() == 1 }) {
+		t.Fatalf("Got ack for palette %d, wanted 1", cl.paletteAck.Load())
+	}
+	if got := srv.paletteID.Load(); got != 1 {
+		t.Errorf("Got palette %d on the server, wanted 1", got)
+	}
+	<-done
+
+	// A newer palette is sent, despite the older one's ack, and
+	// stops the sending of the one before it.
+	cl.paletteID.Store(2)
+	sp.lose.Store(1)
+	go cl.sendPalette(palette(2, "#ffffff"))
+	go cl.sendPalette(palette(1, "#000000"))
+	if !waitFor(func() bool { return cl.paletteAck.Load() == 2 }) {
+		t.Fatalf("Got ack for palette %d, wanted 2", cl.paletteAck.Load())
+	}
+	if got := srv.paletteID.Load(); got != 2 {
+		t.Errorf("Got palette %d on the server, wanted 2", got)
+	}
+
+	// An older one arriving late is acked but not set.
+	msg := cl.buildPayload(goshpb.PayloadType_PALETTE.Enum())
+	msg.SetPalette(palette(1, "#000000"))
+	cl.sendPayload(msg)
+	if !waitFor(func() bool { return cl.paletteAck.Load() == 1 }) {
+		t.Fatalf("Got ack for palette %d, wanted 1", cl.paletteAck.Load())
+	}
+	if got := srv.paletteID.Load(); got != 2 {
+		t.Errorf("Got palette %d on the server after a late one, wanted 2", got)
+	}
+}
@@ -2,28 +2,114 @@
 // All rights reserved.
 package vt
 
+import (
+	"log/slog"
+	"strings"
+)
+
+// glyphSet is a character set that can be designated as one of G0
+// through G3. The zero value is US ASCII.
+type glyphSet uint8
+
+const (
+	CS_ASCII          glyphSet = iota
+	CS_DEC_SPECIAL             // DEC special graphics (line drawing)
+	CS_DEC_SUPPLEMENT          // DEC supplemental graphics
+	CS_DEC_TECHNICAL           // DEC technical
+	CS_LATIN1                  // ISO Latin-1 supplemental, a 96 character set
+	CS_UK                      // the national replacement character sets
+	CS_DUTCH
+	CS_FINNISH
+	CS_FRENCH
+	CS_FRENCH_CANADIAN
+	CS_GERMAN
+	CS_ITALIAN
+	CS_NORWEGIAN_DANISH
+	CS_PORTUGUESE
+	CS_SPANISH
+	CS_SWEDISH
+	CS_SWISS
+)
+
+// The intermediates that designate a set as G0 through G3. Sets of
+// 96 characters can't be G0.
+const (
+	SCS_94 = "()*+"
+	SCS_96 = "-./"
+)
+
+// charsets94 and charsets96 map the final characters of a
+// designation, including any intermediates after the first, to the
+// set they name.
+var charsets94 = map[string]glyphSet{
+	"B":  CS_ASCII,
+	"1":  CS_ASCII, // alternate ROM
+	"0":  CS_DEC_SPECIAL,
+	"2":  CS_DEC_SPECIAL, // alternate ROM, special graphics
+	"<":  CS_DEC_SUPPLEMENT,
+	"%5": CS_DEC_SUPPLEMENT,
+	">":  CS_DEC_TECHNICAL,
+	"A":  CS_UK,
+	"4":  CS_DUTCH,
+	"C":  CS_FINNISH,
+	"5":  CS_FINNISH,
+	"R":  CS_FRENCH,
+	"f":  CS_FRENCH,
+	"Q":  CS_FRENCH_CANADIAN,
+	"9":  CS_FRENCH_CANADIAN,
+	"K":  CS_GERMAN,
+	"Y":  CS_ITALIAN,
+	"E":  CS_NORWEGIAN_DANISH,
+	"6":  CS_NORWEGIAN_DANISH,
+	"`":  CS_NORWEGIAN_DANISH,
+	"%6": CS_PORTUGUESE,
+	"Z":  CS_SPANISH,
+	"H":  CS_SWEDISH,
+	"7":  CS_SWEDISH,
+	"=":  CS_SWISS,
+}
+
+var charsets96 = map[string]glyphSet{
+	"A": CS_LATIN1,
+}
+
 type charset struct {
-	// index into g. toggled for shift in/out
-	set uint8
-	// glyphs (g0, g1) // false means 'B' (US ASCII; default),
-	// true means '0' (DEC Special line drawing)
-	g [2]bool
+	// which of g is invoked into GL by the locking shifts: SI
+	// and SO for G0 and G1, LS2 and LS3 for G2 and G3.
+	gl uint8
+	// which of g a single shift, SS2 or SS3, picked for the next
+	// character, or 0 if none.
+	ss uint8
+	// the sets designated as G0 through G3.
+	g [4]glyphSet
 }
 
 func (c *charset) copy() *charset {
-	return &charset{
-		set: c.set,
-		g:   c.g,
-	}
+	nc := *c
+	return &nc
 }
 
 func (c *charset) equal(other *charset) bool {
-	return c.set == other.set && c.g[0] == other.g[0] && c.g[1] == other.g[1]
+	return *c == *other
 }
 
+// runeFor returns what r shows as in the set a single shift picked,
+// or otherwise the one invoked into GL. Any single shift is used up.
 func (c *charset) runeFor(r rune) rune {
-	if c.g[c.set] {
-		if rr, ok := acs[r]; ok {
+	set := c.gl
+	if c.ss != 0 {
+		set, c.ss = c.ss, 0
+	}
+
+	switch gs := c.g[set]; {
+	case r < 0x20 || r > 0x7e:
+		// Not in GL, so not translated.
+	case gs == CS_LATIN1:
+		if r != ' ' {
+			return r + 0x80
+		}
+	default:
+		if rr, ok := glyphs[gs][r]; ok {
 			return rr
 		}
 	}
@@ -32,27 +118,83 @@ func (c *charset) runeFor(r rune) rune {
 }
 
 func (c *charset) shiftIn() {
-	c.set = 0
+	c.gl = 0
 }
 
 func (c *charset) shiftOut() {
-	c.set = 1
+	c.gl = 1
+}
+
+// lockingShift invokes gn into GL until the next locking shift.
+func (c *charset) lockingShift(gn uint8) {
+	c.gl = gn
 }
 
+// singleShift invokes gn for the next character only.
+func (c *charset) singleShift(gn uint8) {
+	c.ss = gn
+}
+
+// setCS designates a set as G0 through G3. s holds the intermediates
+// of the ESC sequence, the first of which says which G set and
+// whether a 94 or 96 character set is wanted, and r is its final
+// character. Sets we don't know leave the G set as it was.
 func (c *charset) setCS(s string, r rune) {
-	gset, val := 0, false // set g0 to 'B' (US ASCII) by default
-	if s == ")" {
-		gset = 1
+	if len(s) == 0 {
+		return
 	}
-	if r == '0' {
-		val = true
+
+	name := s[1:] + string(r)
+	var gn int
+	var gs glyphSet
+	var ok bool
+	if gn = strings.IndexByte(SCS_94, s[0]); gn >= 0 {
+		gs, ok = charsets94[name]
+	} else if gn = strings.IndexByte(SCS_96, s[0]); gn >= 0 {
+		gn += 1
+		gs, ok = charsets96[name]
 	}
 
-	c.g[gset] = val
+	if !ok {
+		slog.Debug("unsupported character set designation", "intermediates", s, "final", string(r))
+		return
+	}
+	c.g[gn] = gs
+}
+
+// glyphs maps from the natural character set into what each set shows
+// for it. Characters that aren't listed show as themselves.
+var glyphs = map[glyphSet]map[rune]rune{
+	CS_DEC_SPECIAL:      acs,
+	CS_DEC_SUPPLEMENT:   decSupplement,
+	CS_DEC_TECHNICAL:    decTechnical,
+	CS_UK:               {'#': '£'},
+	CS_DUTCH:            nrcs("#@[\\]{|}~", "£¾ĳ½|¨ƒ¼´"),
+	CS_FINNISH:          nrcs("[\\]^`{|}~", "ÄÖÅÜéäöåü"),
+	CS_FRENCH:           nrcs("#@[\\]{|}~", "£à°ç§éùè¨"),
+	CS_FRENCH_CANADIAN:  nrcs("@[\\]^`{|}~", "àâçêîôéùèû"),
+	CS_GERMAN:           nrcs("@[\\]{|}~", "§ÄÖÜäöüß"),
+	CS_ITALIAN:          nrcs("#@[\\]`{|}~", "£§°çéùàòèì"),
+	CS_NORWEGIAN_DANISH: nrcs("@[\\]^`{|}~", "ÄÆØÅÜäæøåü"),
+	CS_PORTUGUESE:       nrcs("[\\]{|}", "ÃÇÕãçõ"),
+	CS_SPANISH:          nrcs("#@[\\]{|}", "£§¡Ñ¿°ñç"),
+	CS_SWEDISH:          nrcs("@[\\]^`{|}~", "ÉÄÖÅÜéäöåü"),
+	CS_SWISS:            nrcs("#@[\\]^_`{|}~", "ùàéçêîèôäöüû"),
+}
+
+// nrcs builds the map for a national replacement character set,
+// which replaces the characters in from, in order, with those in to.
+func nrcs(from, to string) map[rune]rune {
+	tr := []rune(to)
+	m := make(map[rune]rune, len(from))
+	for i, r := range []rune(from) {
+		m[r] = tr[i]
+	}
+	return m
 }
 
 // This maps from the natural character set into the "B" character
-// set. We only support ESC {),(} {0,B} for alternate charset handling
+// set for DEC special graphics.
 var acs = map[rune]rune{
 	'+': '→',
 	',': '←',
@@ -91,3 +233,104 @@ var acs = map[rune]rune{
 	'}': '£',
 	'~': '·',
 }
+
+// DEC supplemental graphics is ISO Latin-1 in the upper half, apart
+// from a few characters. The positions DEC left reserved show as
+// themselves.
+var decSupplement = func() map[rune]rune {
+	m := make(map[rune]rune)
+	for r := rune(0x21); r <= 0x7e; r++ {
+		if !strings.ContainsRune("$&,-./48>P^p~", r) {
+			m[r] = r + 0x80
+		}
+	}
+	m['('] = '¤'
+	m['W'] = 'Œ'
+	m[']'] = 'Ÿ'
+	m['w'] = 'œ'
+	m['}'] = 'ÿ'
+	return m
+}()
+
+// DEC technical, as xterm shows it. The pieces of large brackets and
+// signs it has no Unicode equivalent for show as themselves.
+var decTechnical = map[rune]rune{
+	'!':  '⎷',
+	'"':  '┌',
+	'#':  '─',
+	'$':  '⌠',
+	'%':  '⌡',
+	'&':  '│',
+	'\'': '⎡',
+	'(':  '⎣',
+	')':  '⎤',
+	'*':  '⎦',
+	'+':  '⎛',
+	',':  '⎝',
+	'-':  '⎞',
+	'.':  '⎠',
+	'/':  '⎨',
+	'0':  '⎬',
+	'<':  '≤',
+	'=':  '≠',
+	'>':  '≥',
+	'?':  '∫',
+	'@':  '∴',
+	'A':  '∝',
+	'B':  '∞',
+	'C':  '÷',
+	'D':  'Δ',
+	'E':  '∇',
+	'F':  'Φ',
+	'G':  'Γ',
+	'H':  '∼',
+	'I':  '≃',
+	'J':  'Θ',
+	'K':  '×',
+	'L':  'Λ',
+	'M':  '⇔',
+	'N':  '⇒',
+	'O':  '≡',
+	'P':  'Π',
+	'Q':  'Ψ',
+	'S':  'Σ',
+	'V':  '√',
+	'W':  'Ω',
+	'X':  'Ξ',
+	'Y':  'Υ',
+	'Z':  '⊂',
+	'[':  '⊃',
+	'\\': '∩',
+	']':  '∪',
+	'^':  '∧',
+	'_':  '∨',
+	'`':  '¬',
+	'a':  'α',
+	'b':  'β',
+	'c':  'χ',
+	'd':  'δ',
+	'e':  'ε',
+	'f':  'φ',
+	'g':  'γ',
+	'h':  'η',
+	'i':  'ι',
+	'j':  'θ',
+	'k':  'κ',
+	'l':  'λ',
+	'n':  'ν',
+	'o':  '∂',
+	'p':  'π',
+	'q':  'ψ',
+	'r':  'ρ',
+	's':  'σ',
+	't':  'τ',
+	'v':  'ƒ',
+	'w':  'ω',
+	'x':  'ξ',
+	'y':  'υ',
+	'z':  'ζ',
+	'{':  '←',
+	'|':  '↑',
+	'}':  '→',
+	'~':  '↓',
+}
@@ -3,6 +3,7 @@
 package vt
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -12,10 +13,12 @@ func TestCharsetEqual(t *testing.T) {
 		want     bool
 	}{
 		{&charset{}, &charset{}, true},
-		{&charset{set: 1}, &charset{}, false},
-		{&charset{g: [2]bool{true, false}}, &charset{g: [2]bool{false, true}}, false},
-		{&charset{g: [2]bool{true, false}}, &charset{g: [2]bool{true, false}}, true},
-		{&charset{set: 1, g: [2]bool{true, false}}, &charset{set: 1, g: [2]bool{true, false}}, true},
+		{&charset{gl: 1}, &charset{}, false},
+		{&charset{ss: 2}, &charset{}, false},
+		{&charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, &charset{g: [4]glyphSet{CS_ASCII, CS_DEC_SPECIAL}}, false},
+		{&charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, true},
+		{&charset{gl: 1, g: [4]glyphSet{CS_DEC_SPECIAL}}, &charset{gl: 1, g: [4]glyphSet{CS_DEC_SPECIAL}}, true},
+		{&charset{g: [4]glyphSet{3: CS_UK}}, &charset{g: [4]glyphSet{3: CS_GERMAN}}, false},
 	}
 
 	for i, c := range cases {
@@ -32,12 +35,24 @@ func TestSetCS(t *testing.T) {
 		csv   rune
 		want  *charset
 	}{
-		{&charset{}, ")", '0', &charset{g: [2]bool{false, true}}},
-		{&charset{}, "(", '0', &charset{g: [2]bool{true, false}}},
-		{&charset{g: [2]bool{true, false}}, "(", '0', &charset{g: [2]bool{true, false}}},
-		{&charset{g: [2]bool{true, false}}, ")", '0', &charset{g: [2]bool{true, true}}},
-		{&charset{g: [2]bool{true, true}}, "(", 'B', &charset{g: [2]bool{false, true}}},
-		{&charset{g: [2]bool{true, true}}, ")", 'B', &charset{g: [2]bool{true, false}}},
+		{&charset{}, ")", '0', &charset{g: [4]glyphSet{CS_ASCII, CS_DEC_SPECIAL}}},
+		{&charset{}, "(", '0', &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}},
+		{&charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, "(", '0', &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}},
+		{&charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, ")", '0', &charset{g: [4]glyphSet{CS_DEC_SPECIAL, CS_DEC_SPECIAL}}},
+		{&charset{g: [4]glyphSet{CS_DEC_SPECIAL, CS_DEC_SPECIAL}}, "(", 'B', &charset{g: [4]glyphSet{CS_ASCII, CS_DEC_SPECIAL}}},
+		{&charset{g: [4]glyphSet{CS_DEC_SPECIAL, CS_DEC_SPECIAL}}, ")", 'B', &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}},
+		{&charset{}, "*", '>', &charset{g: [4]glyphSet{2: CS_DEC_TECHNICAL}}},
+		{&charset{}, "+", '<', &charset{g: [4]glyphSet{3: CS_DEC_SUPPLEMENT}}},
+		{&charset{}, "+%", '5', &charset{g: [4]glyphSet{3: CS_DEC_SUPPLEMENT}}},
+		{&charset{}, "(%", '6', &charset{g: [4]glyphSet{CS_PORTUGUESE}}},
+		{&charset{}, "(", 'A', &charset{g: [4]glyphSet{CS_UK}}},
+		{&charset{}, "-", 'A', &charset{g: [4]glyphSet{CS_ASCII, CS_LATIN1}}},
+		{&charset{}, "/", 'A', &charset{g: [4]glyphSet{3: CS_LATIN1}}},
+		{&charset{}, "(", 'K', &charset{g: [4]glyphSet{CS_GERMAN}}},
+		// Unknown sets leave things be.
+		{&charset{g: [4]glyphSet{CS_UK}}, "(", 'X', &charset{g: [4]glyphSet{CS_UK}}},
+		{&charset{}, "-", 'B', &charset{}},
+		{&charset{}, "(\"", '4', &charset{}},
 	}
 
 	for i, c := range cases {
@@ -55,60 +70,122 @@ func TestRuneFor(t *testing.T) {
 		want rune
 	}{
 		{'a', &charset{}, 'a'},
-		{'a', &charset{set: 1}, 'a'},
-		{'a', &charset{set: 1, g: [2]bool{false, true}}, '▒'},
-		{'+', &charset{set: 1, g: [2]bool{}}, '+'},
-		{'+', &charset{g: [2]bool{true, false}}, '→'},
-		{'A', &charset{g: [2]bool{true, false}}, 'A'},
+		{'a', &charset{gl: 1}, 'a'},
+		{'a', &charset{gl: 1, g: [4]glyphSet{CS_ASCII, CS_DEC_SPECIAL}}, '▒'},
+		{'+', &charset{gl: 1}, '+'},
+		{'+', &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, '→'},
+		{'A', &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}, 'A'},
+		{'a', &charset{gl: 2, g: [4]glyphSet{2: CS_DEC_TECHNICAL}}, 'α'},
+		{'a', &charset{ss: 3, g: [4]glyphSet{3: CS_DEC_TECHNICAL}}, 'α'},
+		{'W', &charset{g: [4]glyphSet{CS_DEC_SUPPLEMENT}}, 'Œ'},
+		{'A', &charset{g: [4]glyphSet{CS_DEC_SUPPLEMENT}}, 'Á'},
+		{'A', &charset{g: [4]glyphSet{CS_LATIN1}}, 'Á'},
+		{' ', &charset{g: [4]glyphSet{CS_LATIN1}}, ' '},
+		{'#', &charset{g: [4]glyphSet{CS_UK}}, '£'},
+		{'~', &charset{g: [4]glyphSet{CS_GERMAN}}, 'ß'},
+		// Only GL is translated.
+		{'é', &charset{g: [4]glyphSet{CS_LATIN1}}, 'é'},
+		{'\x7f', &charset{g: [4]glyphSet{CS_DEC_SUPPLEMENT}}, '\x7f'},
 	}
 
 	for i, c := range cases {
 		if got := c.cs.runeFor(c.in); got != c.want {
 			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
 		}
+		if c.cs.ss != 0 {
+			t.Errorf("%d: Single shift not used up", i)
+		}
 	}
 }
 
-func TestShiftIn(t *testing.T) {
+func TestShifts(t *testing.T) {
 	cases := []struct {
-		cs   *charset
-		want *charset
+		cs    *charset
+		shift func(*charset)
+		want  *charset
 	}{
-		{&charset{}, &charset{set: 0}},
-		{&charset{set: 0}, &charset{set: 0}},
-		{&charset{set: 1}, &charset{set: 0}},
-		{&charset{set: 1, g: [2]bool{}}, &charset{set: 0}},
-		{&charset{set: 1, g: [2]bool{true, false}}, &charset{set: 0, g: [2]bool{true, false}}},
-		{&charset{set: 1, g: [2]bool{true, true}}, &charset{set: 0, g: [2]bool{true, true}}},
-		{&charset{set: 1, g: [2]bool{false, true}}, &charset{set: 0, g: [2]bool{false, true}}},
+		{&charset{}, (*charset).shiftIn, &charset{gl: 0}},
+		{&charset{gl: 1}, (*charset).shiftIn, &charset{gl: 0}},
+		{&charset{gl: 3, g: [4]glyphSet{CS_DEC_SPECIAL}}, (*charset).shiftIn, &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}},
+		{&charset{}, (*charset).shiftOut, &charset{gl: 1}},
+		{&charset{gl: 1}, (*charset).shiftOut, &charset{gl: 1}},
+		{&charset{gl: 2, g: [4]glyphSet{CS_DEC_SPECIAL}}, (*charset).shiftOut, &charset{gl: 1, g: [4]glyphSet{CS_DEC_SPECIAL}}},
+		{&charset{}, func(c *charset) { c.lockingShift(2) }, &charset{gl: 2}},
+		{&charset{gl: 1}, func(c *charset) { c.lockingShift(3) }, &charset{gl: 3}},
+		{&charset{gl: 1}, func(c *charset) { c.singleShift(2) }, &charset{gl: 1, ss: 2}},
 	}
 
 	for i, c := range cases {
-		c.cs.shiftIn()
+		c.shift(c.cs)
 		if !c.cs.equal(c.want) {
 			t.Errorf("%d: Got %v, wanted %v", i, c.cs, c.want)
 		}
 	}
 }
 
-func TestShiftOut(t *testing.T) {
+// TestCharsetScreens follows vttest's character set tests, checking
+// what the screen shows after each.
+func TestCharsetScreens(t *testing.T) {
 	cases := []struct {
-		cs   *charset
-		want *charset
+		input string
+		want  string
 	}{
-		{&charset{}, &charset{set: 1}},
-		{&charset{set: 0}, &charset{set: 1}},
-		{&charset{set: 1}, &charset{set: 1}},
-		{&charset{set: 0, g: [2]bool{}}, &charset{set: 1}},
-		{&charset{set: 0, g: [2]bool{true, false}}, &charset{set: 1, g: [2]bool{true, false}}},
-		{&charset{set: 0, g: [2]bool{true, true}}, &charset{set: 1, g: [2]bool{true, true}}},
-		{&charset{set: 0, g: [2]bool{false, true}}, &charset{set: 1, g: [2]bool{false, true}}},
+		// "Test of character sets": each set designated as each
+		// G set, then invoked into GL.
+		{"\x1b(0`abcdefghijklmnopqrstuvwxyz{|}~", "◆▒␉␌␍␊°±␤␋┘┐┌└┼⎺⎻─⎼⎽├┤┴┬│≤≥π≠£·"},
+		{"\x1b)0\x0eqqq\x0fqqq", "───qqq"},
+		{"\x1b*0\x1bnqqq\x1b(Bqqq", "──────"},
+		{"\x1b*0\x1bnqqq\x0fqqq", "───qqq"},
+		{"\x1b+0\x1boxx\x0fxx", "││xx"},
+		{"\x1b*0\x1bNxx\x1b+0\x1bOxx", "│x│x"},
+		{"\x1b)B\x1b*0\x0e\x1bNxx", "│x"},
+		// DEC supplemental and technical.
+		{"\x1b(<!\"#(WFMw}", "¡¢£¤ŒÆÍœÿ"},
+		{"\x1b(%5AZ", "ÁÚ"},
+		{"\x1b)>\x0eabgdp\x0fab", "αβγδπab"},
+		{"\x1b->\x0eab", "ab"},
+		{"\x1b-A\x0e!AZ az\x0fA", "¡ÁÚ áúA"},
+		// "Test of national replacement character sets", which
+		// shows the characters each set replaces.
+		{"\x1b(A#@[\\]^_`{|}~", "£@[\\]^_`{|}~"},
+		{"\x1b(4#@[\\]^_`{|}~", "£¾ĳ½|^_`¨ƒ¼´"},
+		{"\x1b(5#@[\\]^_`{|}~", "#@ÄÖÅÜ_éäöåü"},
+		{"\x1b(R#@[\\]^_`{|}~", "£à°ç§^_`éùè¨"},
+		{"\x1b(9#@[\\]^_`{|}~", "#àâçêî_ôéùèû"},
+		{"\x1b(K#@[\\]^_`{|}~", "#§ÄÖÜ^_`äöüß"},
+		{"\x1b(Y#@[\\]^_`{|}~", "£§°çé^_ùàòèì"},
+		{"\x1b(6#@[\\]^_`{|}~", "#ÄÆØÅÜ_äæøåü"},
+		{"\x1b(%6#@[\\]^_`{|}~", "#@ÃÇÕ^_`ãçõ~"},
+		{"\x1b(Z#@[\\]^_`{|}~", "£§¡Ñ¿^_`°ñç~"},
+		{"\x1b(7#@[\\]^_`{|}~", "#ÉÄÖÅÜ_éäöåü"},
+		{"\x1b(=#@[\\]^_`{|}~", "ùàéçêîèôäöüû"},
+		// Reset puts everything back.
+		{"\x1b(0\x1b)0\x0e\x1bcqq", "qq"},
+		{"\x1b(0\x1b[!pqq", "qq"},
 	}
 
 	for i, c := range cases {
-		c.cs.shiftOut()
-		if !c.cs.equal(c.want) {
-			t.Errorf("%d: Got %v, wanted %v", i, c.cs, c.want)
+		nt, _ := NewTerminal(3, 40)
+		nt.Write([]byte(c.input))
+		if got := strings.TrimRight(strings.Split(nt.fb.String(), "\n")[0], " "); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
 		}
 	}
 }
+
+func TestCharsetSaveRestore(t *testing.T) {
+	nt, _ := NewTerminal(3, 20)
+	// Restoring before saving gives the defaults.
+	nt.Write([]byte("\x1b(0\x1b8q"))
+
+	nt.Write([]byte("\x1b)0\x1b*>\x0e\x1b7\x0f\x1b)B\x1b*Bq\x1b8qa\x1bna"))
+	if got := strings.TrimRight(strings.Split(nt.fb.String(), "\n")[0], " "); got != "q─▒α" {
+		t.Errorf("Got %q, wanted the charsets restored", got)
+	}
+
+	// The alternate screen saves them too.
+	nt.Write([]byte("\x1b[H\x1b[2K\x0f\x1b(0\x1b[?1049hq\x1b[?1049lq"))
+	if got := strings.TrimRight(strings.Split(nt.fb.String(), "\n")[0], " "); got != "─" {
+		t.Errorf("Got %q, wanted the charsets restored with the screen", got)
+	}
+}
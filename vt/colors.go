@@ -27,8 +27,11 @@ func (c color) equal(other color) bool {
 func (c color) ansiString(set int) string {
 	switch c.colType {
 	case UNSET:
-		if set == SET_FG {
+		switch set {
+		case SET_FG:
 			return fmt.Sprintf("%d", FG_DEF)
+		case SET_UL:
+			return fmt.Sprintf("%d", UL_DEF)
 		}
 		return fmt.Sprintf("%d", BG_DEF)
 	case BASIC:
@@ -61,12 +64,30 @@ func newRGBColor(cols []int) color {
 
 // colorFromParams takes a paramter object and interprets it as
 // either a 256 color or 24-bit true color ansi sequence. It expects
-// the parameters to be prefixed by either SET_FG, SET_BG that specify
-// what the color will be used for, but that parameter itself is
-// ignored. It returns a color and the number of parameters consumed
-// by the color, including the SET* parameter. Upon error, it will
-// return nil and 0 (no parameters consumed)
+// the parameters to be prefixed by either SET_FG, SET_BG or SET_UL
+// that specify what the color will be used for, but that parameter
+// itself has already been consumed. The rest may be separated by ';'
+// or given as ':' separated sub-parameters, where a true color may
+// include a color space id before its components. Upon error, def is
+// returned.
 func colorFromParams(params *parameters, def color) color {
+	if subs := params.consumeSubItems(); len(subs) > 0 {
+		switch {
+		case subs[0] == 2 && len(subs) >= 5: // with a color space id
+			return newRGBColor(subs[2:5])
+		case subs[0] == 2:
+			cols := make([]int, 3)
+			copy(cols, subs[1:])
+			return newRGBColor(cols)
+		case subs[0] == 5 && len(subs) > 1:
+			return newAnsiColor(subs[1])
+		case subs[0] == 5:
+			return newAnsiColor(0)
+		}
+		slog.Debug("invalid color type selector, returning default", "selector param", subs[0])
+		return def
+	}
+
 	cm, ok := params.consumeItem()
 	if !ok {
 		slog.Debug("invalid parameters to provide extended color", "params", params.items)
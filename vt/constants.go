@@ -43,6 +43,14 @@ const (
 	CSI   = 0x5b // ]; control sequence introducer
 	OSC   = 0x5d // [; operating system command
 	ST    = '\\' // string terminator
+	APC   = '_'  // application program command
+	SS2   = 'N'  // SS2 - single shift 2, G2 for the next character
+	SS3   = 'O'  // SS3 - single shift 3, G3 for the next character
+	LS2   = 'n'  // LS2 - locking shift 2, G2 into GL
+	LS3   = 'o'  // LS3 - locking shift 3, G3 into GL
+	LS1R  = '~'  // LS1R - locking shift 1 right, G1 into GR
+	LS2R  = '}'  // LS2R - locking shift 2 right, G2 into GR
+	LS3R  = '|'  // LS3R - locking shift 3 right, G3 into GR
 )
 
 // CSI codes
@@ -70,6 +78,7 @@ const (
 	CSI_CBT        = 'Z' // cursor backward tabulation
 	CSI_HPA        = '`' // character position absolute (column), default [row,1]
 	CSI_HPR        = 'a' // character position relative (column), default [row,col+1]
+	CSI_REP        = 'b' // repeat the preceding graphic character
 	CSI_DA         = 'c' // send (primary) device attributes
 	CSI_VPA        = 'd' // line position absolute (row), default [1,col]
 	CSI_VPR        = 'e' // line position relative (row), default [row+1,col]
@@ -99,6 +108,7 @@ const (
 	INVISIBLE_ON     = 8
 	STRIKEOUT_ON     = 9
 	PRIMARY_FONT     = 10
+	DOUBLE_UNDERLINE = 21
 	INTENSITY_NORMAL = 22
 	ITALIC_OFF       = 23
 	UNDERLINE_OFF    = 24
@@ -130,6 +140,8 @@ const (
 	BG_WHITE          = 47
 	SET_BG            = 48
 	BG_DEF            = 49
+	SET_UL            = 58
+	UL_DEF            = 59
 	FG_BRIGHT_BLACK   = 90
 	FG_BRIGHT_RED     = 91
 	FG_BRIGHT_GREEN   = 92
@@ -177,19 +189,41 @@ const (
 	MOUSE_SGR              = 1006 // SGR Mouse Mode
 	MOUSE_ALT              = 1007 // Alternate scroll mode
 	MOUSE_URXVT            = 1015 // urxvt mouse mode
+	META_ESC               = 1036 // Send ESC when Meta modifies a key
+	ALT_ESC                = 1039 // Send ESC when Alt modifies a key
 	XTERM_ALT_BUFFER       = 1047 // xterm switch to alternate screen buffer
 	XTERM_SAVE_RESTORE     = 1048 // xterm save/restore cursor
 	XTERM_SAVE_ALT         = 1049 // xterm save/retore cursor and alt buffer
+	PRIVATE_COLOR_REGS     = 1070 // Each sixel image has its own color registers
 	BRACKET_PASTE          = 2004 // Bracketed paste, ala xterm
+	SYNC_OUTPUT            = 2026 // Synchronized output - https://gist.github.com/christianparpart/d8a62cc1ab659194337d73e399004036
+	GRAPHEME_CLUSTERS      = 2027 // Grapheme cluster widths - https://github.com/contour-terminal/terminal-unicode-core
+)
+
+// DECRQM replies, saying what we know of a mode.
+const (
+	DECRQM_UNKNOWN         = 0
+	DECRQM_SET             = 1
+	DECRQM_RESET           = 2
+	DECRQM_PERMANENT_SET   = 3
+	DECRQM_PERMANENT_RESET = 4
 )
 
 // OSC actions
 const (
-	OSC_ICON_TITLE = "0"
-	OSC_ICON       = "1"
-	OSC_TITLE      = "2"
-	OSC_HYPERLINK  = "8" // hyperlink - https://gist.github.com/egmontkob/eb114294efbcd5adb1944c9f3cb5feda
-	OSC_SETSIZE    = "X" // Gosh-specific
+	OSC_ICON_TITLE    = "0"
+	OSC_ICON          = "1"
+	OSC_TITLE         = "2"
+	OSC_PALETTE       = "4" // set or query indexed colors
+	OSC_HYPERLINK     = "8" // hyperlink - https://gist.github.com/egmontkob/eb114294efbcd5adb1944c9f3cb5feda
+	OSC_FG            = "10"
+	OSC_BG            = "11"
+	OSC_CURSOR_COLOR  = "12"
+	OSC_PALETTE_RESET = "104"
+	OSC_FG_RESET      = "110"
+	OSC_BG_RESET      = "111"
+	OSC_CURSOR_RESET  = "112"
+	OSC_ITERM2        = "1337" // iTerm2 commands - https://iterm2.com/documentation-escape-codes.html
 )
 
 // Modes for CSI_TBC
@@ -36,3 +36,22 @@ func (c cursor) equal(other cursor) bool {
 func (c cursor) String() string {
 	return fmt.Sprintf("(%d, %d)", c.row, c.col)
 }
+
+// cursorStyle is the cursor's shape and whether it blinks, as set by
+// DECSCUSR. The default is whatever the outer terminal shows.
+type cursorStyle uint8
+
+const (
+	CURSOR_DEFAULT cursorStyle = iota
+	CURSOR_BLOCK_BLINK
+	CURSOR_BLOCK
+	CURSOR_UNDERLINE_BLINK
+	CURSOR_UNDERLINE
+	CURSOR_BAR_BLINK
+	CURSOR_BAR
+	CURSOR_STYLES // the number of styles
+)
+
+func (cs cursorStyle) ansiString() string {
+	return fmt.Sprintf("%c%c%d %c", ESC, CSI, cs, CSI_Q_MULTI)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log/slog"
+	"strings"
+)
+
+// MAX_DCS_LEN caps how much of a device control string we'll buffer
+// to answer it. Protocols that carry a payload should take it as it
+// arrives instead.
+const MAX_DCS_LEN = 4096
+
+// dcsHandler receives the data of a device control string as it
+// arrives and acts on it once the string ends.
+type dcsHandler interface {
+	put(r rune)
+	unhook()
+}
+
+// newDCSHandler returns a handler for a device control string with
+// the given parameters, intermediates and final character, if it's
+// one we understand. Protocols carrying a payload hook in here.
+func (t *Terminal) newDCSHandler(params *parameters, data string, cmd rune) (dcsHandler, bool) {
+	switch data + string(cmd) {
+	case "$q":
+		return &dcsBuffer{done: t.decrqss}, true
+	case "+q":
+		return &dcsBuffer{done: t.xtgettcap}, true
+	case "q":
+		return newSixelDecoder(params, func(img *image.NRGBA) {
+			si, err := newTermImage(img, 0, 0)
+			if err != nil {
+				slog.Debug("dropping sixel image", "err", err)
+				return
+			}
+			t.placeImage(si, IMAGE_CURSOR_BELOW)
+		}), true
+	}
+
+	return nil, false
+}
+
+// dcsBuffer collects a whole device control string and passes it to
+// done. Overly long strings are dropped.
+type dcsBuffer struct {
+	data []rune
+	long bool
+	done func(data string)
+}
+
+func (b *dcsBuffer) put(r rune) {
+	if len(b.data) >= MAX_DCS_LEN {
+		b.long = true
+		return
+	}
+	b.data = append(b.data, r)
+}
+
+func (b *dcsBuffer) unhook() {
+	if b.long {
+		slog.Debug("dropping overly long DCS string", "data", string(b.data[:32]))
+		return
+	}
+	b.done(string(b.data))
+}
+
+func (t *Terminal) handleDCS(act pAction, params *parameters, data string, cmd rune) {
+	switch act {
+	case ACTION_HOOK:
+		var ok bool
+		if t.dcs, ok = t.newDCSHandler(params.copy(), data, cmd); !ok {
+			slog.Debug("unknown DCS string", "params", params, "data", data, "cmd", string(cmd))
+		}
+	case ACTION_PUT:
+		if t.dcs != nil {
+			t.dcs.put(cmd)
+		}
+	case ACTION_UNHOOK:
+		if t.dcs != nil {
+			t.dcs.unhook()
+			t.dcs = nil
+		}
+	}
+}
+
+// dcsReply writes a device control string back to the program.
+func (t *Terminal) dcsReply(s string) {
+	t.Write([]byte(fmt.Sprintf("%c%c%s%c%c", ESC, DCS, s, ESC, ST)))
+}
+
+// decrqss answers a DECRQSS request for the setting named by data
+// with the control sequence that would restore it.
+func (t *Terminal) decrqss(data string) {
+	var pt string
+	switch data {
+	case string(CSI_SGR):
+		pt = t.curF.sgrParams()
+	case string(CSI_DECSTBM):
+		pt = fmt.Sprintf("%d;%d", t.topMargin()+1, t.bottomMargin()+1)
+	case string(CSI_DECSLRM):
+		pt = fmt.Sprintf("%d;%d", t.leftMargin()+1, t.rightMargin()+1)
+	case " q": // DECSCUSR
+		// The default is the outer terminal's, which we
+		// report as the usual blinking block.
+		pt = fmt.Sprintf("%d", max(t.curStyle, CURSOR_BLOCK_BLINK))
+	default:
+		slog.Debug("unhandled DECRQSS request", "data", data)
+		t.dcsReply("0$r")
+		return
+	}
+
+	t.dcsReply("1$r" + pt + data)
+}
+
+// termCaps are the terminfo capabilities reported by XTGETTCAP. An
+// empty value is a boolean capability.
+var termCaps = map[string]string{
+	"TN":     "xterm-256color",
+	"Co":     "256",
+	"colors": "256",
+	"RGB":    "8/8/8",
+	"Tc":     "",
+}
+
+// xtgettcap answers an XTGETTCAP request for the hex encoded,
+// semicolon separated, capability names in data. Each is answered
+// separately, and an unknown or invalid name ends the reply.
+func (t *Terminal) xtgettcap(data string) {
+	for _, name := range strings.Split(data, ";") {
+		n, err := hex.DecodeString(name)
+		if err != nil {
+			slog.Debug("invalid XTGETTCAP name", "name", name, "err", err)
+			t.dcsReply("0+r" + name)
+			return
+		}
+
+		val, ok := termCaps[string(n)]
+		switch {
+		case !ok:
+			t.dcsReply("0+r" + name)
+			return
+		case val == "":
+			t.dcsReply("1+r" + name)
+		default:
+			t.dcsReply(fmt.Sprintf("1+r%s=%s", name, hex.EncodeToString([]byte(val))))
+		}
+	}
+}
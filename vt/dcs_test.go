@@ -0,0 +1,107 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// replies returns what nt sends back to the program after parsing
+// input.
+func replies(t *testing.T, nt *Terminal, input string) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe() error: %v", err)
+	}
+	defer r.Close()
+
+	nt.ptyF = w
+	nt.doParse(bufio.NewReader(strings.NewReader(input)))
+	nt.ptyF = nil
+	w.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	return string(b)
+}
+
+func TestDECRQSS(t *testing.T) {
+	cases := []struct {
+		setup, query string
+		want         string
+	}{
+		{"", "m", "\x1bP1$r0m\x1b\\"},
+		{"\x1b[1;4;31;48;5;200m", "m", "\x1bP1$r0;1;4;31;48;5;200m\x1b\\"},
+		{"\x1b[1;2m", "m", "\x1bP1$r0;1;2m\x1b\\"},
+		{"", "r", "\x1bP1$r1;10r\x1b\\"},
+		{"\x1b[3;7r", "r", "\x1bP1$r3;7r\x1b\\"},
+		{"", "s", "\x1bP1$r1;20s\x1b\\"},
+		{"\x1b[?69h\x1b[5;15s", "s", "\x1bP1$r5;15s\x1b\\"},
+		{"", " q", "\x1bP1$r1 q\x1b\\"},
+		{"\x1b[4 q", " q", "\x1bP1$r4 q\x1b\\"},
+		{"\x1b[6 q\x1b[7 q", " q", "\x1bP1$r6 q\x1b\\"},
+		{"\x1b[6 q\x1bc", " q", "\x1bP1$r1 q\x1b\\"},
+		{"", "x", "\x1bP0$r\x1b\\"},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte(c.setup))
+		if got := replies(t, nt, "\x1bP$q"+c.query+"\x1b\\"); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
+
+func TestXTGETTCAP(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"544e", "\x1bP1+r544e=787465726d2d323536636f6c6f72\x1b\\"},
+		{"5463", "\x1bP1+r5463\x1b\\"},
+		{"436f;544e", "\x1bP1+r436f=323536\x1b\\\x1bP1+r544e=787465726d2d323536636f6c6f72\x1b\\"},
+		{"6e6f6e65;436f", "\x1bP0+r6e6f6e65\x1b\\"},
+		{"zz", "\x1bP0+rzz\x1b\\"},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		if got := replies(t, nt, "\x1bP+q"+c.query+"\x1b\\"); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
+
+func TestUnknownDCS(t *testing.T) {
+	nt, _ := NewTerminal(2, 10)
+	want := nt.ForceCopy()
+	want.Write([]byte("ok"))
+
+	// The string is swallowed, including runes the parser has no
+	// entry for, and output carries on after it.
+	if got := replies(t, nt, "\x1bP1;2|données\x1b\\ok"); got != "" {
+		t.Errorf("Got reply %q, wanted none", got)
+	}
+	if !nt.fb.equal(want.fb) {
+		t.Errorf("Got\n%s\nwanted\n%s", nt.fb, want.fb)
+	}
+	if nt.p.state != STATE_GROUND {
+		t.Errorf("Parser in state %s, wanted GROUND", STATE_NAME[nt.p.state])
+	}
+}
+
+func TestDCSTooLong(t *testing.T) {
+	nt, _ := NewTerminal(2, 10)
+	if got := replies(t, nt, "\x1bP$q"+strings.Repeat("m", MAX_DCS_LEN+1)+"\x1b\\"); got != "" {
+		t.Errorf("Got reply %q, wanted none", got)
+	}
+}
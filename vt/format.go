@@ -20,6 +20,16 @@ const (
 	STRIKEOUT  = 1 << 8
 )
 
+// Underline styles, used when UNDERLINE is set. They're one less
+// than the sub-parameter that selects them, as in SGR 4:3 for curly.
+const (
+	UL_SINGLE = iota
+	UL_DOUBLE
+	UL_CURLY
+	UL_DOTTED
+	UL_DASHED
+)
+
 const FMT_RESET = "\x1b[m"
 
 var defFmt = &format{}
@@ -40,10 +50,30 @@ var attrToggle = map[uint16]map[bool]string{
 type format struct {
 	fg, bg color
 	attrs  uint16 // a bitmap of which of the attrs (^ above) are enabled
+	ul     uint8  // the underline style, UL_SINGLE unless underlined
+	ulc    color  // the underline color
 }
 
 func (f *format) copy() *format {
-	return &format{fg: f.fg, bg: f.bg, attrs: f.attrs}
+	return &format{fg: f.fg, bg: f.bg, attrs: f.attrs, ul: f.ul, ulc: f.ulc}
+}
+
+// setUnderline underlines in style, or removes the underline if on is
+// false.
+func (f *format) setUnderline(on bool, style uint8) {
+	f.setAttr(UNDERLINE, on)
+	f.ul = UL_SINGLE
+	if on {
+		f.ul = style
+	}
+}
+
+// underlineParams returns the SGR parameters that set f's underline.
+func (f *format) underlineParams() string {
+	if f.ul == UL_SINGLE {
+		return attrToggle[UNDERLINE][true]
+	}
+	return fmt.Sprintf("%d:%d", UNDERLINE_ON, f.ul+1)
 }
 
 func (f *format) setAttr(attr uint16, val bool) {
@@ -73,8 +103,19 @@ func (src *format) diff(dest *format) []byte {
 		sb.WriteString(fmt.Sprintf("%c%c%s%c", ESC, CSI, dest.bg.ansiString(SET_BG), CSI_SGR))
 	}
 
+	if !dest.ulc.equal(src.ulc) {
+		sb.WriteString(fmt.Sprintf("%c%c%s%c", ESC, CSI, dest.ulc.ansiString(SET_UL), CSI_SGR))
+	}
+
 	for _, attr := range attrs {
-		if da := dest.attrIsSet(attr); src.attrIsSet(attr) != da {
+		da := dest.attrIsSet(attr)
+		switch {
+		case attr == UNDERLINE && da && (!src.attrIsSet(attr) || src.ul != dest.ul):
+			if ts.Len() > 0 {
+				ts.WriteByte(';')
+			}
+			ts.WriteString(dest.underlineParams())
+		case src.attrIsSet(attr) != da:
 			if ts.Len() > 0 {
 				ts.WriteByte(';')
 			}
@@ -91,6 +132,30 @@ func (src *format) diff(dest *format) []byte {
 	return []byte(sb.String())
 }
 
+// sgrParams returns the SGR parameters that set f from scratch.
+func (f *format) sgrParams() string {
+	ps := []string{fmt.Sprintf("%d", RESET)}
+	for _, attr := range attrs {
+		switch {
+		case attr == UNDERLINE && f.attrIsSet(attr):
+			ps = append(ps, f.underlineParams())
+		case f.attrIsSet(attr):
+			ps = append(ps, attrToggle[attr][true])
+		}
+	}
+	if f.fg.colType != UNSET {
+		ps = append(ps, f.fg.ansiString(SET_FG))
+	}
+	if f.bg.colType != UNSET {
+		ps = append(ps, f.bg.ansiString(SET_BG))
+	}
+	if f.ulc.colType != UNSET {
+		ps = append(ps, f.ulc.ansiString(SET_UL))
+	}
+
+	return strings.Join(ps, ";")
+}
+
 func (f *format) String() string {
 	return fmt.Sprintf("fg: %s; bg: %s; bold: %t, underline: %t, blink: %t, reversed: %t, invisible: %t, strikeout: %t", f.fg.ansiString(SET_FG), f.fg.ansiString(SET_BG), f.attrIsSet(BOLD), f.attrIsSet(UNDERLINE), f.attrIsSet(BLINK), f.attrIsSet(REVERSED), f.attrIsSet(INVISIBLE), f.attrIsSet(STRIKEOUT))
 }
@@ -104,7 +169,11 @@ func (f *format) equal(other *format) bool {
 		return false
 	}
 
-	if f.attrs != other.attrs {
+	if f.attrs != other.attrs || f.ul != other.ul {
+		return false
+	}
+
+	if !f.ulc.equal(other.ulc) {
 		return false
 	}
 
@@ -115,7 +184,7 @@ func applyFormat(curF *format, params *parameters) *format {
 	if params.numItems() == 0 {
 		return defFmt.copy()
 	}
-	f := &format{bg: curF.bg, fg: curF.fg, attrs: curF.attrs}
+	f := curF.copy()
 
 	for {
 		item, ok := params.consumeItem()
@@ -150,8 +219,22 @@ func applyFormat(curF *format, params *parameters) *format {
 			}
 		case item == INTENSITY_NORMAL:
 			f.setAttr(BOLD|FAINT|BOLD_FAINT, false)
-		case item == UNDERLINE_ON || item == UNDERLINE_OFF:
-			f.setAttr(UNDERLINE, item < 10)
+		case item == UNDERLINE_ON:
+			// 4:0 removes the underline, and 4:1 to 4:5
+			// pick its style.
+			style := 1
+			if subs := params.consumeSubItems(); len(subs) > 0 {
+				style = subs[0]
+			}
+			if style <= UL_DASHED+1 {
+				f.setUnderline(style > 0, uint8(max(style-1, 0)))
+			} else {
+				slog.Debug("unknown underline style", "style", style)
+			}
+		case item == DOUBLE_UNDERLINE:
+			f.setUnderline(true, UL_DOUBLE)
+		case item == UNDERLINE_OFF:
+			f.setUnderline(false, UL_SINGLE)
 		case item == ITALIC_ON || item == ITALIC_OFF:
 			f.setAttr(ITALIC, item < 10)
 		case item == BLINK_ON || item == BLINK_OFF:
@@ -180,9 +263,15 @@ func applyFormat(curF *format, params *parameters) *format {
 			f.bg = newColor(item)
 		case item == 48:
 			f.bg = colorFromParams(params, color{})
+		case item == SET_UL:
+			f.ulc = colorFromParams(params, color{})
+		case item == UL_DEF:
+			f.ulc = color{}
 		default:
 			slog.Debug("unimplemented CSI format option", "param", item)
 		}
+		// Sub-parameters of anything else are ignored.
+		params.consumeSubItems()
 	}
 
 	return f
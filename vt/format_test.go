@@ -4,6 +4,7 @@ package vt
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -192,3 +193,95 @@ func TestFormatDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestUnderlineStyles(t *testing.T) {
+	red := newRGBColor([]int{255, 0, 0})
+	cases := []struct {
+		initial *format
+		sgr     string
+		want    *format
+	}{
+		{defFmt, "4", &format{attrs: UNDERLINE}},
+		{defFmt, "4:1", &format{attrs: UNDERLINE}},
+		{defFmt, "4:2", &format{attrs: UNDERLINE, ul: UL_DOUBLE}},
+		{defFmt, "21", &format{attrs: UNDERLINE, ul: UL_DOUBLE}},
+		{defFmt, "4:3", &format{attrs: UNDERLINE, ul: UL_CURLY}},
+		{defFmt, "4:4", &format{attrs: UNDERLINE, ul: UL_DOTTED}},
+		{defFmt, "4:5", &format{attrs: UNDERLINE, ul: UL_DASHED}},
+		{&format{attrs: UNDERLINE, ul: UL_CURLY}, "4:0", defFmt},
+		{&format{attrs: UNDERLINE, ul: UL_CURLY}, "24", defFmt},
+		{&format{attrs: UNDERLINE, ul: UL_CURLY}, "4", &format{attrs: UNDERLINE}},
+		{&format{attrs: UNDERLINE, ul: UL_CURLY}, "4:9", &format{attrs: UNDERLINE, ul: UL_CURLY}},
+		// Not italic, as it would be if : were ;.
+		{defFmt, "4:3;1", &format{attrs: UNDERLINE | BOLD, ul: UL_CURLY}},
+		{defFmt, "1:3", &format{attrs: BOLD}},
+		{defFmt, "58:2::255:0:0", &format{ulc: red}},
+		{defFmt, "58:2:255:0:0", &format{ulc: red}},
+		{defFmt, "58;2;255;0;0", &format{ulc: red}},
+		{defFmt, "58:5:9", &format{ulc: newAnsiColor(9)}},
+		{defFmt, "58;5;9;1", &format{ulc: newAnsiColor(9), attrs: BOLD}},
+		{&format{ulc: red}, "59", defFmt},
+		{&format{ulc: red, attrs: UNDERLINE, ul: UL_CURLY}, "0", defFmt},
+		{defFmt, "38:2::1:2:3", &format{fg: newRGBColor([]int{1, 2, 3})}},
+		{defFmt, "48:5:17", &format{bg: newAnsiColor(17)}},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(1, 10)
+		nt.curF = c.initial.copy()
+		nt.Write([]byte("\x1b[" + c.sgr + "m"))
+		if !nt.curF.equal(c.want) {
+			t.Errorf("%d: Got\n\t%s, wanted\n\t%s after %q", i, nt.curF, c.want, c.sgr)
+		}
+	}
+}
+
+func TestUnderlineDiff(t *testing.T) {
+	red := newRGBColor([]int{255, 0, 0})
+	cases := []struct {
+		srcF, destF *format
+		want        string
+	}{
+		{defFmt, &format{attrs: UNDERLINE, ul: UL_CURLY}, "\x1b[4:3m"},
+		{&format{attrs: UNDERLINE}, &format{attrs: UNDERLINE, ul: UL_DOTTED}, "\x1b[4:4m"},
+		{&format{attrs: UNDERLINE, ul: UL_DOTTED}, &format{attrs: UNDERLINE}, "\x1b[4m"},
+		{&format{attrs: UNDERLINE | BOLD, ul: UL_DOTTED}, &format{attrs: BOLD}, "\x1b[24m"},
+		{defFmt, &format{ulc: red, attrs: UNDERLINE}, "\x1b[58:2:255:0:0m\x1b[4m"},
+		{&format{ulc: red, attrs: BOLD}, &format{ulc: newAnsiColor(9), attrs: BOLD}, "\x1b[58;5;9m"},
+		{&format{ulc: red, attrs: BOLD}, &format{attrs: BOLD}, "\x1b[59m"},
+	}
+
+	for i, c := range cases {
+		if got := string(c.srcF.diff(c.destF)); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+		// What we send is understood.
+		nt, _ := NewTerminal(1, 10)
+		nt.curF = c.srcF.copy()
+		nt.Write(c.srcF.diff(c.destF))
+		if !nt.curF.equal(c.destF) {
+			t.Errorf("%d: Got %s after the diff, wanted %s", i, nt.curF, c.destF)
+		}
+	}
+
+	f := &format{ulc: red, attrs: UNDERLINE | ITALIC, ul: UL_CURLY}
+	if got, want := f.sgrParams(), "0;3;4:3;58:2:255:0:0"; got != want {
+		t.Errorf("Got SGR parameters %q, wanted %q", got, want)
+	}
+}
+
+func TestUnderlineDowngrade(t *testing.T) {
+	src, _ := NewTerminal(2, 10)
+	dest := writeCopy(src, "\x1b[4:3;58:5:9ma\x1b[4:0;1mb")
+
+	got := string(src.Diff(dest))
+	if strings.Contains(got, "4:3") || strings.Contains(got, "58") || !strings.Contains(got, "\x1b[4ma") {
+		t.Errorf("Got %q, wanted a plain underline", got)
+	}
+
+	src.SetStyledUnderlines(true)
+	got = string(src.Diff(dest))
+	if !strings.Contains(got, "\x1b[58;5;9m\x1b[4:3ma") {
+		t.Errorf("Got %q, wanted a curly red underline", got)
+	}
+}
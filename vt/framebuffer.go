@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"unicode"
 )
 
@@ -35,6 +37,8 @@ type cell struct {
 	// 1 = primary rune
 	// 2 = spare/empty cell next to primary
 	frag int
+	// The part of an image shown in this cell, if any
+	tile *imageTile
 }
 
 func (c cell) isFragment() bool {
@@ -77,8 +81,13 @@ func (c *cell) hyperlink() *osc8 {
 	return c.hl
 }
 
+// isBlank reports whether c looks like an erased cell.
+func (c *cell) isBlank() bool {
+	return c.r == ' ' && !c.isFragment() && c.f.equal(defFmt) && c.hl.equal(defOSC8)
+}
+
 func (c *cell) equal(other *cell) bool {
-	return c.set == other.set && c.r == other.r && c.frag == other.frag && c.format().equal(other.format()) && c.hl.equal(other.hl)
+	return c.set == other.set && c.r == other.r && c.frag == other.frag && c.format().equal(other.format()) && c.hl.equal(other.hl) && c.tile.equal(other.tile)
 }
 
 func (c *cell) diff(dest *cell) []byte {
@@ -124,84 +133,139 @@ func (c *cell) String() string {
 	return fmt.Sprintf("%s (f:%d) (%s; %q)", string(c.r), c.frag, c.f.String(), c.hl.data)
 }
 
+// fbRow is a row of cells. Rows are shared between copies of a
+// framebuffer and may only be written in place by the framebuffer
+// that owns them. Others copy them first, so a row's contents never
+// change while it's shared.
+type fbRow struct {
+	cells []cell
+	// Unique to these contents: rows with the same generation
+	// are equal.
+	gen   uint64
+	owner uint64
+}
+
+// fbIDs hands out framebuffer ids and row generations.
+var fbIDs atomic.Uint64
+
+func newFBRow(cols int, owner uint64) *fbRow {
+	return &fbRow{cells: newRow(cols), gen: fbIDs.Add(1), owner: owner}
+}
+
 type framebuffer struct {
-	data [][]*cell
+	data []*fbRow
+	// The rows we can write in place are those we own.
+	id atomic.Uint64
 }
 
 func newFramebuffer(rows, cols int) *framebuffer {
-	d := make([][]*cell, rows, rows)
-	for r := 0; r < rows; r++ {
-		d[r] = newRow(cols)
-	}
-	return &framebuffer{
-		data: d,
+	f := &framebuffer{data: make([]*fbRow, rows)}
+	f.id.Store(fbIDs.Add(1))
+	for r := range f.data {
+		f.data[r] = newFBRow(cols, f.id.Load())
 	}
+	return f
 }
 
-func (f *framebuffer) ansiOSCSize() []byte {
-	return []byte(fmt.Sprintf("%c%c%s;%d;%d%c", ESC, OSC, OSC_SETSIZE, f.rows(), f.cols(), BEL))
-}
-
-func (src *framebuffer) diff(dest *framebuffer) []byte {
-	var sb strings.Builder
+// diff returns the sequences that paint dest over src, assuming the
+// pen is reset. If output has scrolled, scrolling the rows into place
+// and painting the rest is usually much cheaper than repainting them
+// all, so we try that too and send whichever is shorter.
+func (src *framebuffer) diff(dest *framebuffer, disp *display) []byte {
+	d := src.cellDiff(dest, disp)
 
-	lastF := defFmt
-	lastHL := defOSC8
-	lastCur := cursor{-1, -1}
+	if sc, ok := src.findScroll(dest); ok {
+		sd := append([]byte(sc.ansiString(src.rows())), src.shifted(sc).cellDiff(dest, disp)...)
+		if len(sd) < len(d) {
+			d = sd
+		}
+	}
 
-	sz := dest.ansiOSCSize()
-	if !slices.Equal(sz, src.ansiOSCSize()) {
-		sb.Write(sz)
+	if disp.protocol() == GRAPHICS_KITTY {
+		// Kitty draws images above the text, so writing over
+		// them doesn't remove them.
+		gone := src.images()
+		if len(gone) > 0 {
+			for id := range dest.images() {
+				delete(gone, id)
+			}
+			var del []byte
+			for _, id := range slices.Sorted(maps.Keys(gone)) {
+				del = append(del, kittyDelete(id)...)
+			}
+			d = append(del, d...)
+		}
 	}
 
+	return d
+}
+
+// cellDiff returns the sequences that paint each cell of dest that
+// differs from src. Images disp can draw are drawn where any of their
+// cells differ, rather than being stood in for.
+func (src *framebuffer) cellDiff(dest *framebuffer, disp *display) []byte {
+	p := newPainter(dest.cols())
+	p.disp = disp
+	var images []imagePlacement
+	seen := make(map[uint64]bool)
+
 	for r, row := range dest.data {
-		for c, destCell := range row {
-			cur := cursor{r, c}
-			srcCell, err := src.cell(r, c)
-			if err != nil {
-				srcCell = defaultCell()
+		var srow []cell
+		if r < src.rows() {
+			if src.data[r].gen == row.gen {
+				continue
 			}
+			srow = src.row(r)
+		}
+		changed := func(c int) bool {
+			if c >= len(srow) {
+				return !defaultCell().equal(&row.cells[c])
+			}
+			return !srow[c].equal(&row.cells[c])
+		}
+		p.paintRow(r, row.cells, changed)
 
-			if destCell.frag != FRAG_SECONDARY && !srcCell.equal(destCell) {
-				if cur.row != lastCur.row || cur.col != lastCur.col+1 {
-					sb.WriteString(cur.ansiString())
-				}
-
-				d := srcCell.efficientDiff(destCell, lastF, lastHL)
-				if len(d) == 0 {
-					d = []byte(fmt.Sprintf("%c", destCell.r))
-				}
-				sb.Write(d)
-				lastF = destCell.format()
-				lastHL = destCell.hyperlink()
-				lastCur = cur
+		for c := range row.cells {
+			if st := row.cells[c].tile; st != nil && !seen[st.img.id] && changed(c) {
+				seen[st.img.id] = true
+				images = append(images, imagePlacement{st.img, r - st.row, c - st.col})
 			}
 		}
 	}
 
-	return []byte(sb.String())
+	if disp != nil {
+		p.paintImages(dest, images)
+	}
+
+	return p.bytes()
 }
 
+// copy returns a copy of f. It's cheap, as the rows are shared until
+// either framebuffer writes to them.
 func (f *framebuffer) copy() *framebuffer {
-	rows := f.rows()
-	cols := f.cols()
+	// Neither of us owns the rows now.
+	f.id.Store(fbIDs.Add(1))
 
-	nf := &framebuffer{
-		data: make([][]*cell, rows, rows),
-	}
+	nf := &framebuffer{data: slices.Clone(f.data)}
+	nf.id.Store(fbIDs.Add(1))
+	return nf
+}
 
-	for row := range f.data {
-		nf.data[row] = make([]*cell, cols, cols)
-		copy(nf.data[row], f.row(row))
+// mutRow returns the cells of row r for writing, copying the row
+// first if it's shared.
+func (f *framebuffer) mutRow(r int) []cell {
+	row := f.data[r]
+	if id := f.id.Load(); row.owner != id {
+		row = &fbRow{cells: slices.Clone(row.cells), gen: fbIDs.Add(1), owner: id}
+		f.data[r] = row
 	}
-
-	return nf
+	return row.cells
 }
 
 func (f *framebuffer) String() string {
 	var sb strings.Builder
 	for _, row := range f.data {
-		for _, cell := range row {
+		for _, cell := range row.cells {
 			if cell.frag == 2 {
 				continue
 			}
@@ -223,12 +287,11 @@ func (f *framebuffer) equal(other *framebuffer) bool {
 	}
 
 	for r, row := range other.data {
-		for c, cell := range row {
-			oc, err := f.cell(r, c)
-			if err != nil {
-				oc = defaultCell()
-			}
-			if !cell.equal(oc) {
+		if f.data[r].gen == row.gen {
+			continue
+		}
+		for c := range row.cells {
+			if !row.cells[c].equal(&f.data[r].cells[c]) {
 				return false
 			}
 		}
@@ -240,7 +303,7 @@ func (f *framebuffer) scrollRows(n int) {
 	nc := f.cols()
 	nr := f.rows()
 
-	if -n > nr-1 {
+	if n > nr-1 || -n > nr-1 {
 		f.resetRows(0, nr-1)
 		return
 	}
@@ -253,19 +316,69 @@ func (f *framebuffer) scrollRows(n int) {
 		// 0)
 		for i := nr - 1; i > -n-1; i-- {
 			x := i + n // n is negative here
-			copy(f.data[i], f.data[x])
+			copy(f.mutRow(i), f.row(x))
 		}
 	} else {
 		rs, re = nr-n, nr
 		for i := 0; i < nr-n; i++ {
 			x := i + n
-			copy(f.data[i], f.row(x))
+			copy(f.mutRow(i), f.row(x))
 		}
 	}
 
 	for i := rs; i < re; i++ {
-		copy(f.data[i], newRow(nc))
+		copy(f.mutRow(i), newRow(nc))
+	}
+}
+
+// scrollArea scrolls the region from top to bottom and left to right,
+// inclusive, up n rows (or down, if negative). When the region is
+// the full width we move whole rows, rather than copying cells.
+func (f *framebuffer) scrollArea(top, bottom, left, right, n int) error {
+	if left != 0 || right != f.cols()-1 {
+		reg, err := f.subRegion(top, bottom, left, right)
+		if err != nil {
+			return err
+		}
+		reg.scrollRows(n)
+		return nil
+	}
+
+	if top < 0 || top > bottom || bottom >= f.rows() {
+		return invalidRegion
 	}
+
+	sz := bottom - top + 1
+	n = max(-sz, min(n, sz))
+	rows := f.data[top : bottom+1]
+	if n > 0 {
+		gone := slices.Clone(rows[:n])
+		copy(rows, rows[n:])
+		for i, row := range gone {
+			rows[sz-n+i] = f.reuseRow(row)
+		}
+	} else {
+		gone := slices.Clone(rows[sz+n:])
+		copy(rows[-n:], rows)
+		for i, row := range gone {
+			rows[i] = f.reuseRow(row)
+		}
+	}
+
+	return nil
+}
+
+// reuseRow returns a blank row, reusing row if we own it. When output
+// is scrolling, this saves allocating a row for every line.
+func (f *framebuffer) reuseRow(row *fbRow) *fbRow {
+	id := f.id.Load()
+	if row.owner != id {
+		return newFBRow(f.cols(), id)
+	}
+
+	blankCells(row.cells)
+	row.gen = fbIDs.Add(1)
+	return row
 }
 
 func (f *framebuffer) resize(rows, cols int) bool {
@@ -275,32 +388,34 @@ func (f *framebuffer) resize(rows, cols int) bool {
 	}
 
 	nr := len(f.data)
-	nc := len(f.data[0])
+	nc := f.cols()
 	switch {
 	case rows < nr:
 		f.data = f.data[0:rows]
 	case rows > nr:
 		for i := 0; i < rows-nr; i++ {
-			f.data = append(f.data, newRow(nc))
+			f.data = append(f.data, newFBRow(nc, f.id.Load()))
 		}
 	}
 
-	for i, row := range f.data {
+	if cols == nc {
+		return true
+	}
+
+	for i := range f.data {
+		row := f.mutRow(i)
 		switch {
 		case cols < nc:
-			f.data[i] = row[0:cols]
+			row = row[0:cols:cols]
 			// Don't leave dangling fragments, if we
 			// happen to chop one in half.
-			c, err := f.cell(i, cols-1)
-			if err == nil && c.frag > 0 {
-				f.setCell(i, cols-1, defaultCell())
+			if row[cols-1].frag > 0 {
+				row[cols-1] = *defaultCell()
 			}
 		case cols > nc:
-			for i := 0; i < cols-nc; i++ {
-				row = append(row, defaultCell())
-			}
-			f.data[i] = row
+			row = append(row, newRow(cols-nc)...)
 		}
+		f.data[i].cells = row
 	}
 
 	return true
@@ -311,9 +426,9 @@ func (f *framebuffer) resetRows(from, to int) bool {
 		return false
 	}
 
-	nc := len(f.data[0])
+	nc := f.cols()
 	for i := from; i <= to; i++ {
-		copy(f.data[i], newRow(nc))
+		copy(f.mutRow(i), newRow(nc))
 	}
 
 	return true
@@ -329,20 +444,29 @@ func (f *framebuffer) setCells(rowFrom, rowTo, colFrom, colTo int, c *cell) {
 	fr.fill(c)
 }
 
-func newRow(cols int) []*cell {
-	row := make([]*cell, cols, cols)
-	for i := 0; i < len(row); i++ {
-		row[i] = defaultCell()
-	}
+func newRow(cols int) []cell {
+	row := make([]cell, cols, cols)
+	blankCells(row)
 	return row
 }
 
+// blankCells sets all of cells to the default.
+func blankCells(cells []cell) {
+	if len(cells) == 0 {
+		return
+	}
+	cells[0] = cell{r: ' ', f: defFmt, hl: defOSC8}
+	for i := 1; i < len(cells); i *= 2 {
+		copy(cells[i:], cells[:i])
+	}
+}
+
 func (f *framebuffer) rows() int {
 	return len(f.data)
 }
 
 func (f *framebuffer) cols() int {
-	return len(f.data[0])
+	return len(f.data[0].cells)
 }
 
 func (f *framebuffer) validPoint(row, col int) bool {
@@ -354,24 +478,29 @@ func (f *framebuffer) validPoint(row, col int) bool {
 
 func (f *framebuffer) setCell(row, col int, c *cell) {
 	if f.validPoint(row, col) {
-		f.row(row)[col] = c
+		f.mutRow(row)[col] = *c
 	}
 }
 
-func (f *framebuffer) cell(row, col int) (*cell, error) {
+func (f *framebuffer) cell(row, col int) (cell, error) {
 	if f.validPoint(row, col) {
 		return f.row(row)[col], nil
 	}
 
-	return defaultCell(), fmt.Errorf("invalid coordinates (%d, %d): %w", col, row, fbInvalidCell)
+	return *defaultCell(), fmt.Errorf("invalid coordinates (%d, %d): %w", col, row, fbInvalidCell)
 }
 
-func (f *framebuffer) row(row int) []*cell {
-	return f.data[row]
+// row returns the cells of row, which mustn't be written to. Use
+// mutRow for that.
+func (f *framebuffer) row(row int) []cell {
+	return f.data[row].cells
 }
 
 var invalidRegion = errors.New("invalid region specification")
 
+// subRegion returns a framebuffer whose cells are those of the
+// region of f, so writing to it writes to f. It should be discarded
+// once written to, before f is copied.
 func (f *framebuffer) subRegion(t, b, l, r int) (*framebuffer, error) {
 	nr := f.rows() - 1
 	nc := f.cols() - 1
@@ -382,15 +511,13 @@ func (f *framebuffer) subRegion(t, b, l, r int) (*framebuffer, error) {
 
 	sz := b - t + 1
 	fb := &framebuffer{
-		data: make([][]*cell, sz, sz),
+		data: make([]*fbRow, sz, sz),
 	}
+	fb.id.Store(fbIDs.Add(1))
 
 	for i := 0; i < sz; i++ {
-		if r == nc {
-			fb.data[i] = f.data[i+t][l:]
-		} else {
-			fb.data[i] = f.data[i+t][l : r+1]
-		}
+		cells := f.mutRow(i + t)
+		fb.data[i] = &fbRow{cells: cells[l : r+1 : r+1], gen: f.data[i+t].gen, owner: fb.id.Load()}
 	}
 
 	return fb, nil
@@ -398,8 +525,9 @@ func (f *framebuffer) subRegion(t, b, l, r int) (*framebuffer, error) {
 
 func (f *framebuffer) fill(c *cell) {
 	for row := range f.data {
-		for col := range f.data[row] {
-			f.setCell(row, col, c)
+		cells := f.mutRow(row)
+		for col := range cells {
+			cells[col] = *c
 		}
 	}
 }
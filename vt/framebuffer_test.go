@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -436,23 +437,6 @@ func TestCopy(t *testing.T) {
 	}
 }
 
-func TestAnsiOSCSize(t *testing.T) {
-	cases := []struct {
-		fb   *framebuffer
-		want string
-	}{
-		{newFramebuffer(10, 10), fmt.Sprintf("%c%cX;%d;%d%c", ESC, OSC, 10, 10, BEL)},
-		{newFramebuffer(10, 5), fmt.Sprintf("%c%cX;%d;%d%c", ESC, OSC, 10, 5, BEL)},
-		{newFramebuffer(15, 22), fmt.Sprintf("%c%cX;%d;%d%c", ESC, OSC, 15, 22, BEL)},
-	}
-
-	for i, c := range cases {
-		if got := string(c.fb.ansiOSCSize()); got != c.want {
-			t.Errorf("%d: Got\n\t%v, wanted\n\t%v", i, got, c.want)
-		}
-	}
-}
-
 func TestFrameBufferDiff(t *testing.T) {
 	fb1 := newFramebuffer(10, 10)
 	fb2 := newFramebuffer(10, 10)
@@ -504,16 +488,15 @@ func TestFrameBufferDiff(t *testing.T) {
 	}{
 		// no diff
 		{fb1, fb2, ""},
-		// set size, move cursor, write rune
-		{fb2, fb3, "\x1b]X;10;20\a\x1b[6;12Ha"},
+		// move cursor, write rune
+		{fb2, fb3, "\x1b[6;12Ha"},
 		// move cursor, write rune
 		{fb3, fb4, "\x1b[6;13Hb"},
 		// move cursor, set pen, write runes
 		{fb4, fb5, "\x1b[6;13H\x1b[32mbc"},
-		// cursor, set pen, write 2 runes set size, move
-		// cursor, set pen, write rune, move cursor, write
-		// rune (only Y, no Z because of resize)
-		{fb5, fb6, "\x1b]X;10;13\a\x1b[2H\x1b[34m\x1b[41mX\x1b[6;13HY"},
+		// move cursor, set pen, write rune, move cursor,
+		// write rune (only Y, no Z because of resize)
+		{fb5, fb6, "\x1b[2H\x1b[34m\x1b[41mX\x1b[6;13HY"},
 		{fb7, fb8, "\x1b[H \x1b[40mabc \x1b[30m\x1b[44m\ue0b0 ~ \x1b[34m\x1b[49m\ue0b0\x1b[m "},
 		{fb9, fb10, "\x1b[;2H*"},
 		{fb9, fb11, "\x1b[HB"},
@@ -524,7 +507,7 @@ func TestFrameBufferDiff(t *testing.T) {
 		// shadows, but ok
 		srcFB := c.srcFB.copy()
 		destFB := c.destFB.copy()
-		if got := string(srcFB.diff(destFB)); got != c.want {
+		if got := string(srcFB.diff(destFB, nil)); got != c.want {
 			t.Errorf("%d: Got\n\t%q, wanted\n\t%q", i, got, c.want)
 		}
 	}
@@ -538,18 +521,17 @@ func TestFrameBufferDiff(t *testing.T) {
 func numberedFBForTest(start, rows, cols, defaultsStart, defaultsEnd int) *framebuffer {
 	fb := newFramebuffer(rows, cols)
 	for i := 0; i < defaultsStart; i++ {
-		fb.data[i] = newRow(cols)
+		fb.resetRows(i, i)
 	}
 
 	for r := defaultsStart; r < rows-defaultsEnd; r++ {
-		row := fb.data[r]
-		for c := range row {
+		for c := 0; c < cols; c++ {
 			fb.setCell(r, c, newCell(rune(r+-defaultsStart+start+'0'), &format{fg: newColor(30 + start - defaultsStart + r), bg: newDefaultColor()}, defOSC8.copy()))
 		}
 	}
 
 	for r := rows - defaultsEnd; r < rows; r++ {
-		fb.data[r] = newRow(cols)
+		fb.resetRows(r, r)
 	}
 	return fb
 }
@@ -577,3 +559,84 @@ func TestSubRegion(t *testing.T) {
 		}
 	}
 }
+
+// diffScreens returns pairs of framebuffers whose diffs are typical
+// of interactive use.
+func diffScreens() []struct {
+	name      string
+	src, dest *framebuffer
+} {
+	t1, _ := NewTerminal(DEF_ROWS, DEF_COLS)
+	var sb strings.Builder
+	for i := 0; i < DEF_ROWS; i++ {
+		fmt.Fprintf(&sb, "\x1b[%d;1H-rw-r--r-- 1 bob staff %6d Jan %2d 12:%02d file_%d.go", i+1, i*1234, i%30+1, i, i)
+	}
+	text := writeCopy(t1, sb.String())
+
+	sb.Reset()
+	sb.WriteString("\x1b[H┌" + strings.Repeat("─", DEF_COLS-2) + "┐")
+	for i := 2; i < DEF_ROWS; i++ {
+		fmt.Fprintf(&sb, "\x1b[%d;1H│\x1b[%dG│", i, DEF_COLS)
+	}
+	sb.WriteString("\x1b[24;1H└" + strings.Repeat("─", DEF_COLS-2) + "┘\x1b[12;10H" + strings.Repeat("=", 60))
+	boxes := writeCopy(t1, sb.String())
+
+	sb.Reset()
+	for i := 0; i < DEF_ROWS; i += 2 {
+		fmt.Fprintf(&sb, "\x1b[%d;%dH%d\x1b[%d;%dH%d", i+1, 10+i, i, i+1, 40+i, i)
+	}
+	sparse := writeCopy(text, sb.String())
+
+	return []struct {
+		name      string
+		src, dest *framebuffer
+	}{
+		{"clear", text.fb, writeCopy(text, "\x1b[2J").fb},
+		{"erase_lines", text.fb, writeCopy(text, "\x1b[5;1H\x1b[2K\x1b[9;20H\x1b[K\x1b[15;1H\x1b[J").fb},
+		{"boxes", t1.fb, boxes.fb},
+		{"sparse", text.fb, sparse.fb},
+	}
+}
+
+// BenchmarkFrameBufferDiff reports the bytes each diff produces, for
+// comparison between versions of the diff generator.
+func BenchmarkFrameBufferDiff(b *testing.B) {
+	for _, s := range diffScreens() {
+		b.Run(s.name, func(b *testing.B) {
+			var d []byte
+			for i := 0; i < b.N; i++ {
+				d = s.src.diff(s.dest, nil)
+			}
+			b.ReportMetric(float64(len(d)), "bytes/diff")
+		})
+	}
+}
+
+// sameLook reports whether a and b would look the same on screen,
+// regardless of which blank cells were written to.
+func sameLook(a, b *framebuffer) bool {
+	if a.rows() != b.rows() || a.cols() != b.cols() {
+		return false
+	}
+	for r := range a.data {
+		for c, ac := range a.row(r) {
+			bc := b.row(r)[c]
+			if ac.r != bc.r || ac.frag != bc.frag || !ac.f.equal(bc.f) || !ac.hl.equal(bc.hl) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestFrameBufferDiffPaints(t *testing.T) {
+	for _, s := range diffScreens() {
+		nt, _ := NewTerminal(DEF_ROWS, DEF_COLS)
+		nt.fb = s.src.copy()
+		nt.Write([]byte(FMT_RESET))
+		nt.Write(s.src.diff(s.dest, nil))
+		if !sameLook(nt.fb, s.dest) {
+			t.Errorf("%s: Painting diff got\n%s\nwanted\n%s", s.name, nt.fb, s.dest)
+		}
+	}
+}
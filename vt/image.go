@@ -0,0 +1,452 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// We don't know the size of a cell in pixels, on our end or the
+// client's, so we use that of xterm emulating a VT340.
+const (
+	IMAGE_CELL_WIDTH  = 10
+	IMAGE_CELL_HEIGHT = 20
+)
+
+// Limits on the images we'll accept, from the program or the
+// server. MAX_IMAGE_PIXELS caps their decoded size, MAX_IMAGE_BYTES
+// their encoded size and MAX_IMAGE_SPAN the rows or columns one can
+// cover.
+const (
+	MAX_IMAGE_PIXELS = 1 << 22
+	MAX_IMAGE_BYTES  = 4 * MAX_IMAGE_PIXELS
+	MAX_IMAGE_SPAN   = 1000
+)
+
+// MAX_STORED_IMAGES is how many images a client keeps the pixels of.
+// Older ones are shown with their labels if they're painted again.
+const MAX_STORED_IMAGES = 64
+
+var errImageSize = errors.New("image too large")
+
+// Graphics is a set of image protocols a terminal understands.
+type Graphics uint32
+
+const (
+	GRAPHICS_SIXEL Graphics = 1 << iota
+	GRAPHICS_KITTY
+	GRAPHICS_ITERM2
+)
+
+// imageIDs supplies image ids, which are never reused.
+var imageIDs atomic.Uint64
+
+// pixels are the pixels of an image, which are never modified, and
+// their PNG encoding, made when first needed.
+type pixels struct {
+	img  *image.NRGBA
+	once sync.Once
+	data []byte
+}
+
+func (px *pixels) png() []byte {
+	px.once.Do(func() {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, px.img); err != nil {
+			slog.Error("couldn't encode image", "err", err)
+		}
+		px.data = buf.Bytes()
+	})
+	return px.data
+}
+
+// decodePixels decodes a PNG, JPEG or GIF image, if it isn't too
+// large.
+func decodePixels(data []byte) (*pixels, error) {
+	if len(data) > MAX_IMAGE_BYTES {
+		return nil, fmt.Errorf("%d bytes: %w", len(data), errImageSize)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPixels(cfg.Width, cfg.Height); err != nil {
+		return nil, err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	px := &pixels{img: toNRGBA(img)}
+	if format == "png" {
+		px.once.Do(func() { px.data = data })
+	}
+	return px, nil
+}
+
+// decodeBase64 decodes s, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	return b, err
+}
+
+// checkPixels returns an error if a w x h image is empty or too
+// large.
+func checkPixels(w, h int) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("empty %dx%d image", w, h)
+	}
+	if w > MAX_IMAGE_PIXELS || h > MAX_IMAGE_PIXELS || w*h > MAX_IMAGE_PIXELS {
+		return fmt.Errorf("%dx%d: %w", w, h, errImageSize)
+	}
+	return nil
+}
+
+// toNRGBA returns img as an NRGBA image with its origin at (0, 0).
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Bounds().Min == (image.Point{}) {
+		return n
+	}
+	b := img.Bounds()
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), img, b.Min, draw.Src)
+	return n
+}
+
+// padToCells returns img with transparent pixels added to the right
+// and bottom to fill whole cells.
+func padToCells(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	w := (b.Dx() + IMAGE_CELL_WIDTH - 1) / IMAGE_CELL_WIDTH * IMAGE_CELL_WIDTH
+	h := (b.Dy() + IMAGE_CELL_HEIGHT - 1) / IMAGE_CELL_HEIGHT * IMAGE_CELL_HEIGHT
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	n := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(n, b.Sub(b.Min), img, b.Min, draw.Src)
+	return n
+}
+
+// scaleImage returns img stretched, or shrunk, to w x h, taking the
+// nearest pixel.
+func scaleImage(img *image.NRGBA, w, h int) *image.NRGBA {
+	b := img.Bounds()
+	if b.Dx() == w && b.Dy() == h {
+		return img
+	}
+	n := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + y*b.Dy()/h
+		for x := 0; x < w; x++ {
+			n.SetNRGBA(x, y, img.NRGBAAt(b.Min.X+x*b.Dx()/w, sy))
+		}
+	}
+	return n
+}
+
+// imageCells returns the rows and columns of cells a w x h image
+// covers when asked to cover rows x cols of them. If either is 0, it
+// keeps the image's aspect ratio, and if both are, its size.
+func imageCells(w, h, rows, cols int) (int, int) {
+	switch {
+	case rows == 0 && cols == 0:
+		rows = (h + IMAGE_CELL_HEIGHT - 1) / IMAGE_CELL_HEIGHT
+		cols = (w + IMAGE_CELL_WIDTH - 1) / IMAGE_CELL_WIDTH
+	case rows == 0:
+		rows = (cols*IMAGE_CELL_WIDTH*h + w*IMAGE_CELL_HEIGHT - 1) / (w * IMAGE_CELL_HEIGHT)
+	case cols == 0:
+		cols = (rows*IMAGE_CELL_HEIGHT*w + h*IMAGE_CELL_WIDTH - 1) / (h * IMAGE_CELL_WIDTH)
+	}
+	return max(rows, 1), max(cols, 1)
+}
+
+// termImage is an image that has been placed on the screen, covering
+// rows x cols cells with its pixels stretched to fit them. It's never
+// modified after it's placed. A client only has the pixels once they
+// arrive, separately from the diff that placed the image.
+type termImage struct {
+	id         uint64
+	rows, cols int
+	px         *pixels
+}
+
+// newTermImage returns an image showing img across rows x cols
+// cells. If both are 0, it covers the cells its pixels would.
+func newTermImage(img *image.NRGBA, rows, cols int) (*termImage, error) {
+	b := img.Bounds()
+	if err := checkPixels(b.Dx(), b.Dy()); err != nil {
+		return nil, err
+	}
+	if rows == 0 && cols == 0 {
+		img = padToCells(img)
+		b = img.Bounds()
+	}
+
+	rows, cols = imageCells(b.Dx(), b.Dy(), rows, cols)
+	if rows > MAX_IMAGE_SPAN || cols > MAX_IMAGE_SPAN {
+		return nil, fmt.Errorf("%dx%d cells: %w", cols, rows, errImageSize)
+	}
+
+	return &termImage{id: imageIDs.Add(1), rows: rows, cols: cols, px: &pixels{img: img}}, nil
+}
+
+// onScreen returns how many of the image's tiles are on a screen of
+// the given size when its top left tile is at (row, col).
+func (si *termImage) onScreen(row, col, rows, cols int) int {
+	r := min(row+si.rows, rows) - max(row, 0)
+	c := min(col+si.cols, cols) - max(col, 0)
+	return max(r, 0) * max(c, 0)
+}
+
+// label is shown in place of the image where it can't be displayed.
+func (si *termImage) label() []rune {
+	b := si.px.img.Bounds()
+	return []rune(fmt.Sprintf("[image %dx%d]", b.Dx(), b.Dy()))
+}
+
+// crop returns the pixels of img, which si shows, covering the cells
+// from (top, left) to (bottom, right), exclusive, of the image.
+func (si *termImage) crop(img *image.NRGBA, top, left, bottom, right int) *image.NRGBA {
+	b := img.Bounds()
+	r := image.Rect(
+		left*b.Dx()/si.cols, top*b.Dy()/si.rows,
+		right*b.Dx()/si.cols, bottom*b.Dy()/si.rows,
+	)
+	return img.SubImage(r.Add(b.Min)).(*image.NRGBA)
+}
+
+// imageTile is the part of an image that covers one cell.
+type imageTile struct {
+	img      *termImage
+	row, col int
+}
+
+func (it *imageTile) equal(other *imageTile) bool {
+	if it == nil || other == nil {
+		return it == other
+	}
+	return it.img.id == other.img.id && it.row == other.row && it.col == other.col
+}
+
+// Where the cursor is left after placing an image.
+const (
+	IMAGE_CURSOR_BELOW = iota // on the row below it, in its first column
+	IMAGE_CURSOR_AFTER        // on its last row, just after it
+	IMAGE_CURSOR_STAY         // where it was, without scrolling
+)
+
+// placeImage puts si on the screen with its top left at the cursor,
+// scrolling as needed unless move is IMAGE_CURSOR_STAY, and leaves
+// the cursor as move says. The cells it covers show its label, if
+// they're all that's shown.
+func (t *Terminal) placeImage(si *termImage, move int) {
+	row, col := t.row(), t.col()
+	label := si.label()
+	for r := 0; r < si.rows; r++ {
+		if move == IMAGE_CURSOR_STAY && row+r >= t.Rows() {
+			break
+		}
+		cur := t.row()
+		if move == IMAGE_CURSOR_STAY {
+			cur = row + r
+		}
+		for c := 0; c < si.cols && col+c < t.Cols(); c++ {
+			t.clearFrags(cur, col+c)
+			nc := cell{set: true, r: ' ', f: defFmt, hl: defOSC8, tile: &imageTile{si, r, c}}
+			if r == 0 && c < len(label) {
+				nc.r = label[c]
+			}
+			t.fb.mutRow(cur)[col+c] = nc
+		}
+
+		switch {
+		case move == IMAGE_CURSOR_BELOW:
+			t.lineFeed()
+		case move == IMAGE_CURSOR_AFTER && r < si.rows-1:
+			t.lineFeed()
+		}
+	}
+	if move == IMAGE_CURSOR_AFTER {
+		t.cursorMoveAbs(t.row(), col+si.cols)
+	}
+	t.hasImages = true
+}
+
+// evictImages clears what's left of any image that has had some of
+// its cells overwritten. Images partly scrolled off screen are kept.
+func (t *Terminal) evictImages() {
+	if !t.hasImages {
+		return
+	}
+
+	type placement struct {
+		row, col, tiles int
+		ok              bool
+	}
+	seen := make(map[*termImage]*placement)
+	for r, row := range t.fb.data {
+		for c := range row.cells {
+			it := row.cells[c].tile
+			if it == nil {
+				continue
+			}
+			ar, ac := r-it.row, c-it.col
+			p, ok := seen[it.img]
+			switch {
+			case !ok:
+				seen[it.img] = &placement{ar, ac, 1, true}
+			case p.row != ar || p.col != ac:
+				p.ok = false
+			default:
+				p.tiles += 1
+			}
+		}
+	}
+
+	evict := make(map[*termImage]bool)
+	for si, p := range seen {
+		if !p.ok || p.tiles != si.onScreen(p.row, p.col, t.Rows(), t.Cols()) {
+			evict[si] = true
+		}
+	}
+	t.removeImages(evict)
+}
+
+// removeImages clears the cells of the images in gone.
+func (t *Terminal) removeImages(gone map[*termImage]bool) {
+	if len(gone) == 0 {
+		return
+	}
+
+	for r, row := range t.fb.data {
+		for c := range row.cells {
+			if it := row.cells[c].tile; it != nil && gone[it.img] {
+				t.fb.mutRow(r)[c] = *defaultCell()
+			}
+		}
+	}
+}
+
+// images returns the images with tiles in f, by id.
+func (f *framebuffer) images() map[uint64]*termImage {
+	ret := make(map[uint64]*termImage)
+	for _, row := range f.data {
+		for c := range row.cells {
+			if it := row.cells[c].tile; it != nil {
+				ret[it.img.id] = it.img
+			}
+		}
+	}
+	return ret
+}
+
+// placement returns where the top left tile of the image with the
+// given id is in f, if any of it is.
+func (f *framebuffer) placement(id uint64) (imagePlacement, bool) {
+	for r, row := range f.data {
+		for c := range row.cells {
+			if it := row.cells[c].tile; it != nil && it.img.id == id {
+				return imagePlacement{it.img, r - it.row, c - it.col}, true
+			}
+		}
+	}
+	return imagePlacement{}, false
+}
+
+// imageStore holds the pixels of the images a client has received,
+// by id. Only the most recent MAX_STORED_IMAGES are kept.
+type imageStore struct {
+	mux   sync.Mutex
+	px    map[uint64]*pixels
+	order []uint64
+}
+
+func newImageStore() *imageStore {
+	return &imageStore{px: make(map[uint64]*pixels)}
+}
+
+func (st *imageStore) add(id uint64, px *pixels) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	if _, ok := st.px[id]; ok {
+		return
+	}
+	st.px[id] = px
+	st.order = append(st.order, id)
+	if len(st.order) > MAX_STORED_IMAGES {
+		delete(st.px, st.order[0])
+		st.order = st.order[1:]
+	}
+}
+
+func (st *imageStore) get(id uint64) *pixels {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	return st.px[id]
+}
+
+// AddImage gives a client the pixels of the image with the given id,
+// as sent by ImageData.
+func (t *Terminal) AddImage(id uint64, data []byte) error {
+	px, err := decodePixels(data)
+	if err != nil {
+		return err
+	}
+	t.store.add(id, px)
+	return nil
+}
+
+// ImageData returns the pixels of the image with the given id, PNG
+// encoded, if t shows it.
+func (t *Terminal) ImageData(id uint64) ([]byte, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	ip, ok := t.fb.placement(id)
+	if !ok || ip.img.px == nil {
+		return nil, false
+	}
+	return ip.img.px.png(), true
+}
+
+// PaintImage returns the sequences that draw the image with the given
+// id where t shows it, for when its pixels arrive after the cells
+// it's in were painted.
+func (t *Terminal) PaintImage(id uint64) []byte {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	ip, ok := t.fb.placement(id)
+	disp := t.display()
+	if !ok || disp.pixels(ip.img) == nil {
+		return nil
+	}
+
+	p := newPainter(t.Cols())
+	p.disp = disp
+	for r := max(ip.row, 0); r < min(ip.row+ip.img.rows, t.Rows()); r++ {
+		p.paintRow(r, t.fb.row(r), func(c int) bool {
+			return c >= ip.col && c < ip.col+ip.img.cols
+		})
+	}
+	p.paintImages(t.fb, []imagePlacement{ip})
+
+	return []byte("\x1b7" + p.sb.String() + "\x1b8")
+}
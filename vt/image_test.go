@@ -0,0 +1,113 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImageCells(t *testing.T) {
+	cases := []struct {
+		w, h, rows, cols int
+		wantR, wantC     int
+	}{
+		{20, 40, 0, 0, 2, 2},
+		{25, 45, 0, 0, 3, 3},
+		{20, 40, 0, 4, 4, 4},
+		{20, 40, 3, 0, 3, 3},
+		{20, 40, 1, 7, 1, 7},
+		{1000, 1, 0, 1, 1, 1},
+	}
+
+	for i, c := range cases {
+		if r, col := imageCells(c.w, c.h, c.rows, c.cols); r != c.wantR || col != c.wantC {
+			t.Errorf("%d: Got %dx%d cells, wanted %dx%d", i, col, r, c.wantC, c.wantR)
+		}
+	}
+}
+
+func TestImageStore(t *testing.T) {
+	st := newImageStore()
+	px := &pixels{img: testImage(10, 20)}
+	for id := uint64(1); id <= MAX_STORED_IMAGES+1; id++ {
+		st.add(id, px)
+	}
+	if st.get(1) != nil {
+		t.Errorf("Oldest image kept past the limit")
+	}
+	if st.get(2) != px || st.get(MAX_STORED_IMAGES+1) != px {
+		t.Errorf("Recent images dropped")
+	}
+}
+
+func TestImageTransfer(t *testing.T) {
+	server := sixelTerminal()
+	si := shownImage(t, server, 1, 2)
+
+	client, _ := NewTerminal(10, 20)
+	client.SetGraphics(GRAPHICS_KITTY)
+	targ := client.ForceCopy()
+	if err := targ.ApplyDiff(client.StateDiff(server)); err != nil {
+		t.Fatalf("ApplyDiff() error: %v", err)
+	}
+
+	// Until the pixels arrive, the label is shown.
+	if got := string(client.Diff(targ)); strings.Contains(got, "\x1b_G") || !strings.Contains(got, "ab[im") {
+		t.Errorf("Got %q, wanted the label and no image", got)
+	}
+	client.Replace(targ)
+	if got := client.PaintImage(si.id); got != nil {
+		t.Errorf("Got %q painting an image without pixels", got)
+	}
+	if _, ok := client.ImageData(si.id); ok {
+		t.Errorf("Client has the data of an image without pixels")
+	}
+
+	data, ok := server.ImageData(si.id)
+	if !ok {
+		t.Fatalf("No data for image %d", si.id)
+	}
+	if _, ok := server.ImageData(si.id + 1); ok {
+		t.Errorf("Got data for an image not shown")
+	}
+	if err := client.AddImage(si.id, data); err != nil {
+		t.Fatalf("AddImage() error: %v", err)
+	}
+	if err := client.AddImage(si.id+1, []byte("not an image")); err == nil {
+		t.Errorf("AddImage() succeeded with invalid data")
+	}
+
+	got := string(client.PaintImage(si.id))
+	if !strings.HasPrefix(got, "\x1b7") || !strings.HasSuffix(got, "\x1b8") || strings.Contains(got, "[im") {
+		t.Errorf("Got %q, wanted the image drawn over blank cells", got)
+	}
+	if !strings.Contains(got, "\x1b[2;3H"+kittyDelete(si.id)) {
+		t.Errorf("Got %q, wanted the image drawn at (2, 3)", got)
+	}
+
+	// Later diffs that paint its cells draw it too.
+	blank, _ := NewTerminal(10, 20)
+	blank.store = client.store
+	blank.SetGraphics(GRAPHICS_KITTY)
+	if got := string(blank.Diff(targ)); !strings.Contains(got, kittyDelete(si.id)) || strings.Contains(got, "[im") {
+		t.Errorf("Got %q, wanted the image and no label", got)
+	}
+}
+
+func TestKittyDisplayRemoves(t *testing.T) {
+	src := sixelTerminal()
+	si := shownImage(t, src, 1, 2)
+	src.SetGraphics(GRAPHICS_KITTY)
+	dest := writeCopy(src, "\x1b[2J")
+
+	if got := string(src.Diff(dest)); !strings.Contains(got, kittyDelete(si.id)) {
+		t.Errorf("Got %q, wanted the image removed", got)
+	}
+
+	// Other displays overwrite the image instead.
+	src.SetGraphics(GRAPHICS_SIXEL)
+	if got := string(src.Diff(dest)); strings.Contains(got, "\x1b_G") {
+		t.Errorf("Got %q, wanted no kitty graphics", got)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// ITERM2_FILE is the OSC_ITERM2 command that sends a file, such as an
+// image to show inline. See
+// https://iterm2.com/documentation-images.html.
+const ITERM2_FILE = "File="
+
+// itermFile shows the image in an iTerm2 File command, the data after
+// "File=", if it's to be shown inline. Other files would be
+// downloaded, which we don't do.
+func (t *Terminal) itermFile(data string) {
+	args, payload, ok := strings.Cut(data, ":")
+	if !ok {
+		slog.Debug("iTerm2 file without data")
+		return
+	}
+	kv := make(map[string]string)
+	for _, arg := range strings.Split(args, ";") {
+		if k, v, ok := strings.Cut(arg, "="); ok {
+			kv[k] = v
+		}
+	}
+	if kv["inline"] != "1" {
+		slog.Debug("ignoring iTerm2 file download", "args", args)
+		return
+	}
+
+	if len(payload) > base64.StdEncoding.EncodedLen(MAX_IMAGE_BYTES) {
+		slog.Debug("dropping iTerm2 image", "err", errImageSize)
+		return
+	}
+	b, err := decodeBase64(payload)
+	if err != nil {
+		slog.Debug("invalid iTerm2 image", "err", err)
+		return
+	}
+	px, err := decodePixels(b)
+	if err != nil {
+		slog.Debug("invalid iTerm2 image", "err", err)
+		return
+	}
+
+	img := px.img.Bounds()
+	rows := itermSize(kv["height"], t.Rows(), IMAGE_CELL_HEIGHT)
+	cols := itermSize(kv["width"], t.Cols(), IMAGE_CELL_WIDTH)
+	if rows > 0 && cols > 0 && kv["preserveAspectRatio"] != "0" {
+		// Fit the image in the box, rather than stretching it.
+		if r, _ := imageCells(img.Dx(), img.Dy(), 0, cols); r > rows {
+			cols = 0
+		} else {
+			rows = 0
+		}
+	}
+	si, err := newTermImage(px.img, rows, cols)
+	if err != nil {
+		slog.Debug("dropping iTerm2 image", "err", err)
+		return
+	}
+
+	move := IMAGE_CURSOR_AFTER
+	if kv["doNotMoveCursor"] == "1" {
+		move = IMAGE_CURSOR_STAY
+	}
+	t.placeImage(si, move)
+}
+
+// itermSize returns the cells a width or height argument asks for,
+// out of total, where cell is their size in pixels. It's 0 if the
+// image's own size should be used.
+func itermSize(arg string, total, cell int) int {
+	var n int
+	var err error
+	switch {
+	case arg == "" || arg == "auto":
+		return 0
+	case strings.HasSuffix(arg, "px"):
+		n, err = strconv.Atoi(strings.TrimSuffix(arg, "px"))
+		n = (n + cell - 1) / cell
+	case strings.HasSuffix(arg, "%"):
+		n, err = strconv.Atoi(strings.TrimSuffix(arg, "%"))
+		n = total * n / 100
+	default:
+		n, err = strconv.Atoi(arg)
+	}
+	if err != nil {
+		slog.Debug("invalid iTerm2 image size", "arg", arg)
+		return 0
+	}
+	return max(n, 0)
+}
+
+// itermImage returns the sequence that draws the cells of si from
+// (top, left) to (bottom, right), exclusive, at the cursor, using
+// iTerm2's inline images.
+func itermImage(si *termImage, px *pixels, top, left, bottom, right int) string {
+	data := px.png()
+	if top != 0 || left != 0 || bottom != si.rows || right != si.cols {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, si.crop(px.img, top, left, bottom, right)); err != nil {
+			slog.Error("couldn't encode image", "err", err)
+			return ""
+		}
+		data = buf.Bytes()
+	}
+
+	return fmt.Sprintf("%c%c%s;%sinline=1;size=%d;width=%d;height=%d;preserveAspectRatio=0:%s%c",
+		ESC, OSC, OSC_ITERM2, ITERM2_FILE, len(data), right-left, bottom-top,
+		base64.StdEncoding.EncodeToString(data), BEL)
+}
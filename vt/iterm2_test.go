@@ -0,0 +1,93 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// itermCmd returns an iTerm2 command sending data as a file with the
+// given arguments.
+func itermCmd(args string, data []byte) string {
+	return "\x1b]1337;File=" + args + ":" + base64.StdEncoding.EncodeToString(data) + "\a"
+}
+
+func TestITerm2Image(t *testing.T) {
+	img := testImage(20, 40)
+	data := pngData(t, img)
+
+	cases := []struct {
+		args       string
+		rows, cols int
+		cur        cursor
+	}{
+		{"inline=1", 2, 2, cursor{2, 4}},
+		{"inline=1;width=4", 4, 4, cursor{4, 6}},
+		{"inline=1;width=40px", 4, 4, cursor{4, 6}},
+		{"inline=1;height=50%", 5, 5, cursor{5, 7}},
+		{"inline=1;width=4;height=2", 2, 2, cursor{2, 4}},
+		{"inline=1;width=4;height=2;preserveAspectRatio=0", 2, 4, cursor{2, 6}},
+		{"inline=1;width=auto;height=auto", 2, 2, cursor{2, 4}},
+		{"inline=1;doNotMoveCursor=1", 2, 2, cursor{1, 2}},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte("\x1b[2;3H" + itermCmd(c.args, data)))
+		si := shownImage(t, nt, 1, 2)
+		if si.rows != c.rows || si.cols != c.cols || !samePixels(si.px.img, img) {
+			t.Errorf("%d: Got %dx%d cell image, wanted %dx%d of the original", i, si.cols, si.rows, c.cols, c.rows)
+		}
+		if !nt.cur.equal(c.cur) {
+			t.Errorf("%d: Cursor at %s, wanted %s", i, nt.cur, c.cur)
+		}
+	}
+}
+
+func TestITerm2Ignored(t *testing.T) {
+	cases := []string{
+		itermCmd("inline=0", pngData(t, testImage(20, 40))),
+		itermCmd("name=Zm9v", pngData(t, testImage(20, 40))),
+		itermCmd("inline=1", []byte("not an image")),
+		"\x1b]1337;File=inline=1:!!!!\a",
+		"\x1b]1337;File=inline=1\a",
+		"\x1b]1337;SetMark\a",
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte(c + "ok"))
+		if len(nt.fb.images()) != 0 {
+			t.Errorf("%d: Image placed", i)
+		}
+		if got := nt.fb.String(); got[:2] != "ok" {
+			t.Errorf("%d: Output after the command lost", i)
+		}
+	}
+}
+
+func TestITermImage(t *testing.T) {
+	nt := sixelTerminal()
+	si := shownImage(t, nt, 1, 2)
+
+	cases := []struct {
+		top, left, bottom, right int
+	}{
+		{0, 0, 3, 3},
+		{1, 1, 3, 2},
+	}
+
+	for i, c := range cases {
+		// We understand what we send.
+		ot, _ := NewTerminal(10, 20)
+		ot.Write([]byte(itermImage(si, si.px, c.top, c.left, c.bottom, c.right)))
+		oi := shownImage(t, ot, 0, 0)
+		if oi.rows != c.bottom-c.top || oi.cols != c.right-c.left {
+			t.Errorf("%d: Got %dx%d cell image, wanted %dx%d", i, oi.cols, oi.rows, c.right-c.left, c.bottom-c.top)
+		}
+		if want := si.crop(si.px.img, c.top, c.left, c.bottom, c.right); !samePixels(oi.px.img, want) {
+			t.Errorf("%d: Got different pixels", i)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MAX_KITTY_IMAGES is how many images transmitted with the kitty
+// graphics protocol we keep for programs to place later. The oldest
+// are dropped first.
+const MAX_KITTY_IMAGES = 16
+
+// KITTY_CHUNK_SIZE is how much base64 data we put in each escape
+// sequence when sending an image, as the protocol asks.
+const KITTY_CHUNK_SIZE = 4096
+
+// kittyState is what we keep between kitty graphics commands.
+type kittyState struct {
+	// Images transmitted for later placement, by the program's
+	// id, oldest first.
+	images map[uint32]*image.NRGBA
+	order  []uint32
+	// Images placed, with the program's id for them.
+	placed map[*termImage]uint32
+	// A transmission split over several commands.
+	upload *kittyUpload
+}
+
+type kittyUpload struct {
+	ctrl kittyControl
+	data []byte
+	err  error
+}
+
+// kittyControl holds the keys and values that control a command.
+type kittyControl map[string]string
+
+func parseKittyControl(s string) kittyControl {
+	kc := make(kittyControl)
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			kc[k] = v
+		}
+	}
+	return kc
+}
+
+func (kc kittyControl) str(key, def string) string {
+	if v, ok := kc[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (kc kittyControl) num(key string) int {
+	n, _ := strconv.Atoi(kc[key])
+	return max(n, 0)
+}
+
+// kittyError builds an error to report to the program, which starts
+// with an errno style code.
+func kittyError(code, format string, args ...any) error {
+	return fmt.Errorf("%s:%s", code, fmt.Sprintf(format, args...))
+}
+
+// kittyPayload decodes the base64 payload of a command.
+func kittyPayload(s string) ([]byte, error) {
+	b, err := decodeBase64(s)
+	if err != nil {
+		return nil, kittyError("EINVAL", "invalid base64 payload")
+	}
+	return b, nil
+}
+
+// kittyGraphics handles a kitty graphics command, the data of an APC
+// string starting with G. See
+// https://sw.kovidgoyal.net/kitty/graphics-protocol/. Only images
+// sent in the escape sequences themselves are supported, rather than
+// read from files or shared memory.
+func (t *Terminal) kittyGraphics(data string) {
+	if t.kitty == nil {
+		t.kitty = &kittyState{
+			images: make(map[uint32]*image.NRGBA),
+			placed: make(map[*termImage]uint32),
+		}
+	}
+
+	ctrl, payload, _ := strings.Cut(data, ";")
+	kc := parseKittyControl(ctrl)
+
+	up := t.kitty.upload
+	if up == nil {
+		up = &kittyUpload{ctrl: kc}
+	}
+	if up.err == nil {
+		b, err := kittyPayload(payload)
+		switch {
+		case err != nil:
+			up.err = err
+		case len(up.data)+len(b) > MAX_IMAGE_BYTES:
+			up.err = kittyError("EFBIG", "image data too large")
+			up.data = nil
+		default:
+			up.data = append(up.data, b...)
+		}
+	}
+
+	if kc.num("m") == 1 {
+		t.kitty.upload = up
+		return
+	}
+	t.kitty.upload = nil
+
+	err := up.err
+	if err == nil {
+		err = t.kittyCommand(up.ctrl, up.data)
+	}
+	if err != nil {
+		slog.Debug("kitty graphics command failed", "ctrl", up.ctrl, "err", err)
+	}
+	t.kittyReply(up.ctrl, err)
+}
+
+func (t *Terminal) kittyCommand(kc kittyControl, data []byte) error {
+	id := uint32(kc.num("i"))
+	switch a := kc.str("a", "t"); a {
+	case "q":
+		_, err := kittyDecode(kc, data)
+		return err
+	case "t", "T":
+		img, err := kittyDecode(kc, data)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			t.kittyStore(id, img)
+		}
+		if a == "T" {
+			return t.kittyPlace(kc, id, img)
+		}
+	case "p":
+		img, ok := t.kitty.images[id]
+		if !ok {
+			return kittyError("ENOENT", "no image with id %d", id)
+		}
+		return t.kittyPlace(kc, id, img)
+	case "d":
+		t.kittyRemove(kc, id)
+	default:
+		return kittyError("EINVAL", "unsupported action %q", a)
+	}
+
+	return nil
+}
+
+// kittyReply tells the program how a command went, if it gave an id
+// and didn't ask us to be quiet.
+func (t *Terminal) kittyReply(kc kittyControl, err error) {
+	id, q := kc.num("i"), kc.num("q")
+	msg := "OK"
+	switch {
+	case id == 0 || kc.str("a", "t") == "d":
+		return
+	case err != nil && q < 2:
+		msg = err.Error()
+	case err != nil || q > 0:
+		return
+	}
+	t.Write([]byte(fmt.Sprintf("%c%cGi=%d;%s%c%c", ESC, APC, id, msg, ESC, ST)))
+}
+
+// kittyDecode returns the image sent in data, as described by kc.
+func kittyDecode(kc kittyControl, data []byte) (*image.NRGBA, error) {
+	if m := kc.str("t", "d"); m != "d" {
+		return nil, kittyError("EINVAL", "unsupported transmission medium %q", m)
+	}
+
+	switch o := kc.str("o", ""); o {
+	case "":
+	case "z":
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, kittyError("EINVAL", "invalid compressed data")
+		}
+		data, err = io.ReadAll(io.LimitReader(zr, MAX_IMAGE_BYTES+1))
+		if err != nil {
+			return nil, kittyError("EINVAL", "invalid compressed data")
+		}
+		if len(data) > MAX_IMAGE_BYTES {
+			return nil, kittyError("EFBIG", "image data too large")
+		}
+	default:
+		return nil, kittyError("EINVAL", "unsupported compression %q", o)
+	}
+
+	bpp := 4
+	switch f := kc.str("f", "32"); f {
+	case "100":
+		px, err := decodePixels(data)
+		if err != nil {
+			return nil, kittyError("EBADPNG", "%v", err)
+		}
+		return px.img, nil
+	case "24":
+		bpp = 3
+	case "32":
+	default:
+		return nil, kittyError("EINVAL", "unsupported format %q", f)
+	}
+
+	w, h := kc.num("s"), kc.num("v")
+	if err := checkPixels(w, h); err != nil {
+		return nil, kittyError("EINVAL", "%v", err)
+	}
+	if len(data) != w*h*bpp {
+		return nil, kittyError("ENODATA", "got %d bytes for a %dx%d image", len(data), w, h)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		copy(img.Pix[i*4:i*4+3], data[i*bpp:i*bpp+3])
+		img.Pix[i*4+3] = 0xff
+		if bpp == 4 {
+			img.Pix[i*4+3] = data[i*4+3]
+		}
+	}
+	return img, nil
+}
+
+// kittyStore keeps img for the program to place later.
+func (t *Terminal) kittyStore(id uint32, img *image.NRGBA) {
+	ks := t.kitty
+	if _, ok := ks.images[id]; !ok {
+		ks.order = append(ks.order, id)
+	}
+	ks.images[id] = img
+	if len(ks.order) > MAX_KITTY_IMAGES {
+		delete(ks.images, ks.order[0])
+		ks.order = ks.order[1:]
+	}
+}
+
+// kittyPlace shows the part of img kc asks for at the cursor.
+func (t *Terminal) kittyPlace(kc kittyControl, id uint32, img *image.NRGBA) error {
+	b := img.Bounds()
+	x, y := kc.num("x"), kc.num("y")
+	w, h := kc.num("w"), kc.num("h")
+	if w == 0 {
+		w = b.Dx() - x
+	}
+	if h == 0 {
+		h = b.Dy() - y
+	}
+	r := image.Rect(x, y, x+w, y+h).Intersect(b)
+	if r.Empty() {
+		return kittyError("EINVAL", "source rectangle outside the image")
+	}
+
+	si, err := newTermImage(toNRGBA(img.SubImage(r)), kc.num("r"), kc.num("c"))
+	if err != nil {
+		return kittyError("EINVAL", "%v", err)
+	}
+
+	move := IMAGE_CURSOR_AFTER
+	if kc.num("C") == 1 {
+		move = IMAGE_CURSOR_STAY
+	}
+	t.placeImage(si, move)
+
+	// Forget images that have since gone.
+	if len(t.kitty.placed) > 0 {
+		shown := t.fb.images()
+		for pi := range t.kitty.placed {
+			if _, ok := shown[pi.id]; !ok {
+				delete(t.kitty.placed, pi)
+			}
+		}
+	}
+	t.kitty.placed[si] = id
+
+	return nil
+}
+
+// kittyRemove removes the placements, and maybe the images, that kc
+// asks for. Lower case targets keep the images for later placement.
+func (t *Terminal) kittyRemove(kc kittyControl, id uint32) {
+	d := kc.str("d", "a")
+	var match func(pid uint32) bool
+	switch strings.ToLower(d) {
+	case "a":
+		match = func(uint32) bool { return true }
+	case "i":
+		match = func(pid uint32) bool { return pid == id }
+	default:
+		slog.Debug("unsupported kitty graphics deletion", "d", d)
+		return
+	}
+
+	gone := make(map[*termImage]bool)
+	for si, pid := range t.kitty.placed {
+		if match(pid) {
+			gone[si] = true
+			delete(t.kitty.placed, si)
+		}
+	}
+	t.removeImages(gone)
+
+	if d == strings.ToUpper(d) {
+		for _, pid := range t.kitty.order {
+			if match(pid) {
+				delete(t.kitty.images, pid)
+			}
+		}
+		t.kitty.order = slices.DeleteFunc(t.kitty.order, func(pid uint32) bool {
+			_, ok := t.kitty.images[pid]
+			return !ok
+		})
+	}
+}
+
+// kittyID returns the id an outer terminal knows an image by. Ids
+// are 32 bit and can't be 0.
+func kittyID(id uint64) uint32 {
+	return uint32(id%(1<<32-1)) + 1
+}
+
+// kittyImage returns the sequences that draw the cells of si from
+// (top, left) to (bottom, right), exclusive, at the cursor, using the
+// kitty graphics protocol. The image is sent again each time,
+// replacing any earlier placement of it, and the cursor doesn't move.
+func kittyImage(si *termImage, px *pixels, top, left, bottom, right int) string {
+	r := si.crop(px.img, top, left, bottom, right).Bounds()
+	ctrl := fmt.Sprintf("a=T,f=100,t=d,q=2,C=1,i=%d,x=%d,y=%d,w=%d,h=%d,c=%d,r=%d",
+		kittyID(si.id), r.Min.X, r.Min.Y, r.Dx(), r.Dy(), right-left, bottom-top)
+	data := base64.StdEncoding.EncodeToString(px.png())
+
+	var sb strings.Builder
+	sb.WriteString(kittyDelete(si.id))
+	for first := true; len(data) > 0; first = false {
+		n := min(len(data), KITTY_CHUNK_SIZE)
+		keys := "m=0"
+		if n < len(data) {
+			keys = "m=1"
+		}
+		if first {
+			keys = ctrl + "," + keys
+		}
+		fmt.Fprintf(&sb, "%c%cG%s;%s%c%c", ESC, APC, keys, data[:n], ESC, ST)
+		data = data[n:]
+	}
+	return sb.String()
+}
+
+// kittyDelete returns the sequence that removes the image with the
+// given id from an outer terminal using the kitty graphics protocol.
+func kittyDelete(id uint64) string {
+	return fmt.Sprintf("%c%cGa=d,d=I,q=2,i=%d%c%c", ESC, APC, kittyID(id), ESC, ST)
+}
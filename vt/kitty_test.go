@@ -0,0 +1,246 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// kittyCmd returns a kitty graphics command.
+func kittyCmd(ctrl string, data []byte) string {
+	return fmt.Sprintf("\x1b_G%s;%s\x1b\\", ctrl, base64.StdEncoding.EncodeToString(data))
+}
+
+func rgba(img *image.NRGBA) []byte {
+	return img.Pix
+}
+
+func pngData(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode() error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// shownImage returns the image with its top left tile at (row, col).
+func shownImage(t *testing.T, nt *Terminal, row, col int) *termImage {
+	t.Helper()
+	it := tileAt(nt, row, col)
+	if it == nil || it.row != 0 || it.col != 0 {
+		t.Fatalf("Got tile %v at (%d, %d), wanted the top left of an image", it, row, col)
+	}
+	return it.img
+}
+
+func TestKittyTransmitAndDisplay(t *testing.T) {
+	img := testImage(20, 40)
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(rgba(img))
+	zw.Close()
+
+	b64 := base64.StdEncoding.EncodeToString(rgba(img))
+	chunked := fmt.Sprintf("\x1b_Ga=T,f=32,s=20,v=40,i=5,m=1;%s\x1b\\\x1b_Gm=0;%s\x1b\\", b64[:4096], b64[4096:])
+
+	cases := []struct {
+		cmd  string
+		want string
+	}{
+		{kittyCmd("a=T,f=32,s=20,v=40,i=5", rgba(img)), "\x1b_Gi=5;OK\x1b\\"},
+		{kittyCmd("a=T,f=32,s=20,v=40", rgba(img)), ""},
+		{kittyCmd("a=T,f=32,s=20,v=40,i=5,q=1", rgba(img)), ""},
+		{chunked, "\x1b_Gi=5;OK\x1b\\"},
+		{kittyCmd("a=T,f=32,s=20,v=40,o=z,i=5", z.Bytes()), "\x1b_Gi=5;OK\x1b\\"},
+		{kittyCmd("a=T,f=100,i=5", pngData(t, img)), "\x1b_Gi=5;OK\x1b\\"},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte("\x1b[2;3H"))
+		if got := replies(t, nt, c.cmd); got != c.want {
+			t.Errorf("%d: Got reply %q, wanted %q", i, got, c.want)
+		}
+		si := shownImage(t, nt, 1, 2)
+		if si.rows != 2 || si.cols != 2 || !samePixels(si.px.img, img) {
+			t.Errorf("%d: Got %dx%d cell image, wanted 2x2 of the original", i, si.cols, si.rows)
+		}
+		if want := (cursor{2, 4}); !nt.cur.equal(want) {
+			t.Errorf("%d: Cursor at %s, wanted %s", i, nt.cur, want)
+		}
+	}
+}
+
+func TestKittyPlace(t *testing.T) {
+	img := testImage(20, 40)
+	nt, _ := NewTerminal(10, 20)
+	if got := replies(t, nt, kittyCmd("a=t,f=24,s=20,v=40,i=7", rgb(img))); got != "\x1b_Gi=7;OK\x1b\\" {
+		t.Errorf("Got reply %q to transmit", got)
+	}
+	if got := tileAt(nt, 0, 0); got != nil {
+		t.Errorf("Transmitting placed an image")
+	}
+
+	nt.Write([]byte("top\x1b[9;1H"))
+	if got := replies(t, nt, "\x1b_Ga=p,i=7,c=6,r=3,C=1\x1b\\"); got != "\x1b_Gi=7;OK\x1b\\" {
+		t.Errorf("Got reply %q to put", got)
+	}
+	si := shownImage(t, nt, 8, 0)
+	if si.rows != 3 || si.cols != 6 {
+		t.Errorf("Got %dx%d cell image, wanted 6x3", si.cols, si.rows)
+	}
+	if got := tileAt(nt, 9, 5); got == nil || got.row != 1 {
+		t.Errorf("Got tile %v at (9, 5), wanted the image's second row", got)
+	}
+	if want := (cursor{8, 0}); !nt.cur.equal(want) {
+		t.Errorf("Cursor at %s, wanted %s", nt.cur, want)
+	}
+	if got := nt.fb.String(); !strings.HasPrefix(got, "top") {
+		t.Errorf("Placing with C=1 scrolled")
+	}
+
+	// A source rectangle, sized from its width.
+	nt.Write([]byte("\x1b[H"))
+	replies(t, nt, "\x1b_Ga=p,i=7,x=10,w=10,c=1,q=2\x1b\\")
+	si = shownImage(t, nt, 0, 0)
+	if b := si.px.img.Bounds(); si.rows != 2 || si.cols != 1 || b.Dx() != 10 || b.Dy() != 40 {
+		t.Errorf("Got %dx%d cell image of %v, wanted 1x2 of the right half", si.cols, si.rows, b)
+	}
+}
+
+// rgb returns the pixels of img without their alpha.
+func rgb(img *image.NRGBA) []byte {
+	var ret []byte
+	for i := 0; i < len(img.Pix); i += 4 {
+		ret = append(ret, img.Pix[i:i+3]...)
+	}
+	return ret
+}
+
+func TestKittyErrors(t *testing.T) {
+	img := testImage(20, 40)
+	cases := []struct {
+		cmd  string
+		want string
+	}{
+		{"\x1b_Ga=p,i=3\x1b\\", "\x1b_Gi=3;ENOENT:no image with id 3\x1b\\"},
+		{"\x1b_Ga=p,i=3,q=2\x1b\\", ""},
+		{"\x1b_Ga=p,i=3,q=1\x1b\\", "\x1b_Gi=3;ENOENT:no image with id 3\x1b\\"},
+		{kittyCmd("a=T,t=f,i=3", []byte("/etc/passwd")), "\x1b_Gi=3;EINVAL:unsupported transmission medium \"f\"\x1b\\"},
+		{kittyCmd("a=T,s=20,v=41,i=3", rgba(img)), "\x1b_Gi=3;ENODATA:got 3200 bytes for a 20x41 image\x1b\\"},
+		{kittyCmd("a=T,s=5000,v=5000,i=3", rgba(img)), "\x1b_Gi=3;EINVAL:5000x5000: image too large\x1b\\"},
+		{"\x1b_Ga=T,i=3;!!!!\x1b\\", "\x1b_Gi=3;EINVAL:invalid base64 payload\x1b\\"},
+		{kittyCmd("a=T,f=100,i=3", []byte("not a png")), "\x1b_Gi=3;EBADPNG:image: unknown format\x1b\\"},
+		{kittyCmd("a=x,i=3", nil), "\x1b_Gi=3;EINVAL:unsupported action \"x\"\x1b\\"},
+		{kittyCmd("a=q,s=20,v=40,i=3", rgba(img)), "\x1b_Gi=3;OK\x1b\\"},
+		{"\x1b_Ga=p,i=3" + strings.Repeat(",", MAX_APC_LEN) + "\x1b\\", ""},
+		// PM and SOS strings are still ignored.
+		{"\x1b^Ga=p,i=3\x1b\\\x1bXGa=p,i=3\x1b\\", ""},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		if got := replies(t, nt, c.cmd+"ok"); got != c.want {
+			t.Errorf("%d: Got reply %q, wanted %q", i, got, c.want)
+		}
+		if len(nt.fb.images()) != 0 {
+			t.Errorf("%d: Image placed", i)
+		}
+		if got := nt.fb.String(); !strings.HasPrefix(got, "ok") {
+			t.Errorf("%d: Output after the command lost", i)
+		}
+	}
+}
+
+func TestKittyDelete(t *testing.T) {
+	img := testImage(20, 40)
+	setup := kittyCmd("a=t,s=20,v=40,i=1,q=2", rgba(img)) + kittyCmd("a=t,s=20,v=40,i=2,q=2", rgba(img)) +
+		"\x1b_Ga=p,i=1,q=2\x1b\\\x1b[5;1H\x1b_Ga=p,i=2,q=2\x1b\\"
+
+	cases := []struct {
+		del       string
+		shown     int
+		placeable []bool // images 1 and 2
+	}{
+		{"a=d", 0, []bool{true, true}},
+		{"a=d,d=A", 0, []bool{false, false}},
+		{"a=d,d=i,i=1", 1, []bool{true, true}},
+		{"a=d,d=I,i=1", 1, []bool{false, true}},
+		{"a=d,d=x", 2, []bool{true, true}},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte(setup))
+		if got := replies(t, nt, "\x1b_G"+c.del+"\x1b\\"); got != "" {
+			t.Errorf("%d: Got reply %q, wanted none", i, got)
+		}
+		if got := len(nt.fb.images()); got != c.shown {
+			t.Errorf("%d: Got %d images shown, wanted %d", i, got, c.shown)
+		}
+		for id, want := range c.placeable {
+			if _, got := nt.kitty.images[uint32(id+1)]; got != want {
+				t.Errorf("%d: Got image %d kept %t, wanted %t", i, id+1, got, want)
+			}
+		}
+	}
+}
+
+func TestKittyImage(t *testing.T) {
+	nt := sixelTerminal()
+	si := shownImage(t, nt, 1, 2)
+
+	cases := []struct {
+		top, left, bottom, right int
+	}{
+		{0, 0, 3, 3},
+		{1, 1, 3, 2},
+	}
+
+	for i, c := range cases {
+		got := kittyImage(si, si.px, c.top, c.left, c.bottom, c.right)
+		if !strings.HasPrefix(got, kittyDelete(si.id)) {
+			t.Errorf("%d: Got %q, wanted it to remove the image first", i, got[:40])
+		}
+
+		// We understand what we send.
+		ot, _ := NewTerminal(10, 20)
+		ot.Write([]byte(got))
+		oi := shownImage(t, ot, 0, 0)
+		if oi.rows != c.bottom-c.top || oi.cols != c.right-c.left {
+			t.Errorf("%d: Got %dx%d cell image, wanted %dx%d", i, oi.cols, oi.rows, c.right-c.left, c.bottom-c.top)
+		}
+		if want := si.crop(si.px.img, c.top, c.left, c.bottom, c.right); !samePixels(oi.px.img, want) {
+			t.Errorf("%d: Got different pixels", i)
+		}
+		if !ot.cur.equal(cursor{0, 0}) {
+			t.Errorf("%d: Cursor moved to %s", i, ot.cur)
+		}
+	}
+
+	// Large images are sent in chunks.
+	big := testImage(400, 400)
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 400; x++ {
+			big.Pix[(y*400+x)*4] = uint8(x * y)
+		}
+	}
+	bi, _ := newTermImage(big, 0, 0)
+	got := kittyImage(bi, bi.px, 0, 0, bi.rows, bi.cols)
+	if n := strings.Count(got, "\x1b_G"); n < 3 {
+		t.Errorf("Got %d commands, wanted the image in chunks", n)
+	}
+	for _, cmd := range strings.Split(got, "\x1b\\") {
+		if _, data, _ := strings.Cut(cmd, ";"); len(data) > KITTY_CHUNK_SIZE {
+			t.Errorf("Got a chunk of %d bytes", len(data))
+		}
+	}
+}
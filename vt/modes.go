@@ -35,10 +35,16 @@ var modeDefaults = map[string]*mode{
 	"?1006": newMode("MOUSE_SGR", MOUSE_SGR, false, CSI_MODE_RESET),
 	"?1007": newMode("MOUSE_ALT", MOUSE_ALT, false, CSI_MODE_RESET),
 	"?1015": newMode("MOUSE_URXVT", MOUSE_URXVT, false, CSI_MODE_RESET),
+	"?1036": newMode("META_ESC", META_ESC, false, CSI_MODE_RESET),
+	"?1039": newMode("ALT_ESC", ALT_ESC, false, CSI_MODE_RESET),
 	"?1047": newMode("XTERM_ALT_BUFFER", XTERM_ALT_BUFFER, false, CSI_MODE_RESET),
 	"?1048": newMode("XTERM_SAVE_RESTORE", XTERM_SAVE_RESTORE, false, CSI_MODE_RESET),
 	"?1049": newMode("XTERM_SAVE_ALT", XTERM_SAVE_ALT, false, CSI_MODE_RESET),
+	"?1070": newPermanentMode("PRIVATE_COLOR_REGS", PRIVATE_COLOR_REGS, false, CSI_MODE_SET),
 	"?2004": newMode("BRACKET_PASTE", BRACKET_PASTE, false, CSI_MODE_RESET),
+	"?2026": newMode("SYNC_OUTPUT", SYNC_OUTPUT, false, CSI_MODE_RESET),
+	// We go by the width of each rune, not of each cluster.
+	"?2027": newPermanentMode("GRAPHEME_CLUSTERS", GRAPHEME_CLUSTERS, false, CSI_MODE_RESET),
 }
 
 var modeNameToID = map[string]string{
@@ -65,10 +71,15 @@ var modeNameToID = map[string]string{
 	"MOUSE_SGR":              "?1006",
 	"MOUSE_ALT":              "?1007",
 	"MOUSE_URXVT":            "?1015",
+	"META_ESC":               "?1036",
+	"ALT_ESC":                "?1039",
 	"XTERM_ALT_BUFFER":       "?1047",
 	"XTERM_SAVE_RESTORE":     "?1048", // xterm save/restore cursor
 	"XTERM_SAVE_ALT":         "?1049",
+	"PRIVATE_COLOR_REGS":     "?1070",
 	"BRACKET_PASTE":          "?2004",
+	"SYNC_OUTPUT":            "?2026",
+	"GRAPHEME_CLUSTERS":      "?2027",
 }
 
 // Modes in this list will be transported to the client. All other
@@ -93,6 +104,9 @@ var transportModes = []string{
 	"MOUSE_ALT",
 	"MOUSE_URXVT",
 	"BRACKET_PASTE",
+	// How keys are sent is up to the outer terminal.
+	"META_ESC",
+	"ALT_ESC",
 }
 
 // For convenience in logging state changes
@@ -102,18 +116,20 @@ var modeStateNames = map[rune]string{
 }
 
 type mode struct {
-	state  rune // CSI_MODE_SET/h or CSI_MODE_RESET/l
-	public bool // This is an ansi mode, if true, DEC private if false
-	code   int  // The numeric id for the code that gets placed in params
-	name   string
+	state     rune // CSI_MODE_SET/h or CSI_MODE_RESET/l
+	public    bool // This is an ansi mode, if true, DEC private if false
+	code      int  // The numeric id for the code that gets placed in params
+	name      string
+	permanent bool // The state can't be changed
 }
 
 func (m *mode) copy() *mode {
 	return &mode{
-		state:  m.state,
-		public: m.public,
-		code:   m.code,
-		name:   m.name,
+		state:     m.state,
+		public:    m.public,
+		code:      m.code,
+		name:      m.name,
+		permanent: m.permanent,
 	}
 }
 
@@ -123,6 +139,10 @@ func (m *mode) setState(state rune) {
 		slog.Debug("mode setState called with invalid state", "state", state)
 		return
 	}
+	if m.permanent {
+		slog.Debug("ignoring change to permanent mode", "name", m.name, "state", modeStateNames[state])
+		return
+	}
 	m.state = state
 }
 
@@ -130,6 +150,19 @@ func (m *mode) enabled() bool {
 	return m.state == CSI_MODE_SET
 }
 
+// decrqm returns what a DECRQM reply says about m.
+func (m *mode) decrqm() int {
+	switch {
+	case m.permanent && m.enabled():
+		return DECRQM_PERMANENT_SET
+	case m.permanent:
+		return DECRQM_PERMANENT_RESET
+	case m.enabled():
+		return DECRQM_SET
+	}
+	return DECRQM_RESET
+}
+
 func (m *mode) ansiString() string {
 	if m.public {
 		return fmt.Sprintf("%c%c%d%c", ESC, CSI, m.code, m.state)
@@ -147,3 +180,8 @@ func (m *mode) equal(other *mode) bool {
 func newMode(name string, code int, public bool, state rune) *mode {
 	return &mode{name: name, code: code, public: public, state: state}
 }
+
+// newPermanentMode returns a mode we recognize but can't change.
+func newPermanentMode(name string, code int, public bool, state rune) *mode {
+	return &mode{name: name, code: code, public: public, state: state, permanent: true}
+}
@@ -3,6 +3,7 @@
 package vt
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -23,3 +24,53 @@ func TestModeAnsiString(t *testing.T) {
 		}
 	}
 }
+
+func TestDECRQM(t *testing.T) {
+	cases := []struct {
+		setup, query string
+		want         string
+	}{
+		{"", "\x1b[?25$p", "\x1b[?25;1$y"},
+		{"\x1b[?25l", "\x1b[?25$p", "\x1b[?25;2$y"},
+		{"", "\x1b[4$p", "\x1b[4;2$y"},
+		{"\x1b[4h", "\x1b[4$p", "\x1b[4;1$y"},
+		{"", "\x1b[?4$p", "\x1b[?4;2$y"}, // not IRM
+		{"\x1b[?1004h", "\x1b[?1004$p", "\x1b[?1004;1$y"},
+		{"\x1b[?2004h\x1b[?2004l", "\x1b[?2004$p", "\x1b[?2004;2$y"},
+		{"\x1b[?2026h", "\x1b[?2026$p", "\x1b[?2026;1$y"},
+		{"\x1b[?1036h\x1b[?1039h", "\x1b[?1036$p\x1b[?1039$p", "\x1b[?1036;1$y\x1b[?1039;1$y"},
+		{"\x1b[?1070l", "\x1b[?1070$p", "\x1b[?1070;3$y"},
+		{"\x1b[?2027h", "\x1b[?2027$p", "\x1b[?2027;4$y"},
+		{"\x1b[?1049h\x1bc", "\x1b[?1049$p", "\x1b[?1049;2$y"},
+		{"", "\x1b[?9999$p", "\x1b[?9999;0$y"},
+		{"", "\x1b[2004$p", "\x1b[2004;0$y"},
+		{"", "\x1b[$p", "\x1b[0;0$y"},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte(c.setup))
+		if got := replies(t, nt, c.query); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
+
+func TestDECRQMDefaults(t *testing.T) {
+	want := map[rune]int{CSI_MODE_SET: DECRQM_SET, CSI_MODE_RESET: DECRQM_RESET}
+	permanent := map[rune]int{CSI_MODE_SET: DECRQM_PERMANENT_SET, CSI_MODE_RESET: DECRQM_PERMANENT_RESET}
+
+	for id, m := range modeDefaults {
+		w := want[m.state]
+		if m.permanent {
+			w = permanent[m.state]
+		}
+		nt, _ := NewTerminal(10, 20)
+		if got, want := replies(t, nt, fmt.Sprintf("\x1b[%s$p", id)), fmt.Sprintf("\x1b[%s;%d$y", id, w); got != want {
+			t.Errorf("%s: Got %q, wanted %q", m.name, got, want)
+		}
+		if got := modeNameToID[m.name]; got != id {
+			t.Errorf("%s: Got ID %q from modeNameToID, wanted %q", m.name, got, id)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// painter writes the sequences that paint cells on a terminal. It
+// tracks the pen and cursor of that terminal so it can pick the
+// cheapest way to move around and to draw runs of cells.
+type painter struct {
+	sb       strings.Builder
+	f        *format
+	hl       *osc8
+	row, col int // -1 when unknown
+	// The last column was just written, so the next rune wraps
+	// and relative moves are unreliable.
+	wrapNext bool
+	cols     int
+	// What the terminal can do. Images it can't draw are painted
+	// with the runes that stand in for them, and formats are
+	// painted as well as it can show them.
+	disp *display
+}
+
+// display is what the terminal we paint on can do beyond the basics:
+// which image protocols it has, whether it has styled and colored
+// underlines and whether it can repeat runes with REP. A nil display
+// has none of them.
+type display struct {
+	gfx      Graphics
+	store    *imageStore
+	styledUL bool
+	rep      bool
+}
+
+// protocol returns the protocol we draw images with, preferring those
+// that keep all of their pixels.
+func (d *display) protocol() Graphics {
+	if d == nil {
+		return 0
+	}
+	for _, g := range []Graphics{GRAPHICS_KITTY, GRAPHICS_ITERM2, GRAPHICS_SIXEL} {
+		if d.gfx&g != 0 {
+			return g
+		}
+	}
+	return 0
+}
+
+// pixels returns the pixels of si, if we can draw it.
+func (d *display) pixels(si *termImage) *pixels {
+	switch {
+	case d == nil || d.gfx == 0:
+		return nil
+	case si.px != nil:
+		return si.px
+	case d.store != nil:
+		return d.store.get(si.id)
+	}
+	return nil
+}
+
+// SetGraphics says which image protocols the terminal that diffs
+// from t are painted on understands. Images are drawn with one of
+// them, if any, or a label stands in for them.
+func (t *Terminal) SetGraphics(g Graphics) {
+	t.gfx.Store(uint32(g))
+}
+
+// SetStyledUnderlines says whether the terminal that diffs from t are
+// painted on understands SGR 4:n underline styles and SGR 58
+// underline colors. Without them, styled underlines are painted as
+// plain ones.
+func (t *Terminal) SetStyledUnderlines(on bool) {
+	t.styledUL.Store(on)
+}
+
+// SetRepeat says whether the terminal that diffs from t are painted
+// on understands REP. Without it, runs of a rune are written out.
+func (t *Terminal) SetRepeat(on bool) {
+	t.rep.Store(on)
+}
+
+func (t *Terminal) display() *display {
+	g, ul, rep := Graphics(t.gfx.Load()), t.styledUL.Load(), t.rep.Load()
+	if g == 0 && !ul && !rep {
+		return nil
+	}
+	return &display{gfx: g, store: t.store, styledUL: ul, rep: rep}
+}
+
+// repeat returns whether the terminal understands REP.
+func (d *display) repeat() bool {
+	return d != nil && d.rep
+}
+
+// format returns f as the terminal can show it, with any underline
+// plain and in the text's color if it can't do better.
+func (d *display) format(f *format) *format {
+	if (d != nil && d.styledUL) || (f.ul == UL_SINGLE && f.ulc.colType == UNSET) {
+		return f
+	}
+	nf := f.copy()
+	nf.ul = UL_SINGLE
+	nf.ulc = color{}
+	return nf
+}
+
+func newPainter(cols int) *painter {
+	return &painter{f: defFmt, hl: defOSC8, row: -1, col: -1, cols: cols}
+}
+
+func csiN(n int, cmd rune) string {
+	return fmt.Sprintf("%c%c%d%c", ESC, CSI, n, cmd)
+}
+
+// horiz returns the shortest relative move of n columns, right if
+// positive.
+func horiz(n int) string {
+	switch {
+	case n == 0:
+		return ""
+	case n == 1:
+		return fmt.Sprintf("%c%c%c", ESC, CSI, CSI_CUF)
+	case n > 0:
+		return csiN(n, CSI_CUF)
+	case n >= -3:
+		return strings.Repeat("\b", -n)
+	default:
+		return csiN(-n, CSI_CUB)
+	}
+}
+
+func (p *painter) setPen(f *format, hl *osc8) {
+	f = p.disp.format(f)
+	if !p.f.equal(f) {
+		p.sb.Write(p.f.diff(f))
+		p.f = f
+	}
+	if !p.hl.equal(hl) {
+		p.sb.WriteString(hl.ansiString())
+		p.hl = hl
+	}
+}
+
+// literal returns cells as they'd be written with the current pen,
+// if they can be.
+func (p *painter) literal(cells []cell) (string, bool) {
+	var sb strings.Builder
+	for _, c := range cells {
+		if c.isFragment() || c.tile != nil || !c.f.equal(p.f) || !c.hl.equal(p.hl) {
+			return "", false
+		}
+		sb.WriteRune(c.r)
+	}
+	return sb.String(), true
+}
+
+// moveTo moves the cursor to col on row, whose cells are those we're
+// painting. Skipping a few cells is sometimes cheapest done by
+// rewriting them.
+func (p *painter) moveTo(row, col int, cells []cell) {
+	if p.row == row && p.col == col && !p.wrapNext {
+		return
+	}
+
+	best := cursor{row, col}.ansiString()
+	try := func(s string) {
+		if len(s) < len(best) {
+			best = s
+		}
+	}
+
+	switch {
+	case p.row == row:
+		try(csiN(col+1, CSI_CHA))
+		try("\r" + horiz(col))
+		if !p.wrapNext {
+			try(horiz(col - p.col))
+			if n := col - p.col; n > 0 && n < len(best) {
+				if s, ok := p.literal(cells[p.col:col]); ok {
+					try(s)
+				}
+			}
+		}
+	case p.row >= 0 && row == p.row+1:
+		try("\r\n" + horiz(col))
+		if !p.wrapNext {
+			try("\n" + horiz(col-p.col))
+		}
+	}
+
+	p.sb.WriteString(best)
+	p.row, p.col, p.wrapNext = row, col, false
+}
+
+// advance moves the cursor as writing n columns would.
+func (p *painter) advance(n int) {
+	p.col += n
+	if p.col >= p.cols {
+		p.col, p.wrapNext = p.cols-1, true
+	}
+}
+
+// paintRow paints the cells of row that changed is true for.
+func (p *painter) paintRow(r int, row []cell, changed func(c int) bool) {
+	for c := 0; c < len(row); {
+		dc := &row[c]
+		if dc.isSecondaryFrag() || !changed(c) {
+			c++
+			continue
+		}
+
+		if dc.isBlank() {
+			// Blanks to the end of the row are erased, if
+			// enough of them changed. Otherwise, a run of
+			// changed blanks is erased if that's shorter,
+			// including the move past them.
+			end, n := c, 0
+			for end < len(row) && row[end].isBlank() {
+				if changed(end) {
+					n++
+				}
+				end++
+			}
+			el := fmt.Sprintf("%c%c%c", ESC, CSI, CSI_EL)
+			if end == len(row) && n > len(el) {
+				p.moveTo(r, c, row)
+				p.setPen(defFmt, defOSC8)
+				p.sb.WriteString(el)
+				c = end
+				continue
+			}
+
+			n = 0
+			for c+n < end && changed(c+n) {
+				n++
+			}
+			if ech := csiN(n, CSI_ECH); len(ech)+len(horiz(n)) < n {
+				p.moveTo(r, c, row)
+				p.setPen(defFmt, defOSC8)
+				p.sb.WriteString(ech)
+				c += n
+				continue
+			}
+		}
+
+		p.moveTo(r, c, row)
+		p.setPen(dc.f, dc.hl)
+		if dc.tile != nil && p.disp.pixels(dc.tile.img) != nil {
+			// The image is drawn over this later.
+			p.sb.WriteByte(' ')
+		} else {
+			p.sb.WriteRune(dc.r)
+		}
+		if dc.isPrimaryFrag() {
+			p.advance(2)
+			c += 2
+			continue
+		}
+		p.advance(1)
+		c++
+
+		// Repeat the rune if it's cheaper than writing it
+		// out. Any unchanged cells caught up in this are
+		// just rewritten as they are.
+		if !p.disp.repeat() {
+			continue
+		}
+		n := 0
+		for c+n < len(row) && row[c+n].equal(dc) {
+			n++
+		}
+		if rep := csiN(n, CSI_REP); n > 0 && len(rep) < n*utf8.RuneLen(dc.r) {
+			p.sb.WriteString(rep)
+			p.advance(n)
+			c += n
+		}
+	}
+}
+
+// paintImages draws the images, of those placed in f, that are on
+// screen and that we have the pixels of. Text written over part of an
+// image generally clears it, so they're drawn after the text. Unless
+// the protocol lets us leave the cursor be, the bottom row is left
+// out, as a terminal will scroll if an image reaches it.
+func (p *painter) paintImages(f *framebuffer, images []imagePlacement) {
+	proto := p.disp.protocol()
+	for _, ip := range images {
+		px := p.disp.pixels(ip.img)
+		if px == nil {
+			continue
+		}
+
+		bottom := f.rows()
+		if proto != GRAPHICS_KITTY {
+			bottom -= 1
+		}
+		top, left := max(ip.row, 0), max(ip.col, 0)
+		bottom, right := min(ip.row+ip.img.rows, bottom), min(ip.col+ip.img.cols, f.cols())
+		if top >= bottom || left >= right {
+			continue
+		}
+
+		// The cells of the image that are shown.
+		top, left, bottom, right = top-ip.row, left-ip.col, bottom-ip.row, right-ip.col
+		p.moveTo(ip.row+top, ip.col+left, f.row(ip.row+top))
+		switch proto {
+		case GRAPHICS_KITTY:
+			p.sb.WriteString(kittyImage(ip.img, px, top, left, bottom, right))
+		case GRAPHICS_ITERM2:
+			p.sb.WriteString(itermImage(ip.img, px, top, left, bottom, right))
+		case GRAPHICS_SIXEL:
+			img := scaleImage(ip.img.crop(px.img, top, left, bottom, right),
+				(right-left)*IMAGE_CELL_WIDTH, (bottom-top)*IMAGE_CELL_HEIGHT)
+			p.sb.WriteString(sixelDCS(encodeSixel(img)))
+		}
+		p.row, p.col, p.wrapNext = -1, -1, false
+	}
+}
+
+func (p *painter) bytes() []byte {
+	return []byte(p.sb.String())
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHoriz(t *testing.T) {
+	cases := []struct {
+		n    int
+		want string
+	}{
+		{0, ""},
+		{1, "\x1b[C"},
+		{12, "\x1b[12C"},
+		{-1, "\b"},
+		{-3, "\b\b\b"},
+		{-10, "\x1b[10D"},
+	}
+
+	for i, c := range cases {
+		if got := horiz(c.n); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
+
+func TestPainterMoveTo(t *testing.T) {
+	row := newRow(80)
+	row[5] = *newCell('x', &format{fg: newColor(FG_RED)}, defOSC8)
+
+	cases := []struct {
+		from     cursor
+		wrapNext bool
+		to       cursor
+		want     string
+	}{
+		{cursor{-1, -1}, false, cursor{3, 4}, "\x1b[4;5H"},
+		{cursor{3, 4}, false, cursor{3, 4}, ""},
+		{cursor{3, 4}, true, cursor{3, 4}, "\x1b[5G"},
+		{cursor{3, 0}, false, cursor{3, 2}, "  "},      // rewrite blanks
+		{cursor{3, 4}, false, cursor{3, 7}, "\x1b[8G"}, // can't rewrite x
+		{cursor{3, 10}, false, cursor{3, 60}, "\x1b[61G"},
+		{cursor{3, 10}, false, cursor{3, 8}, "\b\b"},
+		{cursor{3, 60}, false, cursor{3, 0}, "\r"},
+		{cursor{3, 60}, false, cursor{4, 0}, "\r\n"},
+		{cursor{3, 79}, true, cursor{4, 0}, "\r\n"},
+		{cursor{3, 10}, false, cursor{4, 10}, "\n"},
+		{cursor{3, 10}, false, cursor{9, 10}, "\x1b[10;11H"},
+	}
+
+	for i, c := range cases {
+		p := newPainter(80)
+		p.row, p.col, p.wrapNext = c.from.row, c.from.col, c.wrapNext
+		p.moveTo(c.to.row, c.to.col, row)
+		if got := p.sb.String(); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+		if p.row != c.to.row || p.col != c.to.col || p.wrapNext {
+			t.Errorf("%d: Painter at (%d, %d)/%t, wanted %s", i, p.row, p.col, p.wrapNext, c.to)
+		}
+	}
+}
+
+func TestPaintRow(t *testing.T) {
+	red := &format{fg: newColor(FG_RED)}
+	src := newRow(40)
+	for i := range src {
+		src[i] = *newCell('a', defFmt, defOSC8)
+	}
+
+	rule := newRow(40)
+	for i := range rule {
+		rule[i] = *newCell('=', red, defOSC8)
+	}
+
+	mixed := newRow(40)
+	copy(mixed, src)
+	for i := 2; i < 20; i++ {
+		mixed[i] = *defaultCell()
+	}
+
+	cases := []struct {
+		dest []cell
+		rep  bool
+		want string
+	}{
+		{newRow(40), true, "\x1b[H\x1b[K"},
+		{rule, true, "\x1b[H\x1b[31m=\x1b[39b"},
+		{rule, false, "\x1b[H\x1b[31m" + strings.Repeat("=", 40)},
+		{mixed, true, "\x1b[;3H\x1b[18X"},
+		{mixed, false, "\x1b[;3H\x1b[18X"},
+	}
+
+	for i, c := range cases {
+		p := newPainter(40)
+		if c.rep {
+			p.disp = &display{rep: true}
+		}
+		p.paintRow(0, c.dest, func(col int) bool { return !src[col].equal(&c.dest[col]) })
+		if got := string(p.bytes()); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// The palette holds the 256 indexed colors and then the default
+// foreground, background and cursor colors.
+const (
+	PALETTE_FG = 256 + iota
+	PALETTE_BG
+	PALETTE_CURSOR
+	PALETTE_SIZE
+)
+
+// rgbColor has 16 bits per channel, as X11 color specs do.
+type rgbColor struct {
+	r, g, b uint16
+}
+
+func rgb8(r, g, b uint8) rgbColor {
+	return rgbColor{uint16(r) * 0x101, uint16(g) * 0x101, uint16(b) * 0x101}
+}
+
+// spec returns c as xterm reports colors.
+func (c rgbColor) spec() string {
+	return fmt.Sprintf("rgb:%04x/%04x/%04x", c.r, c.g, c.b)
+}
+
+// parseColorSpec parses the X11 color specs programs use, either
+// rgb:r/g/b, with 1 to 4 hex digits scaled to the channel, or #rgb
+// with 1 to 4 digits per channel giving the high bits. Color names
+// aren't supported.
+func parseColorSpec(spec string) (rgbColor, bool) {
+	var parts []string
+	scale := true
+	switch {
+	case strings.HasPrefix(spec, "rgb:"):
+		parts = strings.Split(spec[4:], "/")
+	case strings.HasPrefix(spec, "#"):
+		h := spec[1:]
+		n := len(h) / 3
+		if len(h)%3 != 0 {
+			return rgbColor{}, false
+		}
+		parts = []string{h[:n], h[n : 2*n], h[2*n:]}
+		scale = false
+	}
+	if len(parts) != 3 {
+		return rgbColor{}, false
+	}
+
+	var vals [3]uint16
+	for i, p := range parts {
+		if len(p) < 1 || len(p) > 4 {
+			return rgbColor{}, false
+		}
+		v, err := strconv.ParseUint(p, 16, 16)
+		if err != nil {
+			return rgbColor{}, false
+		}
+		bits := 4 * uint(len(p))
+		if scale {
+			top := uint64(1<<bits - 1)
+			v = (v*0xffff + top/2) / top
+		} else {
+			v <<= 16 - bits
+		}
+		vals[i] = uint16(v)
+	}
+
+	return rgbColor{vals[0], vals[1], vals[2]}, true
+}
+
+// xtermColors are xterm's defaults, which we use until the client
+// tells us the outer terminal's.
+var xtermColors = func() *[PALETTE_SIZE]rgbColor {
+	var p [PALETTE_SIZE]rgbColor
+	base := [16][3]uint8{
+		{0x00, 0x00, 0x00}, {0xcd, 0x00, 0x00}, {0x00, 0xcd, 0x00}, {0xcd, 0xcd, 0x00},
+		{0x00, 0x00, 0xee}, {0xcd, 0x00, 0xcd}, {0x00, 0xcd, 0xcd}, {0xe5, 0xe5, 0xe5},
+		{0x7f, 0x7f, 0x7f}, {0xff, 0x00, 0x00}, {0x00, 0xff, 0x00}, {0xff, 0xff, 0x00},
+		{0x5c, 0x5c, 0xff}, {0xff, 0x00, 0xff}, {0x00, 0xff, 0xff}, {0xff, 0xff, 0xff},
+	}
+	for i, c := range base {
+		p[i] = rgb8(c[0], c[1], c[2])
+	}
+
+	// The 6x6x6 color cube, then 24 grays.
+	levels := [6]uint8{0, 95, 135, 175, 215, 255}
+	for i := 0; i < 216; i++ {
+		p[16+i] = rgb8(levels[i/36], levels[i/6%6], levels[i%6])
+	}
+	for i := 0; i < 24; i++ {
+		v := uint8(8 + 10*i)
+		p[232+i] = rgb8(v, v, v)
+	}
+
+	p[PALETTE_FG] = p[7]
+	p[PALETTE_BG] = p[0]
+	p[PALETTE_CURSOR] = p[7]
+	return &p
+}()
+
+// palette is the colors programs see. It's never changed once made,
+// so terminal copies can share it. The defaults are the outer
+// terminal's and set holds the colors programs have changed.
+type palette struct {
+	defaults *[PALETTE_SIZE]rgbColor
+	set      map[int]rgbColor
+}
+
+var defPalette = &palette{defaults: xtermColors}
+
+func (p *palette) color(i int) rgbColor {
+	if c, ok := p.set[i]; ok {
+		return c
+	}
+	return p.defaults[i]
+}
+
+func (p *palette) with(i int, c rgbColor) *palette {
+	np := &palette{defaults: p.defaults, set: maps.Clone(p.set)}
+	if np.set == nil {
+		np.set = make(map[int]rgbColor)
+	}
+	np.set[i] = c
+	return np
+}
+
+// without returns p with the colors at idx, or all of them if none
+// are given, back to their defaults.
+func (p *palette) without(idx ...int) *palette {
+	np := &palette{defaults: p.defaults}
+	if len(idx) > 0 {
+		np.set = maps.Clone(p.set)
+		for _, i := range idx {
+			delete(np.set, i)
+		}
+	}
+	return np
+}
+
+func (p *palette) withDefaults(d *[PALETTE_SIZE]rgbColor) *palette {
+	return &palette{defaults: d, set: p.set}
+}
+
+// equal compares the colors programs have changed. The defaults are
+// the outer terminal's, so don't need painting.
+func (p *palette) equal(other *palette) bool {
+	return maps.Equal(p.set, other.set)
+}
+
+// colorName returns the OSC command and parameters that set or query
+// the color at i.
+func colorName(i int) string {
+	if i < PALETTE_FG {
+		return fmt.Sprintf("%s;%d", OSC_PALETTE, i)
+	}
+	return strconv.Itoa(i - PALETTE_FG + 10)
+}
+
+// resetName returns the OSC command and parameters that reset the
+// color at i. The resets are numbered 100 after the commands that set
+// the colors.
+func resetName(i int) string {
+	if i < PALETTE_FG {
+		return fmt.Sprintf("%s;%d", OSC_PALETTE_RESET, i)
+	}
+	return strconv.Itoa(i - PALETTE_FG + 110)
+}
+
+// diff returns the OSC commands that move the outer terminal's colors
+// from src's to dest's.
+func (src *palette) diff(dest *palette) string {
+	var sb strings.Builder
+	for i := 0; i < PALETTE_SIZE; i++ {
+		sc, sok := src.set[i]
+		dc, dok := dest.set[i]
+		switch {
+		case dok && (!sok || sc != dc):
+			sb.WriteString(fmt.Sprintf("%c%c%s;%s%c", ESC, OSC, colorName(i), dc.spec(), BEL))
+		case sok && !dok:
+			sb.WriteString(fmt.Sprintf("%c%c%s%c", ESC, OSC, resetName(i), BEL))
+		}
+	}
+	return sb.String()
+}
+
+func (p *palette) proto() *goshpb.Palette {
+	colors := make([]*goshpb.PaletteColor, 0, len(p.set))
+	for i := 0; i < PALETTE_SIZE; i++ {
+		if c, ok := p.set[i]; ok {
+			colors = append(colors, c.proto(i))
+		}
+	}
+	return goshpb.Palette_builder{Colors: colors}.Build()
+}
+
+func (c rgbColor) proto(i int) *goshpb.PaletteColor {
+	return goshpb.PaletteColor_builder{
+		Index: proto.Uint32(uint32(i)),
+		Red:   proto.Uint32(uint32(c.r)),
+		Green: proto.Uint32(uint32(c.g)),
+		Blue:  proto.Uint32(uint32(c.b)),
+	}.Build()
+}
+
+func colorsFromProto(p *goshpb.Palette) (map[int]rgbColor, error) {
+	colors := make(map[int]rgbColor)
+	for _, pc := range p.GetColors() {
+		i, r, g, b := pc.GetIndex(), pc.GetRed(), pc.GetGreen(), pc.GetBlue()
+		if i >= PALETTE_SIZE || r > 0xffff || g > 0xffff || b > 0xffff {
+			return nil, fmt.Errorf("invalid palette color %d (%d, %d, %d): %w", i, r, g, b, invalidDiff)
+		}
+		colors[int(i)] = rgbColor{uint16(r), uint16(g), uint16(b)}
+	}
+	return colors, nil
+}
+
+// PaletteColor returns the color at index in spec, as an outer
+// terminal reports it, for a PALETTE payload.
+func PaletteColor(index int, spec string) (*goshpb.PaletteColor, bool) {
+	c, ok := parseColorSpec(spec)
+	if !ok || index < 0 || index >= PALETTE_SIZE {
+		return nil, false
+	}
+	return c.proto(index), true
+}
+
+// SetPalette sets the colors programs see until they change them,
+// which should be the outer terminal's so that queries are answered
+// correctly.
+func (t *Terminal) SetPalette(p *goshpb.Palette) error {
+	colors, err := colorsFromProto(p)
+	if err != nil {
+		return err
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	d := *t.pal.defaults
+	for i, c := range colors {
+		d[i] = c
+	}
+	t.pal = t.pal.withDefaults(&d)
+	return nil
+}
+
+// oscColor handles the OSC commands that set, query and reset
+// colors. args is everything after the command.
+func (t *Terminal) oscColor(cmd, args string) {
+	switch cmd {
+	case OSC_PALETTE:
+		parts := strings.Split(args, ";")
+		for i := 0; i+1 < len(parts); i += 2 {
+			idx, err := strconv.Atoi(parts[i])
+			if err != nil || idx < 0 || idx >= PALETTE_FG {
+				slog.Debug("invalid palette index", "index", parts[i])
+				continue
+			}
+			t.colorSpec(idx, parts[i+1])
+		}
+	case OSC_FG, OSC_BG, OSC_CURSOR_COLOR:
+		// Any further specs are for the colors that follow,
+		// as xterm has it.
+		n, _ := strconv.Atoi(cmd)
+		for i, spec := range strings.Split(args, ";") {
+			if idx := PALETTE_FG + n - 10 + i; idx < PALETTE_SIZE {
+				t.colorSpec(idx, spec)
+			}
+		}
+	case OSC_PALETTE_RESET:
+		if args == "" {
+			var idx []int
+			for i := 0; i < PALETTE_FG; i++ {
+				idx = append(idx, i)
+			}
+			t.pal = t.pal.without(idx...)
+			return
+		}
+		for _, s := range strings.Split(args, ";") {
+			if idx, err := strconv.Atoi(s); err == nil && idx >= 0 && idx < PALETTE_FG {
+				t.pal = t.pal.without(idx)
+			} else {
+				slog.Debug("invalid palette index", "index", s)
+			}
+		}
+	case OSC_FG_RESET:
+		t.pal = t.pal.without(PALETTE_FG)
+	case OSC_BG_RESET:
+		t.pal = t.pal.without(PALETTE_BG)
+	case OSC_CURSOR_RESET:
+		t.pal = t.pal.without(PALETTE_CURSOR)
+	}
+}
+
+// colorSpec sets the color at idx from spec, or answers with it if
+// spec is a query.
+func (t *Terminal) colorSpec(idx int, spec string) {
+	if spec == "?" {
+		t.Write([]byte(fmt.Sprintf("%c%c%s;%s%c%c", ESC, OSC, colorName(idx), t.pal.color(idx).spec(), ESC, ST)))
+		return
+	}
+
+	c, ok := parseColorSpec(spec)
+	if !ok {
+		slog.Debug("unsupported color spec", "index", idx, "spec", spec)
+		return
+	}
+	t.pal = t.pal.with(idx, c)
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"testing"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseColorSpec(t *testing.T) {
+	cases := []struct {
+		spec   string
+		want   rgbColor
+		wantOK bool
+	}{
+		{"rgb:ff/80/00", rgbColor{0xffff, 0x8080, 0}, true},
+		{"rgb:f/8/0", rgbColor{0xffff, 0x8888, 0}, true},
+		{"rgb:fff/800/000", rgbColor{0xffff, 0x8008, 0}, true},
+		{"rgb:1234/abcd/0000", rgbColor{0x1234, 0xabcd, 0}, true},
+		{"#f80", rgbColor{0xf000, 0x8000, 0}, true},
+		{"#ff8000", rgbColor{0xff00, 0x8000, 0}, true},
+		{"#123456789abc", rgbColor{0x1234, 0x5678, 0x9abc}, true},
+		{"rgb:ff/80", rgbColor{}, false},
+		{"rgb:ff/80/00/00", rgbColor{}, false},
+		{"rgb:12345/0/0", rgbColor{}, false},
+		{"rgb:ff//00", rgbColor{}, false},
+		{"rgb:fg/00/00", rgbColor{}, false},
+		{"#ff80", rgbColor{}, false},
+		{"#", rgbColor{}, false},
+		{"red", rgbColor{}, false},
+	}
+
+	for i, c := range cases {
+		got, ok := parseColorSpec(c.spec)
+		if ok != c.wantOK || got != c.want {
+			t.Errorf("%d: Got %v, %t, wanted %v, %t", i, got, ok, c.want, c.wantOK)
+		}
+	}
+}
+
+func TestDefaultPalette(t *testing.T) {
+	cases := []struct {
+		idx  int
+		want rgbColor
+	}{
+		{1, rgb8(0xcd, 0, 0)},
+		{12, rgb8(0x5c, 0x5c, 0xff)},
+		{16, rgb8(0, 0, 0)},
+		{21, rgb8(0, 0, 0xff)},
+		{196, rgb8(0xff, 0, 0)},
+		{231, rgb8(0xff, 0xff, 0xff)},
+		{232, rgb8(8, 8, 8)},
+		{255, rgb8(0xee, 0xee, 0xee)},
+	}
+
+	for i, c := range cases {
+		if got := defPalette.color(c.idx); got != c.want {
+			t.Errorf("%d: Got %v for color %d, wanted %v", i, got, c.idx, c.want)
+		}
+	}
+}
+
+func TestPaletteOSC(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+		set   map[int]rgbColor
+	}{
+		{"\x1b]4;1;?\x07", "\x1b]4;1;rgb:cdcd/0000/0000\x1b\\", nil},
+		{"\x1b]4;1;?;2;?\x1b\\", "\x1b]4;1;rgb:cdcd/0000/0000\x1b\\\x1b]4;2;rgb:0000/cdcd/0000\x1b\\", nil},
+		{"\x1b]4;1;#ff0000;1;?\x07", "\x1b]4;1;rgb:ff00/0000/0000\x1b\\", map[int]rgbColor{1: {0xff00, 0, 0}}},
+		{"\x1b]4;1;rgb:ff/00/00;200;rgb:00/ff/00\x07", "", map[int]rgbColor{1: {0xffff, 0, 0}, 200: {0, 0xffff, 0}}},
+		{"\x1b]10;?\x07", "\x1b]10;rgb:e5e5/e5e5/e5e5\x1b\\", nil},
+		{"\x1b]11;#000010\x07\x1b]11;?\x07", "\x1b]11;rgb:0000/0000/1000\x1b\\", map[int]rgbColor{PALETTE_BG: {0, 0, 0x1000}}},
+		// Further specs are for the colors that follow.
+		{"\x1b]10;#fff;?;?\x07", "\x1b]11;rgb:0000/0000/0000\x1b\\\x1b]12;rgb:e5e5/e5e5/e5e5\x1b\\", map[int]rgbColor{PALETTE_FG: {0xf000, 0xf000, 0xf000}}},
+		{"\x1b]12;#fff;#000\x07", "", map[int]rgbColor{PALETTE_CURSOR: {0xf000, 0xf000, 0xf000}}},
+		// Resets.
+		{"\x1b]4;1;#fff;2;#fff\x07\x1b]104;1\x07", "", map[int]rgbColor{2: {0xf000, 0xf000, 0xf000}}},
+		{"\x1b]4;1;#fff;2;#fff\x07\x1b]10;#fff\x07\x1b]104\x07", "", map[int]rgbColor{PALETTE_FG: {0xf000, 0xf000, 0xf000}}},
+		{"\x1b]10;#fff;#fff;#fff\x07\x1b]110\x07\x1b]112\x07", "", map[int]rgbColor{PALETTE_BG: {0xf000, 0xf000, 0xf000}}},
+		{"\x1b]11;#fff\x07\x1b]111\x07", "", nil},
+		{"\x1b]4;1;#fff\x07\x1bc", "", nil},
+		// Invalid ones are ignored.
+		{"\x1b]4;256;#fff;1;red;x;?;2;#f\x07", "", nil},
+		{"\x1b]104;x\x07", "", nil},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(10, 20)
+		if got := replies(t, nt, c.input); got != c.want {
+			t.Errorf("%d: Got reply %q, wanted %q", i, got, c.want)
+		}
+		if want := (&palette{set: c.set}); !nt.pal.equal(want) {
+			t.Errorf("%d: Got colors %v, wanted %v", i, nt.pal.set, c.set)
+		}
+	}
+}
+
+func TestSetPalette(t *testing.T) {
+	nt, _ := NewTerminal(10, 20)
+	p := goshpb.Palette_builder{Colors: []*goshpb.PaletteColor{
+		rgbColor{0x1111, 0x2222, 0x3333}.proto(1),
+		rgbColor{0xffff, 0xffff, 0xffff}.proto(PALETTE_BG),
+	}}.Build()
+	if err := nt.SetPalette(p); err != nil {
+		t.Fatalf("SetPalette() error: %v", err)
+	}
+
+	want := "\x1b]4;1;rgb:1111/2222/3333\x1b\\\x1b]4;2;rgb:0000/cdcd/0000\x1b\\\x1b]11;rgb:ffff/ffff/ffff\x1b\\"
+	if got := replies(t, nt, "\x1b]4;1;?;2;?\x07\x1b]11;?\x07"); got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+	if !nt.pal.equal(defPalette) {
+		t.Errorf("Setting the outer terminal's colors changed the program's")
+	}
+	if got := defPalette.color(1); got != rgb8(0xcd, 0, 0) {
+		t.Errorf("Setting the palette changed the defaults to %v", got)
+	}
+
+	bad := goshpb.Palette_builder{Colors: []*goshpb.PaletteColor{
+		goshpb.PaletteColor_builder{Index: proto.Uint32(PALETTE_SIZE)}.Build(),
+	}}.Build()
+	if err := nt.SetPalette(bad); err == nil {
+		t.Errorf("SetPalette() accepted an invalid index")
+	}
+}
+
+func TestPaletteDiff(t *testing.T) {
+	cases := []struct {
+		src, dest string
+		want      string
+	}{
+		{"", "", ""},
+		{"", "\x1b]4;1;#fff\x07", "\x1b]4;1;rgb:f000/f000/f000\x07"},
+		{"\x1b]4;1;#fff\x07", "\x1b]4;1;#fff\x07", ""},
+		{"\x1b]4;1;#fff\x07", "\x1b]4;1;#000\x07", "\x1b]4;1;rgb:0000/0000/0000\x07"},
+		{"\x1b]4;1;#fff\x07", "", "\x1b]104;1\x07"},
+		{"", "\x1b]10;#fff;#000;#f00\x07", "\x1b]10;rgb:f000/f000/f000\x07\x1b]11;rgb:0000/0000/0000\x07\x1b]12;rgb:f000/0000/0000\x07"},
+		{"\x1b]10;#fff;#000;#f00\x07", "", "\x1b]110\x07\x1b]111\x07\x1b]112\x07"},
+	}
+
+	for i, c := range cases {
+		src, _ := NewTerminal(10, 20)
+		src.Write([]byte(c.src))
+		dest, _ := NewTerminal(10, 20)
+		dest.Write([]byte(c.dest))
+		if got := src.pal.diff(dest.pal); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+
+		// The state diff carries the same change.
+		st := src.copy()
+		if err := st.ApplyDiff(src.StateDiff(dest)); err != nil {
+			t.Fatalf("%d: ApplyDiff() error: %v", i, err)
+		}
+		if !st.pal.equal(dest.pal) {
+			t.Errorf("%d: Got colors %v after ApplyDiff, wanted %v", i, st.pal.set, dest.pal.set)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// MIN_SCROLL_GAIN is the fewest changed rows a scroll must bring
+// back into place before we'll consider sending it.
+const MIN_SCROLL_GAIN = 2
+
+// scroll shifts rows top to bottom, inclusive, by n rows. As with
+// scrollRows, positive n moves the rows up and the rows exposed are
+// blank.
+type scroll struct {
+	top, bottom, n int
+}
+
+func scrollFromProto(ps *goshpb.Scroll) scroll {
+	return scroll{int(ps.GetTop()), int(ps.GetBottom()), int(ps.GetCount())}
+}
+
+func (s scroll) proto() *goshpb.Scroll {
+	return goshpb.Scroll_builder{
+		Top:    proto.Int32(int32(s.top)),
+		Bottom: proto.Int32(int32(s.bottom)),
+		Count:  proto.Int32(int32(s.n)),
+	}.Build()
+}
+
+// ansiString returns the shortest sequence that performs s on a
+// terminal with the given number of rows and no margins set. The
+// cursor position afterwards is undefined.
+func (s scroll) ansiString(rows int) string {
+	n, up := s.n, s.n > 0
+	if !up {
+		n = -n
+	}
+
+	su, il := CSI_SU, CSI_DL
+	if !up {
+		su, il = CSI_SD, CSI_IL
+	}
+
+	switch {
+	case s.top == 0 && s.bottom == rows-1:
+		return fmt.Sprintf("%c%c%d%c", ESC, CSI, n, su)
+	case s.bottom == rows-1:
+		// Deleting or inserting lines scrolls everything
+		// from the cursor down.
+		return fmt.Sprintf("%s%c%c%d%c", cursor{s.top, 0}.ansiString(), ESC, CSI, n, il)
+	default:
+		return fmt.Sprintf("%s%c%c%d%c%c%c%c", newMargin(s.top, s.bottom).ansiString(CSI_DECSTBM), ESC, CSI, n, su, ESC, CSI, CSI_DECSTBM)
+	}
+}
+
+// shift applies s to f, returning false if s isn't valid for f.
+func (f *framebuffer) shift(s scroll) bool {
+	if s.top < 0 || s.top >= s.bottom || s.bottom >= f.rows() || s.n == 0 || s.n > s.bottom-s.top || -s.n > s.bottom-s.top {
+		return false
+	}
+
+	return f.scrollArea(s.top, s.bottom, 0, f.cols()-1, s.n) == nil
+}
+
+// shifted returns a copy of f with s applied.
+func (f *framebuffer) shifted(s scroll) *framebuffer {
+	nf := f.copy()
+	nf.shift(s)
+	return nf
+}
+
+// rowHashes returns a hash of the contents of each row in f. Equal
+// rows have equal hashes, which is all findScroll relies on: a
+// collision only leads it to a poor guess.
+func (f *framebuffer) rowHashes() []uint64 {
+	ret := make([]uint64, f.rows())
+	h := fnv.New64a()
+	var buf []byte
+
+	appendColor := func(b []byte, c color) []byte {
+		b = binary.AppendVarint(b, int64(c.colType))
+		b = binary.AppendUvarint(b, uint64(len(c.data)))
+		for _, d := range c.data {
+			b = binary.AppendVarint(b, int64(d))
+		}
+		return b
+	}
+
+	for r, row := range f.data {
+		h.Reset()
+		for _, c := range row.cells {
+			buf = buf[:0]
+			if c.set {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+			buf = binary.AppendVarint(buf, int64(c.r))
+			buf = binary.AppendUvarint(buf, uint64(c.frag))
+			buf = binary.AppendUvarint(buf, uint64(c.f.attrs))
+			buf = appendColor(buf, c.f.fg)
+			buf = appendColor(buf, c.f.bg)
+			buf = append(buf, c.f.ul)
+			buf = appendColor(buf, c.f.ulc)
+			buf = binary.AppendUvarint(buf, uint64(len(c.hl.data)))
+			buf = append(buf, c.hl.data...)
+			if c.tile != nil {
+				buf = binary.AppendUvarint(buf, c.tile.img.id)
+				buf = binary.AppendVarint(buf, int64(c.tile.row))
+				buf = binary.AppendVarint(buf, int64(c.tile.col))
+			}
+			h.Write(buf)
+		}
+		ret[r] = h.Sum64()
+	}
+
+	return ret
+}
+
+// findScroll looks for rows of src that have moved up or down in
+// dest, as when output scrolls the screen or a region of it. It
+// returns the scroll that puts the most changed rows back in place,
+// if any puts at least MIN_SCROLL_GAIN. Src and dest must be the same
+// size.
+//
+// Callers should still check the scroll pays off, as the rows it
+// exposes, and any that were unchanged in the region, must then be
+// redrawn.
+func (src *framebuffer) findScroll(dest *framebuffer) (scroll, bool) {
+	rows := src.rows()
+	if rows != dest.rows() || src.cols() != dest.cols() || rows < 2 {
+		return scroll{}, false
+	}
+
+	changed := 0
+	for r, row := range dest.data {
+		if src.data[r].gen != row.gen {
+			changed++
+		}
+	}
+	if changed < MIN_SCROLL_GAIN {
+		return scroll{}, false
+	}
+
+	sh, dh := src.rowHashes(), dest.rowHashes()
+
+	best, bestGain := scroll{}, 0
+	for n := 1 - rows; n < rows; n++ {
+		if n == 0 {
+			continue
+		}
+
+		// Find the runs of dest rows that were n rows
+		// away in src.
+		start, gain := -1, 0
+		for r := 0; r <= rows; r++ {
+			if r < rows && r+n >= 0 && r+n < rows && dh[r] == sh[r+n] {
+				if start < 0 {
+					start, gain = r, 0
+				}
+				if dh[r] != sh[r] {
+					gain++
+				}
+				continue
+			}
+
+			if start >= 0 && gain > bestGain {
+				bestGain = gain
+				if n > 0 {
+					best = scroll{start, r - 1 + n, n}
+				} else {
+					best = scroll{start + n, r - 1, n}
+				}
+			}
+			start = -1
+		}
+	}
+
+	return best, bestGain >= MIN_SCROLL_GAIN
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// scrollTerminals returns a terminal full of numbered lines and
+// copies of it after output has scrolled in various ways.
+func scrollTerminals() (*Terminal, []*Terminal) {
+	t1, _ := NewTerminal(10, 20)
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("\x1b[3%dmline %d", i%8, i))
+	}
+	t1 = writeCopy(t1, strings.Join(lines, "\r\n"))
+
+	return t1, []*Terminal{
+		writeCopy(t1, "\r\nline 10\r\nline 11\r\nline 12"),
+		writeCopy(t1, "\x1b[H\x1b[2L"),
+		writeCopy(t1, "\x1b[2;9r\x1b[9;1H\nnew\x1b[r"),
+		writeCopy(t1, "\x1b[5;1Hx"),
+	}
+}
+
+func TestFindScroll(t *testing.T) {
+	src, dests := scrollTerminals()
+
+	cases := []struct {
+		want scroll
+		ok   bool
+	}{
+		{scroll{0, 9, 3}, true},
+		{scroll{0, 9, -2}, true},
+		{scroll{1, 8, 1}, true},
+		{scroll{}, false},
+	}
+
+	for i, c := range cases {
+		if got, ok := src.fb.findScroll(dests[i].fb); got != c.want || ok != c.ok {
+			t.Errorf("%d: Got %v (%t), wanted %v (%t)", i, got, ok, c.want, c.ok)
+		}
+	}
+
+	if _, ok := src.fb.findScroll(newFramebuffer(5, 20)); ok {
+		t.Errorf("Found a scroll between framebuffers of different sizes")
+	}
+
+	// Rows differing only in their underline style or color
+	// aren't mistaken for each other.
+	for i, sgr := range []string{"4:%d", "4;58;5;%d"} {
+		ul, _ := NewTerminal(10, 20)
+		var lines []string
+		for j := 0; j < 10; j++ {
+			lines = append(lines, fmt.Sprintf("\x1b["+sgr+"msame\x1b[m", j%5+1))
+		}
+		ul = writeCopy(ul, strings.Join(lines, "\r\n"))
+		scrolled := writeCopy(ul, "\r\nsame")
+		if got, ok := ul.fb.findScroll(scrolled.fb); got != (scroll{0, 9, 1}) || !ok {
+			t.Errorf("%d: Got %v (%t) with underlines, wanted %v (true)", i, got, ok, scroll{0, 9, 1})
+		}
+	}
+}
+
+func TestScrollAnsiString(t *testing.T) {
+	cases := []struct {
+		s    scroll
+		want string
+	}{
+		{scroll{0, 9, 3}, "\x1b[3S"},
+		{scroll{0, 9, -2}, "\x1b[2T"},
+		{scroll{4, 9, 1}, "\x1b[5H\x1b[1M"},
+		{scroll{4, 9, -1}, "\x1b[5H\x1b[1L"},
+		{scroll{1, 8, 1}, "\x1b[2;9r\x1b[1S\x1b[r"},
+	}
+
+	for i, c := range cases {
+		if got := c.s.ansiString(10); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
+
+func TestShiftInvalid(t *testing.T) {
+	for i, s := range []scroll{{-1, 5, 1}, {5, 5, 1}, {0, 10, 1}, {0, 9, 0}, {0, 9, 10}, {0, 9, -10}} {
+		if newFramebuffer(10, 20).shift(s) {
+			t.Errorf("%d: shift(%v) succeeded, wanted failure", i, s)
+		}
+	}
+}
+
+func TestDiffScroll(t *testing.T) {
+	src, dests := scrollTerminals()
+
+	for i, dest := range dests[:3] {
+		got := src.Diff(dest)
+		if plain := src.fb.cellDiff(dest.fb, nil); len(got) >= len(plain) {
+			t.Errorf("%d: Got %d bytes, wanted fewer than %d", i, len(got), len(plain))
+		}
+
+		// Paint the diff on a terminal showing src, as the
+		// client would.
+		nt, _ := NewTerminal(10, 20)
+		nt.fb = src.fb.copy()
+		nt.Write(got)
+		if !nt.fb.equal(dest.fb) {
+			t.Errorf("%d: Painting diff got\n%s\nwanted\n%s", i, nt.fb, dest.fb)
+		}
+	}
+}
+
+func TestStateDiffScroll(t *testing.T) {
+	src, dests := scrollTerminals()
+
+	for i, dest := range dests {
+		d := src.StateDiff(dest)
+		if want := i < 3; d.HasScroll() != want {
+			t.Errorf("%d: Got scroll %t, wanted %t", i, d.HasScroll(), want)
+		}
+
+		b, err := proto.Marshal(d)
+		if err != nil {
+			t.Fatalf("%d: Marshal() error: %v", i, err)
+		}
+		var nd goshpb.TermDiff
+		if err := proto.Unmarshal(b, &nd); err != nil {
+			t.Fatalf("%d: Unmarshal() error: %v", i, err)
+		}
+
+		got := src.ForceCopy()
+		if err := got.ApplyDiff(&nd); err != nil {
+			t.Errorf("%d: ApplyDiff() error: %v", i, err)
+			continue
+		}
+		if what := sameDisplay(got, dest); what != "" {
+			t.Errorf("%d: %s differs after applying diff", i, what)
+		}
+	}
+}
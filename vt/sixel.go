@@ -0,0 +1,344 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"fmt"
+	"image"
+	imgcolor "image/color"
+	"log/slog"
+	mbits "math/bits"
+	"strings"
+)
+
+// vt340Colors are the default color registers, in percent.
+var vt340Colors = [16][3]int{
+	{0, 0, 0}, {20, 20, 80}, {80, 13, 13}, {20, 80, 20},
+	{80, 20, 80}, {20, 80, 80}, {80, 80, 20}, {53, 53, 53},
+	{26, 26, 26}, {33, 33, 60}, {60, 26, 26}, {33, 60, 33},
+	{60, 33, 60}, {33, 60, 60}, {60, 60, 33}, {80, 80, 80},
+}
+
+func pctColor(r, g, b int) imgcolor.NRGBA {
+	c := func(v int) uint8 { return uint8((min(max(v, 0), 100)*255 + 50) / 100) }
+	return imgcolor.NRGBA{c(r), c(g), c(b), 0xff}
+}
+
+// hlsColor converts a sixel HLS color, where blue is at 0 degrees,
+// to RGB.
+func hlsColor(h, l, s int) imgcolor.NRGBA {
+	hf := float64((h+240)%360) / 360
+	lf, sf := float64(min(l, 100))/100, float64(min(s, 100))/100
+	if sf == 0 {
+		return pctColor(l, l, l)
+	}
+
+	q := lf + sf - lf*sf
+	if lf < 0.5 {
+		q = lf * (1 + sf)
+	}
+	p := 2*lf - q
+	hue := func(t float64) int {
+		switch {
+		case t < 0:
+			t += 1
+		case t > 1:
+			t -= 1
+		}
+		v := p
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 0.5:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		}
+		return int(v*100 + 0.5)
+	}
+
+	return pctColor(hue(hf+1.0/3), hue(hf), hue(hf-1.0/3))
+}
+
+// sixelDecoder decodes sixel data as it arrives.
+type sixelDecoder struct {
+	palette [256]imgcolor.NRGBA
+	cur     imgcolor.NRGBA
+	// Whether pixels that aren't drawn keep the background, rather
+	// than taking color register 0.
+	transparent bool
+
+	// The pixels drawn have a non-zero alpha. The image is w x h,
+	// but pix may have room for more.
+	pix    []imgcolor.NRGBA
+	stride int
+	w, h   int
+	tooBig bool
+
+	x, y   int
+	cmd    rune // the command whose parameters we're reading
+	params []int
+	repeat int
+	done   func(img *image.NRGBA)
+}
+
+// newSixelDecoder returns a decoder that passes the image to done.
+// P2, the second parameter of the sixel DCS, says whether pixels
+// that aren't drawn are transparent.
+func newSixelDecoder(params *parameters, done func(img *image.NRGBA)) *sixelDecoder {
+	d := &sixelDecoder{transparent: params.item(1, 0) == 1, repeat: 1, done: done}
+	for i, c := range vt340Colors {
+		d.palette[i] = pctColor(c[0], c[1], c[2])
+	}
+	d.cur = d.palette[0]
+	return d
+}
+
+// grow makes the image at least w x h, returning false if that would
+// make it too big.
+func (d *sixelDecoder) grow(w, h int) bool {
+	w, h = max(w, d.w), max(h, d.h)
+	if w*h > MAX_IMAGE_PIXELS {
+		if !d.tooBig {
+			slog.Debug("sixel image too large", "w", w, "h", h)
+		}
+		d.tooBig = true
+		return false
+	}
+
+	if w > d.stride || h*d.stride > len(d.pix) {
+		// Leave room to grow, as images are drawn left to
+		// right and top to bottom.
+		sw, sh := max(w, d.stride), max(h, 2*len(d.pix)/max(d.stride, 1))
+		if sw*sh > MAX_IMAGE_PIXELS {
+			sh = h
+		}
+		pix := make([]imgcolor.NRGBA, sw*sh)
+		for y := 0; y < d.h; y++ {
+			copy(pix[y*sw:], d.pix[y*d.stride:y*d.stride+d.w])
+		}
+		d.pix, d.stride = pix, sw
+	}
+
+	d.w, d.h = w, h
+	return true
+}
+
+func (d *sixelDecoder) put(r rune) {
+	switch {
+	case r >= '0' && r <= '9' && d.cmd != 0:
+		if len(d.params) == 0 {
+			d.params = append(d.params, 0)
+		}
+		n := &d.params[len(d.params)-1]
+		*n = min(*n*10+int(r-'0'), 1<<20)
+		return
+	case r == ';' && d.cmd != 0:
+		if len(d.params) == 0 {
+			d.params = append(d.params, 0)
+		}
+		d.params = append(d.params, 0)
+		return
+	}
+
+	if d.cmd != 0 {
+		d.command()
+	}
+
+	switch {
+	case r == '#' || r == '!' || r == '"':
+		d.cmd, d.params = r, d.params[:0]
+	case r == '$':
+		d.x = 0
+	case r == '-':
+		d.x, d.y = 0, d.y+6
+	case r >= '?' && r <= '~':
+		d.sixel(int(r-'?'), d.repeat)
+		d.repeat = 1
+	}
+}
+
+func (d *sixelDecoder) param(i, def int) int {
+	if i < len(d.params) {
+		return d.params[i]
+	}
+	return def
+}
+
+// command acts on the command whose parameters we've just read.
+func (d *sixelDecoder) command() {
+	switch d.cmd {
+	case '#':
+		reg := d.param(0, 0) % len(d.palette)
+		if len(d.params) >= 5 {
+			switch d.param(1, 0) {
+			case 1:
+				d.palette[reg] = hlsColor(d.param(2, 0), d.param(3, 0), d.param(4, 0))
+			case 2:
+				d.palette[reg] = pctColor(d.param(2, 0), d.param(3, 0), d.param(4, 0))
+			}
+		}
+		d.cur = d.palette[reg]
+	case '!':
+		d.repeat = max(d.param(0, 1), 1)
+	case '"':
+		// Pan;Pad;Ph;Pv. The aspect ratio is ignored, as
+		// terminals generally do.
+		if w, h := d.param(2, 0), d.param(3, 0); w > 0 && h > 0 {
+			d.grow(w, h)
+		}
+	}
+	d.cmd = 0
+}
+
+// sixel draws bits, a column of six pixels, n times.
+func (d *sixelDecoder) sixel(bits, n int) {
+	if bits != 0 && d.grow(d.x+n, d.y+mbits.Len(uint(bits))) {
+		for i := 0; i < 6; i++ {
+			if bits&(1<<i) == 0 {
+				continue
+			}
+			row := d.pix[(d.y+i)*d.stride:]
+			for x := d.x; x < d.x+n; x++ {
+				row[x] = d.cur
+			}
+		}
+	}
+	d.x += n
+}
+
+func (d *sixelDecoder) unhook() {
+	if d.cmd != 0 {
+		d.command()
+	}
+	if img := d.image(); img != nil {
+		d.done(img)
+	}
+}
+
+// image returns what's been decoded, or nil if nothing has.
+func (d *sixelDecoder) image() *image.NRGBA {
+	if d.w == 0 || d.h == 0 {
+		return nil
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, d.w, d.h))
+	bg := d.palette[0]
+	for y := 0; y < d.h; y++ {
+		for x := 0; x < d.w; x++ {
+			c := d.pix[y*d.stride+x]
+			if c.A == 0 && !d.transparent {
+				c = bg
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// encodeSixel returns the sixel data, without the DCS around it,
+// that draws img. Pixels that are more than half transparent aren't
+// drawn. Only 256 colors can be used, so any beyond that are drawn in
+// the closest one.
+func encodeSixel(img *image.NRGBA) string {
+	b := img.Bounds()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\"1;1;%d;%d", b.Dx(), b.Dy())
+
+	toPct := func(v uint8) int { return (int(v)*100 + 127) / 255 }
+	var palette []imgcolor.NRGBA
+	regs := make(map[imgcolor.NRGBA]int)
+	reg := func(c imgcolor.NRGBA) int {
+		c.A = 0xff
+		if r, ok := regs[c]; ok {
+			return r
+		}
+		if len(palette) == 256 {
+			best, bd := 0, 1<<30
+			for i, p := range palette {
+				dr, dg, db := int(p.R)-int(c.R), int(p.G)-int(c.G), int(p.B)-int(c.B)
+				if d := dr*dr + dg*dg + db*db; d < bd {
+					best, bd = i, d
+				}
+			}
+			regs[c] = best
+			return best
+		}
+		palette = append(palette, c)
+		regs[c] = len(palette) - 1
+		fmt.Fprintf(&sb, "#%d;2;%d;%d;%d", len(palette)-1, toPct(c.R), toPct(c.G), toPct(c.B))
+		return len(palette) - 1
+	}
+
+	regOf := make([]int, b.Dx()*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			if c.A < 0x80 {
+				regOf[y*b.Dx()+x] = -1
+				continue
+			}
+			regOf[y*b.Dx()+x] = reg(c)
+		}
+	}
+
+	line := make([]byte, b.Dx())
+	for y0 := 0; y0 < b.Dy(); y0 += 6 {
+		if y0 > 0 {
+			sb.WriteByte('-')
+		}
+
+		var used []int
+		seen := make(map[int]bool)
+		for y := y0; y < min(y0+6, b.Dy()); y++ {
+			for _, r := range regOf[y*b.Dx() : (y+1)*b.Dx()] {
+				if r >= 0 && !seen[r] {
+					seen[r] = true
+					used = append(used, r)
+				}
+			}
+		}
+
+		for i, r := range used {
+			for x := range line {
+				bits := 0
+				for y := y0; y < min(y0+6, b.Dy()); y++ {
+					if regOf[y*b.Dx()+x] == r {
+						bits |= 1 << (y - y0)
+					}
+				}
+				line[x] = byte('?' + bits)
+			}
+
+			if i > 0 {
+				sb.WriteByte('$')
+			}
+			fmt.Fprintf(&sb, "#%d", r)
+			writeSixelRuns(&sb, strings.TrimRight(string(line), "?"))
+		}
+	}
+
+	return sb.String()
+}
+
+// writeSixelRuns writes line, using repeats where they're shorter.
+func writeSixelRuns(sb *strings.Builder, line string) {
+	for i := 0; i < len(line); {
+		n := 1
+		for i+n < len(line) && line[i+n] == line[i] {
+			n++
+		}
+		if n > 3 {
+			fmt.Fprintf(sb, "!%d%c", n, line[i])
+		} else {
+			sb.WriteString(line[i : i+n])
+		}
+		i += n
+	}
+}
+
+// sixelDCS wraps sixel data for a terminal, keeping the background
+// where pixels aren't drawn.
+func sixelDCS(data string) string {
+	return fmt.Sprintf("%c%c0;1;0q%s%c%c", ESC, DCS, data, ESC, ST)
+}
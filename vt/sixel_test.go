@@ -0,0 +1,369 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"errors"
+	"image"
+	imgcolor "image/color"
+	"strings"
+	"testing"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	red  = imgcolor.NRGBA{0xff, 0, 0, 0xff}
+	blue = imgcolor.NRGBA{0, 0, 0xff, 0xff}
+)
+
+// testImage returns a w x h image, red on the left half and blue on
+// the right, with a transparent top left pixel.
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.SetNRGBA(x, y, red)
+			} else {
+				img.SetNRGBA(x, y, blue)
+			}
+		}
+	}
+	img.SetNRGBA(0, 0, imgcolor.NRGBA{})
+	return img
+}
+
+// samePixels returns true if a and b look the same, ignoring the
+// color of transparent pixels.
+func samePixels(a, b *image.NRGBA) bool {
+	if a.Bounds().Dx() != b.Bounds().Dx() || a.Bounds().Dy() != b.Bounds().Dy() {
+		return false
+	}
+	for y := 0; y < a.Bounds().Dy(); y++ {
+		for x := 0; x < a.Bounds().Dx(); x++ {
+			ca := a.NRGBAAt(a.Bounds().Min.X+x, a.Bounds().Min.Y+y)
+			cb := b.NRGBAAt(b.Bounds().Min.X+x, b.Bounds().Min.Y+y)
+			if ca != cb && (ca.A != 0 || cb.A != 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// decodeSixel decodes sixel data, as written by encodeSixel.
+func decodeSixel(data []byte) (*image.NRGBA, error) {
+	var img *image.NRGBA
+	params := newParams()
+	params.addItem(0)
+	params.addItem(1)
+	d := newSixelDecoder(params, func(i *image.NRGBA) { img = i })
+	for _, r := range string(data) {
+		d.put(r)
+	}
+	d.unhook()
+
+	if img == nil || d.tooBig {
+		return nil, errors.New("invalid sixel image")
+	}
+	return img, nil
+}
+
+func TestSixelDecode(t *testing.T) {
+	img, err := decodeSixel([]byte("#1;2;100;0;0!4~$#2;2;0;0;100??~~-#1N"))
+	if err != nil {
+		t.Fatalf("decodeSixel() error: %v", err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 10 {
+		t.Fatalf("Got %dx%d image, wanted 4x10", b.Dx(), b.Dy())
+	}
+
+	cases := []struct {
+		x, y int
+		want imgcolor.NRGBA
+	}{
+		{0, 0, red},
+		{1, 5, red},
+		{2, 0, blue},
+		{3, 5, blue},
+		{0, 6, red}, // N is the top 4 pixels of the band
+		{1, 6, imgcolor.NRGBA{}},
+		{0, 9, red},
+		{1, 9, imgcolor.NRGBA{}},
+	}
+	for i, c := range cases {
+		if got := img.NRGBAAt(c.x, c.y); got != c.want {
+			t.Errorf("%d: Got %v at (%d, %d), wanted %v", i, got, c.x, c.y, c.want)
+		}
+	}
+}
+
+func TestSixelDecodeColors(t *testing.T) {
+	cases := []struct {
+		data string
+		want imgcolor.NRGBA
+	}{
+		{"~", pctColor(0, 0, 0)},      // register 0
+		{"#2~", pctColor(80, 13, 13)}, // VT340 default
+		{"#1;1;0;50;100~", blue},      // HLS, blue at 0 degrees
+		{"#1;1;120;50;100~", red},     // HLS
+		{"#1;2;0;100;0~", pctColor(0, 100, 0)},
+		{"#300;2;0;0;100~", blue}, // registers wrap
+	}
+
+	for i, c := range cases {
+		img, err := decodeSixel([]byte(c.data))
+		if err != nil {
+			t.Errorf("%d: decodeSixel() error: %v", i, err)
+			continue
+		}
+		if got := img.NRGBAAt(0, 0); got != c.want {
+			t.Errorf("%d: Got %v, wanted %v", i, got, c.want)
+		}
+	}
+}
+
+func TestSixelDecodeInvalid(t *testing.T) {
+	for i, data := range []string{"", "#1;2;0;0;0", "\"1;1;5000;5000!5000~"} {
+		if _, err := decodeSixel([]byte(data)); err == nil {
+			t.Errorf("%d: decodeSixel(%q) succeeded, wanted error", i, data)
+		}
+	}
+}
+
+func TestSixelRoundTrip(t *testing.T) {
+	for i, img := range []*image.NRGBA{testImage(1, 1), testImage(7, 13), testImage(40, 60), testImage(40, 60).SubImage(image.Rect(5, 7, 25, 40)).(*image.NRGBA)} {
+		data := encodeSixel(img)
+		got, err := decodeSixel([]byte(data))
+		if err != nil {
+			t.Errorf("%d: decodeSixel() error: %v", i, err)
+			continue
+		}
+		if !samePixels(got, img) {
+			t.Errorf("%d: Image changed after encoding as %q", i, data)
+		}
+	}
+}
+
+func TestSixelEncodeColors(t *testing.T) {
+	// More colors than there are registers.
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 1))
+	for x := 0; x < 300; x++ {
+		img.SetNRGBA(x, 0, imgcolor.NRGBA{uint8(x / 2), uint8(x % 2 * 255), 0, 0xff})
+	}
+
+	got, err := decodeSixel([]byte(encodeSixel(img)))
+	if err != nil {
+		t.Fatalf("decodeSixel() error: %v", err)
+	}
+	if b := got.Bounds(); b.Dx() != 300 || b.Dy() != 1 {
+		t.Errorf("Got %dx%d image, wanted 300x1", b.Dx(), b.Dy())
+	}
+}
+
+// sixelTerminal returns a terminal with a 25x45 pixel, so 3x3 cell,
+// image drawn after "ab" on the second row.
+func sixelTerminal() *Terminal {
+	nt, _ := NewTerminal(10, 20)
+	nt.Write([]byte("\r\nab" + sixelDCS(encodeSixel(testImage(25, 45)))))
+	return nt
+}
+
+// tileAt returns the image tile at (row, col), if any.
+func tileAt(nt *Terminal, row, col int) *imageTile {
+	c, _ := nt.fb.cell(row, col)
+	return c.tile
+}
+
+func TestPlaceImage(t *testing.T) {
+	nt := sixelTerminal()
+
+	var si *termImage
+	for r := 0; r < 10; r++ {
+		for c := 0; c < 20; c++ {
+			st := tileAt(nt, r, c)
+			inImage := r >= 1 && r < 4 && c >= 2 && c < 5
+			switch {
+			case inImage && st == nil:
+				t.Errorf("No tile at (%d, %d)", r, c)
+			case !inImage && st != nil:
+				t.Errorf("Unexpected tile at (%d, %d)", r, c)
+			case inImage:
+				if si == nil {
+					si = st.img
+				}
+				if st.img != si || st.row != r-1 || st.col != c-2 {
+					t.Errorf("Got tile %v at (%d, %d)", st, r, c)
+				}
+			}
+		}
+	}
+
+	if want := (cursor{4, 2}); !nt.cur.equal(want) {
+		t.Errorf("Cursor at %s, wanted %s", nt.cur, want)
+	}
+	if got := strings.Split(nt.fb.String(), "\n")[1]; !strings.HasPrefix(got, "ab[im") {
+		t.Errorf("Got first image row %q, wanted the label", got)
+	}
+}
+
+func TestImageScrolls(t *testing.T) {
+	nt := sixelTerminal()
+	nt.Write([]byte("\x1b[10;1H\n\n"))
+	nt.LastChange() // evicts anything overwritten
+
+	for r := 0; r < 2; r++ {
+		if st := tileAt(nt, r, 2); st == nil || st.row != r+1 {
+			t.Errorf("Got tile %v at (%d, 2), wanted row %d of the image", st, r, r+1)
+		}
+	}
+
+	nt.Write([]byte("\n\n"))
+	nt.LastChange()
+	if got := nt.fb.images(); len(got) != 0 {
+		t.Errorf("Image still on screen after scrolling off")
+	}
+}
+
+func TestImageEvicted(t *testing.T) {
+	cases := []string{
+		"\x1b[3;4Hx",      // overwritten
+		"\x1b[2;1H\x1b[K", // erased
+		"\x1b[2J",
+		"\x1b[3;1H\x1b[P", // shifted
+	}
+
+	for i, c := range cases {
+		nt := sixelTerminal()
+		nt.Write([]byte(c))
+		nt.LastChange()
+		if got := nt.fb.images(); len(got) != 0 {
+			t.Errorf("%d: Image still on screen after %q", i, c)
+		}
+	}
+
+	// Unrelated changes leave it be.
+	nt := sixelTerminal()
+	nt.Write([]byte("\x1b[1;1Hhello\x1b[5;1Hworld"))
+	nt.LastChange()
+	if got := nt.fb.images(); len(got) != 1 {
+		t.Errorf("Image evicted by unrelated output")
+	}
+}
+
+func TestImageStateDiff(t *testing.T) {
+	src, _ := NewTerminal(10, 20)
+	dest := sixelTerminal()
+	scrolled := writeCopy(dest, "\x1b[10;1H\n")
+
+	cases := []struct {
+		src, dest *Terminal
+		sized     bool // the image's size sent
+	}{
+		{src, dest, true},
+		{dest, scrolled, false},
+		{src, scrolled, true},
+		{scrolled, src, false},
+	}
+
+	for i, c := range cases {
+		d := c.src.StateDiff(c.dest)
+		sized := false
+		for _, pi := range d.GetImages() {
+			sized = sized || pi.GetRows() > 0
+		}
+		if sized != c.sized {
+			t.Errorf("%d: Got size sent %t, wanted %t", i, sized, c.sized)
+		}
+
+		b, err := proto.Marshal(d)
+		if err != nil {
+			t.Fatalf("%d: Marshal() error: %v", i, err)
+		}
+		var nd goshpb.TermDiff
+		if err := proto.Unmarshal(b, &nd); err != nil {
+			t.Fatalf("%d: Unmarshal() error: %v", i, err)
+		}
+
+		got := c.src.ForceCopy()
+		if err := got.ApplyDiff(&nd); err != nil {
+			t.Errorf("%d: ApplyDiff() error: %v", i, err)
+			continue
+		}
+		if what := sameDisplay(got, c.dest); what != "" {
+			t.Errorf("%d: %s differs after applying diff", i, what)
+		}
+		for id, si := range got.fb.images() {
+			if want := c.dest.fb.images()[id]; si.rows != want.rows || si.cols != want.cols {
+				t.Errorf("%d: Image %d covers %dx%d cells, wanted %dx%d", i, id, si.cols, si.rows, want.cols, want.rows)
+			}
+		}
+	}
+}
+
+func TestImageApplyDiffInvalid(t *testing.T) {
+	src, _ := NewTerminal(10, 20)
+	good := src.StateDiff(sixelTerminal())
+
+	unknown := proto.Clone(good).(*goshpb.TermDiff)
+	unknown.GetImages()[0].SetRows(0)
+	unknown.GetImages()[0].SetCols(0)
+
+	offImage := proto.Clone(good).(*goshpb.TermDiff)
+	offImage.GetImages()[0].SetCol(5)
+
+	tooBig := proto.Clone(good).(*goshpb.TermDiff)
+	tooBig.GetImages()[0].SetRows(MAX_IMAGE_SPAN + 1)
+
+	for i, d := range []*goshpb.TermDiff{unknown, offImage, tooBig} {
+		if err := src.ForceCopy().ApplyDiff(d); err == nil {
+			t.Errorf("%d: ApplyDiff() succeeded, wanted error", i)
+		}
+	}
+}
+
+func TestImagePaint(t *testing.T) {
+	src, _ := NewTerminal(10, 20)
+	dest := sixelTerminal()
+
+	if got := string(src.Diff(dest)); strings.Contains(got, "\x1bP") || !strings.Contains(got, "ab[im") {
+		t.Errorf("Got %q, wanted the label and no sixel", got)
+	}
+
+	src.SetGraphics(GRAPHICS_SIXEL)
+	got := string(src.Diff(dest))
+	want := "\x1b[2;3H" + sixelDCS(encodeSixel(tileAt(dest, 1, 2).img.px.img))
+	if strings.Contains(got, "[image") || !strings.Contains(got, want) {
+		t.Errorf("Got %q, wanted sixel %q and no label", got, want)
+	}
+
+	// Unrelated changes don't redraw the image.
+	if got := string(dest.Diff(writeCopy(dest, "\x1b[8;1Hhello"))); strings.Contains(got, "\x1bP") {
+		t.Errorf("Got %q, wanted no sixel", got)
+	}
+}
+
+func TestPaintImagesCrops(t *testing.T) {
+	nt := sixelTerminal()
+	nt.Write([]byte("\x1b[10;1H\n\n"))
+	si := nt.fb.images()[tileAt(nt, 0, 2).img.id]
+
+	p := newPainter(nt.Cols())
+	p.disp = &display{gfx: GRAPHICS_SIXEL}
+	p.paintImages(nt.fb, []imagePlacement{{si, -2, 18}})
+	want := "\x1b[;19H" + sixelDCS(encodeSixel(si.px.img.SubImage(image.Rect(0, 40, 20, 60)).(*image.NRGBA)))
+	if got := string(p.bytes()); got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+
+	// Only the bottom row would be drawn.
+	p = newPainter(nt.Cols())
+	p.disp = &display{gfx: GRAPHICS_SIXEL}
+	p.paintImages(nt.fb, []imagePlacement{{si, 9, 0}})
+	if got := string(p.bytes()); got != "" {
+		t.Errorf("Got %q, wanted nothing", got)
+	}
+}
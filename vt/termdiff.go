@@ -0,0 +1,659 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// SPAN_GAP is the most unchanged cells we'll include in a CellSpan
+// rather than starting a new one, as each span has some overhead.
+const SPAN_GAP = 4
+
+var invalidDiff = errors.New("invalid terminal diff")
+
+// diffTables collects the formats, hyperlinks and images used in a
+// TermDiff so each is only sent once. Index 0 is always the default.
+type diffTables struct {
+	formats []*format
+	links   []*osc8
+	images  []*goshpb.Image
+	fmtIdx  map[*format]uint32
+	linkIdx map[*osc8]uint32
+	imgIdx  map[uint64]uint32
+	// The state the receiver has, and the images in it, found
+	// when first needed.
+	src   *framebuffer
+	known map[uint64]*termImage
+}
+
+func newDiffTables(src *framebuffer) *diffTables {
+	return &diffTables{
+		fmtIdx:  make(map[*format]uint32),
+		linkIdx: make(map[*osc8]uint32),
+		imgIdx:  make(map[uint64]uint32),
+		src:     src,
+	}
+}
+
+func (dt *diffTables) format(f *format) uint32 {
+	if i, ok := dt.fmtIdx[f]; ok {
+		return i
+	}
+
+	// Cells usually share format objects, so we only get here
+	// for the first cell written with a given pen.
+	idx := uint32(0)
+	if !f.equal(defFmt) {
+		for i, of := range dt.formats {
+			if of.equal(f) {
+				idx = uint32(i + 1)
+				break
+			}
+		}
+		if idx == 0 {
+			dt.formats = append(dt.formats, f)
+			idx = uint32(len(dt.formats))
+		}
+	}
+
+	dt.fmtIdx[f] = idx
+	return idx
+}
+
+func (dt *diffTables) link(hl *osc8) uint32 {
+	if i, ok := dt.linkIdx[hl]; ok {
+		return i
+	}
+
+	idx := uint32(0)
+	if !hl.equal(defOSC8) {
+		for i, ol := range dt.links {
+			if ol.equal(hl) {
+				idx = uint32(i + 1)
+				break
+			}
+		}
+		if idx == 0 {
+			dt.links = append(dt.links, hl)
+			idx = uint32(len(dt.links))
+		}
+	}
+
+	dt.linkIdx[hl] = idx
+	return idx
+}
+
+// image returns the index of the image shown in c, which is at (row,
+// col), or 0 if there isn't one.
+func (dt *diffTables) image(c *cell, row, col int) uint32 {
+	if c.tile == nil {
+		return 0
+	}
+	si := c.tile.img
+	if i, ok := dt.imgIdx[si.id]; ok {
+		return i
+	}
+
+	pi := goshpb.Image_builder{
+		Id:  proto.Uint64(si.id),
+		Row: proto.Int32(int32(row - c.tile.row)),
+		Col: proto.Int32(int32(col - c.tile.col)),
+	}.Build()
+	if dt.known == nil {
+		dt.known = dt.src.images()
+	}
+	if _, ok := dt.known[si.id]; !ok {
+		pi.SetRows(int32(si.rows))
+		pi.SetCols(int32(si.cols))
+	}
+	dt.images = append(dt.images, pi)
+	dt.imgIdx[si.id] = uint32(len(dt.images))
+	return uint32(len(dt.images))
+}
+
+func (dt *diffTables) addTo(d *goshpb.TermDiff) {
+	if len(dt.formats) > 0 {
+		fmts := make([]*goshpb.Format, len(dt.formats))
+		for i, f := range dt.formats {
+			fmts[i] = f.proto()
+		}
+		d.SetFormats(fmts)
+	}
+
+	if len(dt.links) > 0 {
+		links := make([]string, len(dt.links))
+		for i, hl := range dt.links {
+			links[i] = hl.data
+		}
+		d.SetLinks(links)
+	}
+
+	d.SetImages(dt.images)
+}
+
+// imagePlacement is an image with its top left tile at (row, col).
+type imagePlacement struct {
+	img      *termImage
+	row, col int
+}
+
+// imagesFromProto returns the images in d, with a placeholder for
+// index 0. Those not in src have no pixels until they arrive.
+func imagesFromProto(d *goshpb.TermDiff, src *framebuffer) ([]imagePlacement, error) {
+	ret := []imagePlacement{{}}
+	var known map[uint64]*termImage
+	for _, pi := range d.GetImages() {
+		if known == nil {
+			known = src.images()
+		}
+		si, ok := known[pi.GetId()]
+		if !ok {
+			rows, cols := int(pi.GetRows()), int(pi.GetCols())
+			if rows < 1 || cols < 1 || rows > MAX_IMAGE_SPAN || cols > MAX_IMAGE_SPAN {
+				return nil, fmt.Errorf("unknown image %d covering %dx%d cells: %w", pi.GetId(), cols, rows, invalidDiff)
+			}
+			si = &termImage{id: pi.GetId(), rows: rows, cols: cols}
+		}
+		ret = append(ret, imagePlacement{si, int(pi.GetRow()), int(pi.GetCol())})
+	}
+
+	return ret, nil
+}
+
+func (f *format) proto() *goshpb.Format {
+	pf := &goshpb.Format{}
+	if f.fg.colType != UNSET {
+		pf.SetFg(f.fg.proto())
+	}
+	if f.bg.colType != UNSET {
+		pf.SetBg(f.bg.proto())
+	}
+	if f.attrs != 0 {
+		pf.SetAttrs(uint32(f.attrs))
+	}
+	if f.ul != UL_SINGLE {
+		pf.SetUnderline(uint32(f.ul))
+	}
+	if f.ulc.colType != UNSET {
+		pf.SetUnderlineColor(f.ulc.proto())
+	}
+	return pf
+}
+
+func formatFromProto(pf *goshpb.Format) (*format, error) {
+	fg, err := colorFromProto(pf.GetFg())
+	if err != nil {
+		return nil, err
+	}
+	bg, err := colorFromProto(pf.GetBg())
+	if err != nil {
+		return nil, err
+	}
+	if pf.GetAttrs() > 0xffff {
+		return nil, fmt.Errorf("invalid format attributes %x: %w", pf.GetAttrs(), invalidDiff)
+	}
+	ul := pf.GetUnderline()
+	if ul > UL_DASHED || (ul != UL_SINGLE && pf.GetAttrs()&UNDERLINE == 0) {
+		return nil, fmt.Errorf("invalid underline style %d: %w", ul, invalidDiff)
+	}
+	ulc, err := colorFromProto(pf.GetUnderlineColor())
+	if err != nil {
+		return nil, err
+	}
+	if ulc.colType == BASIC {
+		return nil, fmt.Errorf("invalid underline color %v: %w", ulc.data, invalidDiff)
+	}
+
+	return &format{fg: fg, bg: bg, attrs: uint16(pf.GetAttrs()), ul: uint8(ul), ulc: ulc}, nil
+}
+
+func (c color) proto() *goshpb.Color {
+	data := make([]int32, len(c.data))
+	for i, d := range c.data {
+		data[i] = int32(d)
+	}
+	return goshpb.Color_builder{
+		Type: proto.Int32(int32(c.colType)),
+		Data: data,
+	}.Build()
+}
+
+// colorFromProto returns the color in pc, which may be nil for the
+// default.
+func colorFromProto(pc *goshpb.Color) (color, error) {
+	data := make([]int, len(pc.GetData()))
+	for i, d := range pc.GetData() {
+		data[i] = int(d)
+	}
+
+	want := 0
+	switch pc.GetType() {
+	case UNSET:
+		return newDefaultColor(), nil
+	case BASIC, ANSI256:
+		want = 1
+	case RGB:
+		want = 3
+	default:
+		return color{}, fmt.Errorf("invalid color type %d: %w", pc.GetType(), invalidDiff)
+	}
+	if len(data) != want {
+		return color{}, fmt.Errorf("color type %d with %d values: %w", pc.GetType(), len(data), invalidDiff)
+	}
+
+	return color{colType: int(pc.GetType()), data: data}, nil
+}
+
+// appendRun adds idx to the (count, index) pairs in runs.
+func appendRun(runs []uint32, idx uint32) []uint32 {
+	if n := len(runs); n > 0 && runs[n-1] == idx {
+		runs[n-2] += 1
+		return runs
+	}
+	return append(runs, 1, idx)
+}
+
+// expandRuns returns the n indexes, each less than max, described by
+// the (count, index) pairs in runs. No runs means all zeros.
+func expandRuns(runs []uint32, n, max int) ([]uint32, error) {
+	ret := make([]uint32, 0, n)
+	if len(runs) == 0 {
+		return ret[:n], nil
+	}
+	if len(runs)%2 != 0 {
+		return nil, fmt.Errorf("odd run length encoding: %w", invalidDiff)
+	}
+
+	for i := 0; i < len(runs); i += 2 {
+		cnt, idx := int(runs[i]), runs[i+1]
+		if idx >= uint32(max) || cnt > n-len(ret) {
+			return nil, fmt.Errorf("invalid run of %d x %d: %w", cnt, idx, invalidDiff)
+		}
+		for j := 0; j < cnt; j++ {
+			ret = append(ret, idx)
+		}
+	}
+	if len(ret) != n {
+		return nil, fmt.Errorf("runs cover %d of %d cells: %w", len(ret), n, invalidDiff)
+	}
+
+	return ret, nil
+}
+
+// spans returns CellSpans covering the cells that differ between src
+// and dest, which must be the same size.
+func (src *framebuffer) spans(dest *framebuffer, dt *diffTables) []*goshpb.CellSpan {
+	var ret []*goshpb.CellSpan
+
+	for r, drow := range dest.data {
+		if src.data[r].gen == drow.gen {
+			continue
+		}
+
+		row, srow := drow.cells, src.row(r)
+		start, end := -1, -1 // changed columns [start, end)
+		for c := range row {
+			destCell := &row[c]
+			if srow[c].equal(destCell) {
+				continue
+			}
+
+			// Keep both halves of wide runes together
+			s, e := c, c+1
+			if destCell.isSecondaryFrag() && s > 0 {
+				s -= 1
+			}
+			if destCell.isPrimaryFrag() && e < len(row) {
+				e += 1
+			}
+
+			if start >= 0 && s-end <= SPAN_GAP {
+				end = max(end, e)
+				continue
+			}
+			if start >= 0 {
+				ret = append(ret, makeSpan(r, start, row[start:end], dt))
+			}
+			start, end = s, e
+		}
+		if start >= 0 {
+			ret = append(ret, makeSpan(r, start, row[start:end], dt))
+		}
+	}
+
+	return ret
+}
+
+// spansSize returns the encoded size of spans. The formats and links
+// they refer to aren't counted as they're much the same either way.
+func spansSize(spans []*goshpb.CellSpan) int {
+	n := 0
+	for _, s := range spans {
+		n += proto.Size(s)
+	}
+	return n
+}
+
+func makeSpan(row, col int, cells []cell, dt *diffTables) *goshpb.CellSpan {
+	var sb strings.Builder
+	var fmts, links, blanks, imgs []uint32
+
+	for i, c := range cells {
+		sb.WriteRune(c.r)
+		fmts = appendRun(fmts, dt.format(c.f))
+		links = appendRun(links, dt.link(c.hl))
+		imgs = appendRun(imgs, dt.image(&c, row, col+i))
+		if !c.set {
+			if n := len(blanks); n > 0 && blanks[n-2]+blanks[n-1] == uint32(i) {
+				blanks[n-1] += 1
+			} else {
+				blanks = append(blanks, uint32(i), 1)
+			}
+		}
+	}
+
+	span := &goshpb.CellSpan{}
+	span.SetRow(int32(row))
+	span.SetCol(int32(col))
+	span.SetRunes(sb.String())
+	if len(fmts) > 2 || fmts[1] != 0 {
+		span.SetFormats(fmts)
+	}
+	if len(links) > 2 || links[1] != 0 {
+		span.SetLinks(links)
+	}
+	span.SetBlanks(blanks)
+	if len(imgs) > 2 || imgs[1] != 0 {
+		span.SetImages(imgs)
+	}
+
+	return span
+}
+
+// applySpan writes the cells in span to f. Formats, links and images
+// are the tables, including the defaults at index 0, that span refers
+// to.
+func (f *framebuffer) applySpan(span *goshpb.CellSpan, formats []*format, links []*osc8, images []imagePlacement) error {
+	runes := []rune(span.GetRunes())
+	row, col := int(span.GetRow()), int(span.GetCol())
+	if !f.validPoint(row, col) || len(runes) > f.cols()-col {
+		return fmt.Errorf("span of %d cells at (%d, %d): %w", len(runes), row, col, invalidDiff)
+	}
+
+	fmts, err := expandRuns(span.GetFormats(), len(runes), len(formats))
+	if err != nil {
+		return err
+	}
+	lks, err := expandRuns(span.GetLinks(), len(runes), len(links))
+	if err != nil {
+		return err
+	}
+	imgs, err := expandRuns(span.GetImages(), len(runes), len(images))
+	if err != nil {
+		return err
+	}
+
+	blank := make([]bool, len(runes))
+	bl := span.GetBlanks()
+	if len(bl)%2 != 0 {
+		return fmt.Errorf("odd blank ranges: %w", invalidDiff)
+	}
+	for i := 0; i < len(bl); i += 2 {
+		off, cnt := int(bl[i]), int(bl[i+1])
+		if off > len(runes) || cnt > len(runes)-off {
+			return fmt.Errorf("blank range (%d, %d) outside span: %w", off, cnt, invalidDiff)
+		}
+		for j := off; j < off+cnt; j++ {
+			blank[j] = true
+		}
+	}
+
+	for i, r := range runes {
+		c := newCell(r, formats[fmts[i]], links[lks[i]])
+		switch {
+		case blank[i]:
+			c.set = false
+		case r == 0:
+			c.frag = FRAG_SECONDARY
+		case i+1 < len(runes) && runes[i+1] == 0 && !blank[i+1]:
+			c.frag = FRAG_PRIMARY
+		}
+		if imgs[i] != 0 {
+			ip := images[imgs[i]]
+			tr, tc := row-ip.row, col+i-ip.col
+			if tr < 0 || tr >= ip.img.rows || tc < 0 || tc >= ip.img.cols {
+				return fmt.Errorf("image %d has no tile (%d, %d): %w", ip.img.id, tr, tc, invalidDiff)
+			}
+			c.tile = &imageTile{ip.img, tr, tc}
+		}
+		f.setCell(row, col+i, c)
+	}
+
+	return nil
+}
+
+// looksLike returns true if there's nothing a diff from t to other
+// would need to carry.
+func (t *Terminal) looksLike(other *Terminal) bool {
+	if t.title != other.title || t.icon != other.icon || t.keypad != other.keypad || !t.pal.equal(other.pal) {
+		return false
+	}
+	if t.curStyle != other.curStyle {
+		return false
+	}
+	if !t.cur.equal(other.cur) || !t.curF.equal(other.curF) || !t.hl.equal(other.hl) {
+		return false
+	}
+	for _, name := range transportModes {
+		id := modeNameToID[name]
+		if !t.modes[id].equal(other.modes[id]) {
+			return false
+		}
+	}
+
+	return t.fb.equal(other.fb)
+}
+
+// StateDiff returns the changes that, when applied with ApplyDiff,
+// move src to dest. Like Diff, it's only concerned with what the
+// client needs to display dest.
+func (src *Terminal) StateDiff(dest *Terminal) *goshpb.TermDiff {
+	d := &goshpb.TermDiff{}
+
+	if src.lastChg == dest.lastChg {
+		return d
+	}
+
+	if src.title != dest.title {
+		d.SetTitle(dest.title)
+	}
+	if src.icon != dest.icon {
+		d.SetIcon(dest.icon)
+	}
+
+	if src.keypad != dest.keypad {
+		d.SetKeypad(int32(dest.keypad))
+	}
+
+	if !src.pal.equal(dest.pal) {
+		d.SetPalette(dest.pal.proto())
+	}
+
+	var modes []*goshpb.TermMode
+	for _, name := range transportModes {
+		id := modeNameToID[name]
+		if dm := dest.modes[id]; !src.modes[id].equal(dm) {
+			modes = append(modes, goshpb.TermMode_builder{
+				Code:   proto.Int32(int32(dm.code)),
+				Public: proto.Bool(dm.public),
+				Set:    proto.Bool(dm.enabled()),
+			}.Build())
+		}
+	}
+	d.SetModes(modes)
+
+	sfb := src.fb
+	if rows, cols := dest.Rows(), dest.Cols(); rows != src.Rows() || cols != src.Cols() {
+		d.SetSize(goshpb.Resize_builder{
+			Rows: proto.Int32(int32(rows)),
+			Cols: proto.Int32(int32(cols)),
+		}.Build())
+		sfb = src.fb.copy()
+		sfb.resize(rows, cols)
+	}
+
+	dt := newDiffTables(src.fb)
+	spans := sfb.spans(dest.fb, dt)
+	if sc, ok := sfb.findScroll(dest.fb); ok {
+		sdt := newDiffTables(src.fb)
+		if ss := sfb.shifted(sc).spans(dest.fb, sdt); spansSize(ss) < spansSize(spans) {
+			d.SetScroll(sc.proto())
+			spans, dt = ss, sdt
+		}
+	}
+	d.SetSpans(spans)
+
+	if !src.curF.equal(dest.curF) {
+		d.SetPenFormat(dt.format(dest.curF))
+	}
+	if !src.hl.equal(dest.hl) {
+		d.SetPenLink(dt.link(dest.hl))
+	}
+	dt.addTo(d)
+
+	if !src.cur.equal(dest.cur) {
+		d.SetCursorRow(int32(dest.cur.row))
+		d.SetCursorCol(int32(dest.cur.col))
+	}
+	if src.curStyle != dest.curStyle {
+		d.SetCursorStyle(uint32(dest.curStyle))
+	}
+
+	return d
+}
+
+// ApplyDiff updates t with the changes in d, as generated by
+// StateDiff. If an error is returned, t may be partially updated.
+func (t *Terminal) ApplyDiff(d *goshpb.TermDiff) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	formats := []*format{defFmt}
+	for _, pf := range d.GetFormats() {
+		f, err := formatFromProto(pf)
+		if err != nil {
+			return err
+		}
+		formats = append(formats, f)
+	}
+
+	links := []*osc8{defOSC8}
+	for _, l := range d.GetLinks() {
+		links = append(links, newHyperlink(l))
+	}
+
+	images, err := imagesFromProto(d, t.fb)
+	if err != nil {
+		return err
+	}
+
+	if d.HasTitle() {
+		t.title = d.GetTitle()
+	}
+	if d.HasIcon() {
+		t.icon = d.GetIcon()
+	}
+
+	if d.HasPalette() {
+		colors, err := colorsFromProto(d.GetPalette())
+		if err != nil {
+			return err
+		}
+		t.pal = &palette{defaults: t.pal.defaults, set: colors}
+	}
+
+	if d.HasKeypad() {
+		switch kp := rune(d.GetKeypad()); kp {
+		case PAM, PNM:
+			t.keypad = kp
+		default:
+			return fmt.Errorf("invalid keypad mode %d: %w", kp, invalidDiff)
+		}
+	}
+
+	for _, m := range d.GetModes() {
+		id := fmt.Sprintf("%d", m.GetCode())
+		if !m.GetPublic() {
+			id = "?" + id
+		}
+		md, ok := t.modes[id]
+		if !ok {
+			return fmt.Errorf("unknown mode %q: %w", id, invalidDiff)
+		}
+		md = md.copy()
+		if m.GetSet() {
+			md.setState(CSI_MODE_SET)
+		} else {
+			md.setState(CSI_MODE_RESET)
+		}
+		t.modes[id] = md
+	}
+
+	if d.HasSize() {
+		if !t.fb.resize(int(d.GetSize().GetRows()), int(d.GetSize().GetCols())) {
+			return fmt.Errorf("invalid size %dx%d: %w", d.GetSize().GetRows(), d.GetSize().GetCols(), invalidDiff)
+		}
+	}
+
+	if d.HasScroll() {
+		if sc := scrollFromProto(d.GetScroll()); !t.fb.shift(sc) {
+			return fmt.Errorf("invalid scroll %v: %w", sc, invalidDiff)
+		}
+	}
+
+	for _, span := range d.GetSpans() {
+		if err := t.fb.applySpan(span, formats, links, images); err != nil {
+			return err
+		}
+	}
+
+	if d.HasPenFormat() {
+		if d.GetPenFormat() >= uint32(len(formats)) {
+			return fmt.Errorf("invalid pen format %d: %w", d.GetPenFormat(), invalidDiff)
+		}
+		t.curF = formats[d.GetPenFormat()]
+	}
+	if d.HasPenLink() {
+		if d.GetPenLink() >= uint32(len(links)) {
+			return fmt.Errorf("invalid pen link %d: %w", d.GetPenLink(), invalidDiff)
+		}
+		t.hl = links[d.GetPenLink()]
+	}
+
+	if d.HasCursorRow() || d.HasCursorCol() {
+		// The column may be one past the last while a wrap
+		// is pending.
+		cur := cursor{int(d.GetCursorRow()), int(d.GetCursorCol())}
+		if cur.row < 0 || cur.row >= t.Rows() || cur.col < 0 || cur.col > t.Cols() {
+			return fmt.Errorf("invalid cursor %s: %w", cur, invalidDiff)
+		}
+		t.cur = cur
+	}
+	if d.HasCursorStyle() {
+		if d.GetCursorStyle() >= uint32(CURSOR_STYLES) {
+			return fmt.Errorf("invalid cursor style %d: %w", d.GetCursorStyle(), invalidDiff)
+		}
+		t.curStyle = cursorStyle(d.GetCursorStyle())
+	}
+
+	t.lastChg = time.Now().UTC()
+
+	return nil
+}
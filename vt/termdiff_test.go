@@ -0,0 +1,189 @@
+// Copyright (c) 2025, Ben Walton
+// All rights reserved.
+package vt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bdwalton/gosh/protos/goshpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeCopy returns a copy of src with input written to it.
+func writeCopy(src *Terminal, input string) *Terminal {
+	t := src.ForceCopy()
+	t.Write([]byte(input))
+	return t
+}
+
+// sameDisplay reports what, if anything, differs between a and b for
+// the purposes of the client.
+func sameDisplay(a, b *Terminal) string {
+	switch {
+	case !a.fb.equal(b.fb):
+		return "framebuffer"
+	case a.title != b.title || a.icon != b.icon:
+		return "title"
+	case a.keypad != b.keypad:
+		return "keypad"
+	case !a.cur.equal(b.cur) || a.curStyle != b.curStyle:
+		return "cursor"
+	case !a.pal.equal(b.pal):
+		return "palette"
+	case !a.curF.equal(b.curF) || !a.hl.equal(b.hl):
+		return "pen"
+	}
+
+	for _, name := range transportModes {
+		id := modeNameToID[name]
+		if !a.modes[id].equal(b.modes[id]) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func TestStateDiffRoundTrip(t *testing.T) {
+	t1, _ := NewTerminal(DEF_ROWS, DEF_COLS)
+	t2 := writeCopy(t1, "hello \x1b[1;31mworld\x1b[m")
+	t3 := writeCopy(t2, "\x1b[3;5H\x1b[38;2;10;20;30m\x1b[48;5;200m日本語\x1b[4m ok")
+	t4 := writeCopy(t3, "\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\ plain")
+	t5 := writeCopy(t4, "\x1b]1;icon\a\x1b]2;title\a\x1b=\x1b[?25l\x1b[?2004h")
+	t6 := writeCopy(t5, "\x1b[2J\x1b[10;70Hwrapping past the end of the line")
+	t7 := writeCopy(t6, "\x1b[1;1Hé\x1b[5;1H\x1b[1;2;3;5;7;9m   \x1b[K")
+	t8 := t7.ForceCopy()
+	t8.fb.resize(10, 30)
+	t8.lastChg = t8.lastChg.Add(1)
+	t9 := writeCopy(t8, "\x1b[?25h\x1b>\x1b[2;28H日本\x1b[32m\x1b[5 q")
+	t10 := t9.ForceCopy()
+	t10.fb.resize(40, 100)
+	t10.lastChg = t10.lastChg.Add(1)
+	t11 := writeCopy(t10, "\x1b[4:3;58:2::255:0:0mcurly\x1b[21;58:5:9mdouble")
+
+	cases := []struct {
+		src, dest *Terminal
+	}{
+		{t1, t1},
+		{t1, t2},
+		{t2, t3},
+		{t3, t4},
+		{t4, t5},
+		{t5, t6},
+		{t6, t7},
+		{t7, t8},
+		{t8, t9},
+		{t9, t10},
+		{t10, t11},
+		{t1, t9},
+		{t9, t2},
+	}
+
+	for i, c := range cases {
+		b, err := proto.Marshal(c.src.StateDiff(c.dest))
+		if err != nil {
+			t.Fatalf("%d: Marshal() error: %v", i, err)
+		}
+		var d goshpb.TermDiff
+		if err := proto.Unmarshal(b, &d); err != nil {
+			t.Fatalf("%d: Unmarshal() error: %v", i, err)
+		}
+
+		got := c.src.ForceCopy()
+		if err := got.ApplyDiff(&d); err != nil {
+			t.Errorf("%d: ApplyDiff() error: %v", i, err)
+			continue
+		}
+		if what := sameDisplay(got, c.dest); what != "" {
+			t.Errorf("%d: %s differs after applying diff", i, what)
+		}
+	}
+}
+
+func TestStateDiffSpans(t *testing.T) {
+	t1, _ := NewTerminal(DEF_ROWS, DEF_COLS)
+	t2 := writeCopy(t1, "\x1b[2;1Ha\x1b[2;4Hb\x1b[2;20Hc\x1b[3;1H\x1b[31md")
+
+	d := t1.StateDiff(t2)
+	spans := d.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Got %d spans, wanted 3", len(spans))
+	}
+
+	cases := []struct {
+		row, col int32
+		runes    string
+		formats  []uint32
+		blanks   []uint32
+	}{
+		// Nearby changes are merged, including the
+		// unchanged cells between them
+		{1, 0, "a  b", nil, []uint32{1, 2}},
+		{1, 19, "c", nil, nil},
+		{2, 0, "d", []uint32{1, 1}, nil},
+	}
+
+	for i, c := range cases {
+		s := spans[i]
+		if s.GetRow() != c.row || s.GetCol() != c.col || s.GetRunes() != c.runes {
+			t.Errorf("%d: Got %q at (%d, %d), wanted %q at (%d, %d)", i, s.GetRunes(), s.GetRow(), s.GetCol(), c.runes, c.row, c.col)
+		}
+		if !equalUint32s(s.GetFormats(), c.formats) || !equalUint32s(s.GetBlanks(), c.blanks) {
+			t.Errorf("%d: Got formats %v and blanks %v, wanted %v and %v", i, s.GetFormats(), s.GetBlanks(), c.formats, c.blanks)
+		}
+	}
+
+	if len(d.GetFormats()) != 1 {
+		t.Errorf("Got %d formats, wanted 1", len(d.GetFormats()))
+	}
+}
+
+func equalUint32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyDiffInvalid(t *testing.T) {
+	span := func(row, col int32, runes string, formats []uint32) *goshpb.CellSpan {
+		return goshpb.CellSpan_builder{
+			Row:     proto.Int32(row),
+			Col:     proto.Int32(col),
+			Runes:   proto.String(runes),
+			Formats: formats,
+		}.Build()
+	}
+
+	cases := []*goshpb.TermDiff{
+		goshpb.TermDiff_builder{Spans: []*goshpb.CellSpan{span(DEF_ROWS, 0, "a", nil)}}.Build(),
+		goshpb.TermDiff_builder{Spans: []*goshpb.CellSpan{span(0, DEF_COLS-1, "ab", nil)}}.Build(),
+		goshpb.TermDiff_builder{Spans: []*goshpb.CellSpan{span(0, 0, "ab", []uint32{1, 0})}}.Build(),
+		goshpb.TermDiff_builder{Spans: []*goshpb.CellSpan{span(0, 0, "a", []uint32{1, 1})}}.Build(),
+		goshpb.TermDiff_builder{Spans: []*goshpb.CellSpan{span(0, 0, "a", []uint32{1})}}.Build(),
+		goshpb.TermDiff_builder{Formats: []*goshpb.Format{goshpb.Format_builder{Fg: goshpb.Color_builder{Type: proto.Int32(RGB)}.Build()}.Build()}}.Build(),
+		goshpb.TermDiff_builder{Formats: []*goshpb.Format{goshpb.Format_builder{Attrs: proto.Uint32(UNDERLINE), Underline: proto.Uint32(UL_DASHED + 1)}.Build()}}.Build(),
+		goshpb.TermDiff_builder{Formats: []*goshpb.Format{goshpb.Format_builder{Underline: proto.Uint32(UL_CURLY)}.Build()}}.Build(),
+		goshpb.TermDiff_builder{Formats: []*goshpb.Format{goshpb.Format_builder{UnderlineColor: newColor(FG_RED).proto()}.Build()}}.Build(),
+		goshpb.TermDiff_builder{PenFormat: proto.Uint32(1)}.Build(),
+		goshpb.TermDiff_builder{CursorRow: proto.Int32(-1), CursorCol: proto.Int32(0)}.Build(),
+		goshpb.TermDiff_builder{CursorStyle: proto.Uint32(uint32(CURSOR_STYLES))}.Build(),
+		goshpb.TermDiff_builder{Keypad: proto.Int32('x')}.Build(),
+		goshpb.TermDiff_builder{Modes: []*goshpb.TermMode{goshpb.TermMode_builder{Code: proto.Int32(9999)}.Build()}}.Build(),
+		goshpb.TermDiff_builder{Size: goshpb.Resize_builder{Rows: proto.Int32(MAX_ROWS + 1), Cols: proto.Int32(80)}.Build()}.Build(),
+		goshpb.TermDiff_builder{Scroll: scroll{0, DEF_ROWS, 1}.proto()}.Build(),
+	}
+
+	for i, d := range cases {
+		nt, _ := NewTerminal(DEF_ROWS, DEF_COLS)
+		if err := nt.ApplyDiff(d); !errors.Is(err, invalidDiff) {
+			t.Errorf("%d: Got %v, wanted %v", i, err, invalidDiff)
+		}
+	}
+}
@@ -8,12 +8,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode/utf8"
@@ -24,6 +25,18 @@ import (
 	"golang.org/x/text/unicode/norm"
 )
 
+// MAX_OSC_LEN and MAX_APC_LEN cap the strings we'll collect. OSC
+// strings can carry a whole image, base64 encoded, while APC ones
+// carry at most a chunk of one.
+const (
+	MAX_OSC_LEN = MAX_IMAGE_BYTES/3*4 + 1024
+	MAX_APC_LEN = 1 << 16
+)
+
+// SYNC_TIMEOUT is the longest we'll hold back what a program draws
+// while it has synchronized output on, in case it never turns it off.
+const SYNC_TIMEOUT = time.Second
+
 type manageFunc func()
 
 type Terminal struct {
@@ -39,19 +52,48 @@ type Terminal struct {
 	keypad rune // should be = (application) or > (normal)
 
 	// State
-	lastChg               time.Time
+	lastChg time.Time
+	// Whether we've handled output since lastChg was last
+	// settled, and what was visible then.
+	dirty                 bool
+	shown                 *Terminal
+	syncStart             time.Time // when synchronized output was turned on
 	title, icon           string
 	titlePfx              string
 	savedTitle, savedIcon string
 	cur, savedCur         cursor
+	curStyle              cursorStyle
 	curF, savedF          *format
 	hl, savedHL           *osc8
 	tabs                  []bool
 
 	cs, savedCS *charset
 
+	// The colors programs have set, over the outer terminal's.
+	pal *palette
+
+	// The last rune printed, for REP
+	lastRune rune
+
+	// Whether images have been placed, so we need to look for
+	// any that have been overwritten.
+	hasImages bool
+
+	// The image protocols the terminal we paint to understands,
+	// and the pixels of the images we've received (client).
+	gfx   atomic.Uint32
+	store *imageStore
+	// Whether the terminal we paint to has styled underlines
+	// and REP.
+	styledUL atomic.Bool
+	rep      atomic.Bool
+
 	// Temp
-	oscTemp []rune
+	oscTemp []byte
+	apcTemp []byte
+	strLong bool       // the OSC or APC string being received is too long
+	dcs     dcsHandler // the device control string being received
+	kitty   *kittyState
 
 	// scroll margin/region parameters
 	vertMargin, horizMargin margin
@@ -75,7 +117,7 @@ func NewTerminal(rows, cols int) (*Terminal, error) {
 
 	return &Terminal{
 		fb:      newFramebuffer(rows, cols),
-		oscTemp: make([]rune, 0),
+		oscTemp: make([]byte, 0),
 		tabs:    makeTabs(cols),
 		modes:   modes,
 		keypad:  PNM, // normal
@@ -85,7 +127,11 @@ func NewTerminal(rows, cols int) (*Terminal, error) {
 		curF:    defFmt.copy(),
 		savedF:  defFmt.copy(),
 		cs:      &charset{},
+		savedCS: &charset{},
 		hl:      defOSC8.copy(),
+		savedHL: defOSC8.copy(),
+		pal:     defPalette,
+		store:   newImageStore(),
 	}, nil
 }
 
@@ -185,7 +231,7 @@ func (t *Terminal) FirstRow() []byte {
 
 	var sb strings.Builder
 	sb.WriteString(("\x1b7\x1b[H\x1b[2K"))
-	sb.Write(fbe.diff(fb))
+	sb.Write(fbe.diff(fb, t.display()))
 	sb.WriteString("\x1b8")
 	return []byte(sb.String())
 }
@@ -198,7 +244,11 @@ func (t *Terminal) Write(p []byte) (int, error) {
 	// need to do on the client as it's already represented in the
 	// bytes shipped from the server.
 	if t.ptyF == nil {
-		if err := t.doParse(bufio.NewReader(bytes.NewReader(p))); err != nil {
+		err := t.doParse(bufio.NewReader(bytes.NewReader(p)))
+		t.mux.Lock()
+		t.settle()
+		t.mux.Unlock()
+		if err != nil {
 			return 0, err
 		}
 		return len(p), nil
@@ -216,8 +266,9 @@ func (t *Terminal) CopyIfNewer(ts time.Time) (*Terminal, bool) {
 	t.mux.Lock()
 	defer t.mux.Unlock()
 
+	t.settle()
 	if t.lastChg.After(ts) {
-		return t.copy(), true
+		return t.snapshot(), true
 	}
 
 	return nil, false
@@ -227,9 +278,47 @@ func (t *Terminal) ForceCopy() *Terminal {
 	t.mux.Lock()
 	defer t.mux.Unlock()
 
+	t.settle()
+	return t.snapshot()
+}
+
+// snapshot returns a copy of what the client should see, which is the
+// last complete frame while the program is drawing the next with
+// synchronized output. The caller must hold the lock.
+func (t *Terminal) snapshot() *Terminal {
+	if t.synchronized() && t.shown != nil {
+		return t.shown.copy()
+	}
 	return t.copy()
 }
 
+// synchronized returns whether the program is part way through
+// drawing a frame with synchronized output, which we'll wait for
+// until SYNC_TIMEOUT has passed.
+func (t *Terminal) synchronized() bool {
+	return t.isModeSet("SYNC_OUTPUT") && time.Since(t.syncStart) < SYNC_TIMEOUT
+}
+
+// settle updates lastChg if anything we'd show the client has changed
+// since it was last updated. Many sequences, like queries, redrawing
+// what's already there or setting the pen to what it already is,
+// leave things looking the same, and there's no reason to send a diff
+// for those. Nothing is settled while the program is drawing with
+// synchronized output. The caller must hold the lock.
+func (t *Terminal) settle() {
+	if !t.dirty || t.synchronized() {
+		return
+	}
+	t.dirty = false
+	t.evictImages()
+
+	if t.shown != nil && t.shown.looksLike(t) {
+		return
+	}
+	t.lastChg = time.Now().UTC()
+	t.shown = t.copy()
+}
+
 func (t *Terminal) copy() *Terminal {
 
 	modes := make(map[string]*mode)
@@ -242,19 +331,23 @@ func (t *Terminal) copy() *Terminal {
 	// rendering so we can ignore it as long as we handle it
 	// appropriately and ship the visual diff to the client.
 	return &Terminal{
-		fb:       t.fb.copy(),
-		title:    t.title,
-		titlePfx: t.titlePfx,
-		icon:     t.icon,
-		cur:      t.cur,
-		curF:     t.curF,
-		keypad:   t.keypad,
-		modes:    modes,
-		lastChg:  t.lastChg,
-		p:        t.p.copy(),
-		ptyF:     t.ptyF,
-		cs:       t.cs.copy(),
-		hl:       t.hl,
+		fb:        t.fb.copy(),
+		title:     t.title,
+		titlePfx:  t.titlePfx,
+		icon:      t.icon,
+		cur:       t.cur,
+		curStyle:  t.curStyle,
+		curF:      t.curF,
+		keypad:    t.keypad,
+		modes:     modes,
+		lastChg:   t.lastChg,
+		p:         t.p.copy(),
+		ptyF:      t.ptyF,
+		cs:        t.cs.copy(),
+		hl:        t.hl,
+		pal:       t.pal,
+		hasImages: t.hasImages,
+		store:     t.store,
 	}
 }
 
@@ -270,21 +363,41 @@ func (t *Terminal) Replace(other *Terminal) {
 	t.savedF = other.savedF
 	t.cur = other.cur
 	t.savedCur = other.savedCur
+	t.curStyle = other.curStyle
+	t.keypad = other.keypad
 	t.p = other.p
 	t.modes = other.modes
 	t.hl = other.hl
+	t.pal = other.pal
+}
+
+// Restore returns what puts back the outer terminal's colors and
+// cursor style if programs changed them, for when the client exits.
+func (t *Terminal) Restore() []byte {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	s := t.pal.diff(t.pal.without())
+	if t.curStyle != CURSOR_DEFAULT {
+		s += CURSOR_DEFAULT.ansiString()
+	}
+	return []byte(s)
 }
 
 func (t *Terminal) LastChange() time.Time {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.settle()
 	return t.lastChg
 }
 
 // Diff will generate a sequence of bytes that, when applied, would
-// move src to dest. This is at a visual level only as the server will
-// ship these diffs to the client which is stateless and only used to
-// display output. Because of that, we can ignore some properties like
-// margins which are only important if you're applying all of the
-// display updating based on the output from the pty directly.
+// move src to dest. This is at a visual level only as it's used by
+// the client to paint the outer terminal. Because of that, we can
+// ignore some properties like margins which are only important if
+// you're applying all of the display updating based on the output
+// from the pty directly. The server ships StateDiff instead.
 func (src *Terminal) Diff(dest *Terminal) []byte {
 	var sb strings.Builder
 
@@ -306,6 +419,10 @@ func (src *Terminal) Diff(dest *Terminal) []byte {
 		}
 	}
 
+	if !src.pal.equal(dest.pal) {
+		sb.WriteString(src.pal.diff(dest.pal))
+	}
+
 	if src.keypad != dest.keypad {
 		sb.WriteString(fmt.Sprintf("%c%c", ESC, dest.keypad))
 	}
@@ -324,22 +441,26 @@ func (src *Terminal) Diff(dest *Terminal) []byte {
 			sb.WriteString(dest.modes[id].ansiString())
 		}
 	}
+	if src.curStyle != dest.curStyle {
+		sb.WriteString(dest.curStyle.ansiString())
+	}
 
 	// we always generate diffs as from previous to current
-	fbd := src.fb.diff(dest.fb)
+	disp := src.display()
+	fbd := src.fb.diff(dest.fb, disp)
 	if len(fbd) > 0 {
 		sb.WriteString(FMT_RESET)
 		sb.Write(fbd)
 		// We assume that the pen was changed during the
 		// writing of the framebuffer diff, so always generate
 		// a full format reset for the diff
-		sb.Write(defFmt.diff(dest.curF))
+		sb.Write(defFmt.diff(disp.format(dest.curF)))
 		// Similarly for the osc8 data
 		sb.WriteString(dest.hl.ansiString())
 	} else {
 		// If we didn't write anything, the pen may still be
 		// different so we should ship the delta.
-		sb.Write(src.curF.diff(dest.curF))
+		sb.Write(disp.format(src.curF).diff(disp.format(dest.curF)))
 	}
 
 	if len(fbd) > 0 || !src.cur.equal(dest.cur) {
@@ -359,8 +480,15 @@ func (t *Terminal) Run() {
 
 func (t *Terminal) doParse(rr *bufio.Reader) error {
 	for {
+		if t.p.state == STATE_GROUND && t.printRun(rr) {
+			continue
+		}
 
 		if r, sz, err := rr.ReadRune(); err != nil {
+			if errors.Is(err, io.EOF) && t.ptyF == nil {
+				// The client feeds us its own buffers.
+				return nil
+			}
 			if !errors.Is(err, os.ErrDeadlineExceeded) {
 				slog.Error("pty ReadRune", "r", r, "sz", sz, "err", err)
 				return nil
@@ -379,7 +507,7 @@ func (t *Terminal) doParse(rr *bufio.Reader) error {
 		} else {
 			for _, a := range t.p.parse(r) {
 				t.mux.Lock()
-				t.lastChg = time.Now().UTC()
+				t.dirty = true
 				switch a.act {
 				case ACTION_EXECUTE:
 					t.handleExecute(a.cmd)
@@ -387,6 +515,10 @@ func (t *Terminal) doParse(rr *bufio.Reader) error {
 					t.handleCSI(a.params, string(a.data), a.cmd)
 				case ACTION_OSC_START, ACTION_OSC_PUT, ACTION_OSC_END:
 					t.handleOSC(a.act, a.cmd)
+				case ACTION_HOOK, ACTION_PUT, ACTION_UNHOOK:
+					t.handleDCS(a.act, a.params, string(a.data), a.cmd)
+				case ACTION_APC_START, ACTION_APC_PUT, ACTION_APC_END:
+					t.handleAPC(a.act, a.cmd)
 				case ACTION_PRINT:
 					t.print(a.cmd)
 				case ACTION_ESC_DISPATCH:
@@ -400,6 +532,29 @@ func (t *Terminal) doParse(rr *bufio.Reader) error {
 	}
 }
 
+// printRun prints any run of printable ASCII at the front of rr's
+// buffer, returning true if there was one. In the ground state, the
+// parser would only print each of them, so we skip it and print the
+// run in one go.
+func (t *Terminal) printRun(rr *bufio.Reader) bool {
+	buf, _ := rr.Peek(max(1, rr.Buffered()))
+	n := 0
+	for n < len(buf) && buf[n] >= 0x20 && buf[n] < 0x7f {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+
+	t.mux.Lock()
+	t.dirty = true
+	t.printASCII(buf[:n])
+	t.mux.Unlock()
+
+	rr.Discard(n)
+	return true
+}
+
 func (t *Terminal) Resize(rows, cols int) {
 	pts := &pty.Winsize{
 		Rows: uint16(rows),
@@ -423,7 +578,7 @@ func (t *Terminal) Resize(rows, cols int) {
 	t.mux.Lock()
 	t.fb.resize(rows, cols)
 	t.resizeTabs(cols)
-	t.lastChg = time.Now().UTC()
+	t.dirty = true
 	t.mux.Unlock()
 }
 
@@ -491,14 +646,13 @@ func (t *Terminal) ctrlNEL() {
 }
 
 func (t *Terminal) handleESC(params *parameters, data string, cmd rune) {
+	if len(data) > 0 && strings.IndexByte(SCS_94+SCS_96, data[0]) >= 0 {
+		// designate g0 through g3 charset
+		t.cs.setCS(data, cmd)
+		return
+	}
+
 	switch data {
-	case "(", ")": // desginate g0 or g1 charset
-		switch cmd {
-		case '0', 'B':
-			t.cs.setCS(data, cmd)
-		default:
-			slog.Debug("swallowing ESC character set command", "params", params, "data", data, "cmd", string(cmd))
-		}
 	case "":
 		switch cmd {
 		case NEL:
@@ -534,6 +688,19 @@ func (t *Terminal) handleESC(params *parameters, data string, cmd rune) {
 			t.keypad = cmd
 		case RIS:
 			t.reset()
+		case ST:
+			// Ends a string we've already handled.
+		case SS2:
+			t.cs.singleShift(2)
+		case SS3:
+			t.cs.singleShift(3)
+		case LS2:
+			t.cs.lockingShift(2)
+		case LS3:
+			t.cs.lockingShift(3)
+		case LS1R, LS2R, LS3R:
+			// GR is never used, as we read UTF-8 rather than
+			// 8 bit characters.
 		default:
 			slog.Debug("unhandled ESC command", "cmd", string(cmd), "params", params, "data", data)
 		}
@@ -563,26 +730,26 @@ func (t *Terminal) cursorRestore() {
 func (t *Terminal) handleOSC(act pAction, cmd rune) {
 	switch act {
 	case ACTION_OSC_START:
-		t.oscTemp = make([]rune, 0)
+		t.oscTemp = make([]byte, 0)
+		t.strLong = false
 	case ACTION_OSC_PUT:
-		t.oscTemp = append(t.oscTemp, cmd)
+		if len(t.oscTemp) >= MAX_OSC_LEN {
+			t.strLong = true
+			return
+		}
+		t.oscTemp = utf8.AppendRune(t.oscTemp, cmd)
 	case ACTION_OSC_END:
+		if t.strLong {
+			slog.Debug("dropping overly long OSC string", "data", string(t.oscTemp[:32]))
+			t.oscTemp = t.oscTemp[:0]
+			return
+		}
 		// https://invisible-island.net/xterm/ctlseqs/ctlseqs.html#h3-Operating-System-Commands
 		// is a good description of many of the options
 		// here. So many of them are completely legacy that we
 		// won't implement them here unless it proves to be
 		// useful as we gain experience with things in the
 		// wild.
-		//
-		// NOTE: Per the xterm documentation, we're going to
-		// steal "X" to mean reasize and expect 2 parameters
-		// (rows, cols) as arguments (eg: PS X ; r ; c ST)
-		// which will allow us to succinctly pass along window
-		// size information from the emulation on the server
-		// to the emulation on the client. (The client passes
-		// this to the server with a special message, but we
-		// prefer to ship it back via "diff" which will be in
-		// the form of ANSI code using this capability.)
 		if len(t.oscTemp) > 0 {
 			data := string(t.oscTemp)
 			parts := strings.SplitN(data, ";", 3)
@@ -594,6 +761,15 @@ func (t *Terminal) handleOSC(act pAction, cmd rune) {
 				t.icon = parts[1]
 			case OSC_TITLE:
 				t.title = t.titlePfx + parts[1]
+			case OSC_PALETTE, OSC_FG, OSC_BG, OSC_CURSOR_COLOR, OSC_PALETTE_RESET, OSC_FG_RESET, OSC_BG_RESET, OSC_CURSOR_RESET:
+				_, args, _ := strings.Cut(data, ";")
+				t.oscColor(parts[0], args)
+			case OSC_ITERM2:
+				if len(parts) > 1 && strings.HasPrefix(parts[1], ITERM2_FILE) {
+					t.itermFile(strings.TrimPrefix(data, OSC_ITERM2+";"+ITERM2_FILE))
+				} else {
+					slog.Debug("unknown iTerm2 command", "data", data)
+				}
 			case OSC_HYPERLINK:
 				switch len(parts) {
 				case 3:
@@ -605,32 +781,6 @@ func (t *Terminal) handleOSC(act pAction, cmd rune) {
 				default:
 					slog.Debug("invalid osc8 data", "data", data)
 				}
-			case OSC_SETSIZE: // a Gosh convention
-				if len(parts) == 3 {
-					for {
-						var rows, cols int
-						var err error
-						if rows, err = strconv.Atoi(parts[1]); err != nil {
-							break
-						}
-						if cols, err = strconv.Atoi(parts[2]); err != nil {
-							break
-						}
-
-						// Can't use t.Resize
-						// here as it takes
-						// the same lock.
-						t.fb.resize(rows, cols)
-
-						// we only use the for loop so
-						// that we can break and clean
-						// up osctemp no matter what.
-						break
-					}
-
-				} else {
-					slog.Debug("expected 2 inputs to X;rows;cols osc setsize", "len", len(parts), "osctemp", t.oscTemp)
-				}
 			default:
 				slog.Debug("unknown OSC command", "data", data)
 			}
@@ -639,6 +789,31 @@ func (t *Terminal) handleOSC(act pAction, cmd rune) {
 	}
 }
 
+func (t *Terminal) handleAPC(act pAction, cmd rune) {
+	switch act {
+	case ACTION_APC_START:
+		t.apcTemp = t.apcTemp[:0]
+		t.strLong = false
+	case ACTION_APC_PUT:
+		if len(t.apcTemp) >= MAX_APC_LEN {
+			t.strLong = true
+			return
+		}
+		t.apcTemp = utf8.AppendRune(t.apcTemp, cmd)
+	case ACTION_APC_END:
+		data := string(t.apcTemp)
+		t.apcTemp = t.apcTemp[:0]
+		switch {
+		case t.strLong:
+			slog.Debug("dropping overly long APC string", "data", data[:32])
+		case strings.HasPrefix(data, "G"):
+			t.kittyGraphics(data[1:])
+		default:
+			slog.Debug("unknown APC string", "data", data)
+		}
+	}
+}
+
 // clearFrags will ensure we never leave a dangling fragment when we
 // write to a cell. If the row and column to be written to is part of
 // a fragment, it will clear the previous or next cell, depending on
@@ -666,6 +841,9 @@ func (t *Terminal) softReset() {
 	t.curF = defFmt.copy()
 	t.savedF = defFmt.copy()
 	t.hl = defOSC8.copy()
+	t.savedHL = defOSC8.copy()
+	t.cs = &charset{}
+	t.savedCS = &charset{}
 }
 
 func (t *Terminal) reset() {
@@ -683,9 +861,13 @@ func (t *Terminal) reset() {
 	t.horizMargin = margin{}
 	t.homeCursor()
 	t.savedCur = cursor{0, 0}
+	t.curStyle = CURSOR_DEFAULT
 	t.tabs = makeTabs(cols)
 	t.cs = &charset{}
+	t.savedCS = &charset{}
 	t.hl = defOSC8.copy()
+	t.savedHL = defOSC8.copy()
+	t.pal = t.pal.without()
 }
 
 func (t *Terminal) isModeSet(name string) bool {
@@ -699,6 +881,7 @@ func (t *Terminal) isModeSet(name string) bool {
 
 func (t *Terminal) print(r rune) {
 	row, col := t.row(), t.col()
+	t.lastRune = r
 
 	ar := t.cs.runeFor(r)
 	rw := runewidth.StringWidth(string(ar))
@@ -737,7 +920,7 @@ func (t *Terminal) print(r rune) {
 		}
 
 		c.r = []rune(norm.NFC.String(string(c.r) + string(ar)))[0]
-		t.fb.setCell(combR, combC, c)
+		t.fb.setCell(combR, combC, &c)
 	default: // default (1 column), wide (2 columns)
 		if col > t.Cols()-rw { // rune will not fit on row
 			if t.isModeSet("DECAWM") { // autowrap is on
@@ -773,7 +956,7 @@ func (t *Terminal) print(r rune) {
 					slog.Debug("invalid cell in region", "row", 0, "col", i-1, "err", err)
 					return
 				}
-				cells.setCell(0, i, c)
+				cells.setCell(0, i, &c)
 			}
 		}
 
@@ -796,6 +979,47 @@ func (t *Terminal) print(r rune) {
 	}
 }
 
+// printASCII prints b, which must be printable ASCII, as print would
+// but a row at a time. Every rune, even after charset translation, is
+// one column wide, so only the cells at each end of a row's worth
+// can be part of a wide rune. Insert mode and disabled autowrap take
+// the slow path.
+func (t *Terminal) printASCII(b []byte) {
+	if t.isModeSet("IRM") || !t.isModeSet("DECAWM") {
+		for _, c := range b {
+			t.print(rune(c))
+		}
+		return
+	}
+
+	t.lastRune = rune(b[len(b)-1])
+
+	for len(b) > 0 {
+		row, col := t.row(), t.col()
+		if col >= t.Cols() {
+			if row == t.bottomMargin() {
+				t.scrollRegion(1)
+			} else {
+				row += 1
+			}
+			col = t.boundedMarginLeft()
+		}
+
+		n := min(len(b), t.Cols()-col)
+		t.clearFrags(row, col)
+		t.clearFrags(row, col+n-1)
+
+		cells := t.fb.mutRow(row)
+		for i, c := range b[:n] {
+			cells[col+i] = cell{set: true, r: t.cs.runeFor(rune(c)), f: t.curF, hl: t.hl}
+		}
+
+		t.setRow(row)
+		t.setCol(col + n)
+		b = b[n:]
+	}
+}
+
 func (t *Terminal) handleExecute(cmd rune) {
 	switch cmd {
 	case BEL:
@@ -828,9 +1052,12 @@ func (t *Terminal) handleCSI(params *parameters, data string, cmd rune) {
 	slog.Debug("handling CSI command", "cmd", makeCommand(params, data, cmd), "cur", t.cur)
 	switch cmd {
 	case CSI_RIS:
-		if data == "!" {
+		switch data {
+		case "!":
 			t.softReset()
-		} else {
+		case "$", "?$": // DECRQM
+			t.decrqm(params.item(0, 0), strings.TrimSuffix(data, "$"))
+		default:
 			slog.Debug("unimplemented CSI_RIS command", "cmd", makeCommand(params, data, cmd))
 		}
 	case CSI_DSR:
@@ -849,13 +1076,9 @@ func (t *Terminal) handleCSI(params *parameters, data string, cmd rune) {
 	case CSI_ICH:
 		t.insertChars(' ', params.itemDefaultOneIfZero(0, 1))
 	case CSI_ECH:
-		// Insert n blank characters where n is the provided parameter
-		l := t.cur.col + params.item(0, 1)
-		if lastCol := t.Cols() - 1; l > lastCol {
-			l = lastCol
-		}
-		row := t.row()
-		t.fb.setCells(row, row, t.col(), l, newCell(' ', t.curF, t.hl))
+		t.eraseChars(params.itemDefaultOneIfZero(0, 1))
+	case CSI_REP:
+		t.repeatRune(params.itemDefaultOneIfZero(0, 1))
 	case CSI_MODE_SET, CSI_MODE_RESET:
 		for i := 0; i < params.numItems(); i++ {
 			t.setMode(params.item(i, 0), data, cmd)
@@ -928,10 +1151,6 @@ func (t *Terminal) inScrollingRegion() bool {
 	return t.vertMargin.contains(t.row()) && t.horizMargin.contains(t.col())
 }
 
-func (t *Terminal) scrollingRegion() (*framebuffer, error) {
-	return t.fb.subRegion(t.topMargin(), t.bottomMargin(), t.leftMargin(), t.rightMargin())
-}
-
 func (t *Terminal) lineFeed() {
 	row := t.row()
 	if bottom := t.boundedMarginBottom(); row == bottom {
@@ -946,12 +1165,9 @@ func (t *Terminal) lineFeed() {
 }
 
 func (t *Terminal) scrollRegion(n int) {
-	fb, err := t.scrollingRegion()
-	if err != nil {
-		slog.Debug("couldn't get scrolling region", "err", err)
-		return
+	if err := t.fb.scrollArea(t.topMargin(), t.bottomMargin(), t.leftMargin(), t.rightMargin(), n); err != nil {
+		slog.Debug("couldn't scroll scrolling region", "err", err)
 	}
-	fb.scrollRows(n)
 }
 
 func (t *Terminal) xtwinops(params *parameters) {
@@ -987,11 +1203,27 @@ func (t *Terminal) csiQ(n int, data string) {
 			return
 		}
 		t.Write([]byte(fmt.Sprintf("%c%c>|gosh(%s)%c%c", ESC, DCS, GOSH_VT_VER, ESC, ST)))
+	case " ": // DECSCUSR
+		if n < 0 || n >= int(CURSOR_STYLES) {
+			slog.Debug("invalid cursor style", "n", n)
+			return
+		}
+		t.curStyle = cursorStyle(n)
 	default:
 		slog.Debug("unhandled CSI q", "n", n, "data", data)
 	}
 }
 
+// decrqm answers a DECRQM request for the mode n, which is DEC
+// private if data is "?", with whether it's set.
+func (t *Terminal) decrqm(n int, data string) {
+	state := DECRQM_UNKNOWN
+	if m, ok := t.modes[fmt.Sprintf("%s%d", data, n)]; ok {
+		state = m.decrqm()
+	}
+	t.Write([]byte(fmt.Sprintf("%c%c%s%d;%d$y", ESC, CSI, data, n, state)))
+}
+
 func (t *Terminal) handleDSR(n int, data string) {
 	switch data {
 	case "": // General device status report
@@ -1042,7 +1274,7 @@ func (t *Terminal) replyDeviceAttributes(data string) {
 	case ">": // secondary attributes
 		t.Write([]byte("\033[>1;10;0c")) // vt220
 	case "": // primary attributes
-		t.Write([]byte("\033[?62c")) // vt220
+		t.Write([]byte("\033[?62;4c")) // vt220, with sixel
 	default:
 		slog.Debug("unexpected CSI device attributes request")
 	}
@@ -1089,7 +1321,10 @@ func (t *Terminal) setMode(mode int, data string, state rune) {
 		} else {
 			t.cursorRestore()
 		}
-
+	case "SYNC_OUTPUT":
+		if state == CSI_MODE_SET {
+			t.syncStart = time.Now()
+		}
 	}
 }
 
@@ -1216,12 +1451,9 @@ func (t *Terminal) insertLines(n int) {
 		return
 	}
 
-	sr, err := t.fb.subRegion(t.row(), t.boundedMarginBottom(), t.boundedMarginLeft(), t.boundedMarginRight())
-	if err != nil {
+	if err := t.fb.scrollArea(t.row(), t.boundedMarginBottom(), t.boundedMarginLeft(), t.boundedMarginRight(), -n); err != nil {
 		slog.Error("invalid subregion request", "row", t.row(), "bottom", t.boundedMarginBottom(), "err", err)
-		return
 	}
-	sr.scrollRows(-n)
 }
 
 func (t *Terminal) deleteLines(n int) {
@@ -1229,12 +1461,9 @@ func (t *Terminal) deleteLines(n int) {
 		return
 	}
 
-	sr, err := t.fb.subRegion(t.row(), t.boundedMarginBottom(), t.boundedMarginLeft(), t.boundedMarginRight())
-	if err != nil {
+	if err := t.fb.scrollArea(t.row(), t.boundedMarginBottom(), t.boundedMarginLeft(), t.boundedMarginRight(), n); err != nil {
 		slog.Error("invalid subregion request", "row", t.row(), "bottom", t.boundedMarginBottom(), "err", err)
-		return
 	}
-	sr.scrollRows(n)
 }
 
 func (t *Terminal) deleteChars(n int) {
@@ -1282,7 +1511,7 @@ func (t *Terminal) deleteChars(n int) {
 			slog.Error("invalid cell request during deleteChars", "col", i, "cur", t.cur, "err", err)
 		}
 
-		reg.setCell(0, i-offset, c)
+		reg.setCell(0, i-offset, &c)
 	}
 	// TODO: Handle format more appropriately here.  Leave
 	// it intact? Default as we do now? Does BCE come into
@@ -1304,6 +1533,27 @@ func (t *Terminal) insertChars(r rune, n int) {
 	}
 }
 
+// eraseChars erases n cells from the cursor, without moving it.
+func (t *Terminal) eraseChars(n int) {
+	// TODO: Handle BCE properly
+	dc := defaultCell()
+	dc.f = t.curF
+
+	row, col := t.row(), t.col()
+	t.fb.setCells(row, row, col, min(col+n, t.Cols())-1, dc)
+}
+
+// repeatRune prints the last rune printed n more times, but no more
+// than would fill the screen.
+func (t *Terminal) repeatRune(n int) {
+	if t.lastRune == 0 {
+		return
+	}
+	for i := 0; i < min(n, t.Rows()*t.Cols()); i++ {
+		t.print(t.lastRune)
+	}
+}
+
 func (t *Terminal) eraseLine(n int) {
 	// TODO: Handle BCE properly
 	dc := defaultCell()
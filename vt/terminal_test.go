@@ -5,8 +5,11 @@ package vt
 import (
 	"fmt"
 	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/mattn/go-runewidth"
 )
 
 func TestCursorInScrollingRegion(t *testing.T) {
@@ -107,9 +110,9 @@ func TestLineFeed(t *testing.T) {
 
 func TestPrintCharsets(t *testing.T) {
 	cs1 := &charset{}
-	csg1 := &charset{set: 1}
-	csg0s := &charset{g: [2]bool{true, false}}
-	csg1s := &charset{set: 1, g: [2]bool{false, true}}
+	csg1 := &charset{gl: 1}
+	csg0s := &charset{g: [4]glyphSet{CS_DEC_SPECIAL}}
+	csg1s := &charset{gl: 1, g: [4]glyphSet{CS_ASCII, CS_DEC_SPECIAL}}
 
 	fb1w := newFramebuffer(10, 10)
 	fb1w.setCell(0, 0, newCell('a', defFmt.copy(), defOSC8.copy()))
@@ -362,6 +365,10 @@ func TestTerminalDiff(t *testing.T) {
 	t22.cur = cursor{10, 10}
 	t23 := testTerminalCopy(t22)
 	t23.keypad = PAM
+	t24 := testTerminalCopy(t23)
+	t24.curStyle = CURSOR_BAR
+	t25 := testTerminalCopy(t24)
+	t25.curStyle = CURSOR_DEFAULT
 
 	cases := []struct {
 		src, dest *Terminal
@@ -369,12 +376,12 @@ func TestTerminalDiff(t *testing.T) {
 	}{
 		{t1, t1, ""},
 		{t1, t2, ""},
-		{t2, t3, fmt.Sprintf("%c%c%c%c%c%s;%d;%d%c%c%c%s%c%c%c%c%c", ESC, CSI, CSI_SGR, ESC, OSC, OSC_SETSIZE, 20, 15, BEL, ESC, OSC, cancelHyperlink, ESC, ST, ESC, CSI, CSI_CUP)},
+		{t2, t3, ""}, // Size isn't painted
 		{t3, t4, fmt.Sprintf("%c%c%c%s%c%c%d%c%c%c%c%s%c%c%s", ESC, CSI, CSI_SGR, cursor{5, 7}.ansiString(), ESC, CSI, FG_RED, CSI_SGR, 'a', ESC, OSC, cancelHyperlink, ESC, ST, cursor{}.ansiString())},
 		{t4, t5, fmt.Sprintf("%c%c%s;%s%c", ESC, OSC, OSC_TITLE, "mytitle", BEL)},
 		{t4, t6, fmt.Sprintf("%c%c%s;%s%c", ESC, OSC, OSC_ICON_TITLE, "mytitle", BEL)},
 		{t4, t7, fmt.Sprintf("%c%c%s;%s%c", ESC, OSC, OSC_ICON, "myicon", BEL)},
-		{t1, t8, fmt.Sprintf("%c%c%s;%s%c%c%c%c%c%c%s;%d;%d%c%c%c%s%c%c%c%c%c", ESC, OSC, OSC_ICON, "myicon", BEL, ESC, CSI, CSI_SGR, ESC, OSC, OSC_SETSIZE, 10, 6, BEL, ESC, OSC, cancelHyperlink, ESC, ST, ESC, CSI, CSI_CUP)},
+		{t1, t8, fmt.Sprintf("%c%c%s;%s%c", ESC, OSC, OSC_ICON, "myicon", BEL)},
 		{t8, t9, fmt.Sprintf("%c%c?%d%c", ESC, CSI, REV_VIDEO, CSI_MODE_SET)},
 		{t9, t10, fmt.Sprintf("%c%c?%d%c%c%c?%d%c", ESC, CSI, REV_VIDEO, CSI_MODE_RESET, ESC, CSI, SHOW_CURSOR, CSI_MODE_RESET)},
 		{t10, t11, ""}, // No diff as we don't ship margins
@@ -388,6 +395,8 @@ func TestTerminalDiff(t *testing.T) {
 		{t19, t20, fmt.Sprintf("%c%c%c%c%c;2%c*%c%c%s%c%c%c%c%c", ESC, CSI, CSI_SGR, ESC, CSI, CSI_CUP, ESC, OSC, cancelHyperlink, ESC, ST, ESC, CSI, CSI_CUP)},
 		{t21, t22, fmt.Sprintf("%c%c%d;%d%c", ESC, CSI, 11, 11, CSI_CUP)},
 		{t22, t23, fmt.Sprintf("%c%c", ESC, PAM)},
+		{t23, t24, fmt.Sprintf("%c%c6 %c", ESC, CSI, CSI_Q_MULTI)},
+		{t24, t25, fmt.Sprintf("%c%c0 %c", ESC, CSI, CSI_Q_MULTI)},
 	}
 
 	for i, c := range cases {
@@ -402,20 +411,13 @@ func TestEraseInDisplay(t *testing.T) {
 	fb2 := emptyFb.copy()
 	fillBuffer(fb2)
 	fb2erase1 := fb2.copy()
-	copy(fb2erase1.data[4][4:], newRow(6))
-	fb2erase1.data[5] = newRow(10)
-	fb2erase1.data[6] = newRow(10)
-	fb2erase1.data[7] = newRow(10)
-	fb2erase1.data[8] = newRow(10)
-	fb2erase1.data[9] = newRow(10)
+	fb2erase1.setCells(4, 4, 4, 9, defaultCell())
+	fb2erase1.resetRows(5, 9)
 	fb2erase2 := fb2.copy()
-	copy(fb2erase2.data[9][4:], newRow(6))
+	fb2erase2.setCells(9, 9, 4, 9, defaultCell())
 	fb2erase3 := fb2.copy()
-	fb2erase3.data[0] = newRow(10)
-	fb2erase3.data[1] = newRow(10)
-	fb2erase3.data[2] = newRow(10)
-	fb2erase3.data[3] = newRow(10)
-	copy(fb2erase3.data[4][0:5], newRow(5))
+	fb2erase3.resetRows(0, 3)
+	fb2erase3.setCells(4, 4, 0, 4, defaultCell())
 
 	cases := []struct {
 		cur    cursor
@@ -555,7 +557,7 @@ func TestClearTabs(t *testing.T) {
 
 	for i, c := range cases {
 		term := &Terminal{tabs: c.tabs, cur: c.cur}
-		params := &parameters{1, []int{c.tbc_mode}}
+		params := &parameters{num: 1, items: []int{c.tbc_mode}}
 		term.clearTabs(params)
 		if !slices.Equal(term.tabs, c.want) {
 			t.Errorf("%d: Got\n\t%v, wanted\n\t%v", i, term.tabs, c.want)
@@ -816,38 +818,22 @@ func TestDeleteChars(t *testing.T) {
 	}
 }
 
-func TestOSCResize(t *testing.T) {
-	nt := func() *Terminal {
-		x, _ := NewTerminal(DEF_ROWS, DEF_COLS)
-		return x
-	}
+func TestRestore(t *testing.T) {
 	cases := []struct {
-		term        *Terminal
-		rows, cols  int
-		wantSuccess bool
+		input string
+		want  string
 	}{
-		{nt(), 60, 201, true},
-		{nt(), 24, 81, true},
-		{nt(), 25, 80, true},
-		{nt(), 10, 10, true},
-		{nt(), -1, 201, false},
-		{nt(), 60, -1, false},
-		{nt(), MAX_ROWS + 1, 80, false},
-		{nt(), MAX_ROWS + 1, MAX_COLS + 1, false},
+		{"", ""},
+		{"\x1b[4 q", "\x1b[0 q"},
+		{"\x1b[4 q\x1b[0 q", ""},
+		{"\x1b]4;3;#fff\x07\x1b[2 q", "\x1b]104;3\x07\x1b[0 q"},
 	}
 
 	for i, c := range cases {
-		c.term.oscTemp = []rune(fmt.Sprintf("%s;%d;%d", OSC_SETSIZE, c.rows, c.cols))
-		c.term.handleOSC(ACTION_OSC_END, BEL)
-		switch c.wantSuccess {
-		case true:
-			if rows, cols := c.term.Rows(), c.term.Cols(); rows != c.rows || cols != c.cols {
-				t.Errorf("%d: Wanted r:%d, c: %d; got r:%d, c:%d", i, c.rows, c.cols, rows, cols)
-			}
-		case false:
-			if rows, cols := c.term.Rows(), c.term.Cols(); rows != 24 || cols != 80 {
-				t.Errorf("%d: Wanted r:%d, c: %d; got r:%d, c:%d", i, c.rows, c.cols, rows, cols)
-			}
+		nt, _ := NewTerminal(10, 20)
+		nt.Write([]byte(c.input))
+		if got := string(nt.Restore()); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
 		}
 	}
 }
@@ -878,3 +864,262 @@ func TestMakeOverlay(t *testing.T) {
 		}
 	}
 }
+
+func TestEraseChars(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+		col   int
+	}{
+		{"abcdef\x1b[3G\x1b[2X", "ab  ef", 2},
+		{"abcdef\x1b[3G\x1b[X", "ab def", 2},
+		{"abcdef\x1b[3G\x1b[0X", "ab def", 2},
+		{"abcdef\x1b[5G\x1b[20X", "abcd  ", 4},
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(2, 6)
+		nt.Write([]byte(c.input))
+		if got := strings.Split(nt.fb.String(), "\n")[0]; got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+		if nt.cur.col != c.col {
+			t.Errorf("%d: Got cursor at col %d, wanted %d", i, nt.cur.col, c.col)
+		}
+	}
+}
+
+func TestRepeatRune(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{"a\x1b[3b", "aaaa      \n          "},
+		{"ab\x1b[b", "abb       \n          "},
+		{"\x1b[3b", "          \n          "}, // nothing to repeat
+		{"=\x1b[12b", "==========\n===       "},
+		{"x\x1b[100b", "xxxxxxxxxx\nx         "}, // capped at a screenful
+	}
+
+	for i, c := range cases {
+		nt, _ := NewTerminal(2, 10)
+		nt.Write([]byte(c.input))
+		if got := strings.TrimSuffix(nt.fb.String(), "\n"); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+	}
+}
+
+func TestPrintASCII(t *testing.T) {
+	cases := []struct {
+		setup string
+		input string
+	}{
+		{"", "hello"},
+		{"", "a line longer than the screen is wide"},          // wraps
+		{"\x1b[3;1H", "fills the bottom rows and scrolls up"},  // scrolls
+		{"\x1b[2;3r\x1b[3;1H", "scrolls only the region rows"}, // margins
+		{"\x1b(0", "lqqk x  x mqqj"},                           // DEC special graphics
+		{"\x1b*>\x1bN", "abc"},                                 // single shift
+		{"\x1b.A\x0e", "latin"},                                // 96 character set
+		{"\x1b[1;3H世界\x1b[1;4H", "ab"},                         // splits wide runes
+		{"世界世界\x1b[1;2H", "abc"},
+		{"\x1b[4hxyz\x1b[1;1H", "ab"}, // IRM
+		{"\x1b[?7l", "no autowrap past the edge"},
+		{"\x1b[31;4m", "formatted"},
+	}
+
+	for i, c := range cases {
+		fast, _ := NewTerminal(3, 10)
+		fast.Write([]byte(c.setup + c.input))
+
+		slow, _ := NewTerminal(3, 10)
+		slow.Write([]byte(c.setup))
+		for _, r := range c.input {
+			slow.print(r)
+		}
+
+		if what := sameDisplay(fast, slow); what != "" {
+			t.Errorf("%d: %s differs:\n%s\nwanted\n%s", i, what, fast.fb, slow.fb)
+		}
+		if fast.lastRune != slow.lastRune {
+			t.Errorf("%d: Got lastRune %q, wanted %q", i, fast.lastRune, slow.lastRune)
+		}
+	}
+}
+
+// printASCII translates runes through the charset without checking
+// their width, so every translation must be one column wide.
+func TestACSWidth(t *testing.T) {
+	for gs, m := range glyphs {
+		for from, to := range m {
+			if w := runewidth.RuneWidth(to); w != 1 {
+				t.Errorf("glyphs[%d][%q] = %q has width %d, wanted 1", gs, from, to, w)
+			}
+		}
+	}
+}
+
+func TestLastChange(t *testing.T) {
+	nt, _ := NewTerminal(5, 20)
+	nt.Write([]byte("\x1b[31mhello\x1b[m"))
+	base := nt.LastChange()
+
+	cases := []struct {
+		input   string
+		changed bool
+	}{
+		{"\x1b[m", false},                       // pen unchanged
+		{"\x1b[?25h\x1b[?1l", false},            // modes already set
+		{"\x1b[1;1H\x1b[31mhello\x1b[m", false}, // redrawn as it was
+		{"\x1b[3;3H\x1b[1;6H", false},           // back where it started
+		{"\x1b]8;;\x1b\\", false},               // no link to end
+		{"\x1b[32m", true},
+		{"\x1b[1;1Hjello", true},
+		{"\x1b[?25l", true},
+		{"\x1b]2;title\a", true},
+	}
+
+	for i, c := range cases {
+		nt.Write([]byte(c.input))
+		if got := nt.LastChange().After(base); got != c.changed {
+			t.Errorf("%d: %q changed %t, wanted %t", i, c.input, got, c.changed)
+		}
+		if _, ok := nt.CopyIfNewer(base); ok != c.changed {
+			t.Errorf("%d: %q CopyIfNewer() = %t, wanted %t", i, c.input, ok, c.changed)
+		}
+		base = nt.LastChange()
+	}
+}
+
+// BenchmarkLargeTerminal measures a 300x100 terminal under heavy
+// output, where each frame is written, snapshotted and diffed against
+// the previous snapshot as the server does.
+func BenchmarkLargeTerminal(b *testing.B) {
+	const rows, cols = 100, 300
+
+	line := func(i int) string {
+		return fmt.Sprintf("\x1b[32m[%3d%%]\x1b[m Building C object src/CMakeFiles/app.dir/file_%d.c.o %s\r\n", i%100, i, strings.Repeat("-", i%150))
+	}
+
+	var full strings.Builder
+	full.WriteString("\x1b[H")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&full, "\x1b[%d;1H\x1b[3%dm%s", i+1, i%8, strings.Repeat(fmt.Sprintf("%d", i%10), cols))
+	}
+
+	frames := []struct {
+		name  string
+		frame func(i int) string
+	}{
+		{"one_change", func(i int) string { return fmt.Sprintf("\x1b[50;150H%c", 'a'+i%26) }},
+		{"scrolling", func(i int) string {
+			var sb strings.Builder
+			for j := 0; j < 10; j++ {
+				sb.WriteString(line(i*10 + j))
+			}
+			return sb.String()
+		}},
+		{"full_screen", func(i int) string { return full.String() }},
+	}
+
+	for _, f := range frames {
+		b.Run(f.name, func(b *testing.B) {
+			t1, _ := NewTerminal(rows, cols)
+			t1.Write([]byte(full.String()))
+			prev := t1.ForceCopy()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t1.Write([]byte(f.frame(i)))
+				next := t1.ForceCopy()
+				prev.StateDiff(next)
+				prev = next
+			}
+		})
+	}
+
+	b.Run("snapshot", func(b *testing.B) {
+		t1, _ := NewTerminal(rows, cols)
+		t1.Write([]byte(full.String()))
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			t1.ForceCopy()
+		}
+	})
+}
+
+// BenchmarkParse measures how fast bulk output is parsed.
+func BenchmarkParse(b *testing.B) {
+	var ascii, sgr, utf strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&ascii, "2025-01-%02d 12:00:%02d INFO server: handled request %d in %dms\r\n", i%28+1, i%60, i, i%100)
+		fmt.Fprintf(&sgr, "\x1b[32m[%3d%%]\x1b[m \x1b[1mBuilding\x1b[m C object src/file_%d.c.o\r\n", i%100, i)
+		fmt.Fprintf(&utf, "héllo wörld 日本語 ─── %d\r\n", i)
+	}
+
+	cases := []struct {
+		name  string
+		input string
+	}{
+		{"ascii", ascii.String()},
+		{"sgr", sgr.String()},
+		{"utf8", utf.String()},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			t1, _ := NewTerminal(DEF_ROWS, DEF_COLS)
+			input := []byte(c.input)
+
+			b.SetBytes(int64(len(input)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t1.Write(input)
+			}
+		})
+	}
+}
+
+func TestSynchronizedOutput(t *testing.T) {
+	nt, _ := NewTerminal(5, 20)
+	nt.Write([]byte("a"))
+	base := nt.LastChange()
+
+	cases := []struct {
+		input   string
+		expire  bool // pretend SYNC_TIMEOUT has passed
+		changed bool
+		want    string
+	}{
+		{"\x1b[?2026hb", false, false, "a"},
+		{"c", false, false, "a"},
+		{"\x1b[?2026l", false, true, "abc"},
+		{"\x1b[?2026h\x1b[2J\x1b[Hd", false, false, "abc"},
+		{"e", true, true, "de"},
+		{"\x1b[?2026l", false, false, "de"},
+	}
+
+	for i, c := range cases {
+		nt.Write([]byte(c.input))
+		if c.expire {
+			nt.syncStart = time.Now().Add(-SYNC_TIMEOUT)
+		}
+		if got := nt.LastChange().After(base); got != c.changed {
+			t.Errorf("%d: %q changed %t, wanted %t", i, c.input, got, c.changed)
+		}
+		snap, ok := nt.CopyIfNewer(time.Time{})
+		if !ok {
+			t.Fatalf("%d: CopyIfNewer() found nothing", i)
+		}
+		for _, st := range []*Terminal{snap, nt.ForceCopy()} {
+			if got := strings.TrimRight(strings.Split(st.fb.String(), "\n")[0], " "); got != c.want {
+				t.Errorf("%d: Got %q shown, wanted %q", i, got, c.want)
+			}
+		}
+		base = nt.LastChange()
+	}
+}
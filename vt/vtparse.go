@@ -5,6 +5,7 @@ package vt
 import (
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 )
 
@@ -30,6 +31,9 @@ func (t transition) action() pAction {
 type parameters struct {
 	num   int
 	items []int
+	// sub[i] is true if items[i] is a sub-parameter of the item
+	// before it, having followed a ':' rather than a ';'.
+	sub []bool
 }
 
 func newParams() *parameters {
@@ -39,13 +43,16 @@ func newParams() *parameters {
 func (p *parameters) copy() *parameters {
 	ni := make([]int, len(p.items))
 	copy(ni, p.items)
-	return &parameters{num: p.num, items: ni}
+	return &parameters{num: p.num, items: ni, sub: slices.Clone(p.sub)}
 }
 
 func (p *parameters) String() string {
 	var sb strings.Builder
 	for i := 0; i < p.numItems(); i++ {
-		if i > 0 {
+		switch {
+		case p.isSub(i):
+			sb.WriteByte(':')
+		case i > 0:
 			sb.WriteByte(';')
 		}
 		sb.WriteString(fmt.Sprintf("%d", p.item(i, 0)))
@@ -55,15 +62,27 @@ func (p *parameters) String() string {
 
 func (p *parameters) addItem(item int) {
 	p.items = append(p.items, item)
+	p.sub = append(p.sub, false)
 	p.num += 1
 }
 
+func (p *parameters) addSubItem(item int) {
+	p.items = append(p.items, item)
+	p.sub = append(p.sub, true)
+	p.num += 1
+}
+
+func (p *parameters) isSub(item int) bool {
+	return item < p.num && item < len(p.sub) && p.sub[item]
+}
+
 func (p *parameters) alterItem(val int) {
 	p.items[p.num-1] = val
 }
 
 func (p *parameters) reset() {
 	p.items = p.items[:0]
+	p.sub = p.sub[:0]
 	p.num = 0
 }
 
@@ -100,13 +119,30 @@ func (p *parameters) consumeItem() (int, bool) {
 	n := p.items[0]
 	p.num -= 1
 	p.items = p.items[1:]
+	if len(p.sub) > 0 {
+		p.sub = p.sub[1:]
+	}
 	return n, true
 }
 
+// consumeSubItems consumes and returns the sub-parameters of the item
+// last consumed, if any.
+func (p *parameters) consumeSubItems() []int {
+	var ret []int
+	for p.isSub(0) {
+		n, _ := p.consumeItem()
+		ret = append(ret, n)
+	}
+	return ret
+}
+
 type parser struct {
 	state        pState
 	intermediate []rune
 	params       *parameters
+	// The string being ignored or collected is an APC string,
+	// rather than SOS or PM.
+	apc bool
 }
 
 func newParser() *parser {
@@ -124,17 +160,23 @@ func (p *parser) copy() *parser {
 		state:        p.state,
 		params:       p.params.copy(),
 		intermediate: in,
+		apc:          p.apc,
 	}
 }
 
 func (p *parser) parse(r rune) []*action {
 	trans, ok := STATE_TABLE[p.state][r]
+	if p.state == STATE_SOS_PM_APC_STRING && p.apc && (!ok || trans == newTransition(ACTION_IGNORE, STATE_NONE)) {
+		return []*action{p.action(ACTION_APC_PUT, r)}
+	}
 	if !ok {
 		switch p.state {
 		case STATE_GROUND:
 			return []*action{p.action(ACTION_PRINT, r)}
 		case STATE_OSC_STRING:
 			return []*action{p.action(ACTION_OSC_PUT, r)}
+		case STATE_DCS_PASSThROUGH:
+			return []*action{p.action(ACTION_PUT, r)}
 		default:
 			slog.Debug("unhandled state for failed rune lookup", "state", STATE_NAME[p.state], "r", r)
 		}
@@ -155,21 +197,36 @@ type action struct {
 
 func (p *parser) action(act pAction, r rune) *action {
 	switch act {
-	case ACTION_PRINT, ACTION_EXECUTE, ACTION_HOOK, ACTION_PUT, ACTION_OSC_START, ACTION_OSC_PUT, ACTION_OSC_END, ACTION_UNHOOK, ACTION_CSI_DISPATCH, ACTION_ESC_DISPATCH:
+	case ACTION_PRINT, ACTION_EXECUTE, ACTION_HOOK, ACTION_PUT, ACTION_OSC_START, ACTION_OSC_PUT, ACTION_OSC_END, ACTION_UNHOOK, ACTION_CSI_DISPATCH, ACTION_ESC_DISPATCH, ACTION_APC_PUT:
 		return &action{act, p.params, p.intermediate, r}
+	case ACTION_APC_START:
+		// We're entering the string state on the rune that
+		// introduced it.
+		if p.apc = r == APC; p.apc {
+			return &action{act, p.params, p.intermediate, r}
+		}
+	case ACTION_APC_END:
+		if p.apc {
+			p.apc = false
+			return &action{act, p.params, p.intermediate, r}
+		}
 	case ACTION_IGNORE:
 		// Do nothing
 	case ACTION_COLLECT:
 		p.intermediate = append(p.intermediate, r)
 	case ACTION_PARAM:
 		switch r {
-		// : is used for some CSI sequences like:
-		// CSI 32 : 2 : Pi : Pr : Pg : Pb m to set true colors
+		// : separates sub-parameters in some CSI sequences like:
+		// CSI 38 : 2 : Pi : Pr : Pg : Pb m to set true colors
 		case ';', ':':
 			if p.params.numItems() == 0 {
 				p.params.addItem(0)
 			}
-			p.params.addItem(0)
+			if r == ':' {
+				p.params.addSubItem(0)
+			} else {
+				p.params.addItem(0)
+			}
 		default:
 			switch p.params.numItems() {
 			case 0:
@@ -59,6 +59,12 @@ const (
 	ACTION_PUT          = 13
 	ACTION_UNHOOK       = 14
 	ACTION_ERROR        = 15
+	// APC strings are collected like OSC strings. These don't fit
+	// in a transition, so they're only used as entry and exit
+	// actions, and by the parser directly.
+	ACTION_APC_START = 16
+	ACTION_APC_PUT   = 17
+	ACTION_APC_END   = 18
 )
 
 var ACTION_NAMES map[pAction]string = map[pAction]string{
@@ -78,19 +84,24 @@ var ACTION_NAMES map[pAction]string = map[pAction]string{
 	ACTION_PUT:          "PUT",
 	ACTION_UNHOOK:       "UNHOOK",
 	ACTION_ERROR:        "ERROR",
+	ACTION_APC_START:    "APC_START",
+	ACTION_APC_PUT:      "APC_PUT",
+	ACTION_APC_END:      "APC_END",
 }
 
 var ENTRY_ACTIONS map[pState]pAction = map[pState]pAction{
-	STATE_CSI_ENTRY:       ACTION_CLEAR,
-	STATE_DCS_ENTRY:       ACTION_CLEAR,
-	STATE_DCS_PASSThROUGH: ACTION_HOOK,
-	STATE_ESCAPE:          ACTION_CLEAR,
-	STATE_OSC_STRING:      ACTION_OSC_START,
+	STATE_CSI_ENTRY:         ACTION_CLEAR,
+	STATE_DCS_ENTRY:         ACTION_CLEAR,
+	STATE_DCS_PASSThROUGH:   ACTION_HOOK,
+	STATE_ESCAPE:            ACTION_CLEAR,
+	STATE_OSC_STRING:        ACTION_OSC_START,
+	STATE_SOS_PM_APC_STRING: ACTION_APC_START,
 }
 
 var EXIT_ACTIONS map[pState]pAction = map[pState]pAction{
-	STATE_DCS_PASSThROUGH: ACTION_UNHOOK,
-	STATE_OSC_STRING:      ACTION_OSC_END,
+	STATE_DCS_PASSThROUGH:   ACTION_UNHOOK,
+	STATE_OSC_STRING:        ACTION_OSC_END,
+	STATE_SOS_PM_APC_STRING: ACTION_APC_END,
 }
 
 // For each state, build a map of input byte to encoded
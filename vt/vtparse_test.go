@@ -203,3 +203,31 @@ func TestOSCString(t *testing.T) {
 
 	}
 }
+
+func TestSubParams(t *testing.T) {
+	cases := []struct {
+		input    string
+		want     string
+		wantSubs []int // of the first item
+	}{
+		{"4:3", "4:3", []int{3}},
+		{"38:2::1:2:3;4", "38:2:0:1:2:3;4", []int{2, 0, 1, 2, 3}},
+		{"1;4:3", "1;4:3", nil},
+		{":3", "0:3", []int{3}},
+		{"4;3", "4;3", nil},
+	}
+
+	for i, c := range cases {
+		p := newParser()
+		for _, r := range "\x1b[" + c.input {
+			p.parse(r)
+		}
+		if got := p.params.String(); got != c.want {
+			t.Errorf("%d: Got %q, wanted %q", i, got, c.want)
+		}
+		p.params.consumeItem()
+		if got := p.params.consumeSubItems(); !slices.Equal(got, c.wantSubs) {
+			t.Errorf("%d: Got sub-parameters %v, wanted %v", i, got, c.wantSubs)
+		}
+	}
+}